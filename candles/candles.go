@@ -0,0 +1,165 @@
+// Package candles aggregates trades into OHLCV candles.
+package candles
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Interval is the period of a candle.
+type Interval string
+
+const (
+	Minute      Interval = "1m"
+	FiveMinutes Interval = "5m"
+	Hour        Interval = "1h"
+	Day         Interval = "1d"
+)
+
+// Intervals are the standard intervals, shortest first.
+var Intervals = []Interval{Minute, FiveMinutes, Hour, Day}
+
+var durations = map[Interval]time.Duration{
+	Minute:      time.Minute,
+	FiveMinutes: 5 * time.Minute,
+	Hour:        time.Hour,
+	Day:         24 * time.Hour,
+}
+
+// ParseInterval parses one of the standard intervals.
+func ParseInterval(s string) (Interval, error) {
+	i := Interval(s)
+	if _, ok := durations[i]; !ok {
+		return "", fmt.Errorf("unknown interval %q", s)
+	}
+	return i, nil
+}
+
+// Duration returns the length of the interval.
+func (i Interval) Duration() time.Duration {
+	return durations[i]
+}
+
+// Open returns the open time of the candle of the interval containing the
+// timestamp in nanoseconds. Candles are aligned on the Unix epoch, so daily
+// candles open at midnight UTC.
+func (i Interval) Open(timestamp int64) int64 {
+	d := int64(i.Duration())
+	return timestamp - timestamp%d
+}
+
+// Candle is the open, high, low and close price of the trades of a market
+// in an interval, with their base and quote volume. Times are in
+// nanoseconds, CloseTime is exclusive.
+type Candle struct {
+	Market      string
+	Interval    Interval
+	OpenTime    int64
+	CloseTime   int64
+	Open        float64
+	High        float64
+	Low         float64
+	Close       float64
+	Volume      float64
+	QuoteVolume float64
+	Trades      int
+}
+
+// add adds a trade to the candle.
+func (c *Candle) add(price, size float64) {
+	if c.Trades == 0 {
+		c.Open, c.High, c.Low = price, price, price
+	}
+	if price > c.High {
+		c.High = price
+	}
+	if price < c.Low {
+		c.Low = price
+	}
+	c.Close = price
+	c.Volume += size
+	c.QuoteVolume += price * size
+	c.Trades++
+}
+
+type key struct {
+	market   string
+	interval Interval
+}
+
+// Aggregator keeps the current candle of every market and interval.
+type Aggregator struct {
+	mu        sync.Mutex
+	intervals []Interval
+	current   map[key]Candle
+}
+
+// NewAggregator returns an aggregator of the given intervals, the standard
+// ones if none are given.
+func NewAggregator(intervals ...Interval) *Aggregator {
+	if len(intervals) == 0 {
+		intervals = Intervals
+	}
+	return &Aggregator{
+		intervals: intervals,
+		current:   make(map[key]Candle),
+	}
+}
+
+// Add adds a trade to the candles of its market and returns them, one per
+// interval. A trade after the current candle of an interval starts a new
+// one. Trades are expected in time order, a trade before the current candle
+// is only added to it if it belongs to it.
+func (a *Aggregator) Add(market string, price, size float64, timestamp int64) []Candle {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	updated := make([]Candle, 0, len(a.intervals))
+	for _, interval := range a.intervals {
+		var (
+			k    = key{market: market, interval: interval}
+			open = interval.Open(timestamp)
+		)
+
+		c, ok := a.current[k]
+		if !ok || open > c.OpenTime {
+			c = Candle{
+				Market:    market,
+				Interval:  interval,
+				OpenTime:  open,
+				CloseTime: open + int64(interval.Duration()),
+			}
+		}
+		if open < c.OpenTime {
+			continue
+		}
+
+		c.add(price, size)
+		a.current[k] = c
+		updated = append(updated, c)
+	}
+
+	return updated
+}
+
+// Current returns the current candle of a market, if it has one.
+func (a *Aggregator) Current(market string, interval Interval) (Candle, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c, ok := a.current[key{market: market, interval: interval}]
+	return c, ok
+}
+
+// Restore makes a candle the current candle of its market and interval, so
+// trades after a restart are added to the candle persisted before it.
+func (a *Aggregator) Restore(c Candle) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	k := key{market: c.Market, interval: c.Interval}
+	if current, ok := a.current[k]; !ok || c.OpenTime > current.OpenTime {
+		a.current[k] = c
+	}
+}
@@ -0,0 +1,80 @@
+package candles
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	var (
+		a     = NewAggregator(Minute, Hour)
+		start = time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC).UnixNano()
+	)
+
+	a.Add("ETH", 100, 1, start)
+	a.Add("ETH", 105, 2, start+int64(10*time.Second))
+	candles := a.Add("ETH", 98, 1, start+int64(59*time.Second))
+	assert(t, len(candles), 2)
+	assert(t, candles[0], Candle{
+		Market:      "ETH",
+		Interval:    Minute,
+		OpenTime:    start,
+		CloseTime:   start + int64(time.Minute),
+		Open:        100,
+		High:        105,
+		Low:         98,
+		Close:       98,
+		Volume:      4,
+		QuoteVolume: 100 + 210 + 98,
+		Trades:      3,
+	})
+
+	// The next minute starts a new candle, the hour goes on
+	candles = a.Add("ETH", 101, 1, start+int64(time.Minute))
+	assert(t, candles[0].OpenTime, start+int64(time.Minute))
+	assert(t, candles[0].Open, 101.0)
+	assert(t, candles[0].Trades, 1)
+	assert(t, candles[1].OpenTime, start)
+	assert(t, candles[1].Trades, 4)
+
+	// Markets are aggregated separately
+	candles = a.Add("BTC", 20000, 1, start)
+	assert(t, candles[1].Trades, 1)
+
+	// A late trade of a closed candle is dropped for it
+	candles = a.Add("ETH", 90, 1, start+int64(30*time.Second))
+	assert(t, len(candles), 1)
+	assert(t, candles[0].Interval, Hour)
+	assert(t, candles[0].Low, 90.0)
+}
+
+func TestRestore(t *testing.T) {
+	var (
+		a     = NewAggregator(Day)
+		start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	)
+
+	// Trades after a restart continue the restored candle
+	a.Restore(Candle{Market: "ETH", Interval: Day, OpenTime: start, CloseTime: start + int64(Day.Duration()), Open: 100, High: 100, Low: 100, Close: 100, Volume: 1, QuoteVolume: 100, Trades: 1})
+	candles := a.Add("ETH", 110, 1, start+int64(time.Hour))
+	assert(t, candles[0].Open, 100.0)
+	assert(t, candles[0].High, 110.0)
+	assert(t, candles[0].Trades, 2)
+}
+
+func TestParseInterval(t *testing.T) {
+	interval, err := ParseInterval("5m")
+	assert(t, err, nil)
+	assert(t, interval.Duration(), 5*time.Minute)
+
+	_, err = ParseInterval("2m")
+	assert(t, err != nil, true)
+}
@@ -5,9 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
-	"github.com/inagib21/crypto-exchange/orderbook"
+	"github.com/inagib21/crypto-exchange/risk"
 	"github.com/inagib21/crypto-exchange/server"
+	"github.com/inagib21/crypto-exchange/store"
 )
 
 // Endpoint is the base URL of the cryptocurrency exchange server.
@@ -20,11 +24,53 @@ type PlaceOrderParams struct {
 	// Price only needed for placing LIMIT orders.
 	Price float64
 	Size  float64
+	// Quote sizes a MARKET order in the quote asset instead of Size.
+	Quote float64
+	// MaxSlippage and WorstPrice protect MARKET orders.
+	MaxSlippage float64
+	WorstPrice  float64
+}
+
+// Error is returned when the exchange rejects a request.
+type Error struct {
+	StatusCode int
+	Message    string
+	Reason     risk.Reason
+}
+
+func (e *Error) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("exchange error [%d] [%s]: %s", e.StatusCode, e.Reason, e.Message)
+	}
+	return fmt.Sprintf("exchange error [%d]: %s", e.StatusCode, e.Message)
+}
+
+// decodeResponse decodes the JSON body of a successful response into v and
+// turns error responses into an *Error.
+func decodeResponse(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := server.APIError{}
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+			apiErr.Error = http.StatusText(resp.StatusCode)
+		}
+		return &Error{
+			StatusCode: resp.StatusCode,
+			Message:    apiErr.Error,
+			Reason:     apiErr.Reason,
+		}
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
 }
 
 // Client represents a client for interacting with the cryptocurrency exchange server.
 type Client struct {
 	*http.Client
+	// Token is the API token of the user the client acts for, sent with
+	// every request.
+	Token string
 }
 
 // NewClient creates a new Client instance with the default HTTP client.
@@ -34,8 +80,16 @@ func NewClient() *Client {
 	}
 }
 
-// GetTrades fetches recent trades for a specific market.
-func (c *Client) GetTrades(market string) ([]*orderbook.Trade, error) {
+// Do sends a request with the API token of the client, if any.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if c.Token != "" {
+		req.Header.Set("X-User-Token", c.Token)
+	}
+	return c.Client.Do(req)
+}
+
+// GetTrades fetches the most recent trades of a market, newest first.
+func (c *Client) GetTrades(market string) ([]store.Trade, error) {
 	e := fmt.Sprintf("%s/trades/%s", Endpoint, market)
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
@@ -47,14 +101,37 @@ func (c *Client) GetTrades(market string) ([]*orderbook.Trade, error) {
 		return nil, err
 	}
 
-	trades := []*orderbook.Trade{}
-	if err := json.NewDecoder(resp.Body).Decode(&trades); err != nil {
+	trades := []store.Trade{}
+	if err := decodeResponse(resp, &trades); err != nil {
 		return nil, err
 	}
 
 	return trades, nil
 }
 
+// GetFills fetches a page of the fills of a user, newest first, bounded by
+// the trade IDs of the filter.
+func (c *Client) GetFills(f store.FillFilter) ([]store.Fill, error) {
+	e := fmt.Sprintf("%s/fills/%d?fromTrade=%d&toTrade=%d&offset=%d&limit=%d",
+		Endpoint, f.UserID, f.FromTrade, f.ToTrade, f.Offset, f.Limit)
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	fills := []store.Fill{}
+	if err := decodeResponse(resp, &fills); err != nil {
+		return nil, err
+	}
+
+	return fills, nil
+}
+
 // GetOrders retrieves a user's orders.
 func (c *Client) GetOrders(userID int64) (*server.GetOrdersResponse, error) {
 	e := fmt.Sprintf("%s/order/%d", Endpoint, userID)
@@ -79,11 +156,14 @@ func (c *Client) GetOrders(userID int64) (*server.GetOrdersResponse, error) {
 // PlaceMarketOrder places a market order.
 func (c *Client) PlaceMarketOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
 	params := &server.PlaceOrderRequest{
-		UserID: p.UserID,
-		Type:   server.MarketOrder,
-		Bid:    p.Bid,
-		Size:   p.Size,
-		Market: server.MarketETH,
+		UserID:      p.UserID,
+		Type:        server.MarketOrder,
+		Bid:         p.Bid,
+		Size:        p.Size,
+		Market:      server.MarketETH,
+		Quote:       p.Quote,
+		MaxSlippage: p.MaxSlippage,
+		WorstPrice:  p.WorstPrice,
 	}
 
 	body, err := json.Marshal(params)
@@ -103,15 +183,15 @@ func (c *Client) PlaceMarketOrder(p *PlaceOrderParams) (*server.PlaceOrderRespon
 	}
 
 	placeOrderResponse := &server.PlaceOrderResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(placeOrderResponse); err != nil {
+	if err := decodeResponse(resp, placeOrderResponse); err != nil {
 		return nil, err
 	}
 
 	return placeOrderResponse, nil
 }
 
-// GetBestAsk retrieves the best ask order for a market.
-func (c *Client) GetBestAsk() (*server.Order, error) {
+// GetBestAsk retrieves the best ask price for a market.
+func (c *Client) GetBestAsk() (*server.PriceResponse, error) {
 	e := fmt.Sprintf("%s/book/ETH/ask", Endpoint)
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
@@ -123,16 +203,16 @@ func (c *Client) GetBestAsk() (*server.Order, error) {
 		return nil, err
 	}
 
-	order := &server.Order{}
-	if err := json.NewDecoder(resp.Body).Decode(order); err != nil {
+	price := &server.PriceResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(price); err != nil {
 		return nil, err
 	}
 
-	return order, err
+	return price, err
 }
 
-// GetBestBid retrieves the best bid order for a market.
-func (c *Client) GetBestBid() (*server.Order, error) {
+// GetBestBid retrieves the best bid price for a market.
+func (c *Client) GetBestBid() (*server.PriceResponse, error) {
 	e := fmt.Sprintf("%s/book/ETH/bid", Endpoint)
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
@@ -144,12 +224,12 @@ func (c *Client) GetBestBid() (*server.Order, error) {
 		return nil, err
 	}
 
-	order := &server.Order{}
-	if err := json.NewDecoder(resp.Body).Decode(order); err != nil {
+	price := &server.PriceResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(price); err != nil {
 		return nil, err
 	}
 
-	return order, err
+	return price, err
 }
 
 // CancelOrder cancels an existing order.
@@ -168,6 +248,109 @@ func (c *Client) CancelOrder(orderID int64) error {
 	return nil
 }
 
+// PlaceBatch places and cancels orders of a user in a market in one batch,
+// with a result for every item. A rejected batch returns the results, with
+// the errors of the items that failed, and an *Error.
+func (c *Client) PlaceBatch(batch *server.BatchRequest) (*server.BatchResponse, error) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Endpoint + "/orders/batch"
+	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusBadRequest {
+		defer resp.Body.Close()
+
+		batchResponse := &server.BatchResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(batchResponse); err != nil || len(batchResponse.Results) == 0 {
+			return nil, &Error{StatusCode: resp.StatusCode, Message: "invalid batch"}
+		}
+		return batchResponse, &Error{StatusCode: resp.StatusCode, Message: "batch rejected"}
+	}
+
+	batchResponse := &server.BatchResponse{}
+	if err := decodeResponse(resp, batchResponse); err != nil {
+		return nil, err
+	}
+
+	return batchResponse, nil
+}
+
+// CancelAll cancels the resting orders of a user. An empty market cancels
+// them in every market and an empty side (server.SideBid or server.SideAsk)
+// on both sides.
+func (c *Client) CancelAll(userID int64, market server.Market, side string) (*server.CancelAllResponse, error) {
+	query := url.Values{}
+	query.Set("userID", strconv.FormatInt(userID, 10))
+	if market != "" {
+		query.Set("market", string(market))
+	}
+	if side != "" {
+		query.Set("side", side)
+	}
+
+	e := Endpoint + "/orders?" + query.Encode()
+	req, err := http.NewRequest(http.MethodDelete, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	cancelAllResponse := &server.CancelAllResponse{}
+	if err := decodeResponse(resp, cancelAllResponse); err != nil {
+		return nil, err
+	}
+
+	return cancelAllResponse, nil
+}
+
+// Heartbeat arms or refreshes the dead man's switch of a user: unless it is
+// called again within timeout, all their orders are canceled. A zero timeout
+// disarms the switch.
+func (c *Client) Heartbeat(userID int64, timeout time.Duration) (*server.DeadManResponse, error) {
+	deadMan := server.DeadManRequest{UserID: userID}
+	if timeout > 0 {
+		deadMan.Timeout = timeout.String()
+	}
+
+	body, err := json.Marshal(deadMan)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Endpoint + "/deadman"
+	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	deadManResponse := &server.DeadManResponse{}
+	if err := decodeResponse(resp, deadManResponse); err != nil {
+		return nil, err
+	}
+
+	return deadManResponse, nil
+}
+
 // PlaceLimitOrder places a limit order.
 func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
 	if p.Size == 0.0 {
@@ -200,7 +383,7 @@ func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderRespons
 	}
 
 	placeOrderResponse := &server.PlaceOrderResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(placeOrderResponse); err != nil {
+	if err := decodeResponse(resp, placeOrderResponse); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/inagib21/crypto-exchange/engine"
+	"github.com/inagib21/crypto-exchange/server"
+	"github.com/inagib21/crypto-exchange/sim"
+	"github.com/sirupsen/logrus"
+)
+
+const usage = `usage:
+  exchange snapshot inspect <snapshot>
+  exchange snapshot diff <a> <b>
+  exchange replay <journal>
+  exchange sim [-seed n] [-steps n] [-volatility v] [-json] [-out report]`
+
+// runCommand runs the offline tool named by args[0].
+func runCommand(args []string) error {
+	switch args[0] {
+	case "snapshot":
+		return runSnapshot(args[1:])
+	case "replay":
+		return runReplay(args[1:])
+	case "sim":
+		return runSim(args[1:])
+	default:
+		return errors.New(usage)
+	}
+}
+
+func runSnapshot(args []string) error {
+	switch {
+	case len(args) == 2 && args[0] == "inspect":
+		s, err := engine.ReadSnapshot(args[1])
+		if err != nil {
+			return err
+		}
+		inspectSnapshot(s)
+		return nil
+	case len(args) == 3 && args[0] == "diff":
+		a, err := engine.ReadSnapshot(args[1])
+		if err != nil {
+			return err
+		}
+		b, err := engine.ReadSnapshot(args[2])
+		if err != nil {
+			return err
+		}
+
+		diffs := engine.Diff(a, b)
+		for _, diff := range diffs {
+			fmt.Println(diff)
+		}
+		if len(diffs) > 0 {
+			os.Exit(1)
+		}
+		return nil
+	default:
+		return errors.New(usage)
+	}
+}
+
+// inspectSnapshot prints the order books of a snapshot, asks from the
+// highest price down to the bids.
+func inspectSnapshot(s engine.Snapshot) {
+	fmt.Printf("seq %d taken at %s\n", s.Seq, s.Time)
+
+	markets := make([]string, 0, len(s.Books))
+	for market := range s.Books {
+		markets = append(markets, market)
+	}
+	sort.Strings(markets)
+
+	for _, market := range markets {
+		book := s.Books[market]
+
+		fmt.Printf("\n%s %s\n", market, book.State)
+		if book.Halt != nil {
+			fmt.Printf("  halted: %s\n", book.Halt.Reason)
+		}
+		if book.LastTrade != nil {
+			fmt.Printf("  last trade: %.2f @ %.2f\n", book.LastTrade.Size, book.LastTrade.Price)
+		}
+
+		for i := len(book.Asks) - 1; i >= 0; i-- {
+			level := book.Asks[i]
+			fmt.Printf("  ask %10.2f %10.2f\n", level.Price, level.Volume)
+			for _, o := range level.Orders {
+				fmt.Printf("      #%d order %d user %d size %.2f\n", o.Position, o.ID, o.UserID, o.Size)
+			}
+		}
+		for _, level := range book.Bids {
+			fmt.Printf("  bid %10.2f %10.2f\n", level.Price, level.Volume)
+			for _, o := range level.Orders {
+				fmt.Printf("      #%d order %d user %d size %.2f\n", o.Position, o.ID, o.UserID, o.Size)
+			}
+		}
+	}
+}
+
+// runReplay feeds the commands of a journal through fresh order books and
+// verifies they produce the recorded events, byte for byte.
+func runReplay(args []string) error {
+	if len(args) != 1 {
+		return errors.New(usage)
+	}
+
+	commands, divergence, err := engine.Verify(args[0], server.NewReplayBooks())
+	if err != nil {
+		return err
+	}
+
+	if divergence != nil {
+		fmt.Printf("replay diverged after %d commands at %s\n", commands, divergence)
+		os.Exit(1)
+	}
+
+	fmt.Printf("replayed %d commands, every event matches\n", commands)
+	return nil
+}
+
+// runSim simulates the default participants trading against an in-process
+// exchange and writes the report to stdout or the -out file.
+func runSim(args []string) error {
+	flags := flag.NewFlagSet("sim", flag.ContinueOnError)
+	seed := flags.Int64("seed", 1, "seed of every random choice")
+	steps := flags.Int("steps", sim.DefaultSteps, "number of one second steps")
+	volatility := flags.Float64("volatility", 0.8, "annualized volatility of the fundamental price")
+	asJSON := flags.Bool("json", false, "write the report as JSON")
+	out := flags.String("out", "", "file to write the report to instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return errors.New(usage)
+	}
+
+	// Every order of the simulation would be logged.
+	logrus.SetLevel(logrus.WarnLevel)
+
+	report, err := sim.New(sim.Config{
+		Seed:         *seed,
+		Steps:        *steps,
+		Volatility:   *volatility,
+		Participants: sim.DefaultParticipants(),
+	}).Run()
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if *asJSON {
+		return report.WriteJSON(w)
+	}
+	return report.WriteText(w)
+}
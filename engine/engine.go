@@ -0,0 +1,748 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/inagib21/crypto-exchange/journal"
+	"github.com/inagib21/crypto-exchange/orderbook"
+)
+
+// CommandType is the type of a command accepted by the engine.
+type CommandType string
+
+const (
+	CommandPlace    CommandType = "PLACE"
+	CommandCancel   CommandType = "CANCEL"
+	CommandAmend    CommandType = "AMEND"
+	CommandHalt     CommandType = "HALT"
+	CommandResume   CommandType = "RESUME"
+	CommandSetState CommandType = "SET_STATE"
+)
+
+// EventType is the type of an event resulting from a command.
+type EventType string
+
+const (
+	EventMatch      EventType = "MATCH"
+	EventTrade      EventType = "TRADE"
+	EventClearLevel EventType = "CLEAR_LEVEL"
+	EventCancel     EventType = "CANCEL"
+	EventHalt       EventType = "HALT"
+	EventState      EventType = "STATE"
+)
+
+var (
+	ErrMarketNotFound = errors.New("market not found")
+	ErrOrderNotFound  = errors.New("order not found")
+	// ErrDuplicateOrder rejects placing an order with the ID of an order
+	// resting in the book.
+	ErrDuplicateOrder = errors.New("duplicate order id")
+	// ErrInvalidOrder rejects commands whose order is malformed, e.g. with a
+	// size or a price that isn't positive.
+	ErrInvalidOrder = errors.New("invalid order")
+	// ErrNotEnoughVolume rejects market orders the book can't fill.
+	ErrNotEnoughVolume = errors.New("not enough volume")
+	// ErrMarketHalted rejects market orders while matching is halted.
+	ErrMarketHalted = errors.New("market halted")
+	// ErrMarketState rejects market orders outside of continuous trading.
+	ErrMarketState = errors.New("market orders not accepted")
+	// ErrBatchRejected rejects the valid commands of a batch another command
+	// of which was rejected, see ExecuteAll.
+	ErrBatchRejected = errors.New("batch rejected")
+)
+
+// Command is an instruction that changes the state of an order book.
+type Command struct {
+	Type    CommandType
+	Market  string
+	OrderID int64 `json:",omitempty"`
+	UserID  int64 `json:",omitempty"`
+	// Limit is false for market orders.
+	Limit     bool            `json:",omitempty"`
+	Bid       bool            `json:",omitempty"`
+	Size      float64         `json:",omitempty"`
+	Price     float64         `json:",omitempty"`
+	State     orderbook.State `json:",omitempty"`
+	Reason    string          `json:",omitempty"`
+	Timestamp int64
+	// AuctionEnd is when the auction started by a SET_STATE AUCTION command
+	// uncrosses, in unix nanoseconds. Zero runs it until the state changes.
+	AuctionEnd int64 `json:",omitempty"`
+	// Quote sizes a market order in the quote asset instead of Size.
+	Quote float64 `json:",omitempty"`
+	// WorstPrice and MaxSlippage protect market orders, see
+	// orderbook.MarketOptions.
+	WorstPrice  float64 `json:",omitempty"`
+	MaxSlippage float64 `json:",omitempty"`
+}
+
+// marketOptions returns the options of a market order command.
+func (cmd Command) marketOptions() orderbook.MarketOptions {
+	return orderbook.MarketOptions{
+		WorstPrice:  cmd.WorstPrice,
+		MaxSlippage: cmd.MaxSlippage,
+		Quote:       cmd.Quote,
+	}
+}
+
+// Event is something that happened in an order book as a result of a command.
+type Event struct {
+	Type       EventType
+	Market     string
+	OrderID    int64           `json:",omitempty"`
+	BidOrderID int64           `json:",omitempty"`
+	AskOrderID int64           `json:",omitempty"`
+	Bid        bool            `json:",omitempty"`
+	Price      float64         `json:",omitempty"`
+	Size       float64         `json:",omitempty"`
+	MakerFee   float64         `json:",omitempty"`
+	TakerFee   float64         `json:",omitempty"`
+	State      orderbook.State `json:",omitempty"`
+	Reason     string          `json:",omitempty"`
+	Timestamp  int64
+}
+
+// Entry is a journal record holding either a command or an event.
+type Entry struct {
+	Command *Command `json:",omitempty"`
+	Event   *Event   `json:",omitempty"`
+}
+
+// Result is the outcome of a command.
+type Result struct {
+	// Order is the order placed, canceled or amended by the command.
+	Order *orderbook.Order
+	// OrderState is a copy of Order when the command was applied, safe to
+	// read while later commands change the order.
+	OrderState orderbook.Order
+	Matches    []orderbook.Match
+	Events     []Event
+	// Timestamp is the time the command was applied at.
+	Timestamp int64
+	// Seq is the sequence number of the command across every market: its
+	// journal sequence number when the engine has a journal.
+	Seq uint64
+}
+
+// Engine applies commands to the order books of every market. When it has a
+// journal, every command is appended to it before it is applied, followed
+// by the resulting events.
+//
+// Commands are applied one at a time across every market, under a single
+// lock: the journal numbers the commands of all the markets and keeps each
+// of them next to its events, and the state kept by the check and OnApply
+// functions is shared by the markets.
+type Engine struct {
+	mu      sync.Mutex
+	books   map[string]*orderbook.Orderbook
+	journal *journal.Journal
+	onApply func(cmd Command, res Result)
+	check   func(ob *orderbook.Orderbook, cmd Command, pending []Command) error
+	clock   orderbook.Clock
+	ids     orderbook.IDGenerator
+	// seq is the sequence number of the last record, journaled or not.
+	seq uint64
+}
+
+// New creates an engine for the given order books. The journal may be nil.
+// Order IDs start at 1, see SetIDGenerator to continue from recovered orders.
+func New(books map[string]*orderbook.Orderbook, j *journal.Journal) *Engine {
+	e := &Engine{
+		books: books,
+		clock: orderbook.SystemClock{},
+		ids:   orderbook.NewSequentialIDs(0),
+	}
+	e.SetJournal(j)
+	return e
+}
+
+// SetJournal sets the journal the engine appends to, e.g. once the order
+// books were recovered from it. Sequence numbers continue from the journal.
+func (e *Engine) SetJournal(j *journal.Journal) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.journal = j
+	if j != nil {
+		e.seq = j.Seq()
+	}
+}
+
+// SetClock sets the clock stamping commands without a timestamp and new orders.
+func (e *Engine) SetClock(c orderbook.Clock) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.clock = c
+}
+
+// SetIDGenerator sets the generator of the IDs of new orders.
+func (e *Engine) SetIDGenerator(ids orderbook.IDGenerator) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.ids = ids
+}
+
+// NewOrder creates an order with an ID and a timestamp from the engine.
+func (e *Engine) NewOrder(bid bool, size float64, userID int64) *orderbook.Order {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return orderbook.NewOrderWith(e.ids, e.clock, bid, size, userID)
+}
+
+// OnApply sets a function called with the result of every applied command
+// while the engine is locked, so state derived from the results is
+// consistent with the snapshots of the engine.
+func (e *Engine) OnApply(fn func(cmd Command, res Result)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.onApply = fn
+}
+
+// SetCheck sets a function validating every command against state kept
+// outside of the order books, e.g. the risk limits of its user. It is
+// called while the engine is locked, before the command is journaled, so
+// that state can't change between the check and the command being applied.
+// pending are the commands of the same batch checked before it, which are
+// not applied yet, see ExecuteAll. Replayed commands are not checked again.
+func (e *Engine) SetCheck(fn func(ob *orderbook.Orderbook, cmd Command, pending []Command) error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.check = fn
+}
+
+// Execute validates, journals and applies a command. Commands without a
+// timestamp are stamped with the clock of the engine.
+func (e *Engine) Execute(cmd Command) (Result, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	cmd = e.stamp(cmd)
+	ob, err := e.prepare(cmd, nil)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return e.execute(ob, cmd)
+}
+
+// ExecuteAll validates every command, with the commands before it pending,
+// and applies them one after the other only if they are all valid. When a
+// command is rejected none of them is applied: the rejected ones reply with
+// their error and the others with ErrBatchRejected.
+func (e *Engine) ExecuteAll(cmds []Command) []Reply {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var (
+		replies  = make([]Reply, len(cmds))
+		books    = make([]*orderbook.Orderbook, len(cmds))
+		pending  = make([]Command, 0, len(cmds))
+		rejected = false
+	)
+
+	for i, cmd := range cmds {
+		cmd = e.stamp(cmd)
+		books[i], replies[i].Err = e.prepare(cmd, pending)
+		// An order is placed or canceled once per batch.
+		for _, p := range pending {
+			if replies[i].Err == nil && cmd.OrderID != 0 && p.OrderID == cmd.OrderID {
+				replies[i].Err = fmt.Errorf("%w: %d", ErrDuplicateOrder, cmd.OrderID)
+			}
+		}
+		rejected = rejected || replies[i].Err != nil
+		pending = append(pending, cmd)
+	}
+
+	if rejected {
+		for i := range replies {
+			if replies[i].Err == nil {
+				replies[i].Err = ErrBatchRejected
+			}
+		}
+		return replies
+	}
+
+	for i, cmd := range pending {
+		replies[i].Result, replies[i].Err = e.execute(books[i], cmd)
+	}
+	return replies
+}
+
+// stamp sets the timestamp of a command without one to the clock of the engine.
+func (e *Engine) stamp(cmd Command) Command {
+	if cmd.Timestamp == 0 {
+		cmd.Timestamp = e.clock.Now().UnixNano()
+	}
+	return cmd
+}
+
+// prepare returns the order book of the market of a command once the
+// command is validated and checked.
+func (e *Engine) prepare(cmd Command, pending []Command) (*orderbook.Orderbook, error) {
+	ob, ok := e.books[cmd.Market]
+	if !ok {
+		return nil, ErrMarketNotFound
+	}
+
+	if err := validate(ob, cmd); err != nil {
+		return nil, err
+	}
+	if e.check != nil {
+		if err := e.check(ob, cmd, pending); err != nil {
+			return nil, err
+		}
+	}
+
+	return ob, nil
+}
+
+// execute journals and applies a prepared command.
+func (e *Engine) execute(ob *orderbook.Orderbook, cmd Command) (Result, error) {
+	if err := e.append(Entry{Command: &cmd}); err != nil {
+		return Result{}, err
+	}
+	seq := e.seq
+
+	res, err := Apply(ob, cmd)
+	if err != nil {
+		return res, err
+	}
+	res.Seq = seq
+	e.applied(cmd, res)
+
+	for i := range res.Events {
+		if err := e.append(Entry{Event: &res.Events[i]}); err != nil {
+			return res, err
+		}
+	}
+
+	return res, nil
+}
+
+// Tick runs the timed state transitions of a market. A transition is
+// journaled as the SET_STATE command it is equivalent to, with the end of the
+// auction it starts, so replaying the journal doesn't depend on when the
+// transition happened. The command is returned with its result, its type is
+// empty when nothing changed.
+func (e *Engine) Tick(market string, now time.Time) (Command, Result, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ob, ok := e.books[market]
+	if !ok {
+		return Command{}, Result{}, ErrMarketNotFound
+	}
+
+	before := ob.State()
+	after, end := ob.Next(now)
+
+	if before == after {
+		return Command{}, Result{Timestamp: now.UnixNano()}, nil
+	}
+
+	cmd := Command{
+		Type:      CommandSetState,
+		Market:    market,
+		State:     after,
+		Timestamp: now.UnixNano(),
+	}
+	if after == orderbook.StateAuction && !end.IsZero() {
+		cmd.AuctionEnd = end.UnixNano()
+	}
+
+	if err := e.append(Entry{Command: &cmd}); err != nil {
+		return cmd, Result{}, err
+	}
+
+	matches := ob.Tick(now)
+	res := Result{
+		Seq:       e.seq,
+		Matches:   matches,
+		Events:    append(matchEvents(ob, cmd, matches), stateEvent(cmd, ob.State())),
+		Timestamp: cmd.Timestamp,
+	}
+	e.applied(cmd, res)
+
+	for i := range res.Events {
+		if err := e.append(Entry{Event: &res.Events[i]}); err != nil {
+			return cmd, res, err
+		}
+	}
+
+	return cmd, res, nil
+}
+
+func (e *Engine) applied(cmd Command, res Result) {
+	if e.onApply != nil {
+		e.onApply(cmd, res)
+	}
+}
+
+// append journals an entry and advances the sequence number.
+func (e *Engine) append(entry Entry) error {
+	if e.journal == nil {
+		e.seq++
+		return nil
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	seq, err := e.journal.Append(data)
+	if err != nil {
+		return err
+	}
+	e.seq = seq
+	return nil
+}
+
+// Replay applies every command of the journal at path to the order books and
+// calls fn with the result of each of them. Events in the journal are
+// skipped, they are reproduced by applying the commands.
+func Replay(path string, books map[string]*orderbook.Orderbook, fn func(cmd Command, res Result)) error {
+	_, err := ReplayFrom(path, 0, books, fn)
+	return err
+}
+
+// ReplayFrom is like Replay but skips the records up to sequence number seq.
+// The results have the sequence number of their command. It returns the
+// sequence number of the last record of the journal.
+func ReplayFrom(path string, seq uint64, books map[string]*orderbook.Orderbook, fn func(cmd Command, res Result)) (uint64, error) {
+	last := uint64(0)
+	err := journal.Read(path, func(n uint64, data []byte) error {
+		last = n
+		if n <= seq {
+			return nil
+		}
+
+		entry := Entry{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("decoding journal record %d: %w", n, err)
+		}
+		if entry.Command == nil {
+			return nil
+		}
+
+		ob, ok := books[entry.Command.Market]
+		if !ok {
+			return fmt.Errorf("journal record %d: %w: %s", n, ErrMarketNotFound, entry.Command.Market)
+		}
+
+		// Commands that failed when they were executed fail the same way now.
+		res, _ := Apply(ob, *entry.Command)
+		res.Seq = n
+		if fn != nil {
+			fn(*entry.Command, res)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return last, err
+	}
+
+	// A journal that ends before seq doesn't belong with what came before it.
+	if last < seq {
+		return last, fmt.Errorf("journal ends at seq %d before seq %d", last, seq)
+	}
+
+	return last, nil
+}
+
+// validate rejects commands that can't be applied before they are journaled.
+func validate(ob *orderbook.Orderbook, cmd Command) error {
+	switch cmd.Type {
+	case CommandPlace:
+		if ob.Order(cmd.OrderID) != nil {
+			return fmt.Errorf("%w: %d", ErrDuplicateOrder, cmd.OrderID)
+		}
+		if cmd.Limit && ob.State() == orderbook.StateClosed {
+			return orderbook.ErrMarketClosed
+		}
+		if halt := ob.Halted(); !cmd.Limit && halt != nil {
+			return fmt.Errorf("%w: %s", ErrMarketHalted, halt.Reason)
+		}
+		if state := ob.State(); !cmd.Limit && state != orderbook.StateContinuous {
+			return fmt.Errorf("%w in state %s", ErrMarketState, state)
+		}
+		if cmd.Limit && (cmd.Quote != 0 || cmd.WorstPrice != 0 || cmd.MaxSlippage != 0) {
+			return fmt.Errorf("%w: only market orders have a quote size or a protection", ErrInvalidOrder)
+		}
+		if cmd.Quote < 0 || cmd.WorstPrice < 0 || cmd.MaxSlippage < 0 {
+			return fmt.Errorf("%w: market order protection", ErrInvalidOrder)
+		}
+		if cmd.Quote > 0 {
+			if cmd.Size != 0 {
+				return fmt.Errorf("%w: market orders have either a size or a quote size", ErrInvalidOrder)
+			}
+			return nil
+		}
+		if !positive(cmd.Size) {
+			return fmt.Errorf("%w: size %v", ErrInvalidOrder, cmd.Size)
+		}
+		if cmd.Limit && !positive(cmd.Price) {
+			return fmt.Errorf("%w: price %v", ErrInvalidOrder, cmd.Price)
+		}
+		// Protected orders fill what they can.
+		if cmd.WorstPrice > 0 || cmd.MaxSlippage > 0 {
+			return nil
+		}
+		if !cmd.Limit {
+			volume := ob.AskTotalVolume()
+			if !cmd.Bid {
+				volume = ob.BidTotalVolume()
+			}
+			if volume < cmd.Size {
+				return fmt.Errorf("%w: %.2f available for size %.2f", ErrNotEnoughVolume, volume, cmd.Size)
+			}
+		}
+	case CommandCancel:
+		if ob.Order(cmd.OrderID) == nil {
+			return ErrOrderNotFound
+		}
+	case CommandAmend:
+		if ob.Order(cmd.OrderID) == nil {
+			return ErrOrderNotFound
+		}
+		if !positive(cmd.Price) {
+			return fmt.Errorf("%w: price %v", ErrInvalidOrder, cmd.Price)
+		}
+		if !positive(cmd.Size) {
+			return fmt.Errorf("%w: size %v", ErrInvalidOrder, cmd.Size)
+		}
+	case CommandHalt, CommandResume, CommandSetState:
+	default:
+		return fmt.Errorf("unknown command %q", cmd.Type)
+	}
+
+	return nil
+}
+
+// positive reports whether v is a finite number above zero.
+func positive(v float64) bool {
+	return v > 0 && !math.IsInf(v, 0)
+}
+
+// Apply executes a command against an order book and returns its result.
+// The book is told the time of the command while it is applied, so the
+// result only depends on the state of the book and the command, and gets its
+// own clock back afterwards.
+func Apply(ob *orderbook.Orderbook, cmd Command) (Result, error) {
+	clock := ob.Clock()
+	ob.SetClock(orderbook.FixedClock(time.Unix(0, cmd.Timestamp)))
+	defer ob.SetClock(clock)
+
+	res, err := apply(ob, cmd)
+	res.Timestamp = cmd.Timestamp
+	if res.Order != nil {
+		res.OrderState = *res.Order
+		res.OrderState.Limit = nil
+	}
+	return res, err
+}
+
+func apply(ob *orderbook.Orderbook, cmd Command) (Result, error) {
+	switch cmd.Type {
+	case CommandPlace:
+		return applyPlace(ob, cmd)
+	case CommandCancel:
+		return applyCancel(ob, cmd)
+	case CommandAmend:
+		return applyAmend(ob, cmd)
+	case CommandHalt:
+		ob.Halt(cmd.Reason)
+		return Result{Events: []Event{haltEvent(ob, cmd)}}, nil
+	case CommandResume:
+		matches := ob.Resume()
+		events := append(matchEvents(ob, cmd, matches), stateEvent(cmd, ob.State()))
+		return Result{Matches: matches, Events: events}, nil
+	case CommandSetState:
+		if cmd.State == orderbook.StateAuction && cmd.AuctionEnd != 0 {
+			ob.StartAuction(time.Unix(0, cmd.AuctionEnd))
+			return Result{Events: []Event{stateEvent(cmd, ob.State())}}, nil
+		}
+		matches, err := ob.SetState(cmd.State)
+		if err != nil {
+			return Result{}, err
+		}
+		events := append(matchEvents(ob, cmd, matches), stateEvent(cmd, ob.State()))
+		return Result{Matches: matches, Events: events}, nil
+	default:
+		return Result{}, fmt.Errorf("unknown command %q", cmd.Type)
+	}
+}
+
+func applyPlace(ob *orderbook.Orderbook, cmd Command) (Result, error) {
+	order := &orderbook.Order{
+		ID:        cmd.OrderID,
+		UserID:    cmd.UserID,
+		Size:      cmd.Size,
+		Bid:       cmd.Bid,
+		Timestamp: cmd.Timestamp,
+	}
+
+	if cmd.Limit {
+		err := ob.PlaceLimitOrder(cmd.Price, order)
+		return Result{Order: order}, err
+	}
+
+	halted := ob.Halted() != nil
+	matches := ob.PlaceMarketOrderWith(order, cmd.marketOptions())
+	res := Result{
+		Order:   order,
+		Matches: matches,
+		Events:  matchEvents(ob, cmd, matches),
+	}
+
+	if !halted && ob.Halted() != nil {
+		res.Events = append(res.Events, haltEvent(ob, cmd))
+	}
+
+	return res, nil
+}
+
+func applyCancel(ob *orderbook.Orderbook, cmd Command) (Result, error) {
+	order := ob.Order(cmd.OrderID)
+	if order == nil {
+		return Result{}, ErrOrderNotFound
+	}
+
+	price := order.Limit.Price
+	ob.CancelOrder(order)
+
+	events := []Event{{
+		Type:      EventCancel,
+		Market:    cmd.Market,
+		OrderID:   order.ID,
+		Bid:       order.Bid,
+		Price:     price,
+		Size:      order.Size,
+		Timestamp: cmd.Timestamp,
+	}}
+	if !ob.HasLimit(order.Bid, price) {
+		events = append(events, clearLevelEvent(cmd, order.Bid, price))
+	}
+
+	return Result{Order: order, Events: events}, nil
+}
+
+func applyAmend(ob *orderbook.Orderbook, cmd Command) (Result, error) {
+	order := ob.Order(cmd.OrderID)
+	if order == nil {
+		return Result{}, ErrOrderNotFound
+	}
+
+	price := order.Limit.Price
+	if err := ob.AmendOrder(order, cmd.Price, cmd.Size, cmd.Timestamp); err != nil {
+		return Result{Order: order}, err
+	}
+
+	events := []Event{}
+	if !ob.HasLimit(order.Bid, price) {
+		events = append(events, clearLevelEvent(cmd, order.Bid, price))
+	}
+
+	return Result{Order: order, Events: events}, nil
+}
+
+// matchEvents returns a match and a trade event for every match, followed
+// by an event for every price level the matches cleared.
+func matchEvents(ob *orderbook.Orderbook, cmd Command, matches []orderbook.Match) []Event {
+	var (
+		events = []Event{}
+		seen   = map[level]bool{}
+		levels = []level{}
+	)
+
+	for _, match := range matches {
+		events = append(events,
+			Event{
+				Type:       EventMatch,
+				Market:     cmd.Market,
+				BidOrderID: match.Bid.ID,
+				AskOrderID: match.Ask.ID,
+				Price:      match.Price,
+				Size:       match.SizeFilled,
+				Timestamp:  cmd.Timestamp,
+			},
+			Event{
+				Type:      EventTrade,
+				Market:    cmd.Market,
+				Bid:       match.TakerBid,
+				Price:     match.Price,
+				Size:      match.SizeFilled,
+				MakerFee:  match.MakerFee,
+				TakerFee:  match.TakerFee,
+				Timestamp: cmd.Timestamp,
+			},
+		)
+
+		// Auctions can clear levels on both sides of the book. Market
+		// orders have no price and never rested in the book.
+		for _, order := range []*orderbook.Order{match.Bid, match.Ask} {
+			l := level{bid: order.Bid, price: order.Price}
+			if order.IsFilled() && order.Price > 0 && !seen[l] {
+				seen[l] = true
+				levels = append(levels, l)
+			}
+		}
+	}
+
+	for _, l := range levels {
+		if !ob.HasLimit(l.bid, l.price) {
+			events = append(events, clearLevelEvent(cmd, l.bid, l.price))
+		}
+	}
+
+	return events
+}
+
+// level identifies a price level of the book.
+type level struct {
+	bid   bool
+	price float64
+}
+
+func clearLevelEvent(cmd Command, bid bool, price float64) Event {
+	return Event{
+		Type:      EventClearLevel,
+		Market:    cmd.Market,
+		Bid:       bid,
+		Price:     price,
+		Timestamp: cmd.Timestamp,
+	}
+}
+
+func haltEvent(ob *orderbook.Orderbook, cmd Command) Event {
+	ev := Event{
+		Type:      EventHalt,
+		Market:    cmd.Market,
+		State:     ob.State(),
+		Timestamp: cmd.Timestamp,
+	}
+	if halt := ob.Halted(); halt != nil {
+		ev.Reason = halt.Reason
+	}
+	return ev
+}
+
+func stateEvent(cmd Command, state orderbook.State) Event {
+	return Event{
+		Type:      EventState,
+		Market:    cmd.Market,
+		State:     state,
+		Timestamp: cmd.Timestamp,
+	}
+}
@@ -0,0 +1,393 @@
+package engine
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/inagib21/crypto-exchange/journal"
+	"github.com/inagib21/crypto-exchange/orderbook"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func newBooks() map[string]*orderbook.Orderbook {
+	return map[string]*orderbook.Orderbook{"ETH": orderbook.NewOrderbook()}
+}
+
+func place(id int64, bid, limit bool, size, price float64) Command {
+	return Command{
+		Type:      CommandPlace,
+		Market:    "ETH",
+		OrderID:   id,
+		UserID:    id * 10,
+		Limit:     limit,
+		Bid:       bid,
+		Size:      size,
+		Price:     price,
+		Timestamp: id,
+	}
+}
+
+func TestExecuteEvents(t *testing.T) {
+	e := New(newBooks(), nil)
+
+	_, err := e.Execute(place(1, false, true, 5, 100))
+	assert(t, err, nil)
+	_, err = e.Execute(place(2, false, true, 5, 101))
+	assert(t, err, nil)
+
+	res, err := e.Execute(place(3, true, false, 7, 0))
+	assert(t, err, nil)
+	assert(t, len(res.Matches), 2)
+
+	types := []EventType{}
+	for _, ev := range res.Events {
+		types = append(types, ev.Type)
+	}
+	assert(t, types, []EventType{EventMatch, EventTrade, EventMatch, EventTrade, EventClearLevel})
+	assert(t, res.Events[4].Price, 100.0)
+
+	// Amends and orders are validated before they are journaled
+	_, err = e.Execute(Command{Type: CommandAmend, Market: "ETH", OrderID: 2, Size: 1})
+	assert(t, errors.Is(err, ErrInvalidOrder), true)
+	_, err = e.Execute(Command{Type: CommandAmend, Market: "ETH", OrderID: 2, Size: 1, Price: math.Inf(1)})
+	assert(t, errors.Is(err, ErrInvalidOrder), true)
+	_, err = e.Execute(place(4, true, true, -1, 90))
+	assert(t, errors.Is(err, ErrInvalidOrder), true)
+
+	// The ID of a resting order can't be reused
+	_, err = e.Execute(place(2, true, true, 1, 90))
+	assert(t, errors.Is(err, ErrDuplicateOrder), true)
+
+	res, err = e.Execute(Command{Type: CommandCancel, Market: "ETH", OrderID: 2})
+	assert(t, err, nil)
+	assert(t, res.Events[0].Type, EventCancel)
+	assert(t, res.Events[1].Type, EventClearLevel)
+
+	_, err = e.Execute(Command{Type: CommandCancel, Market: "ETH", OrderID: 1})
+	assert(t, err, ErrOrderNotFound)
+	_, err = e.Execute(Command{Type: CommandCancel, Market: "BTC", OrderID: 1})
+	assert(t, err, ErrMarketNotFound)
+}
+
+func TestMarketOrdersNeedContinuousTrading(t *testing.T) {
+	e := New(newBooks(), nil)
+
+	_, err := e.Execute(place(1, false, true, 5, 100))
+	assert(t, err, nil)
+
+	_, err = e.Execute(Command{Type: CommandHalt, Market: "ETH", Reason: "maintenance"})
+	assert(t, err, nil)
+	_, err = e.Execute(place(2, true, false, 1, 0))
+	assert(t, errors.Is(err, ErrMarketHalted), true)
+
+	_, err = e.Execute(Command{Type: CommandSetState, Market: "ETH", State: orderbook.StateAuction})
+	assert(t, err, nil)
+	_, err = e.Execute(place(2, true, false, 1, 0))
+	assert(t, errors.Is(err, ErrMarketState), true)
+
+	// Limit orders still join the book
+	_, err = e.Execute(place(3, true, true, 1, 99))
+	assert(t, err, nil)
+}
+
+func TestReplayRebuildsBook(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.log")
+	j, err := journal.Open(path, journal.DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	books := newBooks()
+	e := New(books, j)
+
+	commands := []Command{
+		place(1, false, true, 5, 100),
+		place(2, false, true, 3, 102),
+		place(3, true, true, 4, 98),
+		place(4, true, false, 6, 0),
+		{Type: CommandAmend, Market: "ETH", OrderID: 3, Size: 2, Price: 99},
+		place(5, true, true, 1, 97),
+		{Type: CommandCancel, Market: "ETH", OrderID: 5},
+		{Type: CommandSetState, Market: "ETH", State: orderbook.StateAuction},
+		place(6, true, true, 1, 103),
+		{Type: CommandSetState, Market: "ETH", State: orderbook.StateContinuous},
+	}
+	for _, cmd := range commands {
+		if _, err := e.Execute(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Close()
+
+	replayed := newBooks()
+	count := 0
+	err = Replay(path, replayed, func(cmd Command, res Result) { count++ })
+	assert(t, err, nil)
+	assert(t, count, len(commands))
+
+	want, got := books["ETH"], replayed["ETH"]
+	assert(t, got.State(), want.State())
+	assert(t, got.BidTotalVolume(), want.BidTotalVolume())
+	assert(t, got.AskTotalVolume(), want.AskTotalVolume())
+	assert(t, len(got.Trades), len(want.Trades))
+	assert(t, len(got.Orders), len(want.Orders))
+	for id, order := range want.Orders {
+		assert(t, got.Orders[id].Size, order.Size)
+		assert(t, got.Orders[id].Price, order.Price)
+	}
+}
+
+func TestCheckRejectsBeforeJournaling(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.log")
+	j, err := journal.Open(path, journal.DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	books := newBooks()
+	e := New(books, j)
+
+	errLimit := errors.New("limit")
+	e.SetCheck(func(ob *orderbook.Orderbook, cmd Command, pending []Command) error {
+		if cmd.Size > 5 {
+			return errLimit
+		}
+		return nil
+	})
+
+	_, err = e.Execute(place(1, true, true, 5, 100))
+	assert(t, err, nil)
+	_, err = e.Execute(place(2, true, true, 6, 100))
+	assert(t, errors.Is(err, errLimit), true)
+	assert(t, books["ETH"].Order(2) == nil, true)
+	assert(t, j.Seq(), uint64(1))
+	j.Close()
+}
+
+func TestRecoverFromSnapshot(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		path = filepath.Join(dir, "journal.log")
+	)
+	j, err := journal.Open(path, journal.DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	books := newBooks()
+	e := New(books, j)
+	execute := func(commands ...Command) {
+		for _, cmd := range commands {
+			if _, err := e.Execute(cmd); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	execute(
+		place(1, false, true, 5, 100),
+		place(2, false, true, 3, 100),
+		place(3, true, true, 4, 98),
+	)
+
+	// Take a snapshot in the middle of the journal
+	s, err := e.Snapshot(func() any { return map[string]int{"commands": 3} })
+	assert(t, err, nil)
+	_, err = WriteSnapshot(filepath.Join(dir, "snapshots"), s)
+	assert(t, err, nil)
+
+	execute(
+		place(4, true, false, 6, 0),
+		place(5, true, true, 1, 99),
+		Command{Type: CommandCancel, Market: "ETH", OrderID: 3},
+	)
+	j.Close()
+
+	// Only the commands after the snapshot are replayed
+	replayed := newBooks()
+	count := 0
+	recovered, err := Recover(filepath.Join(dir, "snapshots"), path, replayed, func(cmd Command, res Result) { count++ })
+	assert(t, err, nil)
+	assert(t, recovered.Seq, s.Seq)
+	assert(t, string(recovered.State), `{"commands":3}`)
+	assert(t, count, 3)
+
+	want, got := books["ETH"].Snapshot(), replayed["ETH"].Snapshot()
+	assert(t, Diff(Snapshot{Books: map[string]orderbook.Snapshot{"ETH": want}}, Snapshot{Books: map[string]orderbook.Snapshot{"ETH": got}}), []string{})
+	assert(t, got.Asks, want.Asks)
+	assert(t, got.Bids, want.Bids)
+
+	// A snapshot ahead of the journal can't be recovered from
+	s.Seq = 1000
+	_, err = WriteSnapshot(filepath.Join(dir, "snapshots"), s)
+	assert(t, err, nil)
+	_, err = Recover(filepath.Join(dir, "snapshots"), path, newBooks(), nil)
+	assert(t, err != nil, true)
+}
+
+func TestDiff(t *testing.T) {
+	a, b := newBooks(), newBooks()
+	a["ETH"].PlaceLimitOrder(100, &orderbook.Order{ID: 1, Size: 5})
+	b["ETH"].PlaceLimitOrder(100, &orderbook.Order{ID: 1, Size: 4})
+	b["ETH"].PlaceLimitOrder(101, &orderbook.Order{ID: 2, Size: 1})
+
+	diffs := Diff(
+		Snapshot{Books: map[string]orderbook.Snapshot{"ETH": a["ETH"].Snapshot()}},
+		Snapshot{Books: map[string]orderbook.Snapshot{"ETH": b["ETH"].Snapshot()}},
+	)
+	assert(t, diffs, []string{
+		"ETH asks 100.00: volume 5.00 != 4.00",
+		"ETH asks 100.00: queue [1:5.00] != [1:4.00]",
+		"ETH asks 101.00: level only in b (volume 1.00)",
+	})
+}
+
+// stepClock moves one second forward every time it is read.
+type stepClock struct{ now time.Time }
+
+func (c *stepClock) Now() time.Time {
+	c.now = c.now.Add(time.Second)
+	return c.now
+}
+
+func TestVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.log")
+	j, err := journal.Open(path, journal.DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	books := newBooksWithBreaker()
+	e := New(books, j)
+	e.SetClock(&stepClock{now: time.Unix(1700000000, 0)})
+	e.SetIDGenerator(orderbook.NewSequentialIDs(0))
+
+	// Orders get their ID and timestamp from the engine
+	orders := []*orderbook.Order{
+		e.NewOrder(false, 5, 1),
+		e.NewOrder(false, 5, 1),
+		e.NewOrder(true, 8, 2),
+	}
+	assert(t, orders[2].ID, int64(3))
+	assert(t, orders[2].Timestamp, time.Unix(1700000003, 0).UnixNano())
+
+	prices := []float64{100, 110, 0}
+	for i, order := range orders {
+		cmd := Command{Type: CommandPlace, Market: "ETH", OrderID: order.ID, UserID: order.UserID, Limit: prices[i] > 0, Bid: order.Bid, Size: order.Size, Price: prices[i]}
+		if _, err := e.Execute(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The fill at 110 tripped the circuit breaker
+	assert(t, books["ETH"].State(), orderbook.StateHalted)
+	assert(t, books["ETH"].Trades[0].Timestamp, time.Unix(1700000006, 0).UnixNano())
+	j.Close()
+
+	commands, divergence, err := Verify(path, newBooksWithBreaker())
+	assert(t, err, nil)
+	assert(t, commands, 3)
+	assert(t, divergence, (*Divergence)(nil))
+
+	// Without the circuit breaker the replay doesn't halt
+	commands, divergence, err = Verify(path, newBooks())
+	assert(t, err, nil)
+	assert(t, commands, 3)
+	assert(t, divergence != nil, true)
+	assert(t, divergence.Command.OrderID, int64(3))
+	assert(t, divergence.Want != nil, true)
+}
+
+func newBooksWithBreaker() map[string]*orderbook.Orderbook {
+	books := newBooks()
+	books["ETH"].SetCircuitBreaker(orderbook.CircuitBreaker{Band: 0.05, Window: time.Minute, HaltDuration: time.Minute})
+	return books
+}
+
+func TestReplayReopenAuction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.log")
+	j, err := journal.Open(path, journal.DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newBooks := func() map[string]*orderbook.Orderbook {
+		books := newBooksWithBreaker()
+		books["ETH"].SetReopenAuction(30 * time.Second)
+		return books
+	}
+
+	start := time.Unix(1700000000, 0)
+	books := newBooks()
+	e := New(books, j)
+	for i, cmd := range []Command{place(1, false, true, 5, 100), place(2, false, true, 5, 110), place(3, true, false, 8, 0)} {
+		cmd.Timestamp = start.Add(time.Duration(i) * time.Second).UnixNano()
+		if _, err := e.Execute(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert(t, books["ETH"].State(), orderbook.StateHalted)
+
+	// The halt expires and the reopening auction starts
+	cmd, _, err := e.Tick("ETH", start.Add(2*time.Minute))
+	assert(t, err, nil)
+	end := start.Add(2*time.Minute + 30*time.Second)
+	assert(t, cmd.AuctionEnd, end.UnixNano())
+	j.Close()
+
+	replayed := newBooks()
+	assert(t, Replay(path, replayed, nil), nil)
+	assert(t, replayed["ETH"].State(), orderbook.StateAuction)
+	assert(t, replayed["ETH"].AuctionEnd(), books["ETH"].AuctionEnd())
+
+	// The replayed auction still ends
+	replayed["ETH"].Tick(end)
+	assert(t, replayed["ETH"].State(), orderbook.StateContinuous)
+}
+
+func TestTickJournalsBeforeApplying(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.log")
+	j, err := journal.Open(path, journal.DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1700000000, 0)
+	books := newBooksWithBreaker()
+	e := New(books, j)
+	for i, cmd := range []Command{place(1, false, true, 5, 100), place(2, false, true, 5, 110), place(3, true, false, 8, 0)} {
+		cmd.Timestamp = start.Add(time.Duration(i) * time.Second).UnixNano()
+		if _, err := e.Execute(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert(t, books["ETH"].State(), orderbook.StateHalted)
+
+	// A transition that can't be journaled doesn't happen
+	j.Close()
+	_, _, err = e.Tick("ETH", start.Add(2*time.Minute))
+	assert(t, errors.Is(err, journal.ErrFailed), true)
+	assert(t, books["ETH"].State(), orderbook.StateHalted)
+}
+
+func TestApplyKeepsClock(t *testing.T) {
+	ob := orderbook.NewOrderbook()
+	now := time.Unix(1700000000, 0)
+	ob.SetClock(orderbook.FixedClock(now))
+
+	_, err := Apply(ob, place(1, false, true, 5, 100))
+	assert(t, err, nil)
+
+	// The book is back on its own clock after the command
+	ob.Halt("test")
+	assert(t, ob.Halted().Since, now)
+}
@@ -0,0 +1,248 @@
+package engine
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultQueueSize is the number of commands a market queues before
+// submitting blocks.
+const DefaultQueueSize = 1024
+
+var (
+	// ErrSequencerClosed is returned for commands submitted after Close.
+	ErrSequencerClosed = errors.New("sequencer closed")
+	// ErrMixedMarkets rejects batches of commands of several markets.
+	ErrMixedMarkets = errors.New("batch commands must be of a single market")
+)
+
+// Output is a command applied by the sequencer with its result, as
+// published to the consumers.
+type Output struct {
+	Command Command
+	Result  Result
+}
+
+// Reply is the answer of the sequencer to a submitted command.
+type Reply struct {
+	Result Result
+	Err    error
+}
+
+// request holds commands waiting in the queue of a market, applied one after
+// the other with a reply each, or all or none of them when atomic. Ticks run
+// the timed state transitions of the market at now instead of commands.
+type request struct {
+	cmds   []Command
+	atomic bool
+	tick   bool
+	now    time.Time
+	reply  chan Reply
+}
+
+// Sequencer feeds the commands of every market to the engine from a single
+// goroutine per market, reading them from a bounded queue. Commands of a
+// market are applied strictly in the order they were submitted, so a cancel
+// submitted after an order is never applied before it, and the engine
+// numbers them across markets. The goroutines order the commands of their
+// market, they don't match in parallel: the engine applies one command at a
+// time across every market. Every applied command is published to all
+// the consumers, in order within a market. Consumers are not dropped: a
+// consumer that falls behind its buffer holds up the market, which holds up
+// the submitters once its queue is full.
+type Sequencer struct {
+	engine *Engine
+	queues map[string]chan request
+	wg     sync.WaitGroup
+
+	// mu guards closed: submitters hold it for reading while they queue.
+	mu     sync.RWMutex
+	closed bool
+
+	subsMu sync.RWMutex
+	subs   []chan Output
+}
+
+// NewSequencer starts the goroutines applying the commands of every market
+// of the engine, each queueing at most size commands.
+func NewSequencer(e *Engine, size int) *Sequencer {
+	s := &Sequencer{
+		engine: e,
+		queues: make(map[string]chan request, len(e.books)),
+	}
+
+	for market := range e.books {
+		queue := make(chan request, size)
+		s.queues[market] = queue
+
+		s.wg.Add(1)
+		go s.run(queue)
+	}
+
+	return s
+}
+
+// Subscribe returns a channel receiving every command applied from now on
+// with its result. The channel is closed by Close.
+func (s *Sequencer) Subscribe(size int) <-chan Output {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+
+	ch := make(chan Output, size)
+	s.subs = append(s.subs, ch)
+	return ch
+}
+
+// Submit queues a command and returns the channel its reply is sent on. It
+// blocks while the queue of the market is full.
+func (s *Sequencer) Submit(cmd Command) <-chan Reply {
+	return s.submit(cmd.Market, request{cmds: []Command{cmd}})
+}
+
+// Execute submits a command and waits for its result.
+func (s *Sequencer) Execute(cmd Command) (Result, error) {
+	reply := <-s.Submit(cmd)
+	return reply.Result, reply.Err
+}
+
+// ExecuteBatch applies commands of a single market one after the other,
+// without commands of other submitters in between, and returns the reply
+// to each of them. A failed command doesn't stop the others.
+func (s *Sequencer) ExecuteBatch(cmds []Command) []Reply {
+	return s.executeBatch(request{cmds: cmds})
+}
+
+// ExecuteAtomic is like ExecuteBatch but applies the commands only if every
+// one of them is valid, see Engine.ExecuteAll.
+func (s *Sequencer) ExecuteAtomic(cmds []Command) []Reply {
+	return s.executeBatch(request{cmds: cmds, atomic: true})
+}
+
+func (s *Sequencer) executeBatch(req request) []Reply {
+	replies := make([]Reply, len(req.cmds))
+	if len(req.cmds) == 0 {
+		return replies
+	}
+
+	market := req.cmds[0].Market
+	for _, cmd := range req.cmds {
+		if cmd.Market != market {
+			for i := range replies {
+				replies[i].Err = ErrMixedMarkets
+			}
+			return replies
+		}
+	}
+
+	ch := s.submit(market, req)
+	for i := range replies {
+		replies[i] = <-ch
+	}
+	return replies
+}
+
+// Tick runs the timed state transitions of a market in order with its
+// commands, see Engine.Tick.
+func (s *Sequencer) Tick(market string, now time.Time) (Result, error) {
+	reply := <-s.submit(market, request{cmds: []Command{{Market: market}}, tick: true, now: now})
+	return reply.Result, reply.Err
+}
+
+func (s *Sequencer) submit(market string, req request) <-chan Reply {
+	req.reply = make(chan Reply, len(req.cmds))
+
+	// fail replies to every command of the request with err.
+	fail := func(err error) <-chan Reply {
+		for range req.cmds {
+			req.reply <- Reply{Err: err}
+		}
+		return req.reply
+	}
+
+	queue, ok := s.queues[market]
+	if !ok {
+		return fail(ErrMarketNotFound)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return fail(ErrSequencerClosed)
+	}
+
+	queue <- req
+	return req.reply
+}
+
+// run applies the commands of the queue of a market until it is closed.
+func (s *Sequencer) run(queue <-chan request) {
+	defer s.wg.Done()
+
+	for req := range queue {
+		if req.atomic {
+			for i, reply := range s.engine.ExecuteAll(req.cmds) {
+				cmd := req.cmds[i]
+				cmd.Timestamp = reply.Result.Timestamp
+				if reply.Err == nil {
+					s.publish(Output{Command: cmd, Result: reply.Result})
+				}
+				req.reply <- reply
+			}
+			continue
+		}
+
+		for _, cmd := range req.cmds {
+			var (
+				res Result
+				err error
+			)
+			if req.tick {
+				cmd, res, err = s.engine.Tick(cmd.Market, req.now)
+			} else {
+				res, err = s.engine.Execute(cmd)
+				cmd.Timestamp = res.Timestamp
+			}
+
+			// Ticks that didn't change the state of the market have no command.
+			if err == nil && cmd.Type != "" {
+				s.publish(Output{Command: cmd, Result: res})
+			}
+			req.reply <- Reply{Result: res, Err: err}
+		}
+	}
+}
+
+func (s *Sequencer) publish(out Output) {
+	s.subsMu.RLock()
+	defer s.subsMu.RUnlock()
+
+	for _, sub := range s.subs {
+		sub <- out
+	}
+}
+
+// Close stops accepting commands, applies the ones already queued and then
+// closes the channels of the consumers.
+func (s *Sequencer) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	for _, queue := range s.queues {
+		close(queue)
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	for _, sub := range s.subs {
+		close(sub)
+	}
+	s.subs = nil
+}
@@ -0,0 +1,269 @@
+package engine
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/inagib21/crypto-exchange/orderbook"
+	"github.com/sirupsen/logrus"
+)
+
+func TestSequencerOrdersCommands(t *testing.T) {
+	books := newBooks()
+	books["BTC"] = orderbook.NewOrderbook()
+
+	s := NewSequencer(New(books, nil), 4)
+	consumers := []<-chan Output{s.Subscribe(1), s.Subscribe(16)}
+
+	outputs := make([][]Output, len(consumers))
+	var wg sync.WaitGroup
+	for i, ch := range consumers {
+		wg.Add(1)
+		go func(i int, ch <-chan Output) {
+			defer wg.Done()
+			for out := range ch {
+				outputs[i] = append(outputs[i], out)
+			}
+		}(i, ch)
+	}
+
+	// Every cancel is submitted right after its order without waiting for
+	// it, in both markets at once
+	const n = 100
+	replies := make(chan (<-chan Reply), 4*n)
+	var submitters sync.WaitGroup
+	for _, market := range []string{"ETH", "BTC"} {
+		submitters.Add(1)
+		go func(market string) {
+			defer submitters.Done()
+			for id := int64(1); id <= n; id++ {
+				cmd := place(id, false, true, 1, float64(100+id))
+				cmd.Market = market
+				replies <- s.Submit(cmd)
+				replies <- s.Submit(Command{Type: CommandCancel, Market: market, OrderID: id})
+			}
+		}(market)
+	}
+	submitters.Wait()
+	close(replies)
+
+	for reply := range replies {
+		assert(t, (<-reply).Err, nil)
+	}
+
+	s.Close()
+	wg.Wait()
+
+	// Every consumer received every command of a market in the same order
+	assert(t, len(outputs[0]), 4*n)
+	assert(t, byMarket(outputs[0]), byMarket(outputs[1]))
+
+	// Within a market the cancels follow their orders, and sequence
+	// numbers are unique across markets
+	next := map[string]int64{"ETH": 1, "BTC": 1}
+	last := map[string]uint64{}
+	seqs := map[uint64]bool{}
+	for i, out := range outputs[0] {
+		market := out.Command.Market
+		if out.Command.OrderID != next[market] {
+			t.Fatalf("output %d: order %d in %s, want %d", i, out.Command.OrderID, market, next[market])
+		}
+		if out.Command.Type == CommandCancel {
+			next[market]++
+		}
+		if out.Result.Seq <= last[market] || seqs[out.Result.Seq] {
+			t.Fatalf("output %d: sequence %d out of order", i, out.Result.Seq)
+		}
+		last[market] = out.Result.Seq
+		seqs[out.Result.Seq] = true
+	}
+
+	// The books are empty and closed to new commands
+	assert(t, len(books["ETH"].Orders)+len(books["BTC"].Orders), 0)
+	_, err := s.Execute(place(1, true, true, 1, 100))
+	assert(t, err, ErrSequencerClosed)
+}
+
+func byMarket(outputs []Output) map[string][]Output {
+	markets := make(map[string][]Output)
+	for _, out := range outputs {
+		markets[out.Command.Market] = append(markets[out.Command.Market], out)
+	}
+	return markets
+}
+
+func TestSequencerBatch(t *testing.T) {
+	books := newBooks()
+	books["BTC"] = orderbook.NewOrderbook()
+	s := NewSequencer(New(books, nil), 1)
+	defer s.Close()
+
+	// Every command of the batch gets its own reply
+	replies := s.ExecuteBatch([]Command{
+		place(1, true, true, 1, 100),
+		place(2, true, true, 2, 99),
+		{Type: CommandCancel, Market: "ETH", OrderID: 1},
+		{Type: CommandCancel, Market: "ETH", OrderID: 42},
+	})
+	assert(t, len(replies), 4)
+	assert(t, replies[0].Err, nil)
+	assert(t, replies[1].Result.OrderState.Size, 2.0)
+	assert(t, replies[2].Result.OrderState.Status, orderbook.StatusCanceled)
+	assert(t, replies[3].Err, ErrOrderNotFound)
+	assert(t, books["ETH"].BidTotalVolume(), 2.0)
+
+	// A batch is of a single market
+	btc := place(3, true, true, 1, 100)
+	btc.Market = "BTC"
+	replies = s.ExecuteBatch([]Command{place(4, true, true, 1, 100), btc})
+	assert(t, replies[0].Err, ErrMixedMarkets)
+	assert(t, replies[1].Err, ErrMixedMarkets)
+}
+
+func TestSequencerAtomicBatch(t *testing.T) {
+	books := newBooks()
+	e := New(books, nil)
+	// At most 3 open orders, counting the pending ones
+	e.SetCheck(func(ob *orderbook.Orderbook, cmd Command, pending []Command) error {
+		if cmd.Type == CommandPlace && len(ob.Orders)+len(pending) >= 3 {
+			return errors.New("too many orders")
+		}
+		return nil
+	})
+	s := NewSequencer(e, 1)
+	defer s.Close()
+
+	outputs := s.Subscribe(10)
+
+	// A rejected command rejects the whole batch
+	replies := s.ExecuteAtomic([]Command{
+		place(1, true, true, 1, 100),
+		place(2, true, true, 1, 99),
+		place(3, true, true, 1, 98),
+		place(4, true, true, 1, 97),
+	})
+	assert(t, replies[0].Err, ErrBatchRejected)
+	assert(t, replies[2].Err, ErrBatchRejected)
+	assert(t, replies[3].Err.Error(), "too many orders")
+	assert(t, len(books["ETH"].Orders), 0)
+
+	replies = s.ExecuteAtomic([]Command{
+		place(1, true, true, 1, 100),
+		place(2, true, true, 1, 99),
+		{Type: CommandCancel, Market: "ETH", OrderID: 42},
+	})
+	assert(t, replies[0].Err, ErrBatchRejected)
+	assert(t, replies[2].Err, ErrOrderNotFound)
+	assert(t, len(books["ETH"].Orders), 0)
+
+	// A valid batch is applied and published
+	replies = s.ExecuteAtomic([]Command{
+		place(1, true, true, 1, 100),
+		place(2, true, true, 2, 99),
+	})
+	assert(t, replies[0].Err, nil)
+	assert(t, replies[1].Result.OrderState.Size, 2.0)
+	assert(t, len(books["ETH"].Orders), 2)
+	assert(t, (<-outputs).Command.OrderID, int64(1))
+	assert(t, (<-outputs).Command.OrderID, int64(2))
+
+	// An order is canceled once per batch
+	replies = s.ExecuteAtomic([]Command{
+		{Type: CommandCancel, Market: "ETH", OrderID: 1},
+		{Type: CommandCancel, Market: "ETH", OrderID: 1},
+	})
+	assert(t, errors.Is(replies[1].Err, ErrDuplicateOrder), true)
+	assert(t, len(books["ETH"].Orders), 2)
+}
+
+func TestSequencerUnknownMarket(t *testing.T) {
+	s := NewSequencer(New(newBooks(), nil), 1)
+	defer s.Close()
+
+	cmd := place(1, true, true, 1, 100)
+	cmd.Market = "DOGE"
+	_, err := s.Execute(cmd)
+	assert(t, err, ErrMarketNotFound)
+
+	_, err = s.Tick("DOGE", time.Now())
+	assert(t, err, ErrMarketNotFound)
+}
+
+// benchmarkExecute executes crossing limit orders from parallel clients and
+// reports the throughput and the latency percentiles of execute.
+func benchmarkExecute(b *testing.B, execute func(Command) (Result, error)) {
+	var (
+		ids       atomic.Int64
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, b.N)
+	)
+
+	// Logging every order would dominate the measurements
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	defer logrus.SetLevel(level)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		local := []time.Duration{}
+		for pb.Next() {
+			id := ids.Add(1)
+			cmd := place(id, id%2 == 0, true, 1, 100)
+
+			start := time.Now()
+			if _, err := execute(cmd); err != nil {
+				b.Error(err)
+				return
+			}
+			local = append(local, time.Since(start))
+		}
+
+		mu.Lock()
+		latencies = append(latencies, local...)
+		mu.Unlock()
+	})
+	b.StopTimer()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) float64 {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return float64(latencies[int(p*float64(len(latencies)-1))].Nanoseconds())
+	}
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "cmds/s")
+	b.ReportMetric(percentile(0.50), "p50-ns")
+	b.ReportMetric(percentile(0.99), "p99-ns")
+	b.ReportMetric(percentile(0.999), "p999-ns")
+}
+
+func BenchmarkEngine(b *testing.B) {
+	benchmarkExecute(b, New(newBooks(), nil).Execute)
+}
+
+// BenchmarkSequencer measures the cost of queueing commands and publishing
+// their results on top of BenchmarkEngine. Commands of other markets would
+// wait for the same engine lock, so more markets don't add throughput.
+func BenchmarkSequencer(b *testing.B) {
+	s := NewSequencer(New(newBooks(), nil), DefaultQueueSize)
+
+	// Drain the outputs like the consumers of the exchange
+	outputs := s.Subscribe(DefaultQueueSize)
+	done := make(chan struct{})
+	go func() {
+		for range outputs {
+		}
+		close(done)
+	}()
+
+	benchmarkExecute(b, s.Execute)
+
+	s.Close()
+	<-done
+}
@@ -0,0 +1,281 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/inagib21/crypto-exchange/orderbook"
+	"github.com/sirupsen/logrus"
+)
+
+// snapshotPattern matches the files written by WriteSnapshot. The sequence
+// number is zero padded so the names sort in sequence order.
+const snapshotPattern = "snapshot-*.json"
+
+// Snapshot is a consistent copy of every order book at a journal sequence
+// number. Recovering from it only needs the journal records after Seq.
+type Snapshot struct {
+	Seq   uint64
+	Time  time.Time
+	Books map[string]orderbook.Snapshot
+	// State is the state the owner of the engine derives from the results
+	// of commands, see OnApply.
+	State json.RawMessage `json:",omitempty"`
+}
+
+// Snapshot copies the order books and the given state. The engine is only
+// locked while copying, encoding and writing the snapshot happen after.
+func (e *Engine) Snapshot(state func() any) (Snapshot, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s := Snapshot{
+		Time:  e.clock.Now(),
+		Books: make(map[string]orderbook.Snapshot, len(e.books)),
+	}
+	if e.journal != nil {
+		s.Seq = e.journal.Seq()
+	}
+
+	for market, ob := range e.books {
+		s.Books[market] = ob.Snapshot()
+	}
+
+	if state != nil {
+		data, err := json.Marshal(state())
+		if err != nil {
+			return s, err
+		}
+		s.State = data
+	}
+
+	return s, nil
+}
+
+// WriteSnapshot atomically writes a snapshot into dir and returns its path.
+func WriteSnapshot(dir string, s Snapshot) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("snapshot-%020d.json", s.Seq))
+	tmp, err := os.CreateTemp(dir, ".snapshot-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	return path, os.Rename(tmp.Name(), path)
+}
+
+// ReadSnapshot reads the snapshot at path.
+func ReadSnapshot(path string) (Snapshot, error) {
+	s := Snapshot{}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, fmt.Errorf("decoding snapshot %s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+// Snapshots returns the paths of the snapshots in dir, oldest first.
+func Snapshots(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, snapshotPattern))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// PruneSnapshots removes every snapshot in dir but the latest keep.
+func PruneSnapshots(dir string, keep int) error {
+	paths, err := Snapshots(dir)
+	if err != nil {
+		return err
+	}
+
+	for len(paths) > keep {
+		if err := os.Remove(paths[0]); err != nil {
+			return err
+		}
+		paths = paths[1:]
+	}
+
+	return nil
+}
+
+// LatestSnapshot returns the latest readable snapshot in dir, or an empty
+// snapshot when there is none. A snapshot that can't be read is skipped for
+// the one before it.
+func LatestSnapshot(dir string) (Snapshot, error) {
+	paths, err := Snapshots(dir)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	for i := len(paths) - 1; i >= 0; i-- {
+		s, err := ReadSnapshot(paths[i])
+		if err == nil {
+			return s, nil
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"path":  paths[i],
+			"error": err,
+		}).Warn("skipping unreadable snapshot")
+	}
+
+	return Snapshot{}, nil
+}
+
+// Restore replaces the state of the order books with the snapshot.
+func (s Snapshot) Restore(books map[string]*orderbook.Orderbook) error {
+	for market, book := range s.Books {
+		ob, ok := books[market]
+		if !ok {
+			return fmt.Errorf("snapshot seq %d: %w: %s", s.Seq, ErrMarketNotFound, market)
+		}
+		ob.Restore(book)
+	}
+	return nil
+}
+
+// Recover restores the order books from the latest snapshot in dir and
+// replays the journal at path after it, calling fn with the result of every
+// replayed command.
+func Recover(dir, path string, books map[string]*orderbook.Orderbook, fn func(cmd Command, res Result)) (Snapshot, error) {
+	s, err := LatestSnapshot(dir)
+	if err != nil {
+		return s, err
+	}
+	if err := s.Restore(books); err != nil {
+		return s, err
+	}
+
+	_, err = ReplayFrom(path, s.Seq, books, fn)
+	return s, err
+}
+
+// Diff returns a line for every difference between the order books of two
+// snapshots, in market order.
+func Diff(a, b Snapshot) []string {
+	diffs := []string{}
+
+	markets := map[string]bool{}
+	for market := range a.Books {
+		markets[market] = true
+	}
+	for market := range b.Books {
+		markets[market] = true
+	}
+	names := make([]string, 0, len(markets))
+	for market := range markets {
+		names = append(names, market)
+	}
+	sort.Strings(names)
+
+	for _, market := range names {
+		x, inA := a.Books[market]
+		y, inB := b.Books[market]
+		switch {
+		case !inA:
+			diffs = append(diffs, fmt.Sprintf("%s: only in b", market))
+		case !inB:
+			diffs = append(diffs, fmt.Sprintf("%s: only in a", market))
+		default:
+			diffs = append(diffs, diffBook(market, x, y)...)
+		}
+	}
+
+	return diffs
+}
+
+func diffBook(market string, a, b orderbook.Snapshot) []string {
+	diffs := []string{}
+	if a.State != b.State {
+		diffs = append(diffs, fmt.Sprintf("%s: state %s != %s", market, a.State, b.State))
+	}
+	diffs = append(diffs, diffLevels(market+" bids", a.Bids, b.Bids)...)
+	diffs = append(diffs, diffLevels(market+" asks", a.Asks, b.Asks)...)
+	return diffs
+}
+
+func diffLevels(side string, a, b []orderbook.LevelSnapshot) []string {
+	var (
+		diffs  = []string{}
+		levels = map[float64][2]*orderbook.LevelSnapshot{}
+		prices = []float64{}
+	)
+
+	for i := range a {
+		l := levels[a[i].Price]
+		l[0] = &a[i]
+		levels[a[i].Price] = l
+		prices = append(prices, a[i].Price)
+	}
+	for i := range b {
+		l, ok := levels[b[i].Price]
+		l[1] = &b[i]
+		levels[b[i].Price] = l
+		if !ok {
+			prices = append(prices, b[i].Price)
+		}
+	}
+	sort.Float64s(prices)
+
+	for _, price := range prices {
+		x, y := levels[price][0], levels[price][1]
+		switch {
+		case x == nil:
+			diffs = append(diffs, fmt.Sprintf("%s %.2f: level only in b (volume %.2f)", side, price, y.Volume))
+		case y == nil:
+			diffs = append(diffs, fmt.Sprintf("%s %.2f: level only in a (volume %.2f)", side, price, x.Volume))
+		default:
+			if x.Volume != y.Volume {
+				diffs = append(diffs, fmt.Sprintf("%s %.2f: volume %.2f != %.2f", side, price, x.Volume, y.Volume))
+			}
+			if queue(x.Orders) != queue(y.Orders) {
+				diffs = append(diffs, fmt.Sprintf("%s %.2f: queue [%s] != [%s]", side, price, queue(x.Orders), queue(y.Orders)))
+			}
+		}
+	}
+
+	return diffs
+}
+
+// queue describes the orders of a level in queue order.
+func queue(orders []orderbook.OrderSnapshot) string {
+	parts := make([]string, len(orders))
+	for i, o := range orders {
+		parts[i] = fmt.Sprintf("%d:%.2f", o.ID, o.Size)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,120 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/inagib21/crypto-exchange/journal"
+	"github.com/inagib21/crypto-exchange/orderbook"
+)
+
+// errDiverged stops reading the journal at the first divergence.
+var errDiverged = errors.New("diverged")
+
+// Divergence is the first difference between the events recorded in a
+// journal and the events replaying its commands produces.
+type Divergence struct {
+	// Seq is the journal record where the divergence was found.
+	Seq     uint64
+	Command Command
+	// Want is the recorded event, nil if the replay produced an extra event.
+	Want []byte
+	// Got is the replayed event, nil if the replay is missing the recorded event.
+	Got []byte
+}
+
+func (d *Divergence) String() string {
+	return fmt.Sprintf("seq %d after %s command on %s at %d:\n  want: %s\n  got:  %s",
+		d.Seq, d.Command.Type, d.Command.Market, d.Command.Timestamp, orNone(d.Want), orNone(d.Got))
+}
+
+func orNone(data []byte) string {
+	if data == nil {
+		return "<none>"
+	}
+	return string(data)
+}
+
+// Verify replays the commands of the journal at path against the order
+// books, which should be fresh, and compares the encoding of every event it
+// produces to the event recorded after the command, byte for byte. It returns
+// the number of commands replayed and the first divergence, or nil when the
+// replay reproduces the journal.
+func Verify(path string, books map[string]*orderbook.Orderbook) (int, *Divergence, error) {
+	var (
+		commands   = 0
+		last       uint64
+		cmd        Command
+		pending    [][]byte
+		divergence *Divergence
+	)
+
+	// extra reports the first event the replay produced that isn't recorded.
+	extra := func(seq uint64) bool {
+		if len(pending) == 0 {
+			return false
+		}
+		divergence = &Divergence{Seq: seq, Command: cmd, Got: pending[0]}
+		return true
+	}
+
+	err := journal.Read(path, func(seq uint64, data []byte) error {
+		last = seq
+
+		entry := Entry{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("decoding journal record %d: %w", seq, err)
+		}
+
+		if entry.Command == nil {
+			if len(pending) == 0 {
+				divergence = &Divergence{Seq: seq, Command: cmd, Want: data}
+				return errDiverged
+			}
+			if !bytes.Equal(data, pending[0]) {
+				divergence = &Divergence{Seq: seq, Command: cmd, Want: data, Got: pending[0]}
+				return errDiverged
+			}
+			pending = pending[1:]
+			return nil
+		}
+
+		if extra(seq) {
+			return errDiverged
+		}
+
+		cmd = *entry.Command
+		commands++
+
+		ob, ok := books[cmd.Market]
+		if !ok {
+			return fmt.Errorf("journal record %d: %w: %s", seq, ErrMarketNotFound, cmd.Market)
+		}
+
+		res, _ := Apply(ob, cmd)
+		for i := range res.Events {
+			data, err := json.Marshal(Entry{Event: &res.Events[i]})
+			if err != nil {
+				return err
+			}
+			pending = append(pending, data)
+		}
+
+		return nil
+	})
+	if errors.Is(err, errDiverged) {
+		return commands, divergence, nil
+	}
+	if err != nil {
+		return commands, nil, err
+	}
+
+	// The events of the last command may be missing from the end of the journal.
+	if extra(last + 1) {
+		return commands, divergence, nil
+	}
+
+	return commands, nil, nil
+}
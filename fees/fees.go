@@ -0,0 +1,210 @@
+package fees
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Liquidity tells whether a fill added liquidity to the book or removed it.
+type Liquidity string
+
+const (
+	Maker Liquidity = "MAKER"
+	Taker Liquidity = "TAKER"
+)
+
+// Asset identifies which leg of a market a fee is charged in.
+type Asset string
+
+const (
+	Base  Asset = "BASE"
+	Quote Asset = "QUOTE"
+)
+
+// DefaultWindow is the trailing period used to determine a user's fee tier.
+const DefaultWindow = 30 * 24 * time.Hour
+
+// Tier is a fee level that applies once a user's trailing volume reaches MinVolume.
+// Rates are fractions of the received amount; a negative MakerRate is a rebate.
+type Tier struct {
+	MinVolume float64
+	MakerRate float64
+	TakerRate float64
+}
+
+// Schedule is a volume tiered fee schedule.
+type Schedule struct {
+	Tiers []Tier
+}
+
+// FlatSchedule creates a schedule with a single tier.
+func FlatSchedule(makerRate, takerRate float64) Schedule {
+	return Schedule{Tiers: []Tier{{MakerRate: makerRate, TakerRate: takerRate}}}
+}
+
+// TierFor returns the highest tier whose MinVolume is reached by volume.
+func (s Schedule) TierFor(volume float64) Tier {
+	tier := Tier{}
+	for _, t := range s.Tiers {
+		if volume >= t.MinVolume && t.MinVolume >= tier.MinVolume {
+			tier = t
+		}
+	}
+	return tier
+}
+
+// Fill describes one side of a matched trade for fee purposes.
+type Fill struct {
+	Market    string
+	UserID    int64
+	Liquidity Liquidity
+	Bid       bool
+	Size      float64
+	Price     float64
+	Time      time.Time
+}
+
+// Fee is the fee charged for one side of a fill. A negative Amount is a rebate.
+type Fee struct {
+	Rate   float64
+	Amount float64
+	Asset  Asset
+}
+
+// Engine charges fees on fills according to per market schedules and keeps
+// track of the trailing volume of every user.
+type Engine struct {
+	mu        sync.Mutex
+	schedules map[string]Schedule
+	fallback  Schedule
+	window    time.Duration
+	// volumes maps a user to its traded quote volume per day.
+	volumes map[int64]map[int64]float64
+}
+
+// NewEngine creates a fee engine that uses fallback for markets without a
+// schedule of their own.
+func NewEngine(fallback Schedule) *Engine {
+	return &Engine{
+		schedules: make(map[string]Schedule),
+		fallback:  fallback,
+		window:    DefaultWindow,
+		volumes:   make(map[int64]map[int64]float64),
+	}
+}
+
+// SetSchedule configures the fee schedule of a market.
+func (e *Engine) SetSchedule(market string, s Schedule) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	sort.Slice(s.Tiers, func(i, j int) bool { return s.Tiers[i].MinVolume < s.Tiers[j].MinVolume })
+	e.schedules[market] = s
+}
+
+// Schedule returns the fee schedule that applies to a market.
+func (e *Engine) Schedule(market string) Schedule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.schedule(market)
+}
+
+func (e *Engine) schedule(market string) Schedule {
+	if s, ok := e.schedules[market]; ok {
+		return s
+	}
+	return e.fallback
+}
+
+// Volume returns the trailing quote volume of a user at the given time.
+func (e *Engine) Volume(userID int64, now time.Time) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.volume(userID, now)
+}
+
+func (e *Engine) volume(userID int64, now time.Time) float64 {
+	var (
+		total  = 0.0
+		oldest = day(now.Add(-e.window))
+	)
+
+	for d, v := range e.volumes[userID] {
+		if d <= oldest {
+			delete(e.volumes[userID], d)
+			continue
+		}
+		total += v
+	}
+
+	return total
+}
+
+// Volumes returns a copy of the quote volume of every user per day, to be
+// restored with SetVolumes.
+func (e *Engine) Volumes() map[int64]map[int64]float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	volumes := make(map[int64]map[int64]float64, len(e.volumes))
+	for userID, days := range e.volumes {
+		volumes[userID] = make(map[int64]float64, len(days))
+		for d, v := range days {
+			volumes[userID][d] = v
+		}
+	}
+	return volumes
+}
+
+// SetVolumes replaces the volume of every user with volumes.
+func (e *Engine) SetVolumes(volumes map[int64]map[int64]float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.volumes = make(map[int64]map[int64]float64, len(volumes))
+	for userID, days := range volumes {
+		e.volumes[userID] = make(map[int64]float64, len(days))
+		for d, v := range days {
+			e.volumes[userID][d] = v
+		}
+	}
+}
+
+// Charge computes the fee for a fill and adds the fill to the user's volume.
+// The fee is charged in the asset the user receives: base for buyers and
+// quote for sellers.
+func (e *Engine) Charge(f Fill) Fee {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	tier := e.schedule(f.Market).TierFor(e.volume(f.UserID, f.Time))
+
+	fee := Fee{Rate: tier.TakerRate}
+	if f.Liquidity == Maker {
+		fee.Rate = tier.MakerRate
+	}
+
+	notional := f.Size * f.Price
+	if f.Bid {
+		fee.Asset = Base
+		fee.Amount = f.Size * fee.Rate
+	} else {
+		fee.Asset = Quote
+		fee.Amount = notional * fee.Rate
+	}
+
+	if e.volumes[f.UserID] == nil {
+		e.volumes[f.UserID] = make(map[int64]float64)
+	}
+	e.volumes[f.UserID][day(f.Time)] += notional
+
+	return fee
+}
+
+// day returns the number of whole days since the unix epoch.
+func day(t time.Time) int64 {
+	return t.Unix() / int64(24*time.Hour/time.Second)
+}
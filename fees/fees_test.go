@@ -0,0 +1,69 @@
+package fees
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func assertFloat(t *testing.T, a, b float64) {
+	t.Helper()
+	if math.Abs(a-b) > 1e-9 {
+		t.Errorf("%v != %v", a, b)
+	}
+}
+
+var tiered = Schedule{Tiers: []Tier{
+	{MinVolume: 0, MakerRate: 0.001, TakerRate: 0.002},
+	{MinVolume: 10_000, MakerRate: -0.0001, TakerRate: 0.001},
+}}
+
+func TestTierFor(t *testing.T) {
+	assertFloat(t, tiered.TierFor(0).TakerRate, 0.002)
+	assertFloat(t, tiered.TierFor(9_999).TakerRate, 0.002)
+	assertFloat(t, tiered.TierFor(10_000).TakerRate, 0.001)
+}
+
+func TestChargeReceivedAsset(t *testing.T) {
+	e := NewEngine(FlatSchedule(0.001, 0.002))
+	now := time.Now()
+
+	buy := e.Charge(Fill{Market: "ETH", UserID: 1, Liquidity: Taker, Bid: true, Size: 10, Price: 1000, Time: now})
+	if buy.Asset != Base {
+		t.Errorf("buyer fee asset %s != %s", buy.Asset, Base)
+	}
+	assertFloat(t, buy.Amount, 0.02)
+
+	sell := e.Charge(Fill{Market: "ETH", UserID: 2, Liquidity: Maker, Bid: false, Size: 10, Price: 1000, Time: now})
+	if sell.Asset != Quote {
+		t.Errorf("seller fee asset %s != %s", sell.Asset, Quote)
+	}
+	assertFloat(t, sell.Amount, 10)
+}
+
+func TestChargeTrailingVolume(t *testing.T) {
+	e := NewEngine(FlatSchedule(0.001, 0.002))
+	e.SetSchedule("ETH", tiered)
+	start := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	fill := Fill{Market: "ETH", UserID: 1, Liquidity: Maker, Bid: true, Size: 10, Price: 1000, Time: start}
+
+	// The first fill is charged at the base tier and pushes the user into the
+	// rebate tier for the next one.
+	assertFloat(t, e.Charge(fill).Rate, 0.001)
+	assertFloat(t, e.Volume(1, start), 10_000)
+
+	fill.Time = start.Add(time.Hour)
+	rebate := e.Charge(fill)
+	assertFloat(t, rebate.Rate, -0.0001)
+	assertFloat(t, rebate.Amount, -0.001)
+
+	// Volume older than the window no longer counts.
+	later := start.Add(DefaultWindow + 48*time.Hour)
+	assertFloat(t, e.Volume(1, later), 0)
+
+	// Markets without a schedule use the fallback.
+	fill.Market = "BTC"
+	fill.Time = later
+	assertFloat(t, e.Charge(fill).Rate, 0.001)
+}
@@ -0,0 +1,326 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A record is stored as its header followed by the payload:
+//
+//	length  uint32  length of the payload
+//	crc     uint32  CRC-32C of sequence and payload
+//	seq     uint64  sequence number
+const headerSize = 16
+
+// maxRecordSize bounds the payload size so a damaged length can't make the
+// reader allocate arbitrary amounts of memory.
+const maxRecordSize = 16 << 20
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorrupt is returned when a record in the middle of a journal fails its checksum.
+var ErrCorrupt = errors.New("journal corrupt")
+
+// ErrFailed is returned by every write to a journal after one of its writes
+// failed.
+var ErrFailed = errors.New("journal failed")
+
+// SyncPolicy decides when appended records are fsynced to disk.
+type SyncPolicy string
+
+const (
+	// SyncAlways fsyncs every record before Append returns.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval flushes every record and fsyncs in the background every
+	// Options.Interval. A crash can lose the records of the last interval.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever buffers records and leaves flushing to Sync, Close and the OS.
+	SyncNever SyncPolicy = "never"
+)
+
+// Options configure a Journal.
+type Options struct {
+	Sync     SyncPolicy
+	Interval time.Duration
+}
+
+// DefaultOptions fsync every record.
+var DefaultOptions = Options{Sync: SyncAlways}
+
+// Journal is an append-only file of sequenced, checksummed records.
+type Journal struct {
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	seq  uint64
+	opts Options
+
+	// err is the error of the write that failed the journal. The failed
+	// write can leave a partial record behind, so nothing is written after
+	// it: the record is truncated as a torn tail when the journal is opened
+	// again.
+	err error
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open opens the journal at path, creating it if needed. A torn record at the
+// end of the file, left by a crash during a write, is truncated.
+func Open(path string, opts Options) (*Journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	seq, end, err := scan(f, nil)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if info, err := f.Stat(); err == nil && info.Size() > end {
+		logrus.WithFields(logrus.Fields{
+			"path":  path,
+			"bytes": info.Size() - end,
+		}).Warn("truncating torn journal tail")
+
+		if err := f.Truncate(end); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	j := &Journal{
+		f:    f,
+		w:    bufio.NewWriter(f),
+		seq:  seq,
+		opts: opts,
+		done: make(chan struct{}),
+	}
+
+	if opts.Sync == SyncInterval {
+		if opts.Interval <= 0 {
+			j.opts.Interval = 10 * time.Millisecond
+		}
+		j.wg.Add(1)
+		go j.syncLoop()
+	}
+
+	return j, nil
+}
+
+// Seq returns the sequence number of the last appended record.
+func (j *Journal) Seq() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.seq
+}
+
+// Append writes data as the next record and returns its sequence number.
+// With SyncAlways the record is on disk when Append returns.
+func (j *Journal) Append(data []byte) (uint64, error) {
+	if len(data) > maxRecordSize {
+		return 0, fmt.Errorf("record of %d bytes exceeds the max of %d", len(data), maxRecordSize)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.err != nil {
+		return 0, j.failed()
+	}
+
+	seq := j.seq + 1
+
+	var header [headerSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(header[4:8], checksum(seq, data))
+	binary.BigEndian.PutUint64(header[8:16], seq)
+
+	if _, err := j.w.Write(header[:]); err != nil {
+		return 0, j.fail(err)
+	}
+	if _, err := j.w.Write(data); err != nil {
+		return 0, j.fail(err)
+	}
+
+	switch j.opts.Sync {
+	case SyncAlways:
+		if err := j.sync(); err != nil {
+			return 0, err
+		}
+	case SyncInterval:
+		if err := j.w.Flush(); err != nil {
+			return 0, j.fail(err)
+		}
+	}
+
+	j.seq = seq
+	return seq, nil
+}
+
+// Sync flushes buffered records and fsyncs the file.
+func (j *Journal) Sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.sync()
+}
+
+func (j *Journal) sync() error {
+	if j.err != nil {
+		return j.failed()
+	}
+	if err := j.w.Flush(); err != nil {
+		return j.fail(err)
+	}
+	if err := j.f.Sync(); err != nil {
+		return j.fail(err)
+	}
+	return nil
+}
+
+// fail fails the journal with err and returns it.
+func (j *Journal) fail(err error) error {
+	j.err = err
+	logrus.WithError(err).Error("journal failed")
+	return j.failed()
+}
+
+func (j *Journal) failed() error {
+	return fmt.Errorf("%w: %v", ErrFailed, j.err)
+}
+
+func (j *Journal) syncLoop() {
+	defer j.wg.Done()
+
+	ticker := time.NewTicker(j.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := j.Sync(); err != nil {
+				logrus.Error(err)
+			}
+		case <-j.done:
+			return
+		}
+	}
+}
+
+// Close syncs and closes the journal.
+func (j *Journal) Close() error {
+	close(j.done)
+	j.wg.Wait()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.sync(); err != nil {
+		j.f.Close()
+		return err
+	}
+	return j.f.Close()
+}
+
+// Read calls fn for every record of the journal at path, in order. A torn
+// record at the end of the file is ignored. A missing file has no records.
+func Read(path string, fn func(seq uint64, data []byte) error) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, _, err = scan(f, fn)
+	return err
+}
+
+// scan reads the records of f from the start, calling fn for each of them if
+// it isn't nil. It returns the last sequence number and the offset right
+// after the last valid record.
+func scan(f *os.File, fn func(seq uint64, data []byte) error) (uint64, int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		r      = bufio.NewReader(f)
+		seq    uint64
+		offset int64
+		header [headerSize]byte
+	)
+
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			// EOF at a record boundary is the clean end of the journal, a
+			// partial header is a torn write.
+			return seq, offset, nil
+		}
+
+		var (
+			length  = binary.BigEndian.Uint32(header[0:4])
+			sum     = binary.BigEndian.Uint32(header[4:8])
+			nextSeq = binary.BigEndian.Uint64(header[8:16])
+		)
+
+		if length > maxRecordSize {
+			return seq, offset, fmt.Errorf("%w: record of %d bytes after seq %d", ErrCorrupt, length, seq)
+		}
+		data := make([]byte, length)
+
+		if _, err := io.ReadFull(r, data); err != nil {
+			return seq, offset, nil
+		}
+
+		if checksum(nextSeq, data) != sum || nextSeq != seq+1 {
+			// Only the last record can be torn, anything after it means the
+			// journal is damaged.
+			if _, err := r.Peek(1); err == io.EOF {
+				return seq, offset, nil
+			}
+			return seq, offset, fmt.Errorf("%w: bad record after seq %d at offset %d", ErrCorrupt, seq, offset)
+		}
+
+		if fn != nil {
+			if err := fn(nextSeq, data); err != nil {
+				return seq, offset, err
+			}
+		}
+
+		seq = nextSeq
+		offset += headerSize + int64(length)
+	}
+}
+
+func checksum(seq uint64, data []byte) uint32 {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], seq)
+
+	return crc32.Update(crc32.Checksum(b[:], crcTable), crcTable, data)
+}
@@ -0,0 +1,173 @@
+package journal
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func readAll(t *testing.T, path string) []string {
+	t.Helper()
+
+	records := []string{}
+	err := Read(path, func(seq uint64, data []byte) error {
+		assert(t, seq, uint64(len(records)+1))
+		records = append(records, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return records
+}
+
+func TestAppendAndRead(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		t.Run(string(policy), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "journal.log")
+
+			j, err := Open(path, Options{Sync: policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, data := range []string{"a", "bb", "ccc"} {
+				if _, err := j.Append([]byte(data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := j.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			assert(t, readAll(t, path), []string{"a", "bb", "ccc"})
+
+			// Reopening continues the sequence
+			j, err = Open(path, Options{Sync: policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert(t, j.Seq(), uint64(3))
+			seq, err := j.Append([]byte("dddd"))
+			assert(t, err, nil)
+			assert(t, seq, uint64(4))
+			j.Close()
+
+			assert(t, readAll(t, path), []string{"a", "bb", "ccc", "dddd"})
+		})
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.log")
+
+	j, err := Open(path, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Append([]byte("first"))
+	j.Append([]byte("second"))
+	j.Close()
+
+	// Simulate a crash in the middle of writing the second record
+	info, _ := os.Stat(path)
+	os.Truncate(path, info.Size()-3)
+	assert(t, readAll(t, path), []string{"first"})
+
+	// Opening truncates the torn record and appends after the first one
+	j, err = Open(path, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, j.Seq(), uint64(1))
+	j.Append([]byte("third"))
+	j.Close()
+
+	assert(t, readAll(t, path), []string{"first", "third"})
+}
+
+func TestCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.log")
+
+	j, err := Open(path, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Append([]byte("first"))
+	j.Append([]byte("second"))
+	j.Close()
+
+	// Flip a byte of the first payload
+	data, _ := os.ReadFile(path)
+	data[headerSize] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+
+	err = Read(path, func(uint64, []byte) error { return nil })
+	assert(t, errors.Is(err, ErrCorrupt), true)
+
+	_, err = Open(path, DefaultOptions)
+	assert(t, errors.Is(err, ErrCorrupt), true)
+}
+
+// shortWriter writes at most n bytes to w and fails after them, like a full disk.
+type shortWriter struct {
+	w io.Writer
+	n int
+}
+
+func (sw *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > sw.n {
+		n, _ := sw.w.Write(p[:sw.n])
+		sw.n = 0
+		return n, errors.New("no space left on device")
+	}
+	sw.n -= len(p)
+	return sw.w.Write(p)
+}
+
+func TestFailedWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.log")
+
+	j, err := Open(path, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Append([]byte("first"))
+
+	// The disk fills up in the middle of the second record
+	j.w = bufio.NewWriter(&shortWriter{w: j.f, n: 4})
+	_, err = j.Append([]byte("second"))
+	assert(t, errors.Is(err, ErrFailed), true)
+
+	// Nothing is written after the partial record
+	j.w = bufio.NewWriter(j.f)
+	_, err = j.Append([]byte("third"))
+	assert(t, errors.Is(err, ErrFailed), true)
+	assert(t, j.Seq(), uint64(1))
+	assert(t, errors.Is(j.Close(), ErrFailed), true)
+
+	assert(t, readAll(t, path), []string{"first"})
+
+	// Opening truncates the partial record and appends after the first one
+	j, err = Open(path, DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, err := j.Append([]byte("fourth"))
+	assert(t, err, nil)
+	assert(t, seq, uint64(2))
+	j.Close()
+
+	assert(t, readAll(t, path), []string{"first", "fourth"})
+}
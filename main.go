@@ -1,7 +1,12 @@
 package main
 
 import (
-	"math/rand"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/signal"
 	"time"
 
 	"github.com/inagib21/crypto-exchange/client"
@@ -10,11 +15,33 @@ import (
 )
 
 func main() {
+	// Offline tools run instead of the exchange when a command is given.
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// The market maker acts with the API token of its user, one is made up
+	// for this run when none is configured.
+	token := os.Getenv("USER_8_API_TOKEN")
+	if token == "" {
+		var err error
+		if token, err = randomToken(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Setenv("USER_8_API_TOKEN", token)
+	}
+
 	// Start the server in a goroutine.
 	go server.StartServer()
 	time.Sleep(1 * time.Second)
 
 	c := client.NewClient()
+	c.Token = token
 
 	// Configuration for the Market Maker.
 	cfg := mm.Config{
@@ -25,44 +52,26 @@ func main() {
 		SeedOffset:     40,
 		ExchangeClient: c,
 		PriceOffset:    10,
+		MaxLevels:      3,
+		MaxLong:        50,
+		MaxShort:       50,
+		SkewFactor:     0.5,
 	}
 	maker := mm.NewMakerMaker(cfg)
 
-	// Start the Market Maker.
-	maker.Start()
-
-	time.Sleep(2 * time.Second)
-
-	// Start the market order placer in a goroutine.
-	go marketOrderPlacer(c)
+	// Start the Market Maker, it cancels its orders on interrupt.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	maker.Start(ctx)
 
-	select {}
+	<-maker.Done()
 }
 
-func marketOrderPlacer(c *client.Client) {
-	ticker := time.NewTicker(500 * time.Millisecond)
-
-	for {
-		// Generate a random integer.
-		randint := rand.Intn(10)
-		bid := true
-		if randint < 7 {
-			bid = false
-		}
-
-		// Create a market order with random bid/ask and size.
-		order := client.PlaceOrderParams{
-			UserID: 7,
-			Bid:    bid,
-			Size:   1,
-		}
-
-		// Place the market order using the client.
-		_, err := c.PlaceMarketOrder(&order)
-		if err != nil {
-			panic(err)
-		}
-
-		<-ticker.C
+// randomToken returns a random API token.
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(b), nil
 }
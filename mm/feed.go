@@ -0,0 +1,403 @@
+package mm
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secondsPerYear converts the annualized drift and volatility of GBMFeed.
+const secondsPerYear = 365 * 24 * 60 * 60
+
+var (
+	// ErrStalePrice is returned for a price older than the maximum age.
+	ErrStalePrice = errors.New("stale price")
+	// ErrNoPrice is returned by a MedianFeed none of whose sources has a
+	// fresh price.
+	ErrNoPrice = errors.New("no price")
+	// ErrInvalidPrice is returned for a price that isn't a positive number.
+	ErrInvalidPrice = errors.New("invalid price")
+)
+
+// PricePoint is a reference price and when it was observed.
+type PricePoint struct {
+	Price float64
+	Time  time.Time
+}
+
+// PriceFeed provides the reference price of the market, e.g. the price of
+// the asset on other exchanges.
+type PriceFeed interface {
+	// Price returns the latest price.
+	Price(ctx context.Context) (PricePoint, error)
+}
+
+// checkFresh returns ErrStalePrice if p is older than maxAge at now. A zero
+// maxAge accepts every price.
+func checkFresh(p PricePoint, maxAge time.Duration, now time.Time) error {
+	if maxAge > 0 && now.Sub(p.Time) > maxAge {
+		return fmt.Errorf("%w: %.2f from %s", ErrStalePrice, p.Price, p.Time.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkPrice returns ErrInvalidPrice if price isn't finite and positive.
+func checkPrice(price float64) error {
+	if math.IsNaN(price) || math.IsInf(price, 0) || price <= 0 {
+		return fmt.Errorf("%w: %v", ErrInvalidPrice, price)
+	}
+	return nil
+}
+
+// StaticFeed always returns the same price, observed now.
+type StaticFeed struct {
+	Value float64
+}
+
+// Price returns the static price.
+func (f StaticFeed) Price(context.Context) (PricePoint, error) {
+	return PricePoint{Price: f.Value, Time: time.Now()}, nil
+}
+
+// ReplayFeed replays recorded prices in real time, sped up by Speed: the
+// first call returns the first price and later calls the price recorded as
+// long after it as has passed since. Once the recording ends the last price
+// keeps the time it was reached at, so it goes stale.
+type ReplayFeed struct {
+	Speed float64
+
+	mu     sync.Mutex
+	points []PricePoint
+	start  time.Time
+}
+
+// NewReplayFeed loads the prices of a CSV file with a time and a price
+// column, or of a JSONL file with objects such as {"time": ..., "price": ...}.
+// Times are RFC 3339 or unix seconds, the format follows the extension.
+// Prices must be finite and positive.
+func NewReplayFeed(path string) (*ReplayFeed, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var points []PricePoint
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".csv":
+		points, err = readCSVPrices(f)
+	case ".jsonl", ".json":
+		points, err = readJSONLPrices(f)
+	default:
+		return nil, fmt.Errorf("unknown price file format %q", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if len(points) == 0 {
+		return nil, fmt.Errorf("reading %s: no prices", path)
+	}
+
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	return &ReplayFeed{Speed: 1, points: points}, nil
+}
+
+// Price returns the price recorded at the time replayed so far.
+func (f *ReplayFeed) Price(context.Context) (PricePoint, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if f.start.IsZero() {
+		f.start = now
+	}
+
+	speed := f.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+
+	first := f.points[0].Time
+	replayed := time.Duration(float64(now.Sub(f.start)) * speed)
+	i := sort.Search(len(f.points), func(i int) bool { return f.points[i].Time.Sub(first) > replayed }) - 1
+
+	return PricePoint{
+		Price: f.points[i].Price,
+		Time:  f.start.Add(time.Duration(float64(f.points[i].Time.Sub(first)) / speed)),
+	}, nil
+}
+
+// readCSVPrices reads time and price rows, skipping a header.
+func readCSVPrices(r io.Reader) ([]PricePoint, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	points := []PricePoint{}
+	for i, row := range rows {
+		if len(row) < 2 {
+			return nil, fmt.Errorf("line %d: want time and price", i+1)
+		}
+		price, err := strconv.ParseFloat(strings.TrimSpace(row[1]), 64)
+		if err != nil && i == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if err := checkPrice(price); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		t, err := parsePriceTime(strings.TrimSpace(row[0]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		points = append(points, PricePoint{Price: price, Time: t})
+	}
+	return points, nil
+}
+
+// readJSONLPrices reads one JSON object with a time and a price per line.
+func readJSONLPrices(r io.Reader) ([]PricePoint, error) {
+	points := []PricePoint{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var record struct {
+			Time  json.RawMessage `json:"time"`
+			Price float64         `json:"price"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := checkPrice(record.Price); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		t, err := parsePriceTime(strings.Trim(string(record.Time), `"`))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		points = append(points, PricePoint{Price: record.Price, Time: t})
+	}
+	return points, scanner.Err()
+}
+
+// parsePriceTime parses an RFC 3339 time or unix seconds.
+func parsePriceTime(s string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		whole, frac := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(frac*1e9)), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// GBMFeed simulates a price following a geometric Brownian motion with an
+// annualized drift and volatility. Every call moves the price by Step, or by
+// the time passed since the last call when Step is zero. The same seed gives
+// the same prices for the same steps.
+type GBMFeed struct {
+	Drift      float64
+	Volatility float64
+	Step       time.Duration
+
+	mu    sync.Mutex
+	price float64
+	last  time.Time
+	rand  *rand.Rand
+}
+
+// NewGBMFeed creates a GBMFeed starting at price.
+func NewGBMFeed(price, drift, volatility float64, seed int64) *GBMFeed {
+	return &GBMFeed{
+		Drift:      drift,
+		Volatility: volatility,
+		price:      price,
+		rand:       rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Price moves the price by a step and returns it.
+func (f *GBMFeed) Price(context.Context) (PricePoint, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	step := f.Step
+	if step == 0 && !f.last.IsZero() {
+		step = now.Sub(f.last)
+	}
+	f.last = now
+
+	if step > 0 {
+		dt := step.Seconds() / secondsPerYear
+		drift := (f.Drift - f.Volatility*f.Volatility/2) * dt
+		f.price *= math.Exp(drift + f.Volatility*math.Sqrt(dt)*f.rand.NormFloat64())
+	}
+
+	return PricePoint{Price: f.price, Time: now}, nil
+}
+
+// HTTPFeed reads the price from a JSON document served at URL. Path is the
+// dot separated field of the price, e.g. "data.price", whose value is a
+// number or a string holding one. TimePath is the field of the time the
+// price was observed at, in RFC 3339 or unix seconds. Without it the price
+// is taken as observed when it was fetched.
+type HTTPFeed struct {
+	URL      string
+	Path     string
+	TimePath string
+	Client   *http.Client
+}
+
+// Price fetches the document and returns the price in it. Prices that
+// aren't finite and positive are rejected.
+func (f HTTPFeed) Price(ctx context.Context) (PricePoint, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.URL, nil)
+	if err != nil {
+		return PricePoint{}, err
+	}
+
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return PricePoint{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return PricePoint{}, fmt.Errorf("price feed %s: %s", f.URL, resp.Status)
+	}
+
+	var doc any
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return PricePoint{}, fmt.Errorf("price feed %s: %w", f.URL, err)
+	}
+
+	value, ok := lookup(doc, f.Path)
+	if !ok {
+		return PricePoint{}, fmt.Errorf("price feed %s: no field %q", f.URL, f.Path)
+	}
+
+	var price float64
+	switch v := value.(type) {
+	case float64:
+		price = v
+	case string:
+		if price, err = strconv.ParseFloat(v, 64); err != nil {
+			return PricePoint{}, fmt.Errorf("price feed %s: %w", f.URL, err)
+		}
+	default:
+		return PricePoint{}, fmt.Errorf("price feed %s: field %q isn't a price", f.URL, f.Path)
+	}
+	if err := checkPrice(price); err != nil {
+		return PricePoint{}, fmt.Errorf("price feed %s: %w", f.URL, err)
+	}
+
+	observed := time.Now()
+	if f.TimePath != "" {
+		value, ok := lookup(doc, f.TimePath)
+		if !ok {
+			return PricePoint{}, fmt.Errorf("price feed %s: no field %q", f.URL, f.TimePath)
+		}
+
+		switch v := value.(type) {
+		case float64:
+			observed, err = parsePriceTime(strconv.FormatFloat(v, 'f', -1, 64))
+		case string:
+			observed, err = parsePriceTime(v)
+		default:
+			err = fmt.Errorf("field %q isn't a time", f.TimePath)
+		}
+		if err != nil {
+			return PricePoint{}, fmt.Errorf("price feed %s: %w", f.URL, err)
+		}
+	}
+
+	return PricePoint{Price: price, Time: observed}, nil
+}
+
+// lookup returns the value of the dot separated field path of a JSON
+// document.
+func lookup(doc any, path string) (any, bool) {
+	value := doc
+	for _, field := range strings.Split(path, ".") {
+		if field == "" {
+			continue
+		}
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = obj[field]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// MedianFeed returns the median price of its sources. Sources that fail,
+// whose price isn't finite and positive or is older than MaxAge are left out, and the time of the median
+// is that of the oldest price it was taken from.
+type MedianFeed struct {
+	Feeds  []PriceFeed
+	MaxAge time.Duration
+}
+
+// Price queries the sources and returns the median of their prices.
+func (f MedianFeed) Price(ctx context.Context) (PricePoint, error) {
+	now := time.Now()
+	points := []PricePoint{}
+	for _, feed := range f.Feeds {
+		p, err := feed.Price(ctx)
+		if err == nil {
+			err = checkPrice(p.Price)
+		}
+		if err == nil {
+			err = checkFresh(p, f.MaxAge, now)
+		}
+		if err != nil {
+			continue
+		}
+		points = append(points, p)
+	}
+	if len(points) == 0 {
+		return PricePoint{}, ErrNoPrice
+	}
+
+	sort.Slice(points, func(i, j int) bool { return points[i].Price < points[j].Price })
+	oldest := points[0].Time
+	for _, p := range points {
+		if p.Time.Before(oldest) {
+			oldest = p.Time
+		}
+	}
+
+	n := len(points)
+	median := points[n/2].Price
+	if n%2 == 0 {
+		median = (points[n/2-1].Price + points[n/2].Price) / 2
+	}
+
+	return PricePoint{Price: median, Time: oldest}, nil
+}
@@ -0,0 +1,198 @@
+package mm
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplayFeed(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"prices.csv":   "time,price\n1700000000,1000\n1700000010,1010\n1700000020,1020\n",
+		"prices.jsonl": `{"time": "2023-11-14T22:13:20Z", "price": 1000}` + "\n" + `{"time": 1700000010, "price": 1010}` + "\n\n" + `{"time": 1700000020, "price": 1020}` + "\n",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		feed, err := NewReplayFeed(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// Ten recorded seconds pass in a millisecond
+		feed.Speed = 10000
+
+		// The first call starts the replay at the first price
+		p, _ := feed.Price(context.Background())
+		if p.Price != 1000 {
+			t.Errorf("%s: first price %f", name, p.Price)
+		}
+
+		// Once the recording ends the last price goes stale
+		time.Sleep(5 * time.Millisecond)
+		p, _ = feed.Price(context.Background())
+		if p.Price != 1020 {
+			t.Errorf("%s: last price %f", name, p.Price)
+		}
+		if err := checkFresh(p, time.Millisecond, time.Now()); !errors.Is(err, ErrStalePrice) {
+			t.Errorf("%s: last price is fresh: %v", name, err)
+		}
+	}
+
+	// Unknown formats are rejected
+	if _, err := NewReplayFeed(filepath.Join(dir, "prices.txt")); err == nil {
+		t.Error("replaying an unknown file")
+	}
+
+	// and so are prices that aren't positive
+	for name, content := range map[string]string{
+		"zero.csv":  "1700000000,1000\n1700000010,0\n",
+		"nan.csv":   "1700000000,NaN\n",
+		"neg.jsonl": `{"time": 1700000000, "price": -1}` + "\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewReplayFeed(path); !errors.Is(err, ErrInvalidPrice) {
+			t.Errorf("%s: %v, want invalid price", name, err)
+		}
+	}
+}
+
+func TestGBMFeed(t *testing.T) {
+	prices := func(seed int64) []float64 {
+		feed := NewGBMFeed(1000, 0, 0.8, seed)
+		feed.Step = time.Hour
+
+		prices := []float64{}
+		for i := 0; i < 100; i++ {
+			p, _ := feed.Price(context.Background())
+			prices = append(prices, p.Price)
+		}
+		return prices
+	}
+
+	// The same seed gives the same path
+	a, b := prices(1), prices(1)
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("step %d: %f != %f", i, a[i], b[i])
+		}
+		if a[i] <= 0 {
+			t.Fatalf("step %d: price %f", i, a[i])
+		}
+	}
+
+	// Hourly steps at 80% volatility stay in a plausible range
+	if last := a[len(a)-1]; math.Abs(math.Log(last/1000)) > 0.5 {
+		t.Errorf("price moved to %f", last)
+	}
+}
+
+func TestHTTPFeed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/number":
+			w.Write([]byte(`{"data": {"price": 1234.5}}`))
+		case "/string":
+			w.Write([]byte(`{"price": "1230.25"}`))
+		case "/timed":
+			w.Write([]byte(`{"price": 1200, "time": 1700000000, "at": "2023-11-14T22:13:20Z", "bad": true}`))
+		case "/zero":
+			w.Write([]byte(`{"price": 0}`))
+		case "/inf":
+			w.Write([]byte(`{"price": "+Inf"}`))
+		default:
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	observed := time.Unix(1700000000, 0)
+	tests := []struct {
+		path, field, timeField string
+		want                   float64
+		wantTime               time.Time
+		wantErr                bool
+	}{
+		{path: "/number", field: "data.price", want: 1234.5},
+		{path: "/string", field: "price", want: 1230.25},
+		{path: "/timed", field: "price", timeField: "time", want: 1200, wantTime: observed},
+		{path: "/timed", field: "price", timeField: "at", want: 1200, wantTime: observed},
+		{path: "/timed", field: "price", timeField: "bad", wantErr: true},
+		{path: "/timed", field: "price", timeField: "missing", wantErr: true},
+		{path: "/number", field: "data.volume", wantErr: true},
+		{path: "/zero", field: "price", wantErr: true},
+		{path: "/inf", field: "price", wantErr: true},
+		{path: "/down", field: "price", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		p, err := HTTPFeed{URL: srv.URL + tt.path, Path: tt.field, TimePath: tt.timeField}.Price(context.Background())
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s %s: error %v", tt.path, tt.field, err)
+			continue
+		}
+		if p.Price != tt.want {
+			t.Errorf("%s %s: price %f, want %f", tt.path, tt.field, p.Price, tt.want)
+		}
+		if !tt.wantTime.IsZero() && !p.Time.Equal(tt.wantTime) {
+			t.Errorf("%s %s: time %s, want %s", tt.path, tt.timeField, p.Time, tt.wantTime)
+		}
+	}
+}
+
+// pointFeed returns a fixed point or error.
+type pointFeed struct {
+	point PricePoint
+	err   error
+}
+
+func (f pointFeed) Price(context.Context) (PricePoint, error) {
+	return f.point, f.err
+}
+
+func TestMedianFeed(t *testing.T) {
+	now := time.Now()
+	feed := MedianFeed{
+		MaxAge: time.Minute,
+		Feeds: []PriceFeed{
+			StaticFeed{Value: 1000},
+			pointFeed{point: PricePoint{Price: 1010, Time: now.Add(-time.Second)}},
+			pointFeed{point: PricePoint{Price: 1005, Time: now}},
+			pointFeed{point: PricePoint{Price: 5000, Time: now.Add(-time.Hour)}},
+			pointFeed{point: PricePoint{Price: math.Inf(1), Time: now}},
+			pointFeed{point: PricePoint{Price: 0, Time: now}},
+			pointFeed{err: errors.New("down")},
+		},
+	}
+
+	// Stale, invalid and failing sources are left out
+	p, err := feed.Price(context.Background())
+	if err != nil || p.Price != 1005 || !p.Time.Equal(now.Add(-time.Second)) {
+		t.Errorf("median %+v, %v", p, err)
+	}
+
+	// An even number of sources averages the middle two
+	feed.Feeds = feed.Feeds[:2]
+	if p, _ := feed.Price(context.Background()); p.Price != 1005 {
+		t.Errorf("median %f, want 1005", p.Price)
+	}
+
+	// Without fresh sources there is no price
+	feed.Feeds = []PriceFeed{pointFeed{point: PricePoint{Price: 1000, Time: now.Add(-time.Hour)}}}
+	if _, err := feed.Price(context.Background()); !errors.Is(err, ErrNoPrice) {
+		t.Errorf("stale median: %v", err)
+	}
+}
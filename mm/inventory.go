@@ -0,0 +1,138 @@
+package mm
+
+import (
+	"math"
+
+	"github.com/inagib21/crypto-exchange/store"
+)
+
+// fillsPage is the number of fills fetched at a time when syncing the fills.
+const fillsPage = 100
+
+// Inventory is the position of the market maker and its profit and loss, in
+// the quote asset, with average cost accounting.
+type Inventory struct {
+	Position float64 // Position is the base size held, negative when short.
+	AvgPrice float64 // AvgPrice is the average price the position was entered at.
+	Realized float64 // Realized is the profit of the closed positions, net of fees.
+	Fees     float64 // Fees is the fees paid, negative for rebates.
+	Mark     float64 // Mark is the price the position was last valued at.
+}
+
+// Unrealized returns the profit of the open position at the mark price.
+func (inv Inventory) Unrealized() float64 {
+	if inv.Mark == 0 {
+		return 0
+	}
+	return (inv.Mark - inv.AvgPrice) * inv.Position
+}
+
+// PnL returns the realized and unrealized profit.
+func (inv Inventory) PnL() float64 {
+	return inv.Realized + inv.Unrealized()
+}
+
+// apply books a fill. Fees are charged in the asset received, so the fee of
+// a bid is valued at the price of the fill.
+func (inv *Inventory) apply(f store.Fill) {
+	fee := f.Fee
+	if f.Bid {
+		fee *= f.Price
+	}
+	inv.Fees += fee
+	inv.Realized -= fee
+
+	size := f.Size
+	if !f.Bid {
+		size = -size
+	}
+
+	// A fill against the position closes it first, the rest opens a new
+	// position at the price of the fill.
+	if inv.Position != 0 && math.Signbit(inv.Position) != math.Signbit(size) {
+		closed := math.Min(math.Abs(size), math.Abs(inv.Position))
+		if inv.Position > 0 {
+			inv.Realized += (f.Price - inv.AvgPrice) * closed
+			inv.Position -= closed
+			size += closed
+		} else {
+			inv.Realized += (inv.AvgPrice - f.Price) * closed
+			inv.Position += closed
+			size -= closed
+		}
+		if math.Abs(inv.Position) < 1e-9 {
+			inv.Position, inv.AvgPrice = 0, 0
+		}
+	}
+
+	if size != 0 {
+		position := inv.Position + size
+		inv.AvgPrice = (inv.AvgPrice*inv.Position + f.Price*size) / position
+		inv.Position = position
+	}
+}
+
+// fillKey identifies a fill, both sides of a self-trade share the trade.
+type fillKey struct {
+	tradeID uint64
+	orderID int64
+}
+
+// syncFills books the fills of the market maker since the last sync and
+// returns the number of fills booked.
+func (mm *MarketMaker) syncFills() (int, error) {
+	fresh, err := fillsSince(mm.exchangeClient.GetFills, mm.userID, mm.lastTrade)
+	if err != nil || len(fresh) == 0 {
+		return 0, err
+	}
+
+	mm.lastTrade = fresh[len(fresh)-1].TradeID
+
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	for _, f := range fresh {
+		mm.inventory.apply(f)
+	}
+
+	return len(fresh), nil
+}
+
+// fillsSince fetches the fills of a user from the trades after the trade ID
+// after and returns them oldest first. The fills come newest first, so the
+// pages go down by trade ID rather than offset and fills arriving meanwhile
+// don't shift them. A page may end between the fills of a self-trade, so the
+// next page starts at its oldest trade again and the fills already fetched
+// are skipped.
+func fillsSince(fetch func(store.FillFilter) ([]store.Fill, error), userID int64, after uint64) ([]store.Fill, error) {
+	var (
+		fresh  = []store.Fill{}
+		seen   = make(map[fillKey]bool)
+		filter = store.FillFilter{UserID: userID, FromTrade: after + 1, Page: store.Page{Limit: fillsPage}}
+	)
+
+	for {
+		fills, err := fetch(filter)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range fills {
+			key := fillKey{f.TradeID, f.OrderID}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			fresh = append(fresh, f)
+		}
+		if len(fills) < fillsPage {
+			break
+		}
+		filter.ToTrade = fills[len(fills)-1].TradeID + 1
+	}
+
+	for i, j := 0, len(fresh)-1; i < j; i, j = i+1, j-1 {
+		fresh[i], fresh[j] = fresh[j], fresh[i]
+	}
+	return fresh, nil
+}
@@ -1,12 +1,29 @@
 package mm
 
 import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/inagib21/crypto-exchange/client"
+	"github.com/inagib21/crypto-exchange/server"
 	"github.com/sirupsen/logrus"
 )
 
+// defaultPrice is the reference price of the market maker without a price feed.
+const defaultPrice = 1000.0
+
+// tolerance is how close the price and size of a live order have to be to
+// those of a quote for the order to be kept.
+const tolerance = 1e-9
+
+// sizeDecimals is the number of decimals skewed sizes are rounded down to.
+const sizeDecimals = 4
+
 // Config holds configuration parameters for the MarketMaker.
 type Config struct {
 	UserID         int64          // UserID is the identifier of the market maker.
@@ -15,144 +32,394 @@ type Config struct {
 	SeedOffset     float64        // SeedOffset is the offset used for seeding the market.
 	ExchangeClient *client.Client // ExchangeClient is the client for interacting with the exchange.
 	MakeInterval   time.Duration  // MakeInterval is the time interval between market maker actions.
-	PriceOffset    float64        // PriceOffset is the offset applied to bid and ask prices.
+	PriceOffset    float64        // PriceOffset is the offset applied to bid and ask prices, and between levels.
+	MaxLevels      int            // MaxLevels is the number of resting orders per side, 1 if zero.
+	MaxLong        float64        // MaxLong is the largest long position, where bids stop. Zero for no limit.
+	MaxShort       float64        // MaxShort is the largest short position, where asks stop. Zero for no limit.
+	SkewFactor     float64        // SkewFactor is how far the quotes move against the position, per unit held.
+	Strategy       Strategy       // Strategy decides the quotes, Join with the offsets and size above if nil.
+	PriceFeed      PriceFeed      // PriceFeed provides the reference price, a static price of 1000 if nil.
+	MaxPriceAge    time.Duration  // MaxPriceAge pauses quoting while the reference price is older. Zero for no limit.
 }
 
 // MarketMaker represents a market maker responsible for placing orders on the exchange.
 type MarketMaker struct {
 	userID         int64
-	orderSize      float64
 	minSpread      float64
-	seedOffset     float64
-	priceOffset    float64
+	maxLevels      int
+	maxLong        float64
+	maxShort       float64
+	skewFactor     float64
 	exchangeClient *client.Client
 	makeInterval   time.Duration
+	strategy       Strategy
+	priceFeed      PriceFeed
+	maxPriceAge    time.Duration
+
+	// bids and asks are the live orders of the market maker, best first.
+	bids []server.Order
+	asks []server.Order
+	// lastTrade is the ID of the newest trade booked in the inventory, the
+	// trade IDs of the exchange only go up.
+	lastTrade uint64
+
+	mu        sync.Mutex
+	inventory Inventory
+	done      chan struct{}
 }
 
 // NewMakerMaker creates a new MarketMaker instance with the provided configuration.
 func NewMakerMaker(cfg Config) *MarketMaker {
+	maxLevels := cfg.MaxLevels
+	if maxLevels <= 0 {
+		maxLevels = 1
+	}
+
+	strategy := cfg.Strategy
+	if strategy == nil {
+		strategy = &Join{
+			Offset:     cfg.PriceOffset,
+			SeedOffset: cfg.SeedOffset,
+			Levels:     maxLevels,
+			Size:       cfg.OrderSize,
+		}
+	}
+
+	priceFeed := cfg.PriceFeed
+	if priceFeed == nil {
+		priceFeed = StaticFeed{Value: defaultPrice}
+	}
+
 	return &MarketMaker{
 		userID:         cfg.UserID,
-		orderSize:      cfg.OrderSize,
 		minSpread:      cfg.MinSpread,
-		seedOffset:     cfg.SeedOffset,
 		exchangeClient: cfg.ExchangeClient,
 		makeInterval:   cfg.MakeInterval,
-		priceOffset:    cfg.PriceOffset,
+		strategy:       strategy,
+		priceFeed:      priceFeed,
+		maxPriceAge:    cfg.MaxPriceAge,
+		maxLevels:      maxLevels,
+		maxLong:        cfg.MaxLong,
+		maxShort:       cfg.MaxShort,
+		skewFactor:     cfg.SkewFactor,
+		done:           make(chan struct{}),
 	}
 }
 
-// Start starts the MarketMaker and initiates the market making process.
-func (mm *MarketMaker) Start() {
+// Start starts the MarketMaker and initiates the market making process. The
+// market maker stops and cancels its orders when ctx is done.
+func (mm *MarketMaker) Start(ctx context.Context) {
 	logrus.WithFields(logrus.Fields{
 		"id":           mm.userID,
-		"orderSize":    mm.orderSize,
+		"strategy":     fmt.Sprintf("%T", mm.strategy),
 		"makeInterval": mm.makeInterval,
 		"minSpread":    mm.minSpread,
-		"priceOffset":  mm.priceOffset,
+		"maxLevels":    mm.maxLevels,
+		"maxLong":      mm.maxLong,
+		"maxShort":     mm.maxShort,
+		"skewFactor":   mm.skewFactor,
 	}).Info("starting market maker")
 
-	go mm.makerLoop()
+	go mm.makerLoop(ctx)
+}
+
+// Inventory returns the position and the profit and loss of the market maker.
+func (mm *MarketMaker) Inventory() Inventory {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	return mm.inventory
+}
+
+// Done is closed once the market maker has stopped and canceled its orders.
+func (mm *MarketMaker) Done() <-chan struct{} {
+	return mm.done
 }
 
-// makerLoop is the main loop for the market maker.
-func (mm *MarketMaker) makerLoop() {
+// makerLoop is the main loop for the market maker. Every interval it moves
+// its orders to the new quotes, errors are logged and retried on the next
+// interval.
+func (mm *MarketMaker) makerLoop(ctx context.Context) {
+	defer close(mm.done)
+
 	ticker := time.NewTicker(mm.makeInterval)
+	defer ticker.Stop()
 
 	for {
-		bestBid, err := mm.exchangeClient.GetBestBid()
-		if err != nil {
+		if err := mm.requote(ctx); err != nil {
 			logrus.Error(err)
-			break
 		}
 
-		bestAsk, err := mm.exchangeClient.GetBestAsk()
-		if err != nil {
-			logrus.Error(err)
-			break
+		select {
+		case <-ctx.Done():
+			mm.stop()
+			return
+		case <-ticker.C:
 		}
+	}
+}
+
+// stop cancels the live orders of the market maker.
+func (mm *MarketMaker) stop() {
+	resp, err := mm.exchangeClient.CancelAll(mm.userID, server.MarketETH, "")
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	mm.bids, mm.asks = nil, nil
 
-		if bestAsk.Price == 0 && bestBid.Price == 0 {
-			if err := mm.seedMarket(); err != nil {
-				logrus.Error(err)
-				break
+	logrus.WithFields(logrus.Fields{
+		"id":       mm.userID,
+		"canceled": len(resp.Canceled),
+	}).Info("stopped market maker")
+}
+
+// requote moves the orders of the market maker to the quotes of its
+// strategy in one batch: orders off the quotes are canceled and the missing
+// levels placed. The quotes are skewed against the inventory so that it
+// reverts to zero. Quoting pauses while there is no fresh reference price.
+func (mm *MarketMaker) requote(ctx context.Context) error {
+	if err := mm.syncOrders(); err != nil {
+		return err
+	}
+	fills, err := mm.syncFills()
+	if err != nil {
+		return err
+	}
+
+	point, err := mm.priceFeed.Price(ctx)
+	if err == nil {
+		err = checkPrice(point.Price)
+	}
+	if err == nil {
+		err = checkFresh(point, mm.maxPriceAge, time.Now())
+	}
+	if err != nil {
+		return mm.pause(err)
+	}
+
+	state, err := mm.marketState(point.Price)
+	if err != nil {
+		return err
+	}
+	inv := mm.mark(state.Reference)
+	if fills > 0 {
+		logrus.WithFields(logrus.Fields{
+			"id":         mm.userID,
+			"fills":      fills,
+			"position":   inv.Position,
+			"avgPrice":   inv.AvgPrice,
+			"realized":   inv.Realized,
+			"unrealized": inv.Unrealized(),
+			"fees":       inv.Fees,
+		}).Info("market maker inventory")
+	}
+
+	bidQuotes, askQuotes := mm.strategy.Quotes(state, inv)
+	if len(bidQuotes) > 0 && len(askQuotes) > 0 && askQuotes[0].Price-bidQuotes[0].Price <= mm.minSpread {
+		return nil
+	}
+
+	bidQuotes, askQuotes = mm.skew(bidQuotes, askQuotes, inv.Position)
+	bidCancels, bids := reconcile(mm.bids, bidQuotes)
+	askCancels, asks := reconcile(mm.asks, askQuotes)
+
+	items := []server.BatchItem{}
+	for _, id := range append(bidCancels, askCancels...) {
+		items = append(items, server.BatchItem{CancelID: id})
+	}
+	for _, q := range bids {
+		items = append(items, server.BatchItem{Bid: true, Size: q.Size, Price: q.Price})
+	}
+	for _, q := range asks {
+		items = append(items, server.BatchItem{Size: q.Size, Price: q.Price})
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	resp, err := mm.exchangeClient.PlaceBatch(&server.BatchRequest{
+		UserID: mm.userID,
+		Market: server.MarketETH,
+		Items:  items,
+	})
+	if resp != nil {
+		for _, result := range resp.Results {
+			if result.Error != "" {
+				logrus.WithFields(logrus.Fields{
+					"id":      mm.userID,
+					"orderID": result.OrderID,
+					"reason":  result.Reason,
+				}).Warn(result.Error)
 			}
-			continue
 		}
+	}
+	if err != nil {
+		return err
+	}
 
-		if bestBid.Price == 0 {
-			bestBid.Price = bestAsk.Price - mm.priceOffset*2
-		}
+	// The live orders are synced again on the next cycle, placed orders
+	// that filled right away drop out then.
+	return mm.syncOrders()
+}
 
-		if bestAsk.Price == 0 {
-			bestAsk.Price = bestBid.Price + mm.priceOffset*2
-		}
+// mark values the inventory at the mark price and returns it.
+func (mm *MarketMaker) mark(price float64) Inventory {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
 
-		spread := bestAsk.Price - bestBid.Price
+	mm.inventory.Mark = price
+	return mm.inventory
+}
 
-		if spread <= mm.minSpread {
-			continue
+// skew moves the quotes down by the skew factor per unit long, up when
+// short, unless the strategy skews its prices itself, and caps them to the
+// levels and position limits of the market maker. The side that grows the
+// position shrinks as it nears its limit and the other side grows, down to
+// nothing and up to twice its size.
+func (mm *MarketMaker) skew(bids, asks []Quote, position float64) ([]Quote, []Quote) {
+	shift := -mm.skewFactor * position
+	if s, ok := mm.strategy.(InventorySkewer); ok && s.SkewsInventory() {
+		shift = 0
+	}
+
+	bidScale, askScale := 1.0, 1.0
+	bidRoom, askRoom := math.Inf(1), math.Inf(1)
+	if mm.maxLong > 0 {
+		bidRoom = mm.maxLong - position
+		if position > 0 {
+			ratio := math.Min(position/mm.maxLong, 1)
+			bidScale, askScale = 1-ratio, 1+ratio
+		}
+	}
+	if mm.maxShort > 0 {
+		askRoom = mm.maxShort + position
+		if position < 0 {
+			ratio := math.Min(-position/mm.maxShort, 1)
+			bidScale, askScale = 1+ratio, 1-ratio
 		}
+	}
 
-		if err := mm.placeOrder(true, bestBid.Price+mm.priceOffset); err != nil {
-			logrus.Error(err)
+	return mm.limit(bids, shift, bidScale, bidRoom), mm.limit(asks, shift, askScale, askRoom)
+}
+
+// limit shifts and scales the quotes of a side and keeps the first levels
+// that fit in room.
+func (mm *MarketMaker) limit(quotes []Quote, shift, scale, room float64) []Quote {
+	limited := []Quote{}
+	for _, q := range quotes {
+		if len(limited) == mm.maxLevels {
 			break
 		}
-		if err := mm.placeOrder(false, bestAsk.Price-mm.priceOffset); err != nil {
-			logrus.Error(err)
+		size := roundSize(math.Min(q.Size*scale, room))
+		if size <= tolerance {
 			break
 		}
-
-		<-ticker.C
+		limited = append(limited, Quote{Price: q.Price + shift, Size: size})
+		room -= size
 	}
+	return limited
 }
 
-// placeOrder places a limit order with the specified bid and price.
-func (mm *MarketMaker) placeOrder(bid bool, price float64) error {
-	bidOrder := &client.PlaceOrderParams{
-		UserID: mm.userID,
-		Size:   mm.orderSize,
-		Bid:    bid,
-		Price:  price,
-	}
-	_, err := mm.exchangeClient.PlaceLimitOrder(bidOrder)
-	return err
+// roundSize rounds a size down to sizeDecimals.
+func roundSize(size float64) float64 {
+	scale := math.Pow10(sizeDecimals)
+	return math.Floor(size*scale+tolerance) / scale
 }
 
-// seedMarket seeds the market with initial bid and ask orders.
-func (mm *MarketMaker) seedMarket() error {
-	currentPrice := simulateFetchCurrentETHPrice()
+// syncOrders refreshes the live orders of the market maker from the exchange.
+func (mm *MarketMaker) syncOrders() error {
+	orders, err := mm.exchangeClient.GetOrders(mm.userID)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(orders.Bids, func(i, j int) bool { return orders.Bids[i].Price > orders.Bids[j].Price })
+	sort.Slice(orders.Asks, func(i, j int) bool { return orders.Asks[i].Price < orders.Asks[j].Price })
+	mm.bids, mm.asks = orders.Bids, orders.Asks
+
+	return nil
+}
 
+// pause pulls the orders of the market maker while it has no reference
+// price, they are placed again once the price feed recovers.
+func (mm *MarketMaker) pause(reason error) error {
 	logrus.WithFields(logrus.Fields{
-		"currentETHPrice": currentPrice,
-		"seedOffset":      mm.seedOffset,
-	}).Info("orderbooks empty => seeding market!")
+		"id":    mm.userID,
+		"error": reason,
+	}).Warn("pausing quotes")
 
-	bidOrder := &client.PlaceOrderParams{
-		UserID: mm.userID,
-		Size:   mm.orderSize,
-		Bid:    true,
-		Price:  currentPrice - mm.seedOffset,
+	if len(mm.bids) == 0 && len(mm.asks) == 0 {
+		return nil
 	}
-	_, err := mm.exchangeClient.PlaceLimitOrder(bidOrder)
-	if err != nil {
+
+	if _, err := mm.exchangeClient.CancelAll(mm.userID, server.MarketETH, ""); err != nil {
 		return err
 	}
+	mm.bids, mm.asks = nil, nil
 
-	askOrder := &client.PlaceOrderParams{
-		UserID: mm.userID,
-		Size:   mm.orderSize,
-		Bid:    false,
-		Price:  currentPrice + mm.seedOffset,
+	return nil
+}
+
+// marketState reads the best prices of the book. The best price is the
+// market maker's own when its best live order is at it. An empty book is
+// valued at the price of the price feed.
+func (mm *MarketMaker) marketState(feedPrice float64) (MarketState, error) {
+	bestBid, err := mm.exchangeClient.GetBestBid()
+	if err != nil {
+		return MarketState{}, err
 	}
-	_, err = mm.exchangeClient.PlaceLimitOrder(askOrder)
 
-	return err
+	bestAsk, err := mm.exchangeClient.GetBestAsk()
+	if err != nil {
+		return MarketState{}, err
+	}
+
+	state := MarketState{
+		BestBid:   bestBid.Price,
+		BestAsk:   bestAsk.Price,
+		OwnBid:    bestBid.Price != 0 && len(mm.bids) > 0 && mm.bids[0].Price == bestBid.Price,
+		OwnAsk:    bestAsk.Price != 0 && len(mm.asks) > 0 && mm.asks[0].Price == bestAsk.Price,
+		FeedPrice: feedPrice,
+	}
+
+	switch {
+	case state.Empty():
+		state.Reference = feedPrice
+
+		logrus.WithFields(logrus.Fields{
+			"feedPrice": feedPrice,
+		}).Info("orderbooks empty => seeding market!")
+	case state.BestBid == 0 || state.BestAsk == 0:
+		state.Reference = math.Max(state.BestBid, state.BestAsk)
+	default:
+		state.Reference = (state.BestBid + state.BestAsk) / 2
+	}
+
+	return state, nil
 }
 
-// simulateFetchCurrentETHPrice simulates fetching the current ETH price from another exchange.
-func simulateFetchCurrentETHPrice() float64 {
-	time.Sleep(80 * time.Millisecond)
+// reconcile returns the live orders to cancel and the quotes to place so
+// that exactly one order rests at each quote. Orders already at the price of
+// a quote, and no larger, keep their place in the queue.
+func reconcile(live []server.Order, quotes []Quote) (cancel []int64, place []Quote) {
+	kept := make([]bool, len(quotes))
+	for _, o := range live {
+		i := slices.IndexFunc(quotes, func(q Quote) bool {
+			return math.Abs(q.Price-o.Price) < tolerance && o.Size <= q.Size+tolerance
+		})
+		if i < 0 || kept[i] {
+			cancel = append(cancel, o.ID)
+			continue
+		}
+		kept[i] = true
+	}
+
+	for i, q := range quotes {
+		if !kept[i] {
+			place = append(place, q)
+		}
+	}
 
-	return 1000.0
+	return cancel, place
 }
@@ -0,0 +1,200 @@
+package mm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/inagib21/crypto-exchange/server"
+	"github.com/inagib21/crypto-exchange/store"
+)
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name       string
+		live       []server.Order
+		quotes     []Quote
+		wantCancel []int64
+		wantPlace  []Quote
+	}{
+		{
+			name:      "no orders yet",
+			quotes:    []Quote{{100, 1}, {90, 1}},
+			wantPlace: []Quote{{100, 1}, {90, 1}},
+		},
+		{
+			name:   "orders on the quotes are kept",
+			live:   []server.Order{{ID: 1, Price: 100, Size: 1}, {ID: 2, Price: 90, Size: 0.5}},
+			quotes: []Quote{{100, 1}, {90, 1}},
+		},
+		{
+			name:       "quotes moved by a level",
+			live:       []server.Order{{ID: 1, Price: 100, Size: 1}, {ID: 2, Price: 90, Size: 1}},
+			quotes:     []Quote{{110, 1}, {100, 1}},
+			wantCancel: []int64{2},
+			wantPlace:  []Quote{{110, 1}},
+		},
+		{
+			name:       "stacked orders and levels beyond the max are canceled",
+			live:       []server.Order{{ID: 1, Price: 100, Size: 1}, {ID: 2, Price: 100, Size: 1}, {ID: 3, Price: 80, Size: 1}},
+			quotes:     []Quote{{100, 1}},
+			wantCancel: []int64{2, 3},
+		},
+		{
+			name:       "orders larger than their quote are replaced",
+			live:       []server.Order{{ID: 1, Price: 100, Size: 2}},
+			quotes:     []Quote{{100, 1}},
+			wantCancel: []int64{1},
+			wantPlace:  []Quote{{100, 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cancel, place := reconcile(tt.live, tt.quotes)
+			if !reflect.DeepEqual(cancel, tt.wantCancel) {
+				t.Errorf("canceled %v, want %v", cancel, tt.wantCancel)
+			}
+			if !reflect.DeepEqual(place, tt.wantPlace) {
+				t.Errorf("placed %v, want %v", place, tt.wantPlace)
+			}
+		})
+	}
+}
+
+func TestInventory(t *testing.T) {
+	inv := Inventory{}
+
+	// Buys average the entry price
+	inv.apply(store.Fill{Bid: true, Price: 100, Size: 2})
+	inv.apply(store.Fill{Bid: true, Price: 110, Size: 2})
+	if inv.Position != 4 || inv.AvgPrice != 105 {
+		t.Fatalf("unexpected inventory %+v", inv)
+	}
+
+	// A sell realizes against the average price
+	inv.apply(store.Fill{Price: 120, Size: 1, Fee: 1})
+	if inv.Position != 3 || inv.Realized != 14 || inv.Fees != 1 {
+		t.Fatalf("unexpected inventory %+v", inv)
+	}
+
+	// Selling through zero opens a short at the price of the fill
+	inv.apply(store.Fill{Price: 100, Size: 5})
+	if inv.Position != -2 || inv.AvgPrice != 100 || inv.Realized != -1 {
+		t.Fatalf("unexpected inventory %+v", inv)
+	}
+
+	// The short loses as the price rises
+	inv.Mark = 110
+	if inv.Unrealized() != -20 || inv.PnL() != -21 {
+		t.Errorf("unrealized %f, pnl %f", inv.Unrealized(), inv.PnL())
+	}
+
+	// Bid fees are paid in the base asset
+	inv.apply(store.Fill{Bid: true, Price: 90, Size: 2, Fee: 0.1})
+	if inv.Position != 0 || inv.Fees != 10 || inv.Realized != 10 {
+		t.Errorf("unexpected inventory %+v", inv)
+	}
+}
+
+func TestFillsSince(t *testing.T) {
+	st := store.NewMemory()
+	addTrades := func(n int) {
+		for i := 0; i < n; i++ {
+			// Every third trade is a self-trade, two fills of the maker.
+			ask := int64(8)
+			if i%3 == 0 {
+				ask = 7
+			}
+			st.AddTrade(&store.Trade{
+				Market:     "ETH",
+				BidOrderID: int64(2 * i),
+				AskOrderID: int64(2*i + 1),
+				BidUserID:  7,
+				AskUserID:  ask,
+				Price:      100,
+				Size:       1,
+			})
+		}
+	}
+	addTrades(150)
+
+	// Fills arriving while paging don't shift the pages
+	calls := 0
+	fetch := func(f store.FillFilter) ([]store.Fill, error) {
+		calls++
+		fills, err := st.Fills(f)
+		if calls == 1 {
+			addTrades(10)
+		}
+		return fills, err
+	}
+
+	check := func(fills []store.Fill, n int, from, to uint64) {
+		t.Helper()
+		if len(fills) != n {
+			t.Fatalf("%d fills, want %d", len(fills), n)
+		}
+		seen := map[fillKey]bool{}
+		for i, f := range fills {
+			if seen[fillKey{f.TradeID, f.OrderID}] {
+				t.Fatalf("fill %+v booked twice", f)
+			}
+			seen[fillKey{f.TradeID, f.OrderID}] = true
+			if f.TradeID < from || f.TradeID > to || (i > 0 && f.TradeID < fills[i-1].TradeID) {
+				t.Fatalf("unexpected fill %+v at %d", f, i)
+			}
+		}
+	}
+
+	fills, err := fillsSince(fetch, 7, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls < 2 {
+		t.Fatalf("%d pages", calls)
+	}
+	check(fills, 200, 1, 150)
+
+	fills, err = fillsSince(fetch, 7, fills[len(fills)-1].TradeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(fills, 14, 151, 160)
+}
+
+func TestSkew(t *testing.T) {
+	mm := NewMakerMaker(Config{MaxLevels: 2, MaxLong: 20, MaxShort: 20, SkewFactor: 0.5})
+	bids := []Quote{{100, 10}, {99, 10}, {98, 10}}
+	asks := []Quote{{101, 10}, {102, 10}, {103, 10}}
+
+	// Flat, the quotes are only capped to the levels
+	gotBids, gotAsks := mm.skew(bids, asks, 0)
+	if !reflect.DeepEqual(gotBids, bids[:2]) || !reflect.DeepEqual(gotAsks, asks[:2]) {
+		t.Errorf("flat: %v %v", gotBids, gotAsks)
+	}
+
+	// Long, prices move down, bids shrink within the room left and asks grow
+	gotBids, gotAsks = mm.skew(bids, asks, 10)
+	if want := []Quote{{95, 5}, {94, 5}}; !reflect.DeepEqual(gotBids, want) {
+		t.Errorf("long bids %v, want %v", gotBids, want)
+	}
+	if want := []Quote{{96, 15}, {97, 15}}; !reflect.DeepEqual(gotAsks, want) {
+		t.Errorf("long asks %v, want %v", gotAsks, want)
+	}
+
+	// At the short limit only bids are quoted
+	gotBids, gotAsks = mm.skew(bids, asks, -20)
+	if len(gotBids) != 2 || gotBids[0].Size != 20 || len(gotAsks) != 0 {
+		t.Errorf("short: %v %v", gotBids, gotAsks)
+	}
+
+	// Strategies skewing their prices themselves are only scaled
+	mm.strategy = AvellanedaStoikov{}
+	gotBids, gotAsks = mm.skew(bids, asks, 10)
+	if want := []Quote{{100, 5}, {99, 5}}; !reflect.DeepEqual(gotBids, want) {
+		t.Errorf("long bids %v, want %v", gotBids, want)
+	}
+	if want := []Quote{{101, 15}, {102, 15}}; !reflect.DeepEqual(gotAsks, want) {
+		t.Errorf("long asks %v, want %v", gotAsks, want)
+	}
+}
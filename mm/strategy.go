@@ -0,0 +1,179 @@
+package mm
+
+import (
+	"math"
+	"time"
+)
+
+// Quote is an order the market maker wants resting in the book.
+type Quote struct {
+	Price float64
+	Size  float64
+}
+
+// MarketState is the state of the market a strategy quotes from.
+type MarketState struct {
+	BestBid float64 // BestBid is the best bid price, zero when there are no bids.
+	BestAsk float64 // BestAsk is the best ask price, zero when there are no asks.
+	OwnBid  bool    // OwnBid reports whether the best bid is an order of the market maker.
+	OwnAsk  bool    // OwnAsk reports whether the best ask is an order of the market maker.
+	// Reference is the mid price of the book, the best price of its only
+	// side, or the price of the price feed when the book is empty.
+	Reference float64
+	// FeedPrice is the price of the price feed, e.g. on other exchanges.
+	FeedPrice float64
+}
+
+// Empty reports whether the book has no orders.
+func (s MarketState) Empty() bool {
+	return s.BestBid == 0 && s.BestAsk == 0
+}
+
+// Strategy decides the orders the market maker wants resting in the book.
+// The market maker skews the quotes against its inventory, caps them to its
+// position limits and levels, and moves its orders to them.
+type Strategy interface {
+	// Quotes returns the bids and asks to rest, best first.
+	Quotes(state MarketState, inv Inventory) (bids, asks []Quote)
+}
+
+// InventorySkewer is implemented by strategies whose prices already move
+// against the inventory. The market maker doesn't shift their quotes again,
+// it only scales and caps them.
+type InventorySkewer interface {
+	SkewsInventory() bool
+}
+
+// Join joins the best prices of the book, improving them by Offset unless
+// they are the market maker's own orders, with Levels levels Offset apart.
+// An empty book is seeded SeedOffset around the reference price.
+type Join struct {
+	Offset     float64
+	SeedOffset float64
+	Levels     int
+	Size       float64
+
+	// refBid and refAsk are the last quotes, kept while they are the best
+	// prices so the strategy doesn't step ahead of itself.
+	refBid, refAsk float64
+}
+
+// Quotes joins the best prices of the book.
+func (j *Join) Quotes(state MarketState, _ Inventory) (bids, asks []Quote) {
+	var bid, ask float64
+	if state.Empty() {
+		bid, ask = state.Reference-j.SeedOffset, state.Reference+j.SeedOffset
+	} else {
+		bid = j.join(state.BestBid, state.OwnBid, j.refBid, j.Offset)
+		ask = j.join(state.BestAsk, state.OwnAsk, j.refAsk, -j.Offset)
+
+		if bid == 0 {
+			bid = ask - j.Offset*2
+		}
+		if ask == 0 {
+			ask = bid + j.Offset*2
+		}
+	}
+	j.refBid, j.refAsk = bid, ask
+
+	return levels(bid, -j.Offset, j.Size, 0, j.Levels), levels(ask, j.Offset, j.Size, 0, j.Levels)
+}
+
+// join returns the price that joins best, improved by offset unless it is
+// an own order.
+func (j *Join) join(best float64, own bool, ref, offset float64) float64 {
+	switch {
+	case best == 0:
+		return 0
+	case !own:
+		return best + offset
+	case ref != 0:
+		return ref
+	default:
+		return best
+	}
+}
+
+// FixedSpread quotes one level Spread wide around the reference price.
+type FixedSpread struct {
+	Spread float64
+	Size   float64
+}
+
+// Quotes centers the spread on the reference price.
+func (f FixedSpread) Quotes(state MarketState, _ Inventory) (bids, asks []Quote) {
+	half := f.Spread / 2
+	return []Quote{{Price: state.Reference - half, Size: f.Size}},
+		[]Quote{{Price: state.Reference + half, Size: f.Size}}
+}
+
+// Ladder quotes Levels levels on each side, the first Spread wide around
+// the reference price and the next ones Step further out. Every level is
+// SizeStep times Size larger than the one before it, so the depth grows away
+// from the reference price.
+type Ladder struct {
+	Spread   float64
+	Step     float64
+	Size     float64
+	SizeStep float64
+	Levels   int
+}
+
+// Quotes spreads the levels out from the reference price.
+func (l Ladder) Quotes(state MarketState, _ Inventory) (bids, asks []Quote) {
+	half := l.Spread / 2
+	return levels(state.Reference-half, -l.Step, l.Size, l.SizeStep, l.Levels),
+		levels(state.Reference+half, l.Step, l.Size, l.SizeStep, l.Levels)
+}
+
+// AvellanedaStoikov quotes around a reservation price that moves against
+// the inventory, with a spread set by the volatility, the risk aversion and
+// how quickly orders arrive, after Avellaneda and Stoikov's "High-frequency
+// trading in a limit order book". The horizon rolls, so the quotes depend on
+// Horizon rather than on the time left in a session.
+type AvellanedaStoikov struct {
+	// Gamma is the risk aversion, higher values skew and widen the quotes.
+	Gamma float64
+	// Kappa is the intensity of order arrival, higher values tighten the
+	// quotes.
+	Kappa float64
+	// Sigma is the volatility of the price, in price units per square root
+	// of a second.
+	Sigma float64
+	// Horizon is how long the inventory is expected to be held.
+	Horizon time.Duration
+	Size    float64
+}
+
+// Quotes centers the optimal spread on the reservation price.
+func (a AvellanedaStoikov) Quotes(state MarketState, inv Inventory) (bids, asks []Quote) {
+	reservation, spread := a.Reservation(state.Reference, inv.Position)
+	return []Quote{{Price: reservation - spread/2, Size: a.Size}},
+		[]Quote{{Price: reservation + spread/2, Size: a.Size}}
+}
+
+// SkewsInventory reports that the reservation price already moves against
+// the inventory.
+func (a AvellanedaStoikov) SkewsInventory() bool { return true }
+
+// Reservation returns the reservation price for a position at the mid price
+// and the optimal spread around it.
+func (a AvellanedaStoikov) Reservation(mid, position float64) (price, spread float64) {
+	risk := a.Gamma * a.Sigma * a.Sigma * a.Horizon.Seconds()
+	price = mid - position*risk
+	spread = risk + 2/a.Gamma*math.Log(1+a.Gamma/a.Kappa)
+	return price, spread
+}
+
+// levels returns n quotes starting at best and moving away from the spread
+// by step, each sizeStep times size larger than the one before it.
+func levels(best, step, size, sizeStep float64, n int) []Quote {
+	quotes := make([]Quote, 0, n)
+	for i := 0; i < n; i++ {
+		quotes = append(quotes, Quote{
+			Price: best + float64(i)*step,
+			Size:  size * (1 + float64(i)*sizeStep),
+		})
+	}
+	return quotes
+}
@@ -0,0 +1,79 @@
+package mm
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestJoin(t *testing.T) {
+	j := &Join{Offset: 1, SeedOffset: 10, Levels: 2, Size: 5}
+
+	// An empty book is seeded around the reference price
+	bids, asks := j.Quotes(MarketState{Reference: 100}, Inventory{})
+	if want := []Quote{{90, 5}, {89, 5}}; !reflect.DeepEqual(bids, want) {
+		t.Errorf("seed bids %v, want %v", bids, want)
+	}
+	if want := []Quote{{110, 5}, {111, 5}}; !reflect.DeepEqual(asks, want) {
+		t.Errorf("seed asks %v, want %v", asks, want)
+	}
+
+	// Other orders are improved, own orders are not
+	bids, asks = j.Quotes(MarketState{BestBid: 95, BestAsk: 110, OwnAsk: true, Reference: 102.5}, Inventory{})
+	if bids[0].Price != 96 || asks[0].Price != 110 {
+		t.Errorf("joined at %f/%f", bids[0].Price, asks[0].Price)
+	}
+	bids, _ = j.Quotes(MarketState{BestBid: 96, BestAsk: 110, OwnBid: true, OwnAsk: true, Reference: 103}, Inventory{})
+	if bids[0].Price != 96 {
+		t.Errorf("stepped ahead of itself to %f", bids[0].Price)
+	}
+
+	// A one sided book is mirrored
+	bids, asks = j.Quotes(MarketState{BestAsk: 110, Reference: 110}, Inventory{})
+	if bids[0].Price != 107 || asks[0].Price != 109 {
+		t.Errorf("one sided at %f/%f", bids[0].Price, asks[0].Price)
+	}
+}
+
+func TestFixedSpreadAndLadder(t *testing.T) {
+	state := MarketState{BestBid: 99, BestAsk: 101, Reference: 100}
+
+	bids, asks := FixedSpread{Spread: 4, Size: 1}.Quotes(state, Inventory{})
+	if !reflect.DeepEqual(bids, []Quote{{98, 1}}) || !reflect.DeepEqual(asks, []Quote{{102, 1}}) {
+		t.Errorf("fixed spread %v %v", bids, asks)
+	}
+
+	// The depth grows away from the reference price
+	bids, asks = Ladder{Spread: 2, Step: 1, Size: 2, SizeStep: 0.5, Levels: 3}.Quotes(state, Inventory{})
+	if want := []Quote{{99, 2}, {98, 3}, {97, 4}}; !reflect.DeepEqual(bids, want) {
+		t.Errorf("ladder bids %v, want %v", bids, want)
+	}
+	if want := []Quote{{101, 2}, {102, 3}, {103, 4}}; !reflect.DeepEqual(asks, want) {
+		t.Errorf("ladder asks %v, want %v", asks, want)
+	}
+}
+
+func TestAvellanedaStoikov(t *testing.T) {
+	a := AvellanedaStoikov{Gamma: 0.1, Kappa: 1.5, Sigma: 2, Horizon: 10 * time.Second, Size: 1}
+	state := MarketState{BestBid: 99, BestAsk: 101, Reference: 100}
+
+	// Flat, the quotes are symmetric around the mid price
+	spread := 0.1*4*10 + 2/0.1*math.Log(1+0.1/1.5)
+	bids, asks := a.Quotes(state, Inventory{})
+	if math.Abs(bids[0].Price-(100-spread/2)) > 1e-9 || math.Abs(asks[0].Price-(100+spread/2)) > 1e-9 {
+		t.Errorf("flat quotes %v %v, spread %f", bids, asks, spread)
+	}
+
+	// Long, the reservation price moves down by the inventory risk
+	long, _ := a.Quotes(state, Inventory{Position: 2})
+	if shift := bids[0].Price - long[0].Price; math.Abs(shift-8) > 1e-9 {
+		t.Errorf("moved down by %f, want 8", shift)
+	}
+
+	// Higher risk aversion widens the spread
+	_, wide := AvellanedaStoikov{Gamma: 0.5, Kappa: 1.5, Sigma: 2, Horizon: 10 * time.Second}.Reservation(100, 0)
+	if wide <= spread {
+		t.Errorf("spread %f isn't wider than %f", wide, spread)
+	}
+}
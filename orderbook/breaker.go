@@ -0,0 +1,155 @@
+package orderbook
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CircuitBreaker configures the dynamic price band of an order book. A fill
+// more than Band away from the reference price halts matching.
+type CircuitBreaker struct {
+	// Band is the maximum relative distance from the reference price, e.g. 0.05 for 5%.
+	Band float64
+	// Window is the period over which the reference price is taken.
+	Window time.Duration
+	// HaltDuration is how long matching stays halted before the book reopens
+	// by itself through a call auction. Zero means the book only reopens on Resume.
+	HaltDuration time.Duration
+}
+
+// pricePoint is a traded price at a point in time.
+type pricePoint struct {
+	price float64
+	time  time.Time
+}
+
+// Halt holds the details of a trading halt.
+type Halt struct {
+	Reason string
+	Since  time.Time
+	// Until is the time the book reopens by itself, zero if it doesn't.
+	Until time.Time
+}
+
+// SetCircuitBreaker sets the circuit breaker of the order book.
+func (ob *Orderbook) SetCircuitBreaker(cb CircuitBreaker) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.breaker = &cb
+}
+
+// Halt halts matching until Resume is called.
+func (ob *Orderbook) Halt(reason string) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.halt(reason, ob.clock.Now(), 0)
+}
+
+// Resume reopens a halted order book through the reopening auction and
+// returns the matches of an immediate uncross.
+func (ob *Orderbook) Resume() []Match {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if ob.state != StateHalted {
+		return nil
+	}
+
+	return ob.reopen(ob.clock.Now())
+}
+
+// Halted returns the current halt, or nil if the order book is not halted.
+func (ob *Orderbook) Halted() *Halt {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if ob.halted == nil {
+		return nil
+	}
+
+	halt := *ob.halted
+	return &halt
+}
+
+func (ob *Orderbook) halt(reason string, now time.Time, d time.Duration) {
+	ob.state = StateHalted
+	ob.halted = &Halt{
+		Reason: reason,
+		Since:  now,
+	}
+	if d > 0 {
+		ob.halted.Until = now.Add(d)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"reason": reason,
+		"until":  ob.halted.Until,
+	}).Warn("halting order book")
+}
+
+// reopen ends a halt. The book goes through a call auction when a reopening
+// auction is configured and uncrosses right away otherwise.
+func (ob *Orderbook) reopen(now time.Time) []Match {
+	ob.halted = nil
+
+	logrus.Info("reopening order book")
+
+	if ob.reopenAuction > 0 {
+		ob.startAuction(now.Add(ob.reopenAuction))
+		return nil
+	}
+
+	return ob.open(now)
+}
+
+// referencePrice returns the price the band is anchored to: the last price
+// traded before the window, or the oldest price within it. It returns 0 if
+// the book has no price history.
+func (ob *Orderbook) referencePrice(now time.Time) float64 {
+	start := now.Add(-ob.breaker.Window)
+
+	// Drop every point but the last one before the start of the window.
+	i := 0
+	for i+1 < len(ob.priceHistory) && !ob.priceHistory[i+1].time.After(start) {
+		i++
+	}
+	ob.priceHistory = ob.priceHistory[i:]
+
+	if len(ob.priceHistory) == 0 {
+		return 0
+	}
+	return ob.priceHistory[0].price
+}
+
+// recordPrice adds a traded price to the history of the circuit breaker.
+func (ob *Orderbook) recordPrice(price float64, now time.Time) {
+	if ob.breaker == nil {
+		return
+	}
+	ob.priceHistory = append(ob.priceHistory, pricePoint{price: price, time: now})
+}
+
+// breaches checks whether filling at price would trip the circuit breaker.
+// Without price history the first price of the order is used as reference.
+func (ob *Orderbook) breaches(price, firstPrice float64, now time.Time) bool {
+	if ob.breaker == nil || ob.breaker.Band <= 0 {
+		return false
+	}
+
+	ref := ob.referencePrice(now)
+	if ref == 0 {
+		ref = firstPrice
+	}
+
+	if math.Abs(price-ref)/ref > ob.breaker.Band {
+		ob.halt(fmt.Sprintf("price %.2f is more than %.2f%% away from reference %.2f", price, ob.breaker.Band*100, ref), now, ob.breaker.HaltDuration)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,73 @@
+package orderbook
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Clock tells an order book the time.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the wall clock.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time { return time.Now() }
+
+// FixedClock always tells the same time.
+type FixedClock time.Time
+
+func (c FixedClock) Now() time.Time { return time.Time(c) }
+
+// IDGenerator generates order IDs.
+type IDGenerator interface {
+	NextID() int64
+}
+
+// maxRandomID bounds the IDs of RandomIDs.
+const maxRandomID = 10000000
+
+// RandomIDs generates random order IDs from a seeded source, so the same
+// seed generates the same IDs.
+type RandomIDs struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// NewRandomIDs creates a generator of random IDs seeded with seed.
+func NewRandomIDs(seed int64) *RandomIDs {
+	return &RandomIDs{rand: rand.New(rand.NewSource(seed))}
+}
+
+func (g *RandomIDs) NextID() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return int64(g.rand.Intn(maxRandomID))
+}
+
+// SequentialIDs generates increasing order IDs.
+type SequentialIDs struct {
+	mu   sync.Mutex
+	last int64
+}
+
+// NewSequentialIDs creates a generator whose first ID is last+1.
+func NewSequentialIDs(last int64) *SequentialIDs {
+	return &SequentialIDs{last: last}
+}
+
+func (g *SequentialIDs) NextID() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.last++
+	return g.last
+}
+
+// globalIDs draws IDs from the global random source.
+type globalIDs struct{}
+
+func (globalIDs) NextID() int64 { return int64(rand.Intn(maxRandomID)) }
@@ -0,0 +1,111 @@
+package orderbook
+
+import "sort"
+
+// Level is a price level of the aggregated depth of a book.
+type Level struct {
+	Price float64
+	Size  float64
+	// Orders is the number of orders resting at the price.
+	Orders int
+}
+
+// Depth is the aggregated depth of a book, best levels first.
+type Depth struct {
+	Bids []Level
+	Asks []Level
+}
+
+// Depth returns the best levels of both sides of the book, all of them if
+// levels isn't positive. Both sides are read under the same read lock.
+func (ob *Orderbook) Depth(levels int) Depth {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return Depth{
+		Bids: aggregateLevels(bestLimits(true, ob.bids, levels)),
+		Asks: aggregateLevels(bestLimits(false, ob.asks, levels)),
+	}
+}
+
+// DepthOrders returns the best levels of both sides of the book with their
+// orders in queue order, all of them if levels isn't positive. Both sides
+// are read under the same read lock.
+func (ob *Orderbook) DepthOrders(levels int) (bids, asks []LevelSnapshot) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return snapshotLevels(bestLimits(true, ob.bids, levels)), snapshotLevels(bestLimits(false, ob.asks, levels))
+}
+
+// bestLimits returns a sorted copy of the best levels of a side, so the book
+// isn't reordered under a read lock.
+func bestLimits(bid bool, limits []*Limit, levels int) []*Limit {
+	sorted := make(Limits, len(limits))
+	copy(sorted, limits)
+
+	if bid {
+		sort.Sort(ByBestBid{sorted})
+	} else {
+		sort.Sort(ByBestAsk{sorted})
+	}
+
+	if levels > 0 && len(sorted) > levels {
+		sorted = sorted[:levels]
+	}
+	return sorted
+}
+
+func aggregateLevels(limits []*Limit) []Level {
+	levels := make([]Level, len(limits))
+	for i, limit := range limits {
+		levels[i] = Level{
+			Price:  limit.Price,
+			Size:   limit.TotalVolume,
+			Orders: len(limit.Orders),
+		}
+	}
+	return levels
+}
+
+// Best returns a copy of the first order in the queue of the best level of
+// a side, with the price of the level.
+func (ob *Orderbook) Best(bid bool) (Order, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	limits := bestLimits(bid, ob.asks, 1)
+	if bid {
+		limits = bestLimits(bid, ob.bids, 1)
+	}
+	if len(limits) == 0 || len(limits[0].Orders) == 0 {
+		return Order{}, false
+	}
+
+	return copyOrder(limits[0].Orders[0]), true
+}
+
+// Resting returns copies of the given orders that still rest in the book.
+func (ob *Orderbook) Resting(orders []*Order) []Order {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	resting := []Order{}
+	for _, o := range orders {
+		if ob.Orders[o.ID] == o && o.Limit != nil {
+			resting = append(resting, copyOrder(o))
+		}
+	}
+	return resting
+}
+
+// copyOrder copies a resting order, with the price of its level. The copy
+// doesn't point to the level.
+func copyOrder(o *Order) Order {
+	c := *o
+	if o.Limit != nil {
+		c.Price = o.Limit.Price
+	}
+	c.Limit = nil
+	return c
+}
@@ -0,0 +1,93 @@
+package orderbook
+
+// MarketOptions protect a market order from sweeping the book and can size
+// it in the quote asset.
+type MarketOptions struct {
+	// WorstPrice is the worst price the order fills at, zero for no limit.
+	WorstPrice float64
+	// MaxSlippage is the worst price relative to the best price when the
+	// order arrives, e.g. 0.01 for 1%. With WorstPrice the tighter applies.
+	MaxSlippage float64
+	// Quote is the size of the order in the quote asset, e.g. how much a
+	// buy order spends. The size of the order is then the base size it can
+	// fill, and the quote size that can't be filled expires.
+	Quote float64
+}
+
+// bounded reports whether the order may fill less than its size without
+// being rejected: protected orders and quote orders fill what they can.
+func (opts MarketOptions) bounded() bool {
+	return opts.WorstPrice > 0 || opts.MaxSlippage > 0 || opts.Quote > 0
+}
+
+// worstPrice returns the protection price of an order against the levels,
+// best first, or zero when it isn't protected.
+func (opts MarketOptions) worstPrice(bid bool, limits []*Limit) float64 {
+	worst := opts.WorstPrice
+	if opts.MaxSlippage <= 0 || len(limits) == 0 {
+		return worst
+	}
+
+	best := limits[0].Price
+	slipped := best * (1 - opts.MaxSlippage)
+	if bid {
+		slipped = best * (1 + opts.MaxSlippage)
+	}
+
+	if worst == 0 || !worse(bid, slipped, worst) {
+		return slipped
+	}
+	return worst
+}
+
+// worse reports whether price is worse than worst for a bid, or an ask when
+// bid is false. Nothing is worse than a zero worst price.
+func worse(bid bool, price, worst float64) bool {
+	if worst == 0 {
+		return false
+	}
+	if bid {
+		return price > worst
+	}
+	return price < worst
+}
+
+// baseSize returns the base size an order of quote fills against the
+// levels, best first, up to the worst price, and the quote size it fills.
+func baseSize(bid bool, limits []*Limit, worst, quote float64) (size, filled float64) {
+	for _, limit := range limits {
+		if worse(bid, limit.Price, worst) {
+			break
+		}
+
+		left := quote - filled
+		if notional := limit.TotalVolume * limit.Price; notional < left {
+			size += limit.TotalVolume
+			filled += notional
+			continue
+		}
+
+		size += left / limit.Price
+		filled = quote
+		break
+	}
+
+	return size, filled
+}
+
+// ConsumedLevels returns the price levels the matches of an order filled
+// at, in the order they were reached, with the size filled and the number
+// of resting orders matched at each of them.
+func ConsumedLevels(matches []Match) []Level {
+	levels := []Level{}
+	for _, m := range matches {
+		n := len(levels)
+		if n == 0 || levels[n-1].Price != m.Price {
+			levels = append(levels, Level{Price: m.Price})
+			n++
+		}
+		levels[n-1].Size += m.SizeFilled
+		levels[n-1].Orders++
+	}
+	return levels
+}
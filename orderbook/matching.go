@@ -0,0 +1,116 @@
+package orderbook
+
+import "math"
+
+// DefaultLot is the size pro-rata allocations are rounded down to when the
+// policy doesn't set one.
+const DefaultLot = 0.0001
+
+// Dust is the size below which what is left of an order after a fill is
+// treated as filled, so rounding doesn't leave orders with a sliver of size.
+const Dust = 1e-9
+
+// MatchingPolicy allocates an incoming order among the orders resting at a
+// price level.
+type MatchingPolicy interface {
+	// Allocate returns the size each resting order, in queue order, is
+	// filled for an incoming order of size. No order gets more than its size
+	// and the sizes add up to at most size.
+	Allocate(orders Orders, size float64) []float64
+}
+
+// FIFO fills the resting orders of a level in time priority, oldest first.
+type FIFO struct{}
+
+// Allocate fills the oldest orders first.
+func (FIFO) Allocate(orders Orders, size float64) []float64 {
+	sizes := make([]float64, len(orders))
+	for i, o := range orders {
+		if size <= 0 {
+			break
+		}
+		sizes[i] = math.Min(size, o.Size)
+		size -= sizes[i]
+	}
+	return sizes
+}
+
+// ProRata fills the resting orders of a level in proportion to their size.
+// Proportional allocations are rounded down to Lot, and what rounding and
+// MinAllocation leave is filled in time priority.
+type ProRata struct {
+	// TopOrder fills the oldest order of the level first, up to its size,
+	// before the rest is allocated pro-rata.
+	TopOrder bool
+	// MinAllocation is the smallest proportional allocation an order gets,
+	// smaller allocations are left to the time priority fill.
+	MinAllocation float64
+	// Lot is the size allocations are rounded down to, DefaultLot if zero.
+	Lot float64
+}
+
+// Allocate splits size among the orders in proportion to their size.
+func (p ProRata) Allocate(orders Orders, size float64) []float64 {
+	sizes := make([]float64, len(orders))
+	if len(orders) == 0 || size <= 0 {
+		return sizes
+	}
+
+	lot := p.Lot
+	if lot <= 0 {
+		lot = DefaultLot
+	}
+
+	remaining := size
+	if p.TopOrder {
+		sizes[0] = math.Min(remaining, orders[0].Size)
+		remaining -= sizes[0]
+	}
+
+	total := 0.0
+	for i, o := range orders {
+		total += o.Size - sizes[i]
+	}
+	if total <= 0 || remaining < Dust {
+		return sizes
+	}
+
+	share := math.Min(remaining, total)
+	for i, o := range orders {
+		left := o.Size - sizes[i]
+		alloc := math.Min(left, roundDown(share*left/total, lot))
+		if alloc <= 0 || alloc < p.MinAllocation {
+			continue
+		}
+		sizes[i] += alloc
+		remaining -= alloc
+	}
+
+	// The remainder goes to the oldest orders with size left.
+	for i, o := range orders {
+		if remaining < Dust {
+			break
+		}
+		alloc := math.Min(remaining, o.Size-sizes[i])
+		sizes[i] += alloc
+		remaining -= alloc
+	}
+
+	return sizes
+}
+
+// roundDown rounds size down to a multiple of lot, tolerating the error of
+// the division so that e.g. 0.3 is three lots of 0.1.
+func roundDown(size, lot float64) float64 {
+	return math.Floor(size/lot+1e-9) * lot
+}
+
+// SetMatchingPolicy sets how incoming orders are allocated among the orders
+// resting at a price level, FIFO by default. Auctions allocate the last
+// level they execute on each side with it too.
+func (ob *Orderbook) SetMatchingPolicy(p MatchingPolicy) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.policy = p
+}
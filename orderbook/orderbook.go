@@ -2,7 +2,6 @@ package orderbook
 
 import (
 	"fmt"
-	"math/rand"
 	"sort"
 	"sync"
 	"time"
@@ -12,10 +11,33 @@ import (
 
 // Trade represents a trade that occurred in the order book.
 type Trade struct {
-	Price     float64
-	Size      float64
-	Bid       bool
-	Timestamp int64
+	Price float64
+	Size  float64
+	// Bid tells whether the bid was the taker.
+	Bid        bool
+	Timestamp  int64
+	MakerFee   float64
+	TakerFee   float64
+	BidOrderID int64
+	AskOrderID int64
+	BidUserID  int64
+	AskUserID  int64
+}
+
+// newTrade returns the trade of a match.
+func newTrade(m Match, now time.Time) *Trade {
+	return &Trade{
+		Price:      m.Price,
+		Size:       m.SizeFilled,
+		Bid:        m.TakerBid,
+		Timestamp:  now.UnixNano(),
+		MakerFee:   m.MakerFee,
+		TakerFee:   m.TakerFee,
+		BidOrderID: m.Bid.ID,
+		AskOrderID: m.Ask.ID,
+		BidUserID:  m.Bid.UserID,
+		AskUserID:  m.Ask.UserID,
+	}
 }
 
 // Match represents a matching pair of ask and bid orders in the order book.
@@ -24,16 +46,34 @@ type Match struct {
 	Bid        *Order
 	SizeFilled float64
 	Price      float64
+	MakerFee   float64
+	TakerFee   float64
+	// TakerBid tells whether the bid was the taker of the match.
+	TakerBid bool
+}
+
+// FeeCharger computes the maker and taker fees of a match.
+type FeeCharger interface {
+	ChargeFees(m Match, taker *Order, now time.Time) (makerFee, takerFee float64)
 }
 
 // Order represents an order in the order book.
 type Order struct {
-	ID        int64
-	UserID    int64
-	Size      float64
+	ID     int64
+	UserID int64
+	// Size is the size left to fill.
+	Size float64
+	// Price is the limit price, zero for market orders.
+	Price     float64
 	Bid       bool
 	Limit     *Limit
 	Timestamp int64
+	// OriginalSize is the size the order was placed with, Filled the
+	// cumulative filled size and AvgPrice the average price of the fills.
+	OriginalSize float64
+	Filled       float64
+	AvgPrice     float64
+	Status       OrderStatus
 }
 
 // Orders is a slice of Order pointers.
@@ -48,14 +88,21 @@ func (o Orders) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
 // Less compares two elements in the Orders slice based on Timestamp.
 func (o Orders) Less(i, j int) bool { return o[i].Timestamp < o[j].Timestamp }
 
-// NewOrder creates a new Order with the given bid, size, and user ID.
+// NewOrder creates a new Order with the given bid, size, and user ID. It gets
+// a random ID and the current time.
 func NewOrder(bid bool, size float64, userID int64) *Order {
+	return NewOrderWith(globalIDs{}, SystemClock{}, bid, size, userID)
+}
+
+// NewOrderWith creates a new Order taking its ID from ids and its timestamp
+// from clock.
+func NewOrderWith(ids IDGenerator, clock Clock, bid bool, size float64, userID int64) *Order {
 	return &Order{
 		UserID:    userID,
-		ID:        int64(rand.Intn(10000000)),
+		ID:        ids.NextID(),
 		Size:      size,
 		Bid:       bid,
-		Timestamp: time.Now().UnixNano(),
+		Timestamp: clock.Now().UnixNano(),
 	}
 }
 
@@ -126,34 +173,35 @@ func (l *Limit) AddOrder(o *Order) {
 	l.TotalVolume += o.Size
 }
 
-// DeleteOrder removes an order from the Limit.
+// DeleteOrder removes an order from the Limit, keeping the queue order of
+// the others.
 func (l *Limit) DeleteOrder(o *Order) {
 	for i := 0; i < len(l.Orders); i++ {
 		if l.Orders[i] == o {
-			l.Orders[i] = l.Orders[len(l.Orders)-1]
-			l.Orders = l.Orders[:len(l.Orders)-1]
+			l.Orders = append(l.Orders[:i], l.Orders[i+1:]...)
+			break
 		}
 	}
 
 	o.Limit = nil
 	l.TotalVolume -= o.Size
-
-	sort.Sort(l.Orders)
 }
 
-// Fill matches an order in the Limit with another order, resulting in one or more matches.
-func (l *Limit) Fill(o *Order) []Match {
+// Fill matches an order with the orders in the Limit, allocated among them
+// by policy, resulting in one or more matches.
+func (l *Limit) Fill(o *Order, policy MatchingPolicy) []Match {
 	var (
 		matches        []Match
 		ordersToDelete []*Order
 	)
 
-	for _, order := range l.Orders {
-		if o.IsFilled() {
-			break
+	sizes := policy.Allocate(l.Orders, o.Size)
+	for i, order := range l.Orders {
+		if sizes[i] <= 0 {
+			continue
 		}
 
-		match := l.fillOrder(order, o)
+		match := l.fillOrder(order, o, sizes[i])
 		matches = append(matches, match)
 
 		l.TotalVolume -= match.SizeFilled
@@ -170,12 +218,11 @@ func (l *Limit) Fill(o *Order) []Match {
 	return matches
 }
 
-// fillOrder matches two orders in the Limit and returns a Match.
-func (l *Limit) fillOrder(a, b *Order) Match {
+// fillOrder fills size of two orders in the Limit and returns a Match.
+func (l *Limit) fillOrder(a, b *Order, size float64) Match {
 	var (
-		bid        *Order
-		ask        *Order
-		sizeFilled float64
+		bid *Order
+		ask *Order
 	)
 
 	if a.Bid {
@@ -186,32 +233,57 @@ func (l *Limit) fillOrder(a, b *Order) Match {
 		ask = a
 	}
 
-	if a.Size >= b.Size {
-		a.Size -= b.Size
-		sizeFilled = b.Size
-		b.Size = 0.0
-	} else {
-		b.Size -= a.Size
-		sizeFilled = a.Size
-		a.Size = 0.0
-	}
+	a.Size = sizeLeft(a.Size, size)
+	b.Size = sizeLeft(b.Size, size)
+
+	a.fill(size, l.Price)
+	b.fill(size, l.Price)
 
 	return Match{
 		Bid:        bid,
 		Ask:        ask,
-		SizeFilled: sizeFilled,
+		SizeFilled: size,
 		Price:      l.Price,
 	}
 }
 
+// sizeLeft returns what is left of size after a fill of filled, dropping dust.
+func sizeLeft(size, filled float64) float64 {
+	if size -= filled; size < Dust {
+		return 0
+	}
+	return size
+}
+
+// TradeHistory is the number of recent trades an order book keeps.
+const TradeHistory = 1000
+
 // Orderbook represents an order book with asks, bids, trades, and order management.
+//
+// Every method locks the book: commands take the write lock, reads the read
+// lock and return copies. The orders, levels and trades reachable through
+// the exported fields and the pointers given to the book are only safe to
+// read while no command runs, e.g. by the single writer applying commands.
 type Orderbook struct {
 	asks []*Limit
 	bids []*Limit
 
+	// Trades holds the last TradeHistory trades.
 	Trades []*Trade
 
-	mu        sync.RWMutex
+	mu      sync.RWMutex
+	clock   Clock
+	fees    FeeCharger
+	policy  MatchingPolicy
+	breaker *CircuitBreaker
+	halted  *Halt
+	// priceHistory holds the traded prices the circuit breaker needs.
+	priceHistory []pricePoint
+
+	state         State
+	reopenAuction time.Duration
+	auctionEnd    time.Time
+
 	AskLimits map[float64]*Limit
 	BidLimits map[float64]*Limit
 	Orders    map[int64]*Order
@@ -226,68 +298,177 @@ func NewOrderbook() *Orderbook {
 		AskLimits: make(map[float64]*Limit),
 		BidLimits: make(map[float64]*Limit),
 		Orders:    make(map[int64]*Order),
+		state:     StateContinuous,
+		clock:     SystemClock{},
+		policy:    FIFO{},
 	}
 }
 
+// SetClock sets the clock telling the order book the time of trades,
+// halts and state changes.
+func (ob *Orderbook) SetClock(c Clock) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.clock = c
+}
+
+// Clock returns the clock of the order book.
+func (ob *Orderbook) Clock() Clock {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.clock
+}
+
+// SetFeeCharger sets the charger used to compute fees for every match.
+func (ob *Orderbook) SetFeeCharger(fc FeeCharger) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.fees = fc
+}
+
 // PlaceMarketOrder places a market order in the order book and returns any matches.
+// Matching stops early when the order would trip the circuit breaker, and
+// market orders only match in StateContinuous. The unfilled size is not kept.
 func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
+	return ob.PlaceMarketOrderWith(o, MarketOptions{})
+}
+
+// PlaceMarketOrderWith places a market order protected by, or sized in the
+// quote asset with, opts. Matching stops at the protection price and the
+// unfilled size is not kept: the order expires.
+func (ob *Orderbook) PlaceMarketOrderWith(o *Order, opts MarketOptions) []Match {
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
 
-	matches := []Match{}
+	var (
+		now     = ob.clock.Now()
+		matches = []Match{}
+		limits  = ob.sortedAsks()
+		volume  = ob.askVolume()
+	)
+	if !o.Bid {
+		limits, volume = ob.sortedBids(), ob.bidVolume()
+	}
 
-	if o.Bid {
-		if o.Size > ob.AskTotalVolume() {
-			panic(fmt.Errorf("not enough volume [size: %.2f] for market order [size: %.2f]", ob.AskTotalVolume(), o.Size))
+	worst := opts.worstPrice(o.Bid, limits)
+	quoteFilled := true
+	if opts.Quote > 0 {
+		size, quote := baseSize(o.Bid, limits, worst, opts.Quote)
+		o.Size = size
+		quoteFilled = quote >= opts.Quote-Dust
+	}
+
+	o.start()
+	defer func() {
+		if !o.IsFilled() || !quoteFilled {
+			o.Status = StatusExpired
 		}
+	}()
 
-		for _, limit := range ob.Asks() {
-			limitMatches := limit.Fill(o)
-			matches = append(matches, limitMatches...)
+	if ob.state != StateContinuous {
+		return matches
+	}
 
-			if len(limit.Orders) == 0 {
-				ob.clearLimit(false, limit)
-			}
+	if !opts.bounded() && o.Size > volume {
+		panic(fmt.Errorf("not enough volume [size: %.2f] for market order [size: %.2f]", volume, o.Size))
+	}
+
+	matches = ob.sweep(o, limits, now, worst)
+
+	for i, match := range matches {
+		if ob.fees != nil {
+			matches[i].MakerFee, matches[i].TakerFee = ob.fees.ChargeFees(match, o, now)
 		}
-	} else {
-		if o.Size > ob.BidTotalVolume() {
-			panic(fmt.Errorf("not enough volume [size: %.2f] for market order [size: %.2f]", ob.BidTotalVolume(), o.Size))
+
+		ob.addTrade(newTrade(matches[i], now))
+		ob.recordPrice(match.Price, now)
+	}
+
+	if len(ob.Trades) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"currentPrice": ob.Trades[len(ob.Trades)-1].Price,
+		}).Info()
+	}
+
+	return matches
+}
+
+// addTrade appends a trade to the recent trades, dropping the oldest one
+// past TradeHistory. Dropped trades are only kept by the trade history of
+// the exchange.
+func (ob *Orderbook) addTrade(t *Trade) {
+	ob.Trades = append(ob.Trades, t)
+	if len(ob.Trades) > TradeHistory {
+		ob.Trades = ob.Trades[len(ob.Trades)-TradeHistory:]
+	}
+}
+
+// sweep fills the order against the given price levels, best first, until
+// it is filled, the next level is worse than worst or the circuit breaker
+// trips. A zero worst price doesn't stop the order.
+func (ob *Orderbook) sweep(o *Order, limits []*Limit, now time.Time, worst float64) []Match {
+	var (
+		matches = []Match{}
+		levels  = make([]*Limit, len(limits))
+	)
+
+	// clearLimit reorders the book's levels, so walk a copy of them.
+	copy(levels, limits)
+
+	for _, limit := range levels {
+		if o.IsFilled() {
+			break
+		}
+
+		if worse(o.Bid, limit.Price, worst) {
+			break
+		}
+
+		if ob.breaches(limit.Price, levels[0].Price, now) {
+			break
 		}
 
-		for _, limit := range ob.Bids() {
-			limitMatches := limit.Fill(o)
-			matches = append(matches, limitMatches...)
+		for _, match := range limit.Fill(o, ob.policy) {
+			match.TakerBid = o.Bid
+			matches = append(matches, match)
 
-			if len(limit.Orders) == 0 {
-				ob.clearLimit(true, limit)
+			// Filled resting orders are no longer part of the book.
+			resting := match.Bid
+			if o.Bid {
+				resting = match.Ask
+			}
+			if resting.IsFilled() {
+				delete(ob.Orders, resting.ID)
 			}
 		}
-	}
 
-	for _, match := range matches {
-		trade := &Trade{
-			Price:     match.Price,
-			Size:      match.SizeFilled,
-			Timestamp: time.Now().UnixNano(),
-			Bid:       o.Bid,
+		if len(limit.Orders) == 0 {
+			ob.clearLimit(!o.Bid, limit)
 		}
-		ob.Trades = append(ob.Trades, trade)
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"currentPrice": ob.Trades[len(ob.Trades)-1].Price,
-	}).Info()
-
 	return matches
 }
 
-// PlaceLimitOrder places a limit order in the order book.
-func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
-	var limit *Limit
-
+// PlaceLimitOrder places a limit order in the order book. Limit orders rest
+// in the book in every state but StateClosed.
+func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) error {
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
 
+	return ob.placeLimitOrder(price, o)
+}
+
+func (ob *Orderbook) placeLimitOrder(price float64, o *Order) error {
+	var limit *Limit
+
+	if ob.state == StateClosed {
+		return ErrMarketClosed
+	}
+
 	if o.Bid {
 		limit = ob.BidLimits[price]
 	} else {
@@ -313,8 +494,12 @@ func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 		"userID": o.UserID,
 	}).Info("new limit order")
 
+	o.Price = price
+	o.start()
 	ob.Orders[o.ID] = o
 	limit.AddOrder(o)
+
+	return nil
 }
 
 // clearLimit clears a limit price level from the order book.
@@ -337,11 +522,61 @@ func (ob *Orderbook) clearLimit(bid bool, l *Limit) {
 		}
 	}
 
-	fmt.Printf("clearing limit price level [%.2f]\n", l.Price)
+	logrus.WithField("price", l.Price).Debug("clearing limit price level")
 }
 
-// CancelOrder cancels an order in the order book.
+// AmendOrder changes the price and size of a resting order. Reducing the size
+// at the same price keeps the order's place in the queue, any other change
+// moves it to the back of the queue of its new price with the given timestamp.
+func (ob *Orderbook) AmendOrder(o *Order, price, size float64, timestamp int64) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if o.Limit == nil {
+		return ErrOrderNotResting
+	}
+	if size <= 0 {
+		return fmt.Errorf("invalid size %.2f", size)
+	}
+
+	if price == o.Limit.Price && size <= o.Size {
+		o.Limit.TotalVolume -= o.Size - size
+		o.Size = size
+		o.OriginalSize = o.Filled + size
+		return nil
+	}
+
+	if ob.state == StateClosed {
+		return ErrMarketClosed
+	}
+
+	ob.removeOrder(o)
+	o.Size = size
+	o.OriginalSize = o.Filled + size
+	o.Timestamp = timestamp
+
+	return ob.placeLimitOrder(price, o)
+}
+
+// CancelOrder cancels an order in the order book. Orders that no longer
+// rest in the book, e.g. because they were filled meanwhile, are left alone.
 func (ob *Orderbook) CancelOrder(o *Order) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if ob.Orders[o.ID] != o {
+		return
+	}
+	ob.cancelOrder(o)
+}
+
+func (ob *Orderbook) cancelOrder(o *Order) {
+	ob.removeOrder(o)
+	o.Status = StatusCanceled
+}
+
+// removeOrder takes a resting order out of the book.
+func (ob *Orderbook) removeOrder(o *Order) {
 	limit := o.Limit
 	limit.DeleteOrder(o)
 	delete(ob.Orders, o.ID)
@@ -351,8 +586,44 @@ func (ob *Orderbook) CancelOrder(o *Order) {
 	}
 }
 
+// Order returns the resting order with the given ID, or nil.
+func (ob *Orderbook) Order(id int64) *Order {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.Orders[id]
+}
+
+// HasLimit reports whether the book has a price level at price on the given side.
+func (ob *Orderbook) HasLimit(bid bool, price float64) bool {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if bid {
+		_, ok := ob.BidLimits[price]
+		return ok
+	}
+	_, ok := ob.AskLimits[price]
+	return ok
+}
+
 // BidTotalVolume returns the total volume of all bid orders in the order book.
 func (ob *Orderbook) BidTotalVolume() float64 {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.bidVolume()
+}
+
+// AskTotalVolume returns the total volume of all ask orders in the order book.
+func (ob *Orderbook) AskTotalVolume() float64 {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.askVolume()
+}
+
+func (ob *Orderbook) bidVolume() float64 {
 	totalVolume := 0.0
 
 	for i := 0; i < len(ob.bids); i++ {
@@ -362,8 +633,7 @@ func (ob *Orderbook) BidTotalVolume() float64 {
 	return totalVolume
 }
 
-// AskTotalVolume returns the total volume of all ask orders in the order book.
-func (ob *Orderbook) AskTotalVolume() float64 {
+func (ob *Orderbook) askVolume() float64 {
 	totalVolume := 0.0
 
 	for i := 0; i < len(ob.asks); i++ {
@@ -373,14 +643,46 @@ func (ob *Orderbook) AskTotalVolume() float64 {
 	return totalVolume
 }
 
-// Asks returns the ask orders sorted by price.
+// Asks returns the ask levels sorted by price, best first. The slice is a
+// copy but the levels are shared with the book, their orders and volume
+// change as orders are matched. Use Depth or DepthOrders for a consistent
+// view of a book in use.
 func (ob *Orderbook) Asks() []*Limit {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return bestLimits(false, ob.asks, 0)
+}
+
+// Bids returns the bid levels sorted by price, best first, see Asks.
+func (ob *Orderbook) Bids() []*Limit {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return bestLimits(true, ob.bids, 0)
+}
+
+// LastPrice returns the price of the last trade, zero if there was none.
+func (ob *Orderbook) LastPrice() float64 {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if len(ob.Trades) == 0 {
+		return 0
+	}
+	return ob.Trades[len(ob.Trades)-1].Price
+}
+
+// sortedAsks sorts the ask levels of the book in place, the book must be
+// locked for writing.
+func (ob *Orderbook) sortedAsks() []*Limit {
 	sort.Sort(ByBestAsk{ob.asks})
 	return ob.asks
 }
 
-// Bids returns the bid orders sorted by price.
-func (ob *Orderbook) Bids() []*Limit {
+// sortedBids sorts the bid levels of the book in place, the book must be
+// locked for writing.
+func (ob *Orderbook) sortedBids() []*Limit {
 	sort.Sort(ByBestBid{ob.bids})
 	return ob.bids
 }
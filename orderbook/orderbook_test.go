@@ -2,8 +2,11 @@ package orderbook
 
 import (
 	"fmt"
+	"math"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 // assert is a helper function for testing that checks if two values are deeply equal.
@@ -54,6 +57,152 @@ func TestLimit(t *testing.T) {
 	l.DeleteOrder(buyOrderB)
 
 	fmt.Println(l)
+
+	// The other orders keep their place in the queue, even with equal timestamps
+	assert(t, l.Orders, Orders{buyOrderA, buyOrderC})
+	assert(t, l.TotalVolume, 15.0)
+
+	buyOrderD := &Order{ID: 4, Bid: true, Size: 1, Timestamp: buyOrderC.Timestamp}
+	l.AddOrder(buyOrderD)
+	l.DeleteOrder(buyOrderA)
+	assert(t, l.Orders, Orders{buyOrderC, buyOrderD})
+}
+
+// rounded rounds sizes to get rid of floating point errors in comparisons.
+func rounded(sizes []float64) []float64 {
+	for i, size := range sizes {
+		sizes[i] = math.Round(size*1e9) / 1e9
+	}
+	return sizes
+}
+
+func restingOrders(sizes ...float64) Orders {
+	orders := Orders{}
+	for i, size := range sizes {
+		orders = append(orders, &Order{ID: int64(i + 1), Size: size, Timestamp: int64(i)})
+	}
+	return orders
+}
+
+func TestFIFOAllocation(t *testing.T) {
+	orders := restingOrders(5, 3, 2)
+
+	// The oldest orders are filled first
+	assert(t, FIFO{}.Allocate(orders, 6), []float64{5, 1, 0})
+	assert(t, FIFO{}.Allocate(orders, 20), []float64{5, 3, 2})
+}
+
+func TestProRataAllocation(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ProRata
+		orders Orders
+		size   float64
+		want   []float64
+	}{
+		// 3, 1.5 and 0.5 round down to 3, 1 and 0, the oldest order gets the remaining lot
+		{"rounding remainder", ProRata{Lot: 1}, restingOrders(6, 3, 1), 5, []float64{4, 1, 0}},
+		// The top order is filled first, the rest is split over 8
+		{"top order", ProRata{TopOrder: true, Lot: 1}, restingOrders(2, 6, 2), 6, []float64{2, 3, 1}},
+		// The allocation of 1 is below the minimum and goes to the oldest order
+		{"min allocation", ProRata{MinAllocation: 2, Lot: 1}, restingOrders(6, 3, 1), 5, []float64{5, 0, 0}},
+		{"fractional lots", ProRata{Lot: 0.1}, restingOrders(1, 1, 1), 1, []float64{0.4, 0.3, 0.3}},
+		{"default lot", ProRata{}, restingOrders(1, 3), 1, []float64{0.25, 0.75}},
+		{"larger than the level", ProRata{TopOrder: true}, restingOrders(2, 1), 5, []float64{2, 1}},
+		{"empty level", ProRata{}, Orders{}, 5, []float64{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sizes := test.policy.Allocate(test.orders, test.size)
+			assert(t, rounded(sizes), test.want)
+		})
+	}
+}
+
+func TestProRataMatching(t *testing.T) {
+	ob := NewOrderbook()
+	ob.SetMatchingPolicy(ProRata{TopOrder: true, Lot: 0.5})
+
+	a := &Order{ID: 1, Size: 1, Timestamp: 1}
+	b := &Order{ID: 2, Size: 4, Timestamp: 2}
+	c := &Order{ID: 3, Size: 2, Timestamp: 3}
+	for _, o := range []*Order{a, b, c} {
+		ob.PlaceLimitOrder(100, o)
+	}
+
+	// The top order is filled first, the other 3 are split 2 to 1 between b and c
+	matches := ob.PlaceMarketOrder(&Order{ID: 4, Bid: true, Size: 4})
+	sizes := map[int64]float64{}
+	for _, m := range matches {
+		sizes[m.Ask.ID] = m.SizeFilled
+	}
+	assert(t, sizes, map[int64]float64{1: 1, 2: 2, 3: 1})
+
+	// The filled order left the queue, the others kept their place
+	assert(t, ob.AskLimits[100].Orders, Orders{b, c})
+	assert(t, ob.AskTotalVolume(), 3.0)
+	assert(t, b.Status, StatusPartiallyFilled)
+}
+
+// bookWithAsks returns a book with asks of 2 at 100, 2 at 101 and 5 at 105.
+func bookWithAsks() *Orderbook {
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(100, &Order{ID: 1, Size: 2})
+	ob.PlaceLimitOrder(101, &Order{ID: 2, Size: 2})
+	ob.PlaceLimitOrder(105, &Order{ID: 3, Size: 5})
+	return ob
+}
+
+func TestMarketOrderProtection(t *testing.T) {
+	// The order stops at the worst price and the rest expires
+	ob := bookWithAsks()
+	o := &Order{ID: 4, Bid: true, Size: 5}
+	matches := ob.PlaceMarketOrderWith(o, MarketOptions{WorstPrice: 102})
+	assert(t, ConsumedLevels(matches), []Level{{Price: 100, Size: 2, Orders: 1}, {Price: 101, Size: 2, Orders: 1}})
+	assert(t, o.Filled, 4.0)
+	assert(t, o.AvgPrice, 100.5)
+	assert(t, o.Status, StatusExpired)
+	assert(t, ob.AskTotalVolume(), 5.0)
+
+	// 1% slippage from 100 stops at 101, the tighter worst price at 100.5
+	ob = bookWithAsks()
+	o = &Order{ID: 4, Bid: true, Size: 5}
+	ob.PlaceMarketOrderWith(o, MarketOptions{MaxSlippage: 0.01})
+	assert(t, o.Filled, 4.0)
+
+	ob = bookWithAsks()
+	o = &Order{ID: 4, Bid: true, Size: 5}
+	ob.PlaceMarketOrderWith(o, MarketOptions{MaxSlippage: 0.01, WorstPrice: 100.5})
+	assert(t, o.Filled, 2.0)
+
+	// Sell orders slip downwards: 2% from 100 stops at 98
+	ob = NewOrderbook()
+	ob.PlaceLimitOrder(100, &Order{ID: 1, Bid: true, Size: 1})
+	ob.PlaceLimitOrder(95, &Order{ID: 2, Bid: true, Size: 1})
+	o = &Order{ID: 3, Size: 2}
+	ob.PlaceMarketOrderWith(o, MarketOptions{MaxSlippage: 0.02})
+	assert(t, o.Filled, 1.0)
+	assert(t, o.Status, StatusExpired)
+}
+
+func TestQuoteMarketOrder(t *testing.T) {
+	// Spending 301 buys 2 at 100 and 1 at 101
+	ob := bookWithAsks()
+	o := &Order{ID: 4, Bid: true}
+	matches := ob.PlaceMarketOrderWith(o, MarketOptions{Quote: 301})
+	assert(t, len(matches), 2)
+	assert(t, o.OriginalSize, 3.0)
+	assert(t, o.Filled, 3.0)
+	assert(t, o.AvgPrice, 301.0/3)
+	assert(t, o.Status, StatusFilled)
+
+	// What can't be spent within the protection expires
+	ob = bookWithAsks()
+	o = &Order{ID: 4, Bid: true}
+	ob.PlaceMarketOrderWith(o, MarketOptions{Quote: 2000, WorstPrice: 101})
+	assert(t, o.Filled, 4.0)
+	assert(t, o.Status, StatusExpired)
 }
 
 func TestPlaceLimitOrder(t *testing.T) {
@@ -170,3 +319,449 @@ func TestCancelOrderBid(t *testing.T) {
 	_, ok = ob.BidLimits[price]
 	assert(t, ok, false)
 }
+
+// fixedFees charges a fixed rate on the filled size of every match.
+type fixedFees struct{ maker, taker float64 }
+
+func (f fixedFees) ChargeFees(m Match, taker *Order, now time.Time) (float64, float64) {
+	return m.SizeFilled * f.maker, m.SizeFilled * f.taker
+}
+
+func TestPlaceMarketOrderFees(t *testing.T) {
+	// Create a new order book that charges fees on every match
+	ob := NewOrderbook()
+	ob.SetFeeCharger(fixedFees{maker: -0.5, taker: 1})
+
+	// Create a sell order and place it in the order book
+	sellOrder := NewOrder(false, 10, 0)
+	ob.PlaceLimitOrder(10_000, sellOrder)
+
+	// Create a buy order and place it as a market order
+	buyOrder := NewOrder(true, 4, 0)
+	matches := ob.PlaceMarketOrder(buyOrder)
+
+	// Check that the fees are reported on the match and the trade
+	assert(t, len(matches), 1)
+	assert(t, matches[0].MakerFee, -2.0)
+	assert(t, matches[0].TakerFee, 4.0)
+	assert(t, ob.Trades[0].MakerFee, -2.0)
+	assert(t, ob.Trades[0].TakerFee, 4.0)
+}
+
+func TestCircuitBreakerHalt(t *testing.T) {
+	// Create a new order book with a 10% price band
+	ob := NewOrderbook()
+	ob.SetCircuitBreaker(CircuitBreaker{Band: 0.1, Window: time.Minute})
+
+	// Place sell orders with the last level outside of the band
+	ob.PlaceLimitOrder(100, NewOrder(false, 1, 0))
+	ob.PlaceLimitOrder(105, NewOrder(false, 1, 0))
+	ob.PlaceLimitOrder(120, NewOrder(false, 5, 0))
+
+	// The market order stops before the level that breaches the band
+	buyOrder := NewOrder(true, 7, 0)
+	matches := ob.PlaceMarketOrder(buyOrder)
+	assert(t, len(matches), 2)
+	assert(t, buyOrder.Size, 5.0)
+	assert(t, ob.AskTotalVolume(), 5.0)
+
+	// While halted market orders don't match but cancels are accepted
+	if ob.Halted() == nil {
+		t.Fatal("expected order book to be halted")
+	}
+	assert(t, len(ob.PlaceMarketOrder(NewOrder(true, 1, 0))), 0)
+
+	sellOrder := NewOrder(false, 1, 0)
+	ob.PlaceLimitOrder(110, sellOrder)
+	ob.CancelOrder(sellOrder)
+
+	// Once resumed the order book matches again
+	ob.Resume()
+	assert(t, ob.Halted() == nil, true)
+	assert(t, len(ob.PlaceMarketOrder(NewOrder(true, 1, 0))), 0)
+	assert(t, ob.Halted() != nil, true)
+}
+
+func TestCircuitBreakerReopens(t *testing.T) {
+	// Create a new order book that reopens right after a halt
+	ob := NewOrderbook()
+	ob.SetCircuitBreaker(CircuitBreaker{Band: 0.1, Window: time.Minute, HaltDuration: time.Millisecond})
+
+	ob.PlaceLimitOrder(100, NewOrder(false, 1, 0))
+	ob.PlaceLimitOrder(200, NewOrder(false, 1, 0))
+
+	matches := ob.PlaceMarketOrder(NewOrder(true, 2, 0))
+	assert(t, len(matches), 1)
+	assert(t, ob.Halted() != nil, true)
+
+	// The book reopens once the halt expired
+	ob.Tick(time.Now().Add(time.Second))
+	assert(t, ob.Halted() == nil, true)
+	assert(t, ob.State(), StateContinuous)
+}
+
+func TestAuctionUncross(t *testing.T) {
+	// Create a new order book in a call auction
+	ob := NewOrderbook()
+	ob.SetState(StateAuction)
+
+	// Place crossing orders, they accumulate without matching
+	bidA := NewOrder(true, 5, 0)
+	bidB := NewOrder(true, 5, 0)
+	askA := NewOrder(false, 3, 0)
+	askB := NewOrder(false, 4, 0)
+	askC := NewOrder(false, 5, 0)
+	ob.PlaceLimitOrder(101, bidA)
+	ob.PlaceLimitOrder(100, bidB)
+	ob.PlaceLimitOrder(99, askA)
+	ob.PlaceLimitOrder(100, askB)
+	ob.PlaceLimitOrder(102, askC)
+	assert(t, len(ob.PlaceMarketOrder(NewOrder(true, 1, 0))), 0)
+
+	// 100 maximizes the executed volume
+	assert(t, ob.Indicative(), Indicative{Price: 100, Volume: 7, Imbalance: 3})
+
+	// Uncrossing executes every crossing order at the clearing price
+	matches, err := ob.SetState(StateContinuous)
+	assert(t, err, nil)
+	assert(t, ob.State(), StateContinuous)
+	assert(t, len(matches), 3)
+	for _, match := range matches {
+		assert(t, match.Price, 100.0)
+	}
+	assert(t, ob.BidTotalVolume(), 3.0)
+	assert(t, ob.AskTotalVolume(), 5.0)
+	assert(t, bidB.Size, 3.0)
+	assert(t, len(ob.Trades), 3)
+	assert(t, ob.Indicative().Volume, 0.0)
+}
+
+func TestAuctionUncrossPolicy(t *testing.T) {
+	// The last level executed is allocated by the matching policy
+	ob := NewOrderbook()
+	ob.SetMatchingPolicy(ProRata{Lot: 1})
+	ob.SetState(StateAuction)
+
+	bids := []*Order{NewOrder(true, 6, 0), NewOrder(true, 3, 0), NewOrder(true, 1, 0)}
+	for _, bid := range bids {
+		ob.PlaceLimitOrder(100, bid)
+	}
+	ob.PlaceLimitOrder(100, NewOrder(false, 5, 0))
+
+	_, err := ob.SetState(StateContinuous)
+	assert(t, err, nil)
+	assert(t, bids[0].Size, 2.0)
+	assert(t, bids[1].Size, 2.0)
+	assert(t, bids[2].Size, 1.0)
+	assert(t, ob.BidTotalVolume(), 5.0)
+	assert(t, ob.AskTotalVolume(), 0.0)
+}
+
+func TestAuctionUncrossDust(t *testing.T) {
+	// Float residue doesn't leave orders or volume behind
+	ob := NewOrderbook()
+	ob.SetState(StateAuction)
+
+	bid := NewOrder(true, 0.3, 0)
+	ob.PlaceLimitOrder(100, bid)
+	ob.PlaceLimitOrder(100, NewOrder(false, 0.1, 0))
+	ob.PlaceLimitOrder(100, NewOrder(false, 0.2, 0))
+
+	matches, err := ob.SetState(StateContinuous)
+	assert(t, err, nil)
+	assert(t, len(matches), 2)
+	assert(t, bid.IsFilled(), true)
+	assert(t, len(ob.Orders), 0)
+	assert(t, len(ob.Bids()), 0)
+	assert(t, len(ob.Asks()), 0)
+	assert(t, ob.BidTotalVolume(), 0.0)
+	assert(t, ob.AskTotalVolume(), 0.0)
+}
+
+func TestAuctionTieBreak(t *testing.T) {
+	// Equal volume and imbalance at 99 and 101, the lower price wins
+	ob := NewOrderbook()
+	ob.SetState(StatePreOpen)
+	ob.PlaceLimitOrder(101, NewOrder(true, 5, 0))
+	ob.PlaceLimitOrder(99, NewOrder(false, 5, 0))
+	assert(t, ob.Indicative(), Indicative{Price: 99, Volume: 5})
+
+	// With a last traded price the closest price wins
+	ob.Trades = append(ob.Trades, &Trade{Price: 102})
+	assert(t, ob.Indicative().Price, 101.0)
+}
+
+func TestReopenAuction(t *testing.T) {
+	// Create a new order book that reopens through a one minute auction
+	ob := NewOrderbook()
+	ob.SetReopenAuction(time.Minute)
+	ob.Halt("maintenance")
+	assert(t, ob.State(), StateHalted)
+
+	// Orders placed while halted cross once the book reopens
+	ob.PlaceLimitOrder(100, NewOrder(true, 2, 0))
+	ob.PlaceLimitOrder(100, NewOrder(false, 1, 0))
+
+	assert(t, len(ob.Resume()), 0)
+	assert(t, ob.State(), StateAuction)
+	assert(t, len(ob.Tick(time.Now())), 0)
+
+	matches := ob.Tick(time.Now().Add(2 * time.Minute))
+	assert(t, len(matches), 1)
+	assert(t, ob.State(), StateContinuous)
+}
+
+func TestClosedRejectsOrders(t *testing.T) {
+	ob := NewOrderbook()
+	order := NewOrder(true, 1, 0)
+	ob.PlaceLimitOrder(100, order)
+
+	ob.SetState(StateClosed)
+	assert(t, ob.PlaceLimitOrder(100, NewOrder(true, 1, 0)), ErrMarketClosed)
+
+	// Cancels are still accepted
+	ob.CancelOrder(order)
+	assert(t, ob.BidTotalVolume(), 0.0)
+}
+
+func TestAmendOrder(t *testing.T) {
+	ob := NewOrderbook()
+	orderA := NewOrder(false, 5, 0)
+	orderB := NewOrder(false, 5, 0)
+	ob.PlaceLimitOrder(100, orderA)
+	ob.PlaceLimitOrder(100, orderB)
+
+	// Reducing the size keeps the place in the queue
+	assert(t, ob.AmendOrder(orderA, 100, 2, time.Now().UnixNano()), nil)
+	assert(t, ob.AskTotalVolume(), 7.0)
+	assert(t, ob.AskLimits[100].Orders[0], orderA)
+
+	// Increasing the size moves the order to the back of the queue
+	assert(t, ob.AmendOrder(orderA, 100, 6, time.Now().UnixNano()), nil)
+	assert(t, ob.AskTotalVolume(), 11.0)
+	assert(t, ob.AskLimits[100].Orders[1], orderA)
+
+	// Changing the price moves the order to its new level
+	assert(t, ob.AmendOrder(orderB, 101, 5, time.Now().UnixNano()), nil)
+	assert(t, len(ob.AskLimits[100].Orders), 1)
+	assert(t, ob.AskLimits[101].Orders[0], orderB)
+	assert(t, ob.AskTotalVolume(), 11.0)
+
+	ob.CancelOrder(orderB)
+	assert(t, ob.AmendOrder(orderB, 101, 1, time.Now().UnixNano()), ErrOrderNotResting)
+}
+
+func TestOrderLifecycle(t *testing.T) {
+	ob := NewOrderbook()
+	sellOrderA := NewOrder(false, 4, 1)
+	sellOrderB := NewOrder(false, 4, 2)
+	ob.PlaceLimitOrder(100, sellOrderA)
+	ob.PlaceLimitOrder(110, sellOrderB)
+	assert(t, sellOrderA.Status, StatusNew)
+	assert(t, sellOrderA.OriginalSize, 4.0)
+
+	// A partial fill keeps the original size and tracks the average price
+	buyOrder := NewOrder(true, 6, 3)
+	ob.PlaceMarketOrder(buyOrder)
+	assert(t, buyOrder.Status, StatusFilled)
+	assert(t, buyOrder.Filled, 6.0)
+	assert(t, buyOrder.AvgPrice, (4*100+2*110)/6.0)
+	assert(t, sellOrderA.Status, StatusFilled)
+	assert(t, sellOrderB.Status, StatusPartiallyFilled)
+	assert(t, sellOrderB.Filled, 2.0)
+	assert(t, sellOrderB.OriginalSize, 4.0)
+
+	// Amending changes the original size of the order, not its fills
+	assert(t, ob.AmendOrder(sellOrderB, 110, 1, time.Now().UnixNano()), nil)
+	assert(t, sellOrderB.OriginalSize, 3.0)
+	assert(t, sellOrderB.Status, StatusPartiallyFilled)
+
+	ob.CancelOrder(sellOrderB)
+	assert(t, sellOrderB.Status, StatusCanceled)
+
+	// Market orders the book doesn't accept expire unfilled
+	_, err := ob.SetState(StateAuction)
+	assert(t, err, nil)
+	marketOrder := NewOrder(true, 2, 4)
+	ob.PlaceMarketOrder(marketOrder)
+	assert(t, marketOrder.Status, StatusExpired)
+	assert(t, marketOrder.Filled, 0.0)
+}
+
+func TestDepth(t *testing.T) {
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(99, NewOrder(true, 1, 1))
+	ob.PlaceLimitOrder(100, NewOrder(true, 2, 1))
+	ob.PlaceLimitOrder(100, NewOrder(true, 3, 2))
+	ob.PlaceLimitOrder(98, NewOrder(true, 4, 3))
+	ob.PlaceLimitOrder(102, NewOrder(false, 5, 4))
+	ob.PlaceLimitOrder(101, NewOrder(false, 6, 5))
+
+	// Levels are aggregated, best first
+	depth := ob.Depth(2)
+	assert(t, depth.Bids, []Level{{Price: 100, Size: 5, Orders: 2}, {Price: 99, Size: 1, Orders: 1}})
+	assert(t, depth.Asks, []Level{{Price: 101, Size: 6, Orders: 1}, {Price: 102, Size: 5, Orders: 1}})
+	assert(t, len(ob.Depth(0).Bids), 3)
+
+	bids, asks := ob.DepthOrders(1)
+	assert(t, len(bids), 1)
+	assert(t, bids[0].Orders[1].UserID, int64(2))
+	assert(t, asks[0].Price, 101.0)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	ob := NewOrderbook()
+	buyOrderA := NewOrder(true, 5, 1)
+	buyOrderB := NewOrder(true, 3, 2)
+	sellOrder := NewOrder(false, 4, 3)
+	ob.PlaceLimitOrder(100, buyOrderA)
+	ob.PlaceLimitOrder(100, buyOrderB)
+	ob.PlaceLimitOrder(110, sellOrder)
+	ob.PlaceMarketOrder(NewOrder(true, 1, 4))
+
+	s := ob.Snapshot()
+	assert(t, len(s.Bids), 1)
+	assert(t, s.Bids[0].Orders[1].ID, buyOrderB.ID)
+	assert(t, s.Bids[0].Orders[1].Position, 1)
+	assert(t, s.LastTrade.Price, 110.0)
+
+	// The restored book continues where the snapshot was taken
+	restored := NewOrderbook()
+	restored.Restore(s)
+	assert(t, restored.Snapshot(), s)
+	assert(t, restored.BidTotalVolume(), 8.0)
+	assert(t, restored.AskTotalVolume(), 3.0)
+	assert(t, restored.Orders[buyOrderA.ID].Limit.Price, 100.0)
+
+	matches := restored.PlaceMarketOrder(NewOrder(false, 6, 5))
+	assert(t, len(matches), 2)
+	assert(t, matches[0].Bid.ID, buyOrderA.ID)
+	assert(t, restored.BidTotalVolume(), 2.0)
+}
+
+func TestTradeHistoryBounded(t *testing.T) {
+	ob := NewOrderbook()
+	for i := 0; i < TradeHistory+5; i++ {
+		ob.PlaceLimitOrder(100, NewOrder(false, 1, 0))
+		ob.PlaceMarketOrder(&Order{ID: int64(i), Bid: true, Size: 1, Timestamp: int64(i)})
+	}
+
+	// Only the most recent trades are kept
+	assert(t, len(ob.Trades), TradeHistory)
+}
+
+func TestInjectedClockAndIDs(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ids := NewSequentialIDs(41)
+
+	order := NewOrderWith(ids, FixedClock(now), false, 5, 1)
+	assert(t, order.ID, int64(42))
+	assert(t, order.Timestamp, now.UnixNano())
+
+	// Trades are stamped with the time of the order book's clock
+	ob := NewOrderbook()
+	ob.SetClock(FixedClock(now.Add(time.Minute)))
+	ob.PlaceLimitOrder(100, order)
+	ob.PlaceMarketOrder(NewOrderWith(ids, FixedClock(now), true, 2, 2))
+	assert(t, ob.Trades[0].Timestamp, now.Add(time.Minute).UnixNano())
+	assert(t, ob.Trades[0].AskOrderID, order.ID)
+	assert(t, ob.Trades[0].BidUserID, int64(2))
+
+	// The same seed generates the same IDs
+	a, b := NewRandomIDs(7), NewRandomIDs(7)
+	assert(t, a.NextID(), b.NextID())
+}
+
+func TestConcurrentCommandsAndReads(t *testing.T) {
+	ob := NewOrderbook()
+
+	// Deep levels the taker can't exhaust
+	ob.PlaceLimitOrder(90, NewOrder(true, 1000, 0))
+	ob.PlaceLimitOrder(110, NewOrder(false, 1000, 0))
+
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+
+	// Makers place orders and cancel every other one
+	for w := 1; w <= 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				order := NewOrder(w%2 == 0, 1, int64(w))
+				price := 100 - float64(i%5)
+				if !order.Bid {
+					price = 101 + float64(i%5)
+				}
+				ob.PlaceLimitOrder(price, order)
+				if i%2 == 0 {
+					ob.CancelOrder(order)
+				}
+			}
+		}(w)
+	}
+
+	// A taker matches both sides
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			ob.PlaceMarketOrder(NewOrder(i%2 == 0, 0.5, 5))
+		}
+	}()
+
+	// Readers run until the writers are done
+	var readers sync.WaitGroup
+	for r := 0; r < 2; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				ob.Depth(5)
+				ob.DepthOrders(5)
+				ob.Best(true)
+				ob.Snapshot()
+				ob.BidTotalVolume()
+				ob.LastPrice()
+				for _, limit := range ob.Asks() {
+					_ = limit.Price
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	// Every level holds the volume of its orders and the book the volume of
+	// its levels
+	bids, asks := ob.DepthOrders(0)
+	total := 0.0
+	for _, level := range append(bids, asks...) {
+		volume := 0.0
+		for _, order := range level.Orders {
+			volume += order.Size
+		}
+		assert(t, fmt.Sprintf("%.2f", level.Volume), fmt.Sprintf("%.2f", volume))
+		total += level.Volume
+	}
+	assert(t, fmt.Sprintf("%.2f", ob.BidTotalVolume()+ob.AskTotalVolume()), fmt.Sprintf("%.2f", total))
+	assert(t, len(ob.Orders), countOrders(bids)+countOrders(asks))
+}
+
+func countOrders(levels []LevelSnapshot) int {
+	n := 0
+	for _, level := range levels {
+		n += len(level.Orders)
+	}
+	return n
+}
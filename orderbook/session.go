@@ -0,0 +1,371 @@
+package orderbook
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// State is the trading session state of an order book.
+type State string
+
+const (
+	// StateClosed accepts no new orders, only cancels.
+	StateClosed State = "CLOSED"
+	// StatePreOpen accepts limit orders without matching them.
+	StatePreOpen State = "PRE_OPEN"
+	// StateAuction accepts limit orders without matching them and publishes
+	// the indicative price until the book is uncrossed.
+	StateAuction State = "AUCTION"
+	// StateContinuous matches market orders against the book.
+	StateContinuous State = "CONTINUOUS"
+	// StateHalted stops matching after the circuit breaker tripped or an admin halted the book.
+	StateHalted State = "HALTED"
+)
+
+var (
+	// ErrMarketClosed is returned for orders placed in a closed order book.
+	ErrMarketClosed = errors.New("market is closed")
+	// ErrOrderNotResting is returned when amending an order that isn't in the book.
+	ErrOrderNotResting = errors.New("order is not resting in the book")
+)
+
+// Indicative is the price and volume an auction would uncross at right now.
+type Indicative struct {
+	Price     float64
+	Volume    float64
+	Imbalance float64
+}
+
+// State returns the session state of the order book.
+func (ob *Orderbook) State() State {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.state
+}
+
+// SetReopenAuction sets how long the call auction that reopens the book after
+// a halt runs. Zero uncrosses the book as soon as it reopens.
+func (ob *Orderbook) SetReopenAuction(d time.Duration) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.reopenAuction = d
+}
+
+// SetState moves the order book to the given state. Moving from a non
+// continuous state to StateContinuous uncrosses the book, and the resulting
+// matches are returned.
+func (ob *Orderbook) SetState(state State) ([]Match, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	now := ob.clock.Now()
+
+	switch state {
+	case StateClosed, StatePreOpen:
+		ob.halted = nil
+		ob.auctionEnd = time.Time{}
+		ob.state = state
+	case StateAuction:
+		ob.halted = nil
+		ob.startAuction(time.Time{})
+	case StateHalted:
+		ob.halt("halted by state change", now, 0)
+	case StateContinuous:
+		ob.halted = nil
+		if ob.state == StateContinuous {
+			return nil, nil
+		}
+		return ob.open(now), nil
+	default:
+		return nil, fmt.Errorf("unknown state %q", state)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"state": state,
+	}).Info("order book state changed")
+
+	return nil, nil
+}
+
+// StartAuction moves the order book into a call auction that uncrosses at
+// end on Tick, or runs until the state is changed if end is zero.
+func (ob *Orderbook) StartAuction(end time.Time) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.halted = nil
+	ob.startAuction(end)
+}
+
+// AuctionEnd returns when the running call auction ends, zero when the book
+// isn't in an auction or the auction has no end.
+func (ob *Orderbook) AuctionEnd() time.Time {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.auctionEnd
+}
+
+// Tick runs the timed state transitions of the order book: halts that expire
+// start the reopening auction and auctions that end uncross the book.
+func (ob *Orderbook) Tick(now time.Time) []Match {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	switch ob.state {
+	case StateHalted:
+		if ob.halted != nil && !ob.halted.Until.IsZero() && !now.Before(ob.halted.Until) {
+			return ob.reopen(now)
+		}
+	case StateAuction:
+		if !ob.auctionEnd.IsZero() && !now.Before(ob.auctionEnd) {
+			return ob.open(now)
+		}
+	}
+
+	return nil
+}
+
+// Next returns the state Tick would move the order book to at now, with the
+// end of the auction it starts, without running the transition. It returns
+// the current state if no transition is due.
+func (ob *Orderbook) Next(now time.Time) (State, time.Time) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	switch ob.state {
+	case StateHalted:
+		if ob.halted != nil && !ob.halted.Until.IsZero() && !now.Before(ob.halted.Until) {
+			if ob.reopenAuction > 0 {
+				return StateAuction, now.Add(ob.reopenAuction)
+			}
+			return StateContinuous, time.Time{}
+		}
+	case StateAuction:
+		if !ob.auctionEnd.IsZero() && !now.Before(ob.auctionEnd) {
+			return StateContinuous, time.Time{}
+		}
+	}
+
+	return ob.state, ob.auctionEnd
+}
+
+// Indicative returns the price and volume the book would uncross at.
+func (ob *Orderbook) Indicative() Indicative {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	return ob.indicative()
+}
+
+// startAuction moves the book into a call auction ending at end, or running
+// until the state is changed if end is zero.
+func (ob *Orderbook) startAuction(end time.Time) {
+	ob.state = StateAuction
+	ob.auctionEnd = end
+
+	logrus.WithFields(logrus.Fields{
+		"end": ob.auctionEnd,
+	}).Info("starting call auction")
+}
+
+// open uncrosses the book and starts continuous matching.
+func (ob *Orderbook) open(now time.Time) []Match {
+	matches := ob.uncross(now)
+	ob.state = StateContinuous
+	ob.auctionEnd = time.Time{}
+
+	logrus.WithFields(logrus.Fields{
+		"matches": len(matches),
+	}).Info("order book open for continuous matching")
+
+	return matches
+}
+
+// indicative computes the clearing price that maximizes the executed volume.
+// Ties are broken by the smallest imbalance, then by the distance to the last
+// traded price, then by the lowest price.
+func (ob *Orderbook) indicative() Indicative {
+	var (
+		best = Indicative{}
+		ref  = 0.0
+	)
+
+	if len(ob.Trades) > 0 {
+		ref = ob.Trades[len(ob.Trades)-1].Price
+	}
+
+	for _, price := range ob.candidatePrices() {
+		demand, supply := 0.0, 0.0
+		for _, l := range ob.bids {
+			if l.Price >= price {
+				demand += l.TotalVolume
+			}
+		}
+		for _, l := range ob.asks {
+			if l.Price <= price {
+				supply += l.TotalVolume
+			}
+		}
+
+		c := Indicative{
+			Price:     price,
+			Volume:    math.Min(demand, supply),
+			Imbalance: demand - supply,
+		}
+		if c.Volume == 0 {
+			continue
+		}
+
+		if best.Volume == 0 || betterClearing(c, best, ref) {
+			best = c
+		}
+	}
+
+	return best
+}
+
+func betterClearing(c, best Indicative, ref float64) bool {
+	if c.Volume != best.Volume {
+		return c.Volume > best.Volume
+	}
+	if ci, bi := math.Abs(c.Imbalance), math.Abs(best.Imbalance); ci != bi {
+		return ci < bi
+	}
+	if ref > 0 {
+		if cd, bd := math.Abs(c.Price-ref), math.Abs(best.Price-ref); cd != bd {
+			return cd < bd
+		}
+	}
+	return c.Price < best.Price
+}
+
+// candidatePrices returns the prices of every level in the book.
+func (ob *Orderbook) candidatePrices() []float64 {
+	prices := make([]float64, 0, len(ob.bids)+len(ob.asks))
+	for _, l := range ob.bids {
+		prices = append(prices, l.Price)
+	}
+	for _, l := range ob.asks {
+		prices = append(prices, l.Price)
+	}
+	return prices
+}
+
+// uncross executes every crossing order at the single clearing price, in
+// price priority. The orders of the last level executed on each side are
+// allocated by the matching policy. The order that arrived last is the
+// taker of a match.
+func (ob *Orderbook) uncross(now time.Time) []Match {
+	ind := ob.indicative()
+	if ind.Volume == 0 {
+		return nil
+	}
+
+	var (
+		matches        = []Match{}
+		bids, bidSizes = auctionFills(ob.sortedBids(), true, ind, ob.policy)
+		asks, askSizes = auctionFills(ob.sortedAsks(), false, ind, ob.policy)
+	)
+
+	for i, j := 0, 0; i < len(bids) && j < len(asks); {
+		bid, ask := bids[i], asks[j]
+		size := math.Min(bidSizes[i], askSizes[j])
+
+		bidSizes[i] -= size
+		askSizes[j] -= size
+		if bidSizes[i] < Dust {
+			i++
+		}
+		if askSizes[j] < Dust {
+			j++
+		}
+
+		taker := bid
+		if ask.Timestamp > bid.Timestamp {
+			taker = ask
+		}
+
+		match := Match{
+			Bid:        bid,
+			Ask:        ask,
+			SizeFilled: size,
+			Price:      ind.Price,
+			TakerBid:   taker.Bid,
+		}
+		if ob.fees != nil {
+			match.MakerFee, match.TakerFee = ob.fees.ChargeFees(match, taker, now)
+		}
+		matches = append(matches, match)
+
+		ob.auctionFill(bid, size, ind.Price)
+		ob.auctionFill(ask, size, ind.Price)
+
+		ob.addTrade(newTrade(match, now))
+		ob.recordPrice(match.Price, now)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"price":  ind.Price,
+		"volume": ind.Volume,
+	}).Info("uncrossed order book")
+
+	return matches
+}
+
+// auctionFills returns the orders of the bid or ask levels, sorted best
+// first, that an auction clearing at ind fills, with the size of each of
+// them. Levels are filled in full until the one the volume ends in, whose
+// orders are allocated by policy.
+func auctionFills(levels []*Limit, bid bool, ind Indicative, policy MatchingPolicy) ([]*Order, []float64) {
+	var (
+		orders    = []*Order{}
+		sizes     = []float64{}
+		remaining = ind.Volume
+	)
+
+	for _, l := range levels {
+		if remaining < Dust || (bid && l.Price < ind.Price) || (!bid && l.Price > ind.Price) {
+			break
+		}
+
+		allocs := policy.Allocate(l.Orders, remaining)
+		for i, o := range l.Orders {
+			if allocs[i] <= 0 {
+				continue
+			}
+			orders = append(orders, o)
+			sizes = append(sizes, allocs[i])
+			remaining -= allocs[i]
+		}
+	}
+
+	return orders, sizes
+}
+
+// auctionFill fills size of a resting order at price, taking what is left of
+// the order and its level down to dust off the book.
+func (ob *Orderbook) auctionFill(o *Order, size, price float64) {
+	l := o.Limit
+	before := o.Size
+
+	o.Size = sizeLeft(o.Size, size)
+	o.fill(size, price)
+	l.TotalVolume = sizeLeft(l.TotalVolume, before-o.Size)
+
+	if !o.IsFilled() {
+		return
+	}
+
+	l.DeleteOrder(o)
+	delete(ob.Orders, o.ID)
+	if len(l.Orders) == 0 {
+		ob.clearLimit(o.Bid, l)
+	}
+}
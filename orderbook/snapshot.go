@@ -0,0 +1,166 @@
+package orderbook
+
+import "time"
+
+// Snapshot is a copy of the state of an order book. Levels are sorted best
+// price first.
+type Snapshot struct {
+	State      State
+	Halt       *Halt     `json:",omitempty"`
+	AuctionEnd time.Time `json:",omitempty"`
+	Bids       []LevelSnapshot
+	Asks       []LevelSnapshot
+	LastTrade  *Trade `json:",omitempty"`
+	// Prices is the traded price history of the circuit breaker.
+	Prices []PriceSnapshot `json:",omitempty"`
+}
+
+// LevelSnapshot is a price level of a snapshot.
+type LevelSnapshot struct {
+	Price  float64
+	Volume float64
+	Orders []OrderSnapshot
+}
+
+// OrderSnapshot is a resting order of a snapshot.
+type OrderSnapshot struct {
+	ID     int64
+	UserID int64
+	Size   float64
+	// Position is the place of the order in the queue of its level, 0 is
+	// the first to fill.
+	Position  int
+	Timestamp int64
+	// OriginalSize, Filled and AvgPrice keep the fills of partially
+	// filled orders.
+	OriginalSize float64 `json:",omitempty"`
+	Filled       float64 `json:",omitempty"`
+	AvgPrice     float64 `json:",omitempty"`
+}
+
+// PriceSnapshot is a traded price at a point in time.
+type PriceSnapshot struct {
+	Price float64
+	Time  time.Time
+}
+
+// Snapshot returns a copy of the state of the order book. It only holds the
+// lock of the book while copying.
+func (ob *Orderbook) Snapshot() Snapshot {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	s := Snapshot{
+		State:      ob.state,
+		AuctionEnd: ob.auctionEnd,
+		Bids:       snapshotLevels(ob.sortedBids()),
+		Asks:       snapshotLevels(ob.sortedAsks()),
+	}
+
+	if ob.halted != nil {
+		halt := *ob.halted
+		s.Halt = &halt
+	}
+	if len(ob.Trades) > 0 {
+		trade := *ob.Trades[len(ob.Trades)-1]
+		s.LastTrade = &trade
+	}
+	for _, p := range ob.priceHistory {
+		s.Prices = append(s.Prices, PriceSnapshot{Price: p.price, Time: p.time})
+	}
+
+	return s
+}
+
+func snapshotLevels(limits []*Limit) []LevelSnapshot {
+	levels := make([]LevelSnapshot, 0, len(limits))
+	for _, limit := range limits {
+		level := LevelSnapshot{
+			Price:  limit.Price,
+			Volume: limit.TotalVolume,
+			Orders: make([]OrderSnapshot, 0, len(limit.Orders)),
+		}
+		for i, order := range limit.Orders {
+			level.Orders = append(level.Orders, OrderSnapshot{
+				ID:           order.ID,
+				UserID:       order.UserID,
+				Size:         order.Size,
+				Position:     i,
+				Timestamp:    order.Timestamp,
+				OriginalSize: order.OriginalSize,
+				Filled:       order.Filled,
+				AvgPrice:     order.AvgPrice,
+			})
+		}
+		levels = append(levels, level)
+	}
+	return levels
+}
+
+// Restore replaces the state of the order book with a snapshot. The fee
+// charger, circuit breaker and reopening auction of the book are kept.
+func (ob *Orderbook) Restore(s Snapshot) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.asks = []*Limit{}
+	ob.bids = []*Limit{}
+	ob.AskLimits = make(map[float64]*Limit)
+	ob.BidLimits = make(map[float64]*Limit)
+	ob.Orders = make(map[int64]*Order)
+	ob.Trades = []*Trade{}
+	ob.priceHistory = nil
+
+	ob.state = s.State
+	ob.auctionEnd = s.AuctionEnd
+	ob.halted = nil
+	if s.Halt != nil {
+		halt := *s.Halt
+		ob.halted = &halt
+	}
+	if s.LastTrade != nil {
+		trade := *s.LastTrade
+		ob.Trades = append(ob.Trades, &trade)
+	}
+	for _, p := range s.Prices {
+		ob.priceHistory = append(ob.priceHistory, pricePoint{price: p.Price, time: p.Time})
+	}
+
+	ob.restoreLevels(true, s.Bids)
+	ob.restoreLevels(false, s.Asks)
+}
+
+func (ob *Orderbook) restoreLevels(bid bool, levels []LevelSnapshot) {
+	for _, level := range levels {
+		limit := NewLimit(level.Price)
+		if bid {
+			ob.bids = append(ob.bids, limit)
+			ob.BidLimits[level.Price] = limit
+		} else {
+			ob.asks = append(ob.asks, limit)
+			ob.AskLimits[level.Price] = limit
+		}
+
+		// The orders of a snapshot are in queue order already.
+		for _, o := range level.Orders {
+			order := &Order{
+				ID:           o.ID,
+				UserID:       o.UserID,
+				Size:         o.Size,
+				Price:        level.Price,
+				Bid:          bid,
+				Timestamp:    o.Timestamp,
+				OriginalSize: o.OriginalSize,
+				Filled:       o.Filled,
+				AvgPrice:     o.AvgPrice,
+				Status:       StatusNew,
+			}
+			if order.Filled > 0 {
+				order.Status = StatusPartiallyFilled
+			}
+			order.start()
+			ob.Orders[order.ID] = order
+			limit.AddOrder(order)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package orderbook
+
+// OrderStatus is the lifecycle state of an order.
+type OrderStatus string
+
+const (
+	// StatusNew is an order resting in the book without fills.
+	StatusNew OrderStatus = "NEW"
+	// StatusPartiallyFilled is an order with fills and size left.
+	StatusPartiallyFilled OrderStatus = "PARTIALLY_FILLED"
+	// StatusFilled is an order without size left.
+	StatusFilled OrderStatus = "FILLED"
+	// StatusCanceled is an order canceled before it was filled.
+	StatusCanceled OrderStatus = "CANCELED"
+	// StatusExpired is a market order whose size left was dropped because
+	// the book couldn't fill it.
+	StatusExpired OrderStatus = "EXPIRED"
+	// StatusRejected is an order that never reached the book.
+	StatusRejected OrderStatus = "REJECTED"
+)
+
+// start records the original size of an order entering the book.
+func (o *Order) start() {
+	if o.OriginalSize == 0 {
+		o.OriginalSize = o.Size + o.Filled
+	}
+	if o.Status == "" {
+		o.Status = StatusNew
+	}
+}
+
+// fill records a fill of size at price. The size left is updated by the caller.
+func (o *Order) fill(size, price float64) {
+	o.AvgPrice = (o.AvgPrice*o.Filled + price*size) / (o.Filled + size)
+	o.Filled += size
+
+	o.Status = StatusPartiallyFilled
+	if o.IsFilled() {
+		o.Status = StatusFilled
+	}
+}
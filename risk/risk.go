@@ -0,0 +1,174 @@
+package risk
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Reason is the code attached to a rejected order.
+type Reason string
+
+const (
+	ReasonInvalidOrder  Reason = "INVALID_ORDER"
+	ReasonMaxOrderSize  Reason = "MAX_ORDER_SIZE"
+	ReasonMaxNotional   Reason = "MAX_NOTIONAL"
+	ReasonMaxOpenOrders Reason = "MAX_OPEN_ORDERS"
+	ReasonMaxPosition   Reason = "MAX_POSITION"
+	ReasonPriceCollar   Reason = "PRICE_COLLAR"
+)
+
+// DefaultTier is the tier of users without an explicit tier.
+const DefaultTier Tier = "default"
+
+// Tier groups users sharing the same limits.
+type Tier string
+
+// Rejection is returned when an order fails a pre-trade check.
+type Rejection struct {
+	Reason  Reason
+	Message string
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("order rejected [%s]: %s", r.Reason, r.Message)
+}
+
+func reject(reason Reason, format string, args ...any) *Rejection {
+	return &Rejection{
+		Reason:  reason,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// Limits are the pre-trade limits of a tier in a market. A zero value
+// disables the corresponding check.
+type Limits struct {
+	MaxOrderSize  float64
+	MaxNotional   float64
+	MaxOpenOrders int
+	MaxPosition   float64
+	// PriceCollar is the maximum relative distance of a limit price from the
+	// reference price, e.g. 0.1 for 10%.
+	PriceCollar float64
+}
+
+// Order is the order being checked.
+type Order struct {
+	Market string
+	Tier   Tier
+	Bid    bool
+	// Limit is false for market orders, which have no price.
+	Limit bool
+	Size  float64
+	Price float64
+}
+
+// State is the state of the user and the market at the time of the check.
+type State struct {
+	OpenOrders int
+	Position   float64
+	LastPrice  float64
+	BestBid    float64
+	BestAsk    float64
+}
+
+// ReferencePrice returns the last trade price, or the mid price if the
+// market has not traded yet. It returns 0 if neither is known.
+func (s State) ReferencePrice() float64 {
+	if s.LastPrice > 0 {
+		return s.LastPrice
+	}
+	if s.BestBid > 0 && s.BestAsk > 0 {
+		return (s.BestBid + s.BestAsk) / 2
+	}
+	return 0
+}
+
+type limitsKey struct {
+	tier   Tier
+	market string
+}
+
+// Checker runs the pre-trade checks with limits configured per tier and market.
+type Checker struct {
+	mu       sync.RWMutex
+	defaults Limits
+	limits   map[limitsKey]Limits
+}
+
+// NewChecker creates a Checker applying defaults where no limits are set.
+func NewChecker(defaults Limits) *Checker {
+	return &Checker{
+		defaults: defaults,
+		limits:   make(map[limitsKey]Limits),
+	}
+}
+
+// SetLimits configures the limits of a tier in a market.
+func (c *Checker) SetLimits(tier Tier, market string, l Limits) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.limits[limitsKey{tier: tier, market: market}] = l
+}
+
+// Limits returns the limits that apply to a tier in a market.
+func (c *Checker) Limits(tier Tier, market string) Limits {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if l, ok := c.limits[limitsKey{tier: tier, market: market}]; ok {
+		return l
+	}
+	return c.defaults
+}
+
+// Check runs all pre-trade checks and returns a *Rejection for the first
+// one that fails.
+func (c *Checker) Check(o Order, s State) error {
+	l := c.Limits(o.Tier, o.Market)
+
+	if o.Size <= 0 || math.IsNaN(o.Size) || math.IsInf(o.Size, 0) {
+		return reject(ReasonInvalidOrder, "invalid size %v", o.Size)
+	}
+	if o.Limit && (o.Price <= 0 || math.IsNaN(o.Price) || math.IsInf(o.Price, 0)) {
+		return reject(ReasonInvalidOrder, "invalid price %v", o.Price)
+	}
+
+	if l.MaxOrderSize > 0 && o.Size > l.MaxOrderSize {
+		return reject(ReasonMaxOrderSize, "size %.2f exceeds max %.2f", o.Size, l.MaxOrderSize)
+	}
+
+	ref := s.ReferencePrice()
+
+	price := o.Price
+	if !o.Limit {
+		price = ref
+	}
+	if notional := o.Size * price; l.MaxNotional > 0 && notional > l.MaxNotional {
+		return reject(ReasonMaxNotional, "notional %.2f exceeds max %.2f", notional, l.MaxNotional)
+	}
+
+	if o.Limit && l.MaxOpenOrders > 0 && s.OpenOrders >= l.MaxOpenOrders {
+		return reject(ReasonMaxOpenOrders, "%d open orders, max is %d", s.OpenOrders, l.MaxOpenOrders)
+	}
+
+	position := s.Position + o.Size
+	if !o.Bid {
+		position = s.Position - o.Size
+	}
+	// Orders reducing the position are always allowed.
+	if l.MaxPosition > 0 && math.Abs(position) > l.MaxPosition && math.Abs(position) > math.Abs(s.Position) {
+		return reject(ReasonMaxPosition, "resulting position %.2f exceeds max %.2f", position, l.MaxPosition)
+	}
+
+	if o.Limit && l.PriceCollar > 0 && ref > 0 {
+		if dist := math.Abs(o.Price-ref) / ref; dist > l.PriceCollar {
+			return reject(ReasonPriceCollar, "price %.2f is %.2f%% away from reference %.2f, max is %.2f%%",
+				o.Price, dist*100, ref, l.PriceCollar*100)
+		}
+	}
+
+	return nil
+}
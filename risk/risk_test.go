@@ -0,0 +1,77 @@
+package risk
+
+import (
+	"errors"
+	"testing"
+)
+
+func assertReason(t *testing.T, err error, want Reason) {
+	t.Helper()
+
+	if want == "" {
+		if err != nil {
+			t.Errorf("unexpected rejection: %v", err)
+		}
+		return
+	}
+
+	var rej *Rejection
+	if !errors.As(err, &rej) {
+		t.Fatalf("expected rejection %s, got %v", want, err)
+	}
+	if rej.Reason != want {
+		t.Errorf("%s != %s", rej.Reason, want)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	c := NewChecker(Limits{
+		MaxOrderSize:  100,
+		MaxNotional:   50_000,
+		MaxOpenOrders: 2,
+		MaxPosition:   200,
+		PriceCollar:   0.1,
+	})
+	state := State{LastPrice: 100}
+
+	tests := []struct {
+		name  string
+		order Order
+		state State
+		want  Reason
+	}{
+		{"ok", Order{Limit: true, Bid: true, Size: 10, Price: 100}, state, ""},
+		{"zero size", Order{Limit: true, Size: 0, Price: 100}, state, ReasonInvalidOrder},
+		{"no price", Order{Limit: true, Size: 1}, state, ReasonInvalidOrder},
+		{"size", Order{Limit: true, Size: 101, Price: 100}, state, ReasonMaxOrderSize},
+		{"notional", Order{Limit: true, Size: 100, Price: 501}, State{LastPrice: 500}, ReasonMaxNotional},
+		{"market notional", Order{Size: 100}, State{LastPrice: 501}, ReasonMaxNotional},
+		{"open orders", Order{Limit: true, Size: 1, Price: 100}, State{LastPrice: 100, OpenOrders: 2}, ReasonMaxOpenOrders},
+		{"market ignores open orders", Order{Size: 1}, State{LastPrice: 100, OpenOrders: 2}, ""},
+		{"position", Order{Bid: true, Size: 10}, State{LastPrice: 100, Position: 195}, ReasonMaxPosition},
+		{"reducing position", Order{Bid: false, Size: 10}, State{LastPrice: 100, Position: 250}, ""},
+		{"collar", Order{Limit: true, Size: 1, Price: 111}, state, ReasonPriceCollar},
+		{"collar on mid", Order{Limit: true, Size: 1, Price: 80}, State{BestBid: 95, BestAsk: 105}, ReasonPriceCollar},
+		{"no reference", Order{Limit: true, Size: 1, Price: 80}, State{}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertReason(t, c.Check(tt.order, tt.state), tt.want)
+		})
+	}
+}
+
+func TestLimitsPerTierAndMarket(t *testing.T) {
+	c := NewChecker(Limits{MaxOrderSize: 10})
+	c.SetLimits("mm", "ETH", Limits{MaxOrderSize: 1000})
+
+	order := Order{Market: "ETH", Tier: "mm", Limit: true, Size: 500, Price: 1}
+	assertReason(t, c.Check(order, State{}), "")
+
+	order.Tier = DefaultTier
+	assertReason(t, c.Check(order, State{}), ReasonMaxOrderSize)
+
+	order.Tier, order.Market = "mm", "BTC"
+	assertReason(t, c.Check(order, State{}), ReasonMaxOrderSize)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/inagib21/crypto-exchange/engine"
+	"github.com/inagib21/crypto-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// adminTokenHeader is the header carrying the admin token.
+const adminTokenHeader = "X-Admin-Token"
+
+// Event types of market status changes.
+const (
+	EventHalt   EventType = "HALT"
+	EventResume EventType = "RESUME"
+)
+
+type (
+	// MarketStatus is the trading status of a market.
+	MarketStatus struct {
+		Market Market
+		State  orderbook.State
+		Halted bool
+		Halt   *orderbook.Halt `json:",omitempty"`
+		// Indicative is set while orders accumulate for an auction.
+		Indicative *orderbook.Indicative `json:",omitempty"`
+	}
+
+	HaltRequest struct {
+		Reason string
+	}
+)
+
+// marketTopic returns the public topic of a market.
+func marketTopic(market Market) string {
+	return "market:" + string(market)
+}
+
+// requireAdmin only lets requests through that carry the token configured
+// in EXCHANGE_ADMIN_TOKEN. Admin endpoints are disabled when it isn't set.
+func requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := os.Getenv("EXCHANGE_ADMIN_TOKEN")
+		given := c.Request().Header.Get(adminTokenHeader)
+
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(given)) != 1 {
+			return c.JSON(http.StatusForbidden, APIError{Error: "admin permission required"})
+		}
+
+		return next(c)
+	}
+}
+
+func (ex *Exchange) marketStatus(market Market, ob *orderbook.Orderbook) MarketStatus {
+	halt := ob.Halted()
+	status := MarketStatus{
+		Market: market,
+		State:  ob.State(),
+		Halted: halt != nil,
+		Halt:   halt,
+	}
+
+	if status.State != orderbook.StateContinuous && status.State != orderbook.StateClosed {
+		indicative := ob.Indicative()
+		status.Indicative = &indicative
+	}
+
+	return status
+}
+
+func (ex *Exchange) handleGetMarketStatus(c echo.Context) error {
+	market := Market(c.Param("market"))
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	return c.JSON(http.StatusOK, ex.marketStatus(market, ob))
+}
+
+func (ex *Exchange) handleHaltMarket(c echo.Context) error {
+	market := Market(c.Param("market"))
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	req := HaltRequest{Reason: "halted by admin"}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil && err != io.EOF {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	_, err := ex.execute(engine.Command{
+		Type:   engine.CommandHalt,
+		Market: string(market),
+		Reason: req.Reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	status := ex.marketStatus(market, ob)
+	ex.events.Publish(marketTopic(market), EventHalt, status)
+
+	logrus.WithFields(logrus.Fields{
+		"market": market,
+		"reason": req.Reason,
+	}).Warn("market halted by admin")
+
+	return c.JSON(http.StatusOK, status)
+}
+
+func (ex *Exchange) handleResumeMarket(c echo.Context) error {
+	market := Market(c.Param("market"))
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	_, err := ex.execute(engine.Command{
+		Type:   engine.CommandResume,
+		Market: string(market),
+	})
+	if err != nil {
+		return err
+	}
+
+	status := ex.marketStatus(market, ob)
+	ex.events.Publish(marketTopic(market), EventResume, status)
+
+	logrus.WithFields(logrus.Fields{
+		"market": market,
+	}).Info("market resumed by admin")
+
+	return c.JSON(http.StatusOK, status)
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/inagib21/crypto-exchange/engine"
+	"github.com/inagib21/crypto-exchange/orderbook"
+	"github.com/inagib21/crypto-exchange/risk"
+	"github.com/labstack/echo/v4"
+)
+
+// maxBatchSize is the number of orders a batch places or cancels at most.
+const maxBatchSize = 50
+
+// Sides of the book the orders of a cancel-all are taken from.
+const (
+	SideBid = "bid"
+	SideAsk = "ask"
+)
+
+type (
+	// BatchItem places a limit order, or cancels the order CancelID if set.
+	BatchItem struct {
+		CancelID int64 `json:",omitempty"`
+		Bid      bool
+		Size     float64
+		Price    float64
+	}
+
+	// BatchRequest places and cancels orders of a user in a market. The
+	// batch is atomic: every item is validated first and when one of them
+	// fails none is applied. Otherwise the items are applied in order,
+	// without other orders of the market in between.
+	BatchRequest struct {
+		UserID int64
+		Market Market
+		Items  []BatchItem
+	}
+
+	// BatchResult is the outcome of an item of a batch.
+	BatchResult struct {
+		OrderID int64
+		Status  orderbook.OrderStatus `json:",omitempty"`
+		Error   string                `json:",omitempty"`
+		Reason  risk.Reason           `json:",omitempty"`
+	}
+
+	BatchResponse struct {
+		Results []BatchResult
+	}
+
+	CancelAllResponse struct {
+		Canceled []int64
+	}
+)
+
+// handleBatch places and cancels the orders of a batch, with a result for
+// every item. The user's API token is required. A rejected batch is answered with a 400 and the error of the
+// items that failed, the others fail with engine.ErrBatchRejected.
+func (ex *Exchange) handleBatch(c echo.Context) error {
+	req := BatchRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	if _, ok := ex.orderbooks[req.Market]; !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+	user, ok := ex.user(req.UserID)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "user not found"})
+	}
+	if ok, err := ex.authorizeUser(c, user.ID); !ok {
+		return err
+	}
+	if len(req.Items) == 0 || len(req.Items) > maxBatchSize {
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("a batch has 1 to %d items", maxBatchSize)})
+	}
+
+	var (
+		results = make([]BatchResult, len(req.Items))
+		orders  = make([]*orderbook.Order, len(req.Items))
+		cmds    = make([]engine.Command, len(req.Items))
+	)
+
+	for i, item := range req.Items {
+		if item.CancelID != 0 {
+			results[i].OrderID = item.CancelID
+			// The user of a cancel makes sure only their orders are canceled.
+			cmds[i] = engine.Command{Type: engine.CommandCancel, Market: string(req.Market), OrderID: item.CancelID, UserID: user.ID}
+			continue
+		}
+
+		order := ex.engine.NewOrder(item.Bid, item.Size, user.ID)
+		orders[i] = order
+		results[i].OrderID = order.ID
+		cmds[i] = placeCommand(req.Market, order, true, item.Price)
+	}
+
+	// The items are checked with the ones before them as if they were
+	// applied, and applied only if they all pass.
+	code := http.StatusOK
+	for i, reply := range ex.executeAtomic(cmds) {
+		if reply.Err == nil {
+			results[i].Status = reply.Result.OrderState.Status
+			continue
+		}
+
+		code = http.StatusBadRequest
+		results[i].Error = reply.Err.Error()
+		if apiErr, ok := rejectionError(reply.Err); ok {
+			results[i].Error, results[i].Reason = apiErr.Error, apiErr.Reason
+		}
+		if orders[i] != nil {
+			placeReq := PlaceOrderRequest{Type: LimitOrder, Price: req.Items[i].Price, Size: req.Items[i].Size}
+			ex.recordRejection(req.Market, orders[i], &placeReq)
+			results[i].Status = orderbook.StatusRejected
+		}
+	}
+
+	return c.JSON(code, BatchResponse{Results: results})
+}
+
+// handleCancelAll cancels the resting orders of a user, optionally only in
+// one market or one side of the books. The user's API token is required.
+func (ex *Exchange) handleCancelAll(c echo.Context) error {
+	userID, err := queryInt(c, "userID")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	if _, ok := ex.user(userID); !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "user not found"})
+	}
+	if ok, err := ex.authorizeUser(c, userID); !ok {
+		return err
+	}
+
+	market := Market(c.QueryParam("market"))
+	if _, ok := ex.orderbooks[market]; market != "" && !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	side := strings.ToLower(c.QueryParam("side"))
+	if side != "" && side != SideBid && side != SideAsk {
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("unknown side %q", side)})
+	}
+
+	canceled, err := ex.cancelAll(userID, market, side, CancelReasonRequested)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, CancelAllResponse{Canceled: canceled})
+}
+
+// cancelAll cancels the resting orders of a user in market and on side,
+// every market and both sides when they are empty, and returns the IDs of
+// the canceled orders. The orders of a market are canceled atomically, see
+// cancelAtomic, and a cancel event with reason is published for every one
+// of them.
+func (ex *Exchange) cancelAll(userID int64, market Market, side, reason string) ([]int64, error) {
+	ex.mu.RLock()
+	tracked := append([]*orderbook.Order{}, ex.Orders[userID]...)
+	ex.mu.RUnlock()
+
+	canceled := []int64{}
+	for m, ob := range ex.orderbooks {
+		if market != "" && m != market {
+			continue
+		}
+
+		cmds := []engine.Command{}
+		for _, o := range ob.Resting(tracked) {
+			if (side == SideBid && !o.Bid) || (side == SideAsk && o.Bid) {
+				continue
+			}
+			cmds = append(cmds, engine.Command{Type: engine.CommandCancel, Market: string(m), OrderID: o.ID})
+		}
+
+		applied, err := ex.cancelAtomic(cmds)
+		if err != nil {
+			return canceled, err
+		}
+		for _, cmd := range applied {
+			canceled = append(canceled, cmd.OrderID)
+			ex.events.Publish(userTopic(userID), EventCancel, CancelEvent{
+				OrderID: cmd.OrderID,
+				Market:  m,
+				Reason:  reason,
+			})
+		}
+	}
+
+	sort.Slice(canceled, func(i, j int) bool { return canceled[i] < canceled[j] })
+	return canceled, nil
+}
+
+// cancelAtomic applies the cancels of a market all at once and returns the
+// ones applied. Orders filled meanwhile are no longer there to cancel: the
+// batch is rejected, so it is executed again without them.
+func (ex *Exchange) cancelAtomic(cmds []engine.Command) ([]engine.Command, error) {
+	for len(cmds) > 0 {
+		var (
+			replies = ex.executeAtomic(cmds)
+			left    = []engine.Command{}
+			gone    = false
+		)
+
+		for i, reply := range replies {
+			switch {
+			case reply.Err == nil, errors.Is(reply.Err, engine.ErrBatchRejected):
+				left = append(left, cmds[i])
+			case errors.Is(reply.Err, engine.ErrOrderNotFound):
+				gone = true
+			default:
+				return nil, reply.Err
+			}
+		}
+		if !gone {
+			return cmds, nil
+		}
+		cmds = left
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/inagib21/crypto-exchange/candles"
+	"github.com/inagib21/crypto-exchange/store"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// EventCandle is published on the candle topic of a market and interval
+// every time a trade updates its current candle.
+const EventCandle EventType = "CANDLE"
+
+// candleTopic returns the public topic of the candles of a market, e.g.
+// candles:ETH:1m.
+func candleTopic(market Market, interval candles.Interval) string {
+	return fmt.Sprintf("candles:%s:%s", market, interval)
+}
+
+// recordCandles adds a trade to the candles of its market, stores them and
+// publishes them.
+func (ex *Exchange) recordCandles(market Market, price, size float64, timestamp int64) {
+	for _, c := range ex.Candles.Add(string(market), price, size, timestamp) {
+		if err := ex.Store.SaveCandle(c); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"market":   market,
+				"interval": c.Interval,
+				"error":    err,
+			}).Error("recording candle")
+		}
+		ex.events.Publish(candleTopic(market, c.Interval), EventCandle, c)
+	}
+}
+
+// restoreCandles continues the latest stored candle of every market and
+// interval.
+func (ex *Exchange) restoreCandles() error {
+	for market := range ex.orderbooks {
+		for _, interval := range candles.Intervals {
+			latest, err := ex.Store.Candles(store.CandleFilter{
+				Market:   string(market),
+				Interval: interval,
+				Page:     store.Page{Limit: 1},
+			})
+			if err != nil {
+				return err
+			}
+			if len(latest) > 0 {
+				ex.Candles.Restore(latest[0])
+			}
+		}
+	}
+	return nil
+}
+
+// handleGetKlines returns the candles of a market for the interval query
+// parameter (1m by default), oldest first. The from and to query parameters
+// bound their open time.
+func (ex *Exchange) handleGetKlines(c echo.Context) error {
+	market := Market(c.Param("market"))
+	if _, ok := ex.orderbooks[market]; !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "orderbook not found"})
+	}
+
+	filter := store.CandleFilter{Market: string(market), Interval: candles.Minute}
+	if interval := c.QueryParam("interval"); interval != "" {
+		i, err := candles.ParseInterval(interval)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+		}
+		filter.Interval = i
+	}
+
+	page, err := parsePage(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	filter.Page = page
+
+	if filter.From, err = queryInt(c, "from"); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	if filter.To, err = queryInt(c, "to"); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	klines, err := ex.Store.Candles(filter)
+	if err != nil {
+		return err
+	}
+
+	// The store returns the newest candles first, charts want them in time order.
+	for i, j := 0, len(klines)-1; i < j; i, j = i+1, j-1 {
+		klines[i], klines[j] = klines[j], klines[i]
+	}
+
+	return c.JSON(http.StatusOK, klines)
+}
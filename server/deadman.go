@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// EventCancel is published on the private topic of a user for every order
+// the exchange cancels on their behalf.
+const EventCancel EventType = "CANCEL"
+
+// Reasons of the cancels published in cancel events.
+const (
+	// CancelReasonRequested is a cancel-all requested by the user.
+	CancelReasonRequested = "CANCEL_ALL"
+	// CancelReasonDeadMan is a dead man's switch that wasn't refreshed in time.
+	CancelReasonDeadMan = "DEAD_MAN_SWITCH"
+	// CancelReasonDisconnect is a WebSocket session opened with
+	// cancelOnDisconnect that went away.
+	CancelReasonDisconnect = "DISCONNECT"
+)
+
+type (
+	// CancelEvent is an order canceled by a cancel-all, with the reason.
+	CancelEvent struct {
+		OrderID int64
+		Market  Market
+		Reason  string
+	}
+
+	// DeadManRequest arms, refreshes or disarms the dead man's switch of a
+	// user. Timeout is a duration such as "10s", zero disarms the switch.
+	DeadManRequest struct {
+		UserID  int64
+		Timeout string
+	}
+
+	DeadManResponse struct {
+		UserID int64
+		Armed  bool
+		// Deadline is when the orders are canceled without a heartbeat.
+		Deadline int64 `json:",omitempty"`
+	}
+)
+
+// deadManTimer is the armed switch of a user. gen tells a timer that fired
+// while being re-armed that it was replaced.
+type deadManTimer struct {
+	timer *time.Timer
+	gen   uint64
+}
+
+// handleDeadMan arms the dead man's switch of a user: if it isn't refreshed
+// by another request within the timeout, all their orders are canceled. The
+// user's API token is required.
+func (ex *Exchange) handleDeadMan(c echo.Context) error {
+	req := DeadManRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	if _, ok := ex.user(req.UserID); !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "user not found"})
+	}
+	if ok, err := ex.authorizeUser(c, req.UserID); !ok {
+		return err
+	}
+
+	timeout := time.Duration(0)
+	if req.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(req.Timeout); err != nil || timeout < 0 {
+			return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid timeout %q", req.Timeout)})
+		}
+	}
+
+	if timeout == 0 {
+		ex.disarmDeadMan(req.UserID)
+		return c.JSON(http.StatusOK, DeadManResponse{UserID: req.UserID})
+	}
+
+	deadline := ex.armDeadMan(req.UserID, timeout)
+	return c.JSON(http.StatusOK, DeadManResponse{
+		UserID:   req.UserID,
+		Armed:    true,
+		Deadline: deadline.UnixNano(),
+	})
+}
+
+// armDeadMan arms or refreshes the switch of a user and returns its deadline.
+func (ex *Exchange) armDeadMan(userID int64, timeout time.Duration) time.Time {
+	ex.deadManMu.Lock()
+	defer ex.deadManMu.Unlock()
+
+	if t, ok := ex.deadMan[userID]; ok {
+		t.timer.Stop()
+	}
+
+	ex.deadManGen++
+	gen := ex.deadManGen
+	ex.deadMan[userID] = &deadManTimer{
+		gen: gen,
+		timer: time.AfterFunc(timeout, func() {
+			ex.deadManMu.Lock()
+			t, ok := ex.deadMan[userID]
+			if !ok || t.gen != gen {
+				ex.deadManMu.Unlock()
+				return
+			}
+			delete(ex.deadMan, userID)
+			ex.deadManMu.Unlock()
+
+			ex.cancelOnBehalf(userID, CancelReasonDeadMan)
+		}),
+	}
+
+	return time.Now().Add(timeout)
+}
+
+// disarmDeadMan disarms the switch of a user, if armed.
+func (ex *Exchange) disarmDeadMan(userID int64) {
+	ex.deadManMu.Lock()
+	defer ex.deadManMu.Unlock()
+
+	if t, ok := ex.deadMan[userID]; ok {
+		t.timer.Stop()
+		delete(ex.deadMan, userID)
+	}
+}
+
+// disarmAllDeadMen disarms the switches of every user.
+func (ex *Exchange) disarmAllDeadMen() {
+	ex.deadManMu.Lock()
+	defer ex.deadManMu.Unlock()
+
+	for userID, t := range ex.deadMan {
+		t.timer.Stop()
+		delete(ex.deadMan, userID)
+	}
+}
+
+// cancelOnBehalf cancels every resting order of a user for reason.
+func (ex *Exchange) cancelOnBehalf(userID int64, reason string) {
+	canceled, err := ex.cancelAll(userID, "", "", reason)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"userID": userID,
+			"reason": reason,
+			"error":  err,
+		}).Error("canceling orders")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"userID": userID,
+		"reason": reason,
+		"orders": len(canceled),
+	}).Warn("canceled all orders of user")
+}
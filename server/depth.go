@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/inagib21/crypto-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// defaultDepthLevels is the number of levels per side returned when the
+	// levels query parameter isn't set.
+	defaultDepthLevels = 20
+	// maxDepthLevels bounds the levels query parameter.
+	maxDepthLevels = 1000
+)
+
+// DepthResponse is the aggregated depth of a market.
+type DepthResponse struct {
+	Market Market
+	Bids   []orderbook.Level
+	Asks   []orderbook.Level
+}
+
+// depthLevels reads the levels query parameter.
+func depthLevels(c echo.Context) (int, error) {
+	v := c.QueryParam("levels")
+	if v == "" {
+		return defaultDepthLevels, nil
+	}
+
+	levels, err := strconv.Atoi(v)
+	if err != nil || levels <= 0 {
+		return 0, fmt.Errorf("invalid levels %q", v)
+	}
+	if levels > maxDepthLevels {
+		levels = maxDepthLevels
+	}
+	return levels, nil
+}
+
+// handleGetDepth returns the best price levels of a market with their
+// aggregated size and order count.
+func (ex *Exchange) handleGetDepth(c echo.Context) error {
+	market := Market(c.Param("market"))
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	levels, err := depthLevels(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	depth := ob.Depth(levels)
+	return c.JSON(http.StatusOK, DepthResponse{
+		Market: market,
+		Bids:   depth.Bids,
+		Asks:   depth.Asks,
+	})
+}
+
+// handleGetBook returns every resting order of the best levels of a market
+// in queue order. The user IDs are replaced by aliases numbered in order of
+// appearance, so orders of the same user can be told apart from the others
+// without revealing who the user is.
+func (ex *Exchange) handleGetBook(c echo.Context) error {
+	market := Market(c.Param("market"))
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	levels, err := depthLevels(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	var (
+		bids, asks = ob.DepthOrders(levels)
+		aliases    = make(map[int64]int64)
+	)
+
+	orders := func(bid bool, levels []orderbook.LevelSnapshot) ([]*Order, float64) {
+		orders, volume := []*Order{}, 0.0
+		for _, level := range levels {
+			volume += level.Volume
+			for _, order := range level.Orders {
+				alias, ok := aliases[order.UserID]
+				if !ok {
+					alias = int64(len(aliases) + 1)
+					aliases[order.UserID] = alias
+				}
+
+				orders = append(orders, &Order{
+					UserID:    alias,
+					ID:        order.ID,
+					Price:     level.Price,
+					Size:      order.Size,
+					Bid:       bid,
+					Timestamp: order.Timestamp,
+				})
+			}
+		}
+		return orders, volume
+	}
+
+	data := OrderbookData{}
+	data.Bids, data.TotalBidVolume = orders(true, bids)
+	data.Asks, data.TotalAskVolume = orders(false, asks)
+
+	return c.JSON(http.StatusOK, data)
+}
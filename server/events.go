@@ -0,0 +1,261 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// Event types published by the exchange.
+const (
+	EventFill EventType = "FILL"
+)
+
+type (
+	EventType string
+
+	// Event is a message published to the subscribers of a topic.
+	Event struct {
+		Type      EventType
+		Topic     string
+		Data      any
+		Timestamp int64
+	}
+
+	// FillEvent is published on the private topic of a user for every fill
+	// of one of their orders.
+	FillEvent struct {
+		OrderID   int64
+		Market    Market
+		Bid       bool
+		Price     float64
+		Size      float64
+		Liquidity string
+		Fee       float64
+		FeeAsset  string
+	}
+)
+
+// userTokenHeader is the header carrying the API token of a user.
+const userTokenHeader = "X-User-Token"
+
+// userTopicPrefix starts the private topics of the users.
+const userTopicPrefix = "user:"
+
+// userTopic returns the private topic of a user.
+func userTopic(userID int64) string {
+	return fmt.Sprintf("%s%d", userTopicPrefix, userID)
+}
+
+// Subscription receives the events published to its topics.
+type Subscription struct {
+	C      chan Event
+	topics []string
+	broker *Broker
+}
+
+// Close unsubscribes from all topics.
+func (s *Subscription) Close() {
+	s.broker.unsubscribe(s)
+}
+
+// Broker fans out published events to subscribers by topic.
+type Broker struct {
+	mu   sync.RWMutex
+	subs map[string]map[*Subscription]struct{}
+}
+
+// NewBroker creates an empty Broker.
+func NewBroker() *Broker {
+	return &Broker{
+		subs: make(map[string]map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe creates a subscription to the given topics.
+func (b *Broker) Subscribe(topics ...string) *Subscription {
+	s := &Subscription{
+		C:      make(chan Event, 256),
+		topics: topics,
+		broker: b,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, topic := range topics {
+		if b.subs[topic] == nil {
+			b.subs[topic] = make(map[*Subscription]struct{})
+		}
+		b.subs[topic][s] = struct{}{}
+	}
+
+	return s
+}
+
+func (b *Broker) unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, topic := range s.topics {
+		delete(b.subs[topic], s)
+		if len(b.subs[topic]) == 0 {
+			delete(b.subs, topic)
+		}
+	}
+}
+
+// Publish sends an event to every subscriber of topic. Slow subscribers
+// whose buffer is full miss the event instead of blocking the publisher.
+func (b *Broker) Publish(topic string, typ EventType, data any) {
+	ev := Event{
+		Type:      typ,
+		Topic:     topic,
+		Data:      data,
+		Timestamp: time.Now().UnixNano(),
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for s := range b.subs[topic] {
+		select {
+		case s.C <- ev:
+		default:
+			logrus.WithFields(logrus.Fields{
+				"topic": topic,
+				"type":  typ,
+			}).Warn("dropping event for slow subscriber")
+		}
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// handleWebSocket streams the events of the topics given as comma separated
+// list in the topics query parameter, e.g. /ws?topics=user:7. Private topics
+// of users require the API token of their user in the X-User-Token header.
+// With cancelOnDisconnect=true the orders of the users whose private topic is
+// subscribed are canceled when the session goes away.
+func (ex *Exchange) handleWebSocket(c echo.Context) error {
+	topics := strings.Split(c.QueryParam("topics"), ",")
+	if len(topics) == 0 || topics[0] == "" {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "no topics given"})
+	}
+	for _, topic := range topics {
+		if !ex.canSubscribe(topic, c.Request().Header.Get(userTokenHeader)) {
+			return c.JSON(http.StatusForbidden, APIError{Error: fmt.Sprintf("not allowed to subscribe to %s", topic)})
+		}
+	}
+
+	// The users are authenticated by their private topic.
+	var disconnect []int64
+	if c.QueryParam("cancelOnDisconnect") == "true" {
+		if disconnect = topicUsers(topics); len(disconnect) == 0 {
+			return c.JSON(http.StatusBadRequest, APIError{Error: "cancelOnDisconnect needs a user topic"})
+		}
+	}
+
+	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sub := ex.events.Subscribe(topics...)
+	defer sub.Close()
+
+	defer func() {
+		for _, userID := range disconnect {
+			ex.cancelOnBehalf(userID, CancelReasonDisconnect)
+		}
+	}()
+
+	// Reading is required to notice the client going away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case ev := <-sub.C:
+			if err := conn.WriteJSON(ev); err != nil {
+				return nil
+			}
+		case <-closed:
+			return nil
+		}
+	}
+}
+
+// topicUsers returns the users whose private topic is among topics.
+func topicUsers(topics []string) []int64 {
+	users := []int64{}
+	for _, topic := range topics {
+		id, ok := strings.CutPrefix(topic, userTopicPrefix)
+		if !ok {
+			continue
+		}
+		if userID, err := strconv.ParseInt(id, 10, 64); err == nil {
+			users = append(users, userID)
+		}
+	}
+	return users
+}
+
+// canSubscribe reports whether a client presenting token may subscribe to
+// topic. Public topics are open to everyone, the private topic of a user only
+// to clients with their API token. Users without a token have no private topic.
+func (ex *Exchange) canSubscribe(topic, token string) bool {
+	idStr, private := strings.CutPrefix(topic, userTopicPrefix)
+	if !private {
+		return true
+	}
+
+	userID, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return false
+	}
+	return ex.hasToken(userID, token)
+}
+
+// hasToken reports whether token is the API token of a user. Users without a
+// token can't be authenticated.
+func (ex *Exchange) hasToken(userID int64, token string) bool {
+	user, ok := ex.user(userID)
+	if !ok || user.APIToken == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(user.APIToken), []byte(token)) == 1
+}
+
+// authorizeUser answers a request acting for a user that doesn't carry the
+// API token of the user in the X-User-Token header: with a 401 without a
+// token and a 403 with another one. It returns false once it answered.
+func (ex *Exchange) authorizeUser(c echo.Context, userID int64) (bool, error) {
+	token := c.Request().Header.Get(userTokenHeader)
+	switch {
+	case token == "":
+		return false, c.JSON(http.StatusUnauthorized, APIError{Error: "user token required"})
+	case !ex.hasToken(userID, token):
+		return false, c.JSON(http.StatusForbidden, APIError{Error: fmt.Sprintf("not allowed to act for user %d", userID)})
+	}
+	return true, nil
+}
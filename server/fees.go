@@ -0,0 +1,96 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/inagib21/crypto-exchange/fees"
+	"github.com/inagib21/crypto-exchange/orderbook"
+)
+
+// QuoteAsset is the asset every market is priced in.
+const QuoteAsset = "USD"
+
+// defaultFeeSchedule applies to every market without a schedule of its own.
+var defaultFeeSchedule = fees.Schedule{Tiers: []fees.Tier{
+	{MinVolume: 0, MakerRate: 0.001, TakerRate: 0.002},
+	{MinVolume: 1_000_000, MakerRate: 0.0005, TakerRate: 0.0015},
+	{MinVolume: 10_000_000, MakerRate: -0.0001, TakerRate: 0.001},
+}}
+
+// assetName returns the name of the base or quote asset of the market.
+func (m Market) assetName(a fees.Asset) string {
+	if a == fees.Base {
+		return string(m)
+	}
+	return QuoteAsset
+}
+
+// marketFees charges the fees of a single market's matches.
+type marketFees struct {
+	market Market
+	engine *fees.Engine
+}
+
+// ChargeFees charges the maker and the taker of the match.
+func (mf marketFees) ChargeFees(m orderbook.Match, taker *orderbook.Order, now time.Time) (float64, float64) {
+	maker := m.Bid
+	if taker.Bid {
+		maker = m.Ask
+	}
+
+	makerFee := mf.engine.Charge(fees.Fill{
+		Market:    string(mf.market),
+		UserID:    maker.UserID,
+		Liquidity: fees.Maker,
+		Bid:       maker.Bid,
+		Size:      m.SizeFilled,
+		Price:     m.Price,
+		Time:      now,
+	})
+	takerFee := mf.engine.Charge(fees.Fill{
+		Market:    string(mf.market),
+		UserID:    taker.UserID,
+		Liquidity: fees.Taker,
+		Bid:       taker.Bid,
+		Size:      m.SizeFilled,
+		Price:     m.Price,
+		Time:      now,
+	})
+
+	return makerFee.Amount, takerFee.Amount
+}
+
+// FeeAccount holds the fees collected by the exchange per asset.
+type FeeAccount struct {
+	mu       sync.Mutex
+	balances map[string]float64
+}
+
+// NewFeeAccount creates an empty FeeAccount.
+func NewFeeAccount() *FeeAccount {
+	return &FeeAccount{
+		balances: make(map[string]float64),
+	}
+}
+
+// Credit adds amount of asset to the account. Rebates are negative credits.
+func (fa *FeeAccount) Credit(asset string, amount float64) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	fa.balances[asset] += amount
+}
+
+// Balances returns a copy of the account balances.
+func (fa *FeeAccount) Balances() map[string]float64 {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	balances := make(map[string]float64, len(fa.balances))
+	for asset, amount := range fa.balances {
+		balances[asset] = amount
+	}
+
+	return balances
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/inagib21/crypto-exchange/engine"
+	"github.com/inagib21/crypto-exchange/journal"
+	"github.com/inagib21/crypto-exchange/orderbook"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultJournalPath is where the journal is stored when EXCHANGE_JOURNAL isn't set.
+	defaultJournalPath = "data/journal.log"
+	// defaultSnapshotDir is where snapshots are stored when EXCHANGE_SNAPSHOTS isn't set.
+	defaultSnapshotDir = "data/snapshots"
+	// defaultSnapshotInterval is how often snapshots are taken when
+	// EXCHANGE_SNAPSHOT_INTERVAL isn't set.
+	defaultSnapshotInterval = time.Minute
+	// keepSnapshots is the number of snapshots kept in the snapshot directory.
+	keepSnapshots = 3
+)
+
+// journalOptions reads the fsync policy of the journal from
+// EXCHANGE_JOURNAL_SYNC (always, interval or never) and the interval of the
+// interval policy from EXCHANGE_JOURNAL_SYNC_INTERVAL.
+func journalOptions() (journal.Options, error) {
+	opts := journal.DefaultOptions
+
+	switch policy := journal.SyncPolicy(os.Getenv("EXCHANGE_JOURNAL_SYNC")); policy {
+	case "":
+	case journal.SyncAlways, journal.SyncInterval, journal.SyncNever:
+		opts.Sync = policy
+	default:
+		return opts, fmt.Errorf("unknown journal sync policy %q", policy)
+	}
+
+	if interval := os.Getenv("EXCHANGE_JOURNAL_SYNC_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return opts, fmt.Errorf("invalid EXCHANGE_JOURNAL_SYNC_INTERVAL: %w", err)
+		}
+		opts.Interval = d
+	}
+
+	return opts, nil
+}
+
+// snapshotInterval reads the interval between snapshots from
+// EXCHANGE_SNAPSHOT_INTERVAL.
+func snapshotInterval() (time.Duration, error) {
+	interval := os.Getenv("EXCHANGE_SNAPSHOT_INTERVAL")
+	if interval == "" {
+		return defaultSnapshotInterval, nil
+	}
+
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid EXCHANGE_SNAPSHOT_INTERVAL: %w", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("EXCHANGE_SNAPSHOT_INTERVAL must be positive")
+	}
+	return d, nil
+}
+
+// OpenJournal rebuilds the order books from the latest snapshot in
+// snapshotDir and the journal records at path after it, then journals every
+// command executed by the exchange to path. Replayed matches update the
+// orders and positions of the users. Replayed commands the store hasn't
+// recorded, because the exchange stopped between journaling and recording
+// them, are recorded. The consumers run after a command is journaled, so the
+// exchange may stop before they processed it: the trades of the commands
+// the candles and the settlement didn't process are fed to them again, and
+// the tickers are rebuilt from the stored trades.
+func (ex *Exchange) OpenJournal(path, snapshotDir string, opts journal.Options) error {
+	books := ex.books()
+
+	recorded, err := ex.Store.RecordedSeq()
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := engine.LatestSnapshot(snapshotDir)
+	if err != nil {
+		return err
+	}
+	if err := snapshot.Restore(books); err != nil {
+		return err
+	}
+	if err := ex.restoreState(snapshot); err != nil {
+		return err
+	}
+
+	replayed, rerecorded := 0, 0
+	last, err := engine.ReplayFrom(path, snapshot.Seq, books, func(cmd engine.Command, res engine.Result) {
+		replayed++
+		ex.trackCommand(cmd, res)
+		if res.Seq > recorded {
+			rerecorded++
+			ex.record(cmd, res)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Every order that was placed, or rejected, is in the store once the
+	// journal is replayed, new orders continue after them.
+	lastID, err := ex.Store.LastOrderID()
+	if err != nil {
+		return err
+	}
+	ex.engine.SetIDGenerator(orderbook.NewSequentialIDs(lastID))
+
+	if err := ex.catchUpConsumers(); err != nil {
+		return err
+	}
+	if err := ex.restoreTickers(); err != nil {
+		return err
+	}
+
+	j, err := journal.Open(path, opts)
+	if err != nil {
+		return err
+	}
+	ex.journal = j
+	ex.engine.SetJournal(j)
+
+	logrus.WithFields(logrus.Fields{
+		"path":     path,
+		"snapshot": snapshot.Seq,
+		"commands": replayed,
+		"recorded": rerecorded,
+		"seq":      last,
+		"orderID":  lastID,
+		"sync":     opts.Sync,
+	}).Info("recovered order books")
+
+	return nil
+}
+
+// Close stops the background loops of the exchange, applies the commands
+// queued in the sequencer, waits for the consumers to process them and closes
+// the journal of the exchange, if any.
+func (ex *Exchange) Close() error {
+	close(ex.done)
+	ex.loops.Wait()
+
+	ex.disarmAllDeadMen()
+	ex.sequencer.Close()
+	ex.consumers.Wait()
+
+	if ex.journal == nil {
+		return nil
+	}
+	return ex.journal.Close()
+}
+
+// books returns the order books keyed by the name of their market.
+func (ex *Exchange) books() map[string]*orderbook.Orderbook {
+	books := make(map[string]*orderbook.Orderbook, len(ex.orderbooks))
+	for market, ob := range ex.orderbooks {
+		books[string(market)] = ob
+	}
+	return books
+}
+
+// exchangeState is the state of the exchange kept in snapshots next to the
+// order books.
+type exchangeState struct {
+	Positions map[Market]map[int64]float64
+	// FeeVolumes is the daily volume of every user the fee tiers are based on.
+	FeeVolumes map[int64]map[int64]float64
+}
+
+// snapshotState returns the state of the exchange to snapshot. It is called
+// while the engine is locked.
+func (ex *Exchange) snapshotState() any {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	state := exchangeState{
+		Positions:  make(map[Market]map[int64]float64),
+		FeeVolumes: ex.Fees.Volumes(),
+	}
+	for market, positions := range ex.positions {
+		state.Positions[market] = make(map[int64]float64, len(positions))
+		for userID, position := range positions {
+			state.Positions[market][userID] = position
+		}
+	}
+	return state
+}
+
+// restoreState restores the state of the exchange from a snapshot and
+// tracks the resting orders of the restored order books.
+func (ex *Exchange) restoreState(s engine.Snapshot) error {
+	state := exchangeState{}
+	if len(s.State) > 0 {
+		if err := json.Unmarshal(s.State, &state); err != nil {
+			return fmt.Errorf("decoding exchange state of snapshot seq %d: %w", s.Seq, err)
+		}
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	if state.Positions != nil {
+		ex.positions = state.Positions
+	}
+	if state.FeeVolumes != nil {
+		ex.Fees.SetVolumes(state.FeeVolumes)
+	}
+
+	ex.Orders = make(map[int64][]*orderbook.Order)
+	for _, ob := range ex.orderbooks {
+		for _, limits := range [][]*orderbook.Limit{ob.Bids(), ob.Asks()} {
+			for _, limit := range limits {
+				for _, order := range limit.Orders {
+					ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// runSnapshots writes a snapshot of the order books into dir every interval
+// in which commands were journaled, keeping the latest keepSnapshots, until
+// the exchange is closed.
+func (ex *Exchange) runSnapshots(dir string, interval time.Duration) {
+	defer ex.loops.Done()
+
+	var (
+		ticker = time.NewTicker(interval)
+		last   = uint64(0)
+	)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ex.done:
+			return
+		}
+
+		if ex.journal == nil || ex.journal.Seq() == last {
+			continue
+		}
+
+		start := time.Now()
+		s, err := ex.engine.Snapshot(ex.snapshotState)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+
+		path, err := engine.WriteSnapshot(dir, s)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		last = s.Seq
+
+		if err := engine.PruneSnapshots(dir, keepSnapshots); err != nil {
+			logrus.Error(err)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"path":     path,
+			"seq":      s.Seq,
+			"duration": time.Since(start),
+		}).Info("wrote snapshot")
+	}
+}
+
+// applied tracks a command applied by the engine and records its history.
+// It is called while the engine is locked.
+func (ex *Exchange) applied(cmd engine.Command, res engine.Result) {
+	ex.trackCommand(cmd, res)
+	ex.record(cmd, res)
+}
+
+// trackCommand updates the orders and positions of the users after a
+// command was applied. It is called while the engine is locked.
+func (ex *Exchange) trackCommand(cmd engine.Command, res engine.Result) {
+	if cmd.Type == engine.CommandPlace && cmd.Limit && res.Order != nil && res.Order.Limit != nil {
+		ex.mu.Lock()
+		ex.Orders[res.Order.UserID] = append(ex.Orders[res.Order.UserID], res.Order)
+		ex.mu.Unlock()
+	}
+
+	if len(res.Matches) > 0 {
+		ex.pruneFilledOrders()
+		ex.updatePositions(Market(cmd.Market), res.Matches)
+	}
+}
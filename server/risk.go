@@ -0,0 +1,233 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/inagib21/crypto-exchange/engine"
+	"github.com/inagib21/crypto-exchange/orderbook"
+	"github.com/inagib21/crypto-exchange/risk"
+)
+
+// TierMarketMaker is the risk tier of the exchange's market makers.
+const TierMarketMaker risk.Tier = "market_maker"
+
+// defaultRiskLimits apply to every tier and market without limits of their own.
+var defaultRiskLimits = risk.Limits{
+	MaxOrderSize:  1_000,
+	MaxNotional:   1_000_000,
+	MaxOpenOrders: 200,
+	MaxPosition:   10_000,
+	PriceCollar:   0.1,
+}
+
+// marketMakerRiskLimits apply to market makers in every market.
+var marketMakerRiskLimits = risk.Limits{
+	MaxOrderSize:  10_000,
+	MaxNotional:   10_000_000,
+	MaxOpenOrders: 10_000,
+	MaxPosition:   100_000,
+	PriceCollar:   0.2,
+}
+
+// newRiskChecker creates the checker with the exchange's default limits.
+func newRiskChecker(markets []Market) *risk.Checker {
+	c := risk.NewChecker(defaultRiskLimits)
+	for _, market := range markets {
+		c.SetLimits(TierMarketMaker, string(market), marketMakerRiskLimits)
+	}
+	return c
+}
+
+// checkCommand runs the pre-trade checks of the order placed or amended by
+// a command, with the pending commands of its batch as if they were
+// applied. The engine calls it while it is locked, so no other order of the
+// user can be applied between the check and the order.
+func (ex *Exchange) checkCommand(ob *orderbook.Orderbook, cmd engine.Command, pending []engine.Command) error {
+	switch cmd.Type {
+	case engine.CommandPlace:
+		req := PlaceOrderRequest{
+			UserID: cmd.UserID,
+			Type:   MarketOrder,
+			Bid:    cmd.Bid,
+			Size:   cmd.Size,
+			Price:  cmd.Price,
+			Market: Market(cmd.Market),
+			Quote:  cmd.Quote,
+		}
+		if cmd.Limit {
+			req.Type = LimitOrder
+		}
+
+		user, ok := ex.user(req.UserID)
+		if !ok {
+			return fmt.Errorf("user not found: %d", req.UserID)
+		}
+		state := ex.riskState(user.ID, req.Market, ob, req.Bid)
+		addPending(&state, ob, user.ID, req.Bid, pending)
+		return ex.checkRiskState(user, &req, state)
+	case engine.CommandAmend:
+		return ex.checkAmend(ob, cmd, pending)
+	case engine.CommandCancel:
+		// Cancels with a user only cancel their orders.
+		if order := ob.Order(cmd.OrderID); cmd.UserID != 0 && order != nil && order.UserID != cmd.UserID {
+			return engine.ErrOrderNotFound
+		}
+	}
+
+	return nil
+}
+
+// checkAmend runs the pre-trade checks of an amended order as if it was
+// placed with its new price and size. The order is replaced, so its own
+// open order and resting size don't count against it. Reducing the size
+// at the same price is always allowed.
+func (ex *Exchange) checkAmend(ob *orderbook.Orderbook, cmd engine.Command, pending []engine.Command) error {
+	order := ob.Order(cmd.OrderID)
+	if order == nil {
+		return engine.ErrOrderNotFound
+	}
+	if cmd.Price == order.Price && cmd.Size <= order.Size {
+		return nil
+	}
+
+	user, ok := ex.user(order.UserID)
+	if !ok {
+		return fmt.Errorf("user not found: %d", order.UserID)
+	}
+
+	req := PlaceOrderRequest{
+		UserID: order.UserID,
+		Type:   LimitOrder,
+		Bid:    order.Bid,
+		Size:   cmd.Size,
+		Price:  cmd.Price,
+		Market: Market(cmd.Market),
+	}
+
+	state := ex.riskState(user.ID, req.Market, ob, order.Bid)
+	addPending(&state, ob, user.ID, order.Bid, pending)
+	state.OpenOrders--
+	if order.Bid {
+		state.Position -= order.Size
+	} else {
+		state.Position += order.Size
+	}
+
+	return ex.checkRiskState(user, &req, state)
+}
+
+// checkRiskState runs the pre-trade checks for an order request against
+// state. Orders sized in the quote asset are checked at their size at the
+// best price they trade against, or the reference price.
+func (ex *Exchange) checkRiskState(user *User, req *PlaceOrderRequest, state risk.State) error {
+	size := req.Size
+	if req.Quote > 0 {
+		price := state.BestBid
+		if req.Bid {
+			price = state.BestAsk
+		}
+		if price == 0 {
+			price = state.ReferencePrice()
+		}
+		if price > 0 {
+			size = req.Quote / price
+		}
+	}
+
+	order := risk.Order{
+		Market: string(req.Market),
+		Tier:   user.Tier,
+		Bid:    req.Bid,
+		Limit:  req.Type == LimitOrder,
+		Size:   size,
+		Price:  req.Price,
+	}
+
+	return ex.Risk.Check(order, state)
+}
+
+// riskState collects the state of the user in the market of ob for a check
+// of an order on the bid or the ask side. The open orders are the ones of
+// the user resting in ob, and the position counts those on the side of the
+// order as if they were filled.
+func (ex *Exchange) riskState(userID int64, market Market, ob *orderbook.Orderbook, bid bool) risk.State {
+	state := risk.State{}
+
+	ex.mu.RLock()
+	tracked := append([]*orderbook.Order{}, ex.Orders[userID]...)
+	state.Position = ex.positions[market][userID]
+	ex.mu.RUnlock()
+
+	resting := ob.Resting(tracked)
+	state.OpenOrders = len(resting)
+	for _, o := range resting {
+		switch {
+		case bid && o.Bid:
+			state.Position += o.Size
+		case !bid && !o.Bid:
+			state.Position -= o.Size
+		}
+	}
+
+	state.LastPrice = ob.LastPrice()
+	if best, ok := ob.Best(true); ok {
+		state.BestBid = best.Price
+	}
+	if best, ok := ob.Best(false); ok {
+		state.BestAsk = best.Price
+	}
+
+	return state
+}
+
+// addPending adds the pending commands of a user to their state for a check
+// of an order on the bid or the ask side: placed limit orders rest in the
+// book and canceled orders are gone.
+func addPending(state *risk.State, ob *orderbook.Orderbook, userID int64, bid bool, pending []engine.Command) {
+	for _, cmd := range pending {
+		var (
+			size float64
+			side bool
+		)
+
+		switch cmd.Type {
+		case engine.CommandPlace:
+			if !cmd.Limit || cmd.UserID != userID {
+				continue
+			}
+			state.OpenOrders++
+			size, side = cmd.Size, cmd.Bid
+		case engine.CommandCancel:
+			order := ob.Order(cmd.OrderID)
+			if order == nil || order.UserID != userID {
+				continue
+			}
+			state.OpenOrders--
+			size, side = -order.Size, order.Bid
+		default:
+			continue
+		}
+
+		switch {
+		case bid && side:
+			state.Position += size
+		case !bid && !side:
+			state.Position -= size
+		}
+	}
+}
+
+// updatePositions applies the matches to the positions of the users.
+func (ex *Exchange) updatePositions(market Market, matches []orderbook.Match) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	if ex.positions[market] == nil {
+		ex.positions[market] = make(map[int64]float64)
+	}
+
+	for _, match := range matches {
+		ex.positions[market][match.Bid.UserID] += match.SizeFilled
+		ex.positions[market][match.Ask.UserID] -= match.SizeFilled
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"github.com/inagib21/crypto-exchange/engine"
+	"github.com/inagib21/crypto-exchange/orderbook"
+	"github.com/inagib21/crypto-exchange/store"
+	"github.com/sirupsen/logrus"
+)
+
+// consumerBuffer is the number of applied commands a consumer of the
+// sequencer can fall behind before it holds up matching.
+const consumerBuffer = 1024
+
+// startedSuffix names the Seq a consumer saves before processing a command
+// it must not process twice.
+const startedSuffix = ".started"
+
+// consumer processes the commands applied by the sequencer. A durable
+// consumer saves the Seq of every command with matches it processed, and the
+// trades of the commands it missed because the exchange stopped are fed to
+// it again on startup. A consumer with once set saves the Seq of a command
+// before processing it too, and skips a command it may have partly
+// processed instead of processing it again.
+type consumer struct {
+	name    string
+	durable bool
+	once    bool
+	consume func(cmd engine.Command, res engine.Result)
+}
+
+// consumerList returns the downstream consumers of the exchange:
+//   - candles updates the candles of the markets,
+//   - tickers updates the tickers, they are rebuilt from the stored trades
+//     on startup,
+//   - settlement transfers the assets and fees of the matches and publishes
+//     the fills. Transfers are not sent twice: the settlement of a command
+//     interrupted by a crash is reported for reconciliation.
+func (ex *Exchange) consumerList() []consumer {
+	return []consumer{
+		{name: "candles", durable: true, consume: ex.recordCandleData},
+		{name: "tickers", consume: ex.recordTickers},
+		{name: "settlement", durable: true, once: true, consume: ex.settle},
+	}
+}
+
+// startConsumers subscribes the downstream consumers of the exchange to the
+// sequencer. Each of them sees the commands of a market in the order they
+// were applied.
+func (ex *Exchange) startConsumers() {
+	for _, c := range ex.consumerList() {
+		outputs := ex.sequencer.Subscribe(consumerBuffer)
+
+		ex.consumers.Add(1)
+		go func(c consumer) {
+			defer ex.consumers.Done()
+			for out := range outputs {
+				ex.consume(c, out.Command, out.Result)
+			}
+		}(c)
+	}
+}
+
+// consume feeds a command to a consumer and saves its Seq.
+func (ex *Exchange) consume(c consumer, cmd engine.Command, res engine.Result) {
+	if !c.durable || len(res.Matches) == 0 {
+		c.consume(cmd, res)
+		return
+	}
+
+	if c.once {
+		ex.saveConsumerSeq(c.name+startedSuffix, res.Seq)
+	}
+	c.consume(cmd, res)
+	ex.saveConsumerSeq(c.name, res.Seq)
+}
+
+func (ex *Exchange) saveConsumerSeq(name string, seq uint64) {
+	if err := ex.Store.SaveConsumerSeq(name, seq); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"consumer": name,
+			"seq":      seq,
+			"error":    err,
+		}).Error("saving consumer seq")
+	}
+}
+
+// catchUpConsumers feeds the trades of the commands the durable consumers
+// didn't process before the exchange stopped to them again. It is called
+// once the store recorded every journaled command.
+func (ex *Exchange) catchUpConsumers() error {
+	for _, c := range ex.consumerList() {
+		if !c.durable {
+			continue
+		}
+
+		seq, err := ex.Store.ConsumerSeq(c.name)
+		if err != nil {
+			return err
+		}
+		if c.once {
+			started, err := ex.Store.ConsumerSeq(c.name + startedSuffix)
+			if err != nil {
+				return err
+			}
+			if started > seq {
+				logrus.WithFields(logrus.Fields{
+					"consumer": c.name,
+					"seq":      started,
+				}).Error("command interrupted while it was processed, it is skipped and must be reconciled")
+				seq = started
+				ex.saveConsumerSeq(c.name, seq)
+			}
+		}
+
+		trades, err := ex.Store.TradesAfter(seq)
+		if err != nil {
+			return err
+		}
+		outputs := tradeOutputs(trades)
+		for _, out := range outputs {
+			ex.consume(c, out.Command, out.Result)
+		}
+
+		if len(outputs) > 0 {
+			logrus.WithFields(logrus.Fields{
+				"consumer": c.name,
+				"commands": len(outputs),
+			}).Info("caught up consumer")
+		}
+	}
+
+	return nil
+}
+
+// tradeOutputs rebuilds the matches of the commands that executed stored
+// trades, in the order of the commands.
+func tradeOutputs(trades []store.Trade) []engine.Output {
+	outputs := []engine.Output{}
+	for _, t := range trades {
+		if n := len(outputs); n == 0 || outputs[n-1].Result.Seq != t.Seq {
+			outputs = append(outputs, engine.Output{
+				Command: engine.Command{Market: t.Market, Timestamp: t.Timestamp},
+				Result:  engine.Result{Seq: t.Seq, Timestamp: t.Timestamp},
+			})
+		}
+
+		out := &outputs[len(outputs)-1]
+		out.Result.Matches = append(out.Result.Matches, orderbook.Match{
+			Bid:        &orderbook.Order{ID: t.BidOrderID, UserID: t.BidUserID, Bid: true},
+			Ask:        &orderbook.Order{ID: t.AskOrderID, UserID: t.AskUserID},
+			SizeFilled: t.Size,
+			Price:      t.Price,
+			TakerBid:   t.Bid,
+			MakerFee:   t.MakerFee,
+			TakerFee:   t.TakerFee,
+		})
+	}
+	return outputs
+}
+
+// recordCandleData adds the trades of a command to the candles.
+func (ex *Exchange) recordCandleData(cmd engine.Command, res engine.Result) {
+	market := Market(cmd.Market)
+	for _, match := range res.Matches {
+		ex.recordCandles(market, match.Price, match.SizeFilled, res.Timestamp)
+	}
+}
+
+// recordTickers adds the trades of a command to the tickers.
+func (ex *Exchange) recordTickers(cmd engine.Command, res engine.Result) {
+	for _, match := range res.Matches {
+		ex.Tickers.Add(cmd.Market, match.Price, match.SizeFilled, res.Timestamp)
+	}
+}
+
+// settle settles the matches of a command.
+func (ex *Exchange) settle(cmd engine.Command, res engine.Result) {
+	if err := ex.settleMatches(Market(cmd.Market), res.Matches); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"market": cmd.Market,
+			"error":  err,
+		}).Error("settling matches")
+	}
+}
@@ -2,20 +2,27 @@ package server
 
 import (
 	"context"
-	"crypto/ecdsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math/big"
 	"net/http"
+	"os"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/inagib21/crypto-exchange/candles"
+	"github.com/inagib21/crypto-exchange/engine"
+	"github.com/inagib21/crypto-exchange/fees"
+	"github.com/inagib21/crypto-exchange/journal"
 	"github.com/inagib21/crypto-exchange/orderbook"
+	"github.com/inagib21/crypto-exchange/risk"
+	"github.com/inagib21/crypto-exchange/signer"
+	"github.com/inagib21/crypto-exchange/store"
+	"github.com/inagib21/crypto-exchange/ticker"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
 )
@@ -27,9 +34,55 @@ const (
 	MarketOrder OrderType = "MARKET"
 	LimitOrder  OrderType = "LIMIT"
 
-	exchangePrivateKey = "4f3edf983ac636a65a842ce7c78d9aa706d3b113bce9c46f30d7d21715b23b1d"
+	// ReasonMarketHalted rejects market orders while matching is halted.
+	ReasonMarketHalted risk.Reason = "MARKET_HALTED"
+	// ReasonMarketState rejects market orders outside of continuous trading.
+	ReasonMarketState risk.Reason = "MARKET_STATE"
+	// ReasonMarketClosed rejects orders while the market is closed.
+	ReasonMarketClosed risk.Reason = "MARKET_CLOSED"
+	// ReasonNotEnoughVolume rejects unprotected market orders the book
+	// can't fill.
+	ReasonNotEnoughVolume risk.Reason = "NOT_ENOUGH_VOLUME"
+	// ReasonOrderNotFound rejects cancels and amends of orders that are not
+	// resting in the book.
+	ReasonOrderNotFound risk.Reason = "ORDER_NOT_FOUND"
+	// ReasonBatchRejected rejects the valid items of a batch another item
+	// of which was rejected.
+	ReasonBatchRejected risk.Reason = "BATCH_REJECTED"
 )
 
+// defaultCircuitBreaker halts a market for a minute when a fill would move
+// the price more than 10% within five minutes.
+var defaultCircuitBreaker = orderbook.CircuitBreaker{
+	Band:         0.1,
+	Window:       5 * time.Minute,
+	HaltDuration: time.Minute,
+}
+
+// matchingPolicies selects how the orders resting at a price level are
+// filled in every market, e.g. orderbook.ProRata{TopOrder: true}. Markets
+// without a policy match in price-time priority.
+var matchingPolicies = map[Market]orderbook.MatchingPolicy{
+	MarketETH: orderbook.FIFO{},
+}
+
+// defaultReopenAuction is how long the call auction reopening a market after
+// a halt runs.
+const defaultReopenAuction = 30 * time.Second
+
+// devKeys are the private keys of the local development accounts. They are
+// only used when devKeysEnv opts in and no keystore, remote signer or key is
+// configured for an account.
+var devKeys = map[string]string{
+	"EXCHANGE": "4f3edf983ac636a65a842ce7c78d9aa706d3b113bce9c46f30d7d21715b23b1d",
+	"USER_8":   "829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4",
+	"USER_7":   "a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3",
+	"USER_666": "e485d098507f54e7733a205420dfddbe58db035fa577fc294ebd14db90767a52",
+}
+
+// devKeysEnv is the environment variable that allows the development keys.
+const devKeysEnv = "EXCHANGE_DEV_KEYS"
+
 type (
 	OrderType string
 	Market    string
@@ -41,6 +94,14 @@ type (
 		Size   float64
 		Price  float64
 		Market Market
+		// Quote sizes a market order in the quote asset instead of Size,
+		// e.g. how much a buy order spends.
+		Quote float64 `json:",omitempty"`
+		// MaxSlippage and WorstPrice protect a market order: it stops at
+		// the price MaxSlippage away from the best price, or at WorstPrice,
+		// whichever comes first, and the rest of it is canceled.
+		MaxSlippage float64 `json:",omitempty"`
+		WorstPrice  float64 `json:",omitempty"`
 	}
 
 	Order struct {
@@ -67,7 +128,8 @@ type (
 	}
 
 	APIError struct {
-		Error string
+		Error  string
+		Reason risk.Reason `json:",omitempty"`
 	}
 )
 
@@ -82,76 +144,279 @@ func StartServer() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	exchangeSigner, err := loadSigner("EXCHANGE")
+	if err != nil {
+		log.Fatal(err)
+	}
 	// Create a new exchange instance.
-	ex, err := NewExchange(exchangePrivateKey, client)
+	ex := NewExchange(exchangeSigner, NewETHSettler(client))
+
+	storePath := os.Getenv("EXCHANGE_DB")
+	if storePath == "" {
+		storePath = defaultStorePath
+	}
+	db, err := store.OpenBolt(storePath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer db.Close()
+	ex.Store = db
+	if err := ex.restoreCandles(); err != nil {
+		log.Fatal(err)
+	}
 
-	ex.registerUser("829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4", 8)
-	ex.registerUser("a453611d9419d0e56f499079478fd72c37b251a94bfde4d19872c44cf65386e3", 7)
-	ex.registerUser("e485d098507f54e7733a205420dfddbe58db035fa577fc294ebd14db90767a52", 666)
+	userTiers := map[int64]risk.Tier{
+		8:   TierMarketMaker,
+		7:   risk.DefaultTier,
+		666: risk.DefaultTier,
+	}
+	for userID, tier := range userTiers {
+		s, err := loadSigner(fmt.Sprintf("USER_%d", userID))
+		if err != nil {
+			log.Fatal(err)
+		}
+		user := ex.registerUser(userID, s, tier)
+		user.APIToken = os.Getenv(fmt.Sprintf("USER_%d_API_TOKEN", userID))
+	}
 
-	// Define HTTP routes and their corresponding handlers.
+	journalPath := os.Getenv("EXCHANGE_JOURNAL")
+	if journalPath == "" {
+		journalPath = defaultJournalPath
+	}
+	journalOpts, err := journalOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	snapshotDir := os.Getenv("EXCHANGE_SNAPSHOTS")
+	if snapshotDir == "" {
+		snapshotDir = defaultSnapshotDir
+	}
+	snapshotInterval, err := snapshotInterval()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ex.OpenJournal(journalPath, snapshotDir, journalOpts); err != nil {
+		log.Fatal(err)
+	}
+	defer ex.Close()
+	ex.loops.Add(1)
+	go ex.runSnapshots(snapshotDir, snapshotInterval)
+
+	ex.registerRoutes(e)
+	ex.loops.Add(1)
+	go ex.runSessions(sessionTickInterval)
+
+	// Start the HTTP server.
+	e.Start(":3000")
+}
+
+// registerRoutes registers the HTTP routes of the exchange.
+func (ex *Exchange) registerRoutes(e *echo.Echo) {
 	e.POST("/order", ex.handlePlaceOrder)
 	e.GET("/trades/:market", ex.handleGetTrades)
+	e.GET("/klines/:market", ex.handleGetKlines)
+	e.GET("/ticker", ex.handleGetTickers)
+	e.GET("/ticker/:market", ex.handleGetTicker)
 	e.GET("/order/:userID", ex.handleGetOrders)
-	e.GET("/book/:market", ex.handleGetBook)
+	e.GET("/orders", ex.handleGetOrderHistory)
+	e.DELETE("/orders", ex.handleCancelAll)
+	e.POST("/orders/batch", ex.handleBatch)
+	e.POST("/deadman", ex.handleDeadMan)
+	e.GET("/orders/:id", ex.handleGetOrder)
+	e.GET("/fills/:userID", ex.handleGetFills)
+	e.GET("/ledger/:userID", ex.handleGetLedger)
+	e.GET("/balances/:userID", ex.handleGetBalances)
+	e.GET("/depth/:market", ex.handleGetDepth)
 	e.GET("/book/:market/bid", ex.handleGetBestBid)
 	e.GET("/book/:market/ask", ex.handleGetBestAsk)
 
+	e.GET("/ws", ex.handleWebSocket)
+	e.GET("/markets/:market", ex.handleGetMarketStatus)
+
+	admin := e.Group("/admin", requireAdmin)
+	admin.POST("/markets/:market/halt", ex.handleHaltMarket)
+	admin.POST("/markets/:market/resume", ex.handleResumeMarket)
+	admin.POST("/markets/:market/state", ex.handleSetMarketState)
+	admin.GET("/book/:market", ex.handleGetBook)
+
 	e.DELETE("/order/:id", ex.cancelOrder)
-	// Start the HTTP server.
-	e.Start(":3000")
+	e.PATCH("/order/:id", ex.handleAmendOrder)
 }
 
-type User struct {
-	ID         int64
-	PrivateKey *ecdsa.PrivateKey
-}
+// loadSigner resolves the signer for the account called name. It looks for
+// <name>_KEYSTORE (with <name>_PASSPHRASE), <name>_SIGNER_URL (with
+// <name>_ADDRESS) and <name>_PRIVATE_KEY in that order. It falls back to the
+// development key of the account only when EXCHANGE_DEV_KEYS is true.
+func loadSigner(name string) (signer.Signer, error) {
+	if path := os.Getenv(name + "_KEYSTORE"); path != "" {
+		return signer.FromKeystore(path, os.Getenv(name+"_PASSPHRASE"))
+	}
 
-func NewUser(privKey string, id int64) *User {
-	pk, err := crypto.HexToECDSA(privKey)
-	if err != nil {
-		panic(err)
+	if url := os.Getenv(name + "_SIGNER_URL"); url != "" {
+		address := os.Getenv(name + "_ADDRESS")
+		if !common.IsHexAddress(address) {
+			return nil, fmt.Errorf("%s_ADDRESS must be set when using a remote signer", name)
+		}
+		return signer.NewRemote(url, common.HexToAddress(address)), nil
+	}
+
+	if _, ok := os.LookupEnv(name + "_PRIVATE_KEY"); ok {
+		return signer.FromEnv(name + "_PRIVATE_KEY")
 	}
 
+	devKey, ok := devKeys[name]
+	if !ok || !devKeysAllowed() {
+		return nil, fmt.Errorf("no signer configured for %s", name)
+	}
+
+	logrus.WithField("account", name).Warn("using development key")
+	return signer.FromHex(devKey)
+}
+
+// devKeysAllowed reports whether EXCHANGE_DEV_KEYS opts in to the
+// development keys.
+func devKeysAllowed() bool {
+	allowed, err := strconv.ParseBool(os.Getenv(devKeysEnv))
+	return err == nil && allowed
+}
+
+type User struct {
+	ID     int64
+	Signer signer.Signer
+	Tier   risk.Tier
+	// APIToken authenticates the user on their private WebSocket topic,
+	// which is closed when it is empty.
+	APIToken string
+}
+
+func NewUser(id int64, s signer.Signer, tier risk.Tier) *User {
 	return &User{
-		ID:         id,
-		PrivateKey: pk,
+		ID:     id,
+		Signer: s,
+		Tier:   tier,
 	}
 }
 
+// httpErrorHandler answers the requests whose handler failed with the error
+// as an APIError, a 500 unless it is an echo.HTTPError.
 func httpErrorHandler(err error, c echo.Context) {
-	fmt.Println(err)
+	code, msg := http.StatusInternalServerError, err.Error()
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		code, msg = httpErr.Code, fmt.Sprint(httpErr.Message)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"path":  c.Request().URL.Path,
+		"code":  code,
+		"error": err,
+	}).Error("request failed")
+
+	if !c.Response().Committed {
+		c.JSON(code, APIError{Error: msg})
+	}
 }
 
 type Exchange struct {
-	Client *ethclient.Client
-	mu     sync.RWMutex
-	Users  map[int64]*User
+	Settler Settler
+	mu      sync.RWMutex
+	Users   map[int64]*User
 	// Orders maps a user to his orders.
 	Orders     map[int64][]*orderbook.Order
-	PrivateKey *ecdsa.PrivateKey
+	Signer     signer.Signer
+	Fees       *fees.Engine
+	FeeAccount *FeeAccount
+	Risk       *risk.Checker
+	// Store keeps the users, the order history, the trades, the candles
+	// and the ledger.
+	Store store.Store
+	// Candles aggregates the trades of every market into candles.
+	Candles *candles.Aggregator
+	// Tickers keeps the 24h statistics of every market.
+	Tickers *ticker.Tracker
+	// positions maps a market to the net position of every user.
+	positions  map[Market]map[int64]float64
+	events     *Broker
 	orderbooks map[Market]*orderbook.Orderbook
+	// engine executes every command that changes an order book and
+	// journals it once the journal is opened.
+	engine *engine.Engine
+	// sequencer feeds the commands to the engine one market at a time and
+	// fans the results out to the consumers.
+	sequencer *engine.Sequencer
+	consumers sync.WaitGroup
+	journal   *journal.Journal
+	// done stops the background loops of the exchange, loops waits for
+	// them to return.
+	done  chan struct{}
+	loops sync.WaitGroup
+	// deadMan maps a user to their armed dead man's switch.
+	deadManMu  sync.Mutex
+	deadMan    map[int64]*deadManTimer
+	deadManGen uint64
 }
 
-func NewExchange(privateKey string, client *ethclient.Client) (*Exchange, error) {
-	orderbooks := make(map[Market]*orderbook.Orderbook)
-	orderbooks[MarketETH] = orderbook.NewOrderbook()
+func NewExchange(s signer.Signer, settler Settler) *Exchange {
+	feeEngine := fees.NewEngine(defaultFeeSchedule)
+	orderbooks := newOrderbooks(feeEngine)
 
-	pk, err := crypto.HexToECDSA(privateKey)
-	if err != nil {
-		return nil, err
+	markets := []Market{}
+	for market := range orderbooks {
+		markets = append(markets, market)
 	}
 
-	return &Exchange{
-		Client:     client,
+	ex := &Exchange{
+		Settler:    settler,
 		Users:      make(map[int64]*User),
 		Orders:     make(map[int64][]*orderbook.Order),
-		PrivateKey: pk,
+		Signer:     s,
+		Fees:       feeEngine,
+		FeeAccount: NewFeeAccount(),
+		Risk:       newRiskChecker(markets),
+		Store:      store.NewMemory(),
+		Candles:    candles.NewAggregator(),
+		Tickers:    ticker.NewTracker(ticker.DefaultWindow),
+		positions:  make(map[Market]map[int64]float64),
+		events:     NewBroker(),
 		orderbooks: orderbooks,
-	}, nil
+		deadMan:    make(map[int64]*deadManTimer),
+		done:       make(chan struct{}),
+	}
+	ex.engine = engine.New(ex.books(), nil)
+	ex.engine.OnApply(ex.applied)
+	ex.engine.SetCheck(ex.checkCommand)
+	ex.sequencer = engine.NewSequencer(ex.engine, engine.DefaultQueueSize)
+	ex.startConsumers()
+
+	return ex
+}
+
+// newOrderbooks creates the order book of every market, charging fees
+// with feeEngine.
+func newOrderbooks(feeEngine *fees.Engine) map[Market]*orderbook.Orderbook {
+	orderbooks := make(map[Market]*orderbook.Orderbook)
+	orderbooks[MarketETH] = orderbook.NewOrderbook()
+
+	for market, ob := range orderbooks {
+		ob.SetFeeCharger(marketFees{market: market, engine: feeEngine})
+		ob.SetCircuitBreaker(defaultCircuitBreaker)
+		ob.SetReopenAuction(defaultReopenAuction)
+		if policy, ok := matchingPolicies[market]; ok {
+			ob.SetMatchingPolicy(policy)
+		}
+	}
+
+	return orderbooks
+}
+
+// NewReplayBooks creates empty order books configured like the ones of the
+// exchange, keyed by market, to replay a journal offline.
+func NewReplayBooks() map[string]*orderbook.Orderbook {
+	books := make(map[string]*orderbook.Orderbook)
+	for market, ob := range newOrderbooks(fees.NewEngine(defaultFeeSchedule)) {
+		books[string(market)] = ob
+	}
+	return books
 }
 
 type GetOrdersResponse struct {
@@ -159,23 +424,28 @@ type GetOrdersResponse struct {
 	Bids []Order
 }
 
-func (ex *Exchange) registerUser(pk string, userId int64) {
-	user := NewUser(pk, userId)
+func (ex *Exchange) registerUser(userId int64, s signer.Signer, tier risk.Tier) *User {
+	user := NewUser(userId, s, tier)
+	ex.mu.Lock()
 	ex.Users[userId] = user
+	ex.mu.Unlock()
+
+	err := ex.Store.SaveUser(store.User{
+		ID:      userId,
+		Address: s.Address().Hex(),
+		Tier:    string(tier),
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
 
 	logrus.WithFields(logrus.Fields{
-		"id": userId,
+		"id":      userId,
+		"address": s.Address().Hex(),
+		"tier":    tier,
 	}).Info("new exchange user")
-}
 
-func (ex *Exchange) handleGetTrades(c echo.Context) error {
-	market := Market(c.Param("market"))
-	ob, ok := ex.orderbooks[market]
-	if !ok {
-		return c.JSON(http.StatusBadRequest, APIError{Error: "orderbook not found"})
-	}
-
-	return c.JSON(http.StatusOK, ob.Trades)
+	return user
 }
 
 func (ex *Exchange) handleGetOrders(c echo.Context) error {
@@ -185,27 +455,21 @@ func (ex *Exchange) handleGetOrders(c echo.Context) error {
 		return err
 	}
 
-	ex.mu.RLock()
-	orderbookOrders := ex.Orders[int64(userID)]
 	ordersResp := &GetOrdersResponse{
 		Asks: []Order{},
 		Bids: []Order{},
 	}
 
-	for i := 0; i < len(orderbookOrders); i++ {
-		// It could be that the order is getting filled even though its included in this
-		// response. We must double check if the limit is not nil
-		if orderbookOrders[i].Limit == nil {
-			continue
-		}
-
+	// The orders are copied by their book, they could be filled while the
+	// response is built.
+	for _, resting := range ex.restingOrders(int64(userID)) {
 		order := Order{
-			ID:        orderbookOrders[i].ID,
-			UserID:    orderbookOrders[i].UserID,
-			Price:     orderbookOrders[i].Limit.Price,
-			Size:      orderbookOrders[i].Size,
-			Timestamp: orderbookOrders[i].Timestamp,
-			Bid:       orderbookOrders[i].Bid,
+			ID:        resting.ID,
+			UserID:    resting.UserID,
+			Price:     resting.Price,
+			Size:      resting.Size,
+			Timestamp: resting.Timestamp,
+			Bid:       resting.Bid,
 		}
 
 		if order.Bid {
@@ -214,116 +478,149 @@ func (ex *Exchange) handleGetOrders(c echo.Context) error {
 			ordersResp.Asks = append(ordersResp.Asks, order)
 		}
 	}
-	ex.mu.RUnlock()
 
 	return c.JSON(http.StatusOK, ordersResp)
 }
 
-func (ex *Exchange) handleGetBook(c echo.Context) error {
-	market := Market(c.Param("market"))
-	ob, ok := ex.orderbooks[market]
-	if !ok {
-		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "market not found"})
-	}
+// user returns a registered user.
+func (ex *Exchange) user(id int64) (*User, bool) {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
 
-	orderbookData := OrderbookData{
-		TotalBidVolume: ob.BidTotalVolume(),
-		TotalAskVolume: ob.AskTotalVolume(),
-		Asks:           []*Order{},
-		Bids:           []*Order{},
-	}
+	user, ok := ex.Users[id]
+	return user, ok
+}
 
-	for _, limit := range ob.Asks() {
-		for _, order := range limit.Orders {
-			o := Order{
-				UserID:    order.UserID,
-				ID:        order.ID,
-				Price:     limit.Price,
-				Size:      order.Size,
-				Bid:       order.Bid,
-				Timestamp: order.Timestamp,
-			}
-			orderbookData.Asks = append(orderbookData.Asks, &o)
-		}
-	}
+// restingOrders returns copies of the orders of a user resting in a book.
+func (ex *Exchange) restingOrders(userID int64) []orderbook.Order {
+	ex.mu.RLock()
+	orders := append([]*orderbook.Order{}, ex.Orders[userID]...)
+	ex.mu.RUnlock()
 
-	for _, limit := range ob.Bids() {
-		for _, order := range limit.Orders {
-			o := Order{
-				UserID:    order.UserID,
-				ID:        order.ID,
-				Price:     limit.Price,
-				Size:      order.Size,
-				Bid:       order.Bid,
-				Timestamp: order.Timestamp,
-			}
-			orderbookData.Bids = append(orderbookData.Bids, &o)
-		}
+	resting := []orderbook.Order{}
+	for _, ob := range ex.orderbooks {
+		resting = append(resting, ob.Resting(orders)...)
 	}
-
-	return c.JSON(http.StatusOK, orderbookData)
+	return resting
 }
 
+// PriceResponse is the best price of a side of a book. It doesn't tell
+// whose order it is, /admin/book shows the owners under aliases.
 type PriceResponse struct {
 	Price float64
 }
 
 func (ex *Exchange) handleGetBestBid(c echo.Context) error {
-	var (
-		market = Market(c.Param("market"))
-		ob     = ex.orderbooks[market]
-		order  = Order{}
-	)
-
-	if len(ob.Bids()) == 0 {
-		return c.JSON(http.StatusOK, order)
+	market := Market(c.Param("market"))
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
 	}
 
-	bestLimit := ob.Bids()[0]
-	bestOrder := bestLimit.Orders[0]
-
-	order.Price = bestLimit.Price
-	order.UserID = bestOrder.UserID
+	price := PriceResponse{}
+	if best, ok := ob.Best(true); ok {
+		price.Price = best.Price
+	}
 
-	return c.JSON(http.StatusOK, order)
+	return c.JSON(http.StatusOK, price)
 }
 
 func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
-	var (
-		market = Market(c.Param("market"))
-		ob     = ex.orderbooks[market]
-		order  = Order{}
-	)
-
-	if len(ob.Asks()) == 0 {
-		return c.JSON(http.StatusOK, order)
+	market := Market(c.Param("market"))
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
 	}
 
-	bestLimit := ob.Asks()[0]
-	bestOrder := bestLimit.Orders[0]
-
-	order.Price = bestLimit.Price
-	order.UserID = bestOrder.UserID
+	price := PriceResponse{}
+	if best, ok := ob.Best(false); ok {
+		price.Price = best.Price
+	}
 
-	return c.JSON(http.StatusOK, order)
+	return c.JSON(http.StatusOK, price)
 }
 
 func (ex *Exchange) cancelOrder(c echo.Context) error {
 	idStr := c.Param("id")
 	id, _ := strconv.Atoi(idStr)
 
-	ob := ex.orderbooks[MarketETH]
-	order := ob.Orders[int64(id)]
-	ob.CancelOrder(order)
+	_, err := ex.execute(engine.Command{
+		Type:    engine.CommandCancel,
+		Market:  string(MarketETH),
+		OrderID: int64(id),
+	})
+	if apiErr, ok := rejectionError(err); ok {
+		if errors.Is(err, engine.ErrOrderNotFound) {
+			return c.JSON(http.StatusNotFound, apiErr)
+		}
+		return c.JSON(http.StatusBadRequest, apiErr)
+	}
+	if err != nil {
+		return err
+	}
 
 	log.Println("order canceled id => ", id)
 
 	return c.JSON(200, map[string]any{"msg": "order deleted"})
 }
 
-func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order) ([]orderbook.Match, []*MatchedOrder) {
-	ob := ex.orderbooks[market]
-	matches := ob.PlaceMarketOrder(order)
+type AmendOrderRequest struct {
+	Price float64
+	Size  float64
+}
+
+// handleAmendOrder changes the price and size of a resting order. An order
+// keeps its time priority when only its size is reduced. The amended order
+// passes the pre-trade checks of a new order, see checkAmend.
+func (ex *Exchange) handleAmendOrder(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid order id"})
+	}
+
+	req := AmendOrderRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	res, err := ex.execute(engine.Command{
+		Type:    engine.CommandAmend,
+		Market:  string(MarketETH),
+		OrderID: int64(id),
+		Size:    req.Size,
+		Price:   req.Price,
+	})
+	if apiErr, ok := rejectionError(err); ok {
+		if errors.Is(err, engine.ErrOrderNotFound) {
+			return c.JSON(http.StatusNotFound, apiErr)
+		}
+		return c.JSON(http.StatusBadRequest, apiErr)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, Order{
+		UserID:    res.OrderState.UserID,
+		ID:        res.OrderState.ID,
+		Price:     res.OrderState.Price,
+		Size:      res.OrderState.Size,
+		Bid:       res.OrderState.Bid,
+		Timestamp: res.OrderState.Timestamp,
+	})
+}
+
+func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order, req *PlaceOrderRequest) (engine.Result, []*MatchedOrder, error) {
+	cmd := placeCommand(market, order, false, 0)
+	cmd.Quote = req.Quote
+	cmd.MaxSlippage = req.MaxSlippage
+	cmd.WorstPrice = req.WorstPrice
+
+	res, err := ex.execute(cmd)
+	if err != nil {
+		return res, nil, err
+	}
+	matches := res.Matches
 	matchedOrders := make([]*MatchedOrder, len(matches))
 
 	isBid := false
@@ -332,7 +629,6 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 	}
 
 	totalSizeFilled := 0.0
-	sumPrice := 0.0
 	for i := 0; i < len(matchedOrders); i++ {
 		id := matches[i].Bid.ID
 		limitUserID := matches[i].Bid.UserID
@@ -349,17 +645,35 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 		}
 
 		totalSizeFilled += matches[i].SizeFilled
-		sumPrice += matches[i].Price
 	}
 
-	avgPrice := sumPrice / float64(len(matches))
-
 	logrus.WithFields(logrus.Fields{
 		"type":     order.Type(),
 		"size":     totalSizeFilled,
-		"avgPrice": avgPrice,
+		"avgPrice": res.OrderState.AvgPrice,
+		"status":   res.OrderState.Status,
 	}).Info("filled market order")
 
+	return res, matchedOrders, nil
+}
+
+// placeCommand returns the command placing order in market.
+func placeCommand(market Market, order *orderbook.Order, limit bool, price float64) engine.Command {
+	return engine.Command{
+		Type:      engine.CommandPlace,
+		Market:    string(market),
+		OrderID:   order.ID,
+		UserID:    order.UserID,
+		Limit:     limit,
+		Bid:       order.Bid,
+		Size:      order.Size,
+		Price:     price,
+		Timestamp: order.Timestamp,
+	}
+}
+
+// pruneFilledOrders stops tracking the orders that are completely filled.
+func (ex *Exchange) pruneFilledOrders() {
 	newOrderMap := make(map[int64][]*orderbook.Order)
 
 	ex.mu.Lock()
@@ -374,111 +688,224 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 	}
 	ex.Orders = newOrderMap
 	ex.mu.Unlock()
-
-	return matches, matchedOrders
 }
 
 func (ex *Exchange) handlePlaceLimitOrder(market Market, price float64, order *orderbook.Order) error {
-	ob := ex.orderbooks[market]
-	ob.PlaceLimitOrder(price, order)
-
-	// keep track of the user orders
-	ex.mu.Lock()
-	ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
-	ex.mu.Unlock()
-
-	return nil
+	// The engine keeps track of the user orders, see trackCommand.
+	_, err := ex.execute(placeCommand(market, order, true, price))
+	return err
 }
 
 type PlaceOrderResponse struct {
 	OrderID int64
+	// Status, Filled and AvgPrice are the state of a market order once it
+	// was matched, and Levels the price levels it consumed.
+	Status   orderbook.OrderStatus `json:",omitempty"`
+	Filled   float64               `json:",omitempty"`
+	AvgPrice float64               `json:",omitempty"`
+	Levels   []orderbook.Level     `json:",omitempty"`
 }
 
 func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
 	var placeOrderData PlaceOrderRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&placeOrderData); err != nil {
-		return err
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
 	}
 
 	market := Market(placeOrderData.Market)
-	order := orderbook.NewOrder(placeOrderData.Bid, placeOrderData.Size, placeOrderData.UserID)
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	if _, ok := ex.user(placeOrderData.UserID); !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "user not found"})
+	}
+
+	order := ex.engine.NewOrder(placeOrderData.Bid, placeOrderData.Size, placeOrderData.UserID)
+
+	// reject stores the order as rejected before answering the request.
+	reject := func(apiErr APIError) error {
+		ex.recordRejection(market, order, &placeOrderData)
+		return c.JSON(http.StatusBadRequest, apiErr)
+	}
+
+	if err := validateMarketOptions(&placeOrderData); err != nil {
+		return reject(APIError{Error: err.Error(), Reason: risk.ReasonInvalidOrder})
+	}
 
 	// Limit orders
 	if placeOrderData.Type == LimitOrder {
-		if err := ex.handlePlaceLimitOrder(market, placeOrderData.Price, order); err != nil {
+		err := ex.handlePlaceLimitOrder(market, placeOrderData.Price, order)
+		if apiErr, ok := rejectionError(err); ok {
+			return reject(apiErr)
+		}
+		if err != nil {
 			return err
 		}
 	}
 
+	resp := &PlaceOrderResponse{
+		OrderID: order.ID,
+	}
+
 	// market orders
 	if placeOrderData.Type == MarketOrder {
-		matches, _ := ex.handlePlaceMarketOrder(market, order)
-		if err := ex.handleMatches(matches); err != nil {
+		res, _, err := ex.handlePlaceMarketOrder(market, order, &placeOrderData)
+		if apiErr, ok := rejectionError(err); ok {
+			return reject(apiErr)
+		}
+		if err != nil {
 			return err
 		}
-	}
+		if ob.Halted() != nil {
+			ex.events.Publish(marketTopic(market), EventHalt, ex.marketStatus(market, ob))
+		}
 
-	resp := &PlaceOrderResponse{
-		OrderID: order.ID,
+		resp.Status = res.OrderState.Status
+		resp.Filled = res.OrderState.Filled
+		resp.AvgPrice = res.OrderState.AvgPrice
+		resp.Levels = orderbook.ConsumedLevels(res.Matches)
 	}
 
 	return c.JSON(200, resp)
 }
 
-func (ex *Exchange) handleMatches(matches []orderbook.Match) error {
-	for _, match := range matches {
-		fromUser, ok := ex.Users[match.Ask.UserID]
-		if !ok {
-			return fmt.Errorf("user not found: %d", match.Ask.UserID)
-		}
-
-		toUser, ok := ex.Users[match.Bid.UserID]
-		if !ok {
-			return fmt.Errorf("user not found: %d", match.Bid.UserID)
-		}
-		toAddresss := crypto.PubkeyToAddress(toUser.PrivateKey.PublicKey)
+// rejectionError returns the error answering a request whose order was
+// rejected by the engine with err, and false for errors that are not
+// rejections, e.g. a failing journal.
+func rejectionError(err error) (APIError, bool) {
+	var rejection *risk.Rejection
+	switch {
+	case errors.As(err, &rejection):
+		return APIError{Error: rejection.Message, Reason: rejection.Reason}, true
+	case errors.Is(err, engine.ErrInvalidOrder),
+		errors.Is(err, engine.ErrDuplicateOrder),
+		errors.Is(err, engine.ErrMarketNotFound),
+		errors.Is(err, orderbook.ErrOrderNotResting):
+		return APIError{Error: err.Error(), Reason: risk.ReasonInvalidOrder}, true
+	case errors.Is(err, orderbook.ErrMarketClosed):
+		return APIError{Error: err.Error(), Reason: ReasonMarketClosed}, true
+	case errors.Is(err, engine.ErrMarketHalted):
+		return APIError{Error: err.Error(), Reason: ReasonMarketHalted}, true
+	case errors.Is(err, engine.ErrMarketState):
+		return APIError{Error: err.Error(), Reason: ReasonMarketState}, true
+	case errors.Is(err, engine.ErrNotEnoughVolume):
+		return APIError{Error: err.Error(), Reason: ReasonNotEnoughVolume}, true
+	case errors.Is(err, engine.ErrOrderNotFound):
+		return APIError{Error: err.Error(), Reason: ReasonOrderNotFound}, true
+	case errors.Is(err, engine.ErrBatchRejected):
+		return APIError{Error: err.Error(), Reason: ReasonBatchRejected}, true
+	}
+	return APIError{}, false
+}
 
-		// this is only used for the fees
-		// exchangePubKey := ex.PrivateKey.Public()
-		// publicKeyECDSA, ok := exchangePubKey.(*ecdsa.PublicKey)
-		// if !ok {
-		// 	return fmt.Errorf("error casting public key to ECDSA")
-		// }
+// validateMarketOptions checks the quote size and the protection of an
+// order request, which only market orders have.
+func validateMarketOptions(req *PlaceOrderRequest) error {
+	if req.Quote == 0 && req.MaxSlippage == 0 && req.WorstPrice == 0 {
+		return nil
+	}
+	if req.Type != MarketOrder {
+		return errors.New("only market orders have a quote size or a slippage protection")
+	}
+	if req.Quote < 0 || req.MaxSlippage < 0 || req.WorstPrice < 0 {
+		return errors.New("invalid quote size or slippage protection")
+	}
+	if req.Quote > 0 && req.Size != 0 {
+		return errors.New("market orders have either a size or a quote size")
+	}
+	return nil
+}
 
-		amount := big.NewInt(int64(match.SizeFilled))
-		transferETH(ex.Client, fromUser.PrivateKey, toAddresss, amount)
+// settleMatches settles the matches of a market. The orders and positions
+// of the users are already updated by trackCommand, see settle.
+func (ex *Exchange) settleMatches(market Market, matches []orderbook.Match) error {
+	if len(matches) == 0 {
+		return nil
 	}
 
-	return nil
+	return ex.handleMatches(market, matches)
 }
 
-func transferETH(client *ethclient.Client, fromPrivKey *ecdsa.PrivateKey, to common.Address, amount *big.Int) error {
+// handleMatches settles every match of a market and publishes the fills of
+// the settled ones. A match whose transfers fail is neither credited to the
+// fee account nor reported as filled, its error is returned with the others.
+func (ex *Exchange) handleMatches(market Market, matches []orderbook.Match) error {
 	ctx := context.Background()
-	publicKey := fromPrivKey.Public()
-	publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
-	if !ok {
-		return fmt.Errorf("error casting public key to ECDSA")
+
+	errs := []error{}
+	for _, match := range matches {
+		if err := ex.settleMatch(ctx, market, match); err != nil {
+			errs = append(errs, fmt.Errorf("settling match of orders %d and %d: %w", match.Bid.ID, match.Ask.ID, err))
+			continue
+		}
+
+		bidFee, askFee := matchFees(match)
+		ex.publishFill(market, match.Bid, match, match.TakerBid, bidFee, fees.Base)
+		ex.publishFill(market, match.Ask, match, !match.TakerBid, askFee, fees.Quote)
 	}
 
-	fromAddress := crypto.PubkeyToAddress(*publicKeyECDSA)
-	nonce, err := client.PendingNonceAt(ctx, fromAddress)
-	if err != nil {
-		return err
+	return errors.Join(errs...)
+}
+
+// settleMatch transfers the assets and the fees of a match and credits the
+// fees once every transfer succeeded.
+func (ex *Exchange) settleMatch(ctx context.Context, market Market, match orderbook.Match) error {
+	fromUser, ok := ex.user(match.Ask.UserID)
+	if !ok {
+		return fmt.Errorf("user not found: %d", match.Ask.UserID)
 	}
 
-	gasLimit := uint64(21000)
-	gasPrice, err := client.SuggestGasPrice(ctx)
-	if err != nil {
-		log.Fatal(err)
+	toUser, ok := ex.user(match.Bid.UserID)
+	if !ok {
+		return fmt.Errorf("user not found: %d", match.Bid.UserID)
 	}
 
-	tx := types.NewTransaction(nonce, to, amount, gasLimit, gasPrice, nil)
+	bidFee, askFee := matchFees(match)
 
-	chainID := big.NewInt(1337)
-	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), fromPrivKey)
-	if err != nil {
-		return err
+	// The buyer receives ETH so their fee is deducted from the transferred
+	// amount and sent to the exchange, while rebates are paid by the exchange.
+	// The seller receives the quote asset, which is settled off-chain.
+	amount, fee := toWei(match.SizeFilled), toWei(bidFee)
+	if fee.Sign() > 0 {
+		amount.Sub(amount, fee)
 	}
+	if err := ex.Settler.Transfer(ctx, fromUser.Signer, toUser.Signer.Address(), amount); err != nil {
+		return fmt.Errorf("transferring %s wei to the buyer: %w", amount, err)
+	}
+
+	if fee.Sign() > 0 {
+		if err := ex.Settler.Transfer(ctx, fromUser.Signer, ex.Signer.Address(), fee); err != nil {
+			return fmt.Errorf("transferring fee of %s wei: %w", fee, err)
+		}
+	} else if fee.Sign() < 0 {
+		if err := ex.Settler.Transfer(ctx, ex.Signer, toUser.Signer.Address(), fee.Neg(fee)); err != nil {
+			return fmt.Errorf("paying rebate of %s wei: %w", fee, err)
+		}
+	}
+
+	ex.FeeAccount.Credit(market.assetName(fees.Base), bidFee)
+	ex.FeeAccount.Credit(market.assetName(fees.Quote), askFee)
+
+	return nil
+}
 
-	return client.SendTransaction(ctx, signedTx)
+// publishFill sends a fill event to the owner of the order.
+func (ex *Exchange) publishFill(market Market, order *orderbook.Order, match orderbook.Match, taker bool, fee float64, asset fees.Asset) {
+	liquidity := fees.Maker
+	if taker {
+		liquidity = fees.Taker
+	}
+
+	ex.events.Publish(userTopic(order.UserID), EventFill, FillEvent{
+		OrderID:   order.ID,
+		Market:    market,
+		Bid:       order.Bid,
+		Price:     match.Price,
+		Size:      match.SizeFilled,
+		Liquidity: string(liquidity),
+		Fee:       fee,
+		FeeAsset:  market.assetName(asset),
+	})
 }
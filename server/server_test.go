@@ -0,0 +1,1187 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/websocket"
+	"github.com/inagib21/crypto-exchange/candles"
+	"github.com/inagib21/crypto-exchange/engine"
+	"github.com/inagib21/crypto-exchange/journal"
+	"github.com/inagib21/crypto-exchange/orderbook"
+	"github.com/inagib21/crypto-exchange/risk"
+	"github.com/inagib21/crypto-exchange/signer"
+	"github.com/inagib21/crypto-exchange/store"
+	"github.com/inagib21/crypto-exchange/ticker"
+	"github.com/labstack/echo/v4"
+)
+
+// nopSettler settles nothing.
+type nopSettler struct{}
+
+func (nopSettler) Transfer(ctx context.Context, from signer.Signer, to common.Address, amount *big.Int) error {
+	return nil
+}
+
+func newTestExchange(t *testing.T) *Exchange {
+	t.Helper()
+
+	s, err := signer.FromHex(devKeys["EXCHANGE"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := NewExchange(s, nopSettler{})
+
+	for _, userID := range []int64{7, 8} {
+		s, err := signer.FromHex(devKeys[fmt.Sprintf("USER_%d", userID)])
+		if err != nil {
+			t.Fatal(err)
+		}
+		user := ex.registerUser(userID, s, TierMarketMaker)
+		user.APIToken = fmt.Sprintf("token-%d", userID)
+	}
+
+	return ex
+}
+
+// do sends a request to the routes of the exchange and returns the response.
+func do(e *echo.Echo, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(adminTokenHeader, "secret")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// doAs sends a request to the routes of the exchange with the API token of a
+// user of newTestExchange.
+func doAs(e *echo.Echo, userID int64, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(userTokenHeader, fmt.Sprintf("token-%d", userID))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func placeOrder(e *echo.Echo, req PlaceOrderRequest) (int64, int) {
+	body, _ := json.Marshal(req)
+	rec := do(e, http.MethodPost, "/order", string(body))
+
+	resp := PlaceOrderResponse{}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	return resp.OrderID, rec.Code
+}
+
+func TestConcurrentHandlers(t *testing.T) {
+	t.Setenv("EXCHANGE_ADMIN_TOKEN", "secret")
+
+	ex := newTestExchange(t)
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	// Deep levels the takers can't exhaust
+	placeOrder(e, PlaceOrderRequest{UserID: 8, Type: LimitOrder, Bid: true, Size: 1000, Price: 95, Market: MarketETH})
+	placeOrder(e, PlaceOrderRequest{UserID: 8, Type: LimitOrder, Bid: false, Size: 1000, Price: 105, Market: MarketETH})
+
+	var (
+		wg      sync.WaitGroup
+		done    = make(chan struct{})
+		readers sync.WaitGroup
+		failed  = make(chan string, 100)
+	)
+
+	// check reports responses other than OK and rejections.
+	check := func(name string, rec *httptest.ResponseRecorder) {
+		if rec.Code != http.StatusOK && rec.Code != http.StatusBadRequest && rec.Code != http.StatusNotFound {
+			select {
+			case failed <- fmt.Sprintf("%s: %d %s", name, rec.Code, rec.Body):
+			default:
+			}
+		}
+	}
+
+	// Makers place and cancel limit orders
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				req := PlaceOrderRequest{UserID: 7 + int64(w%2), Type: LimitOrder, Bid: w < 2, Size: 1, Price: 99 - float64(i%3), Market: MarketETH}
+				if !req.Bid {
+					req.Price = 101 + float64(i%3)
+				}
+				id, code := placeOrder(e, req)
+				if code != http.StatusOK {
+					failed <- fmt.Sprintf("placing order: %d", code)
+					return
+				}
+				if i%2 == 0 {
+					check("cancel", do(e, http.MethodDelete, fmt.Sprintf("/order/%d", id), ""))
+				}
+			}
+		}(w)
+	}
+
+	// Takers send market orders
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				placeOrder(e, PlaceOrderRequest{UserID: 7, Type: MarketOrder, Bid: w == 0, Size: 0.5, Market: MarketETH})
+			}
+		}(w)
+	}
+
+	// Readers query the book and the history until the writers are done
+	for r := 0; r < 2; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				for _, target := range []string{
+					"/depth/ETH?levels=5",
+					"/admin/book/ETH",
+					"/book/ETH/bid",
+					"/order/7",
+					"/trades/ETH",
+					"/ticker/ETH",
+				} {
+					rec := do(e, http.MethodGet, target, "")
+					if rec.Code != http.StatusOK {
+						failed <- fmt.Sprintf("%s: %d %s", target, rec.Code, rec.Body)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+	close(failed)
+
+	for msg := range failed {
+		t.Error(msg)
+	}
+
+	// Every consumer of the sequencer is done once the exchange is closed
+	if err := ex.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tk := ex.Tickers.Ticker("ETH", time.Now())
+	if tk.Trades == 0 {
+		t.Error("no trades")
+	}
+	trades, err := ex.Store.Trades(store.TradeFilter{Market: "ETH", Page: store.Page{Limit: store.MaxLimit}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != tk.Trades {
+		t.Errorf("%d stored trades != %d ticker trades", len(trades), tk.Trades)
+	}
+
+	// The resting orders tracked for the users are the orders of the book
+	ob := ex.orderbooks[MarketETH]
+	tracked := len(ex.restingOrders(7)) + len(ex.restingOrders(8))
+	bids, asks := ob.DepthOrders(0)
+	resting := 0
+	for _, level := range append(bids, asks...) {
+		resting += len(level.Orders)
+	}
+	if tracked != resting {
+		t.Errorf("%d tracked orders != %d resting orders", tracked, resting)
+	}
+}
+
+func TestProtectedMarketOrder(t *testing.T) {
+	ex := newTestExchange(t)
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	for _, ask := range []struct{ price, size float64 }{{100, 2}, {101, 2}, {105, 5}} {
+		placeOrder(e, PlaceOrderRequest{UserID: 8, Type: LimitOrder, Size: ask.size, Price: ask.price, Market: MarketETH})
+	}
+
+	// Spending 1000 stops at 1% from the best price, the rest is canceled
+	body, _ := json.Marshal(PlaceOrderRequest{UserID: 7, Type: MarketOrder, Bid: true, Quote: 1000, MaxSlippage: 0.01, Market: MarketETH})
+	rec := do(e, http.MethodPost, "/order", string(body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("placing order: %d %s", rec.Code, rec.Body)
+	}
+
+	resp := PlaceOrderResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != orderbook.StatusExpired || resp.Filled != 4 || resp.AvgPrice != 100.5 {
+		t.Errorf("unexpected fill: %+v", resp)
+	}
+	if len(resp.Levels) != 2 || resp.Levels[1] != (orderbook.Level{Price: 101, Size: 2, Orders: 1}) {
+		t.Errorf("unexpected levels: %+v", resp.Levels)
+	}
+
+	// An order can't have both a size and a quote size
+	_, code := placeOrder(e, PlaceOrderRequest{UserID: 7, Type: MarketOrder, Bid: true, Size: 1, Quote: 100, Market: MarketETH})
+	if code != http.StatusBadRequest {
+		t.Errorf("order with size and quote size: %d", code)
+	}
+}
+
+func TestMarketOrderWithoutLiquidity(t *testing.T) {
+	ex := newTestExchange(t)
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	body, _ := json.Marshal(PlaceOrderRequest{UserID: 7, Type: MarketOrder, Bid: true, Size: 1, Market: MarketETH})
+	rec := do(e, http.MethodPost, "/order", string(body))
+
+	apiErr := APIError{}
+	json.NewDecoder(rec.Body).Decode(&apiErr)
+	if rec.Code != http.StatusBadRequest || apiErr.Reason != ReasonNotEnoughVolume {
+		t.Errorf("got %d %+v, want a rejection for the missing volume", rec.Code, apiErr)
+	}
+
+	orders, _ := ex.Store.Orders(store.OrderFilter{UserID: 7, Status: store.OrderRejected})
+	if len(orders) != 1 {
+		t.Errorf("got %d rejected orders, want 1", len(orders))
+	}
+}
+
+func TestMarketOrderWhileHalted(t *testing.T) {
+	t.Setenv("EXCHANGE_ADMIN_TOKEN", "secret")
+	ex := newTestExchange(t)
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	placeOrder(e, PlaceOrderRequest{UserID: 8, Type: LimitOrder, Bid: false, Size: 1, Price: 100, Market: MarketETH})
+	if rec := do(e, http.MethodPost, "/admin/markets/ETH/halt", ""); rec.Code != http.StatusOK {
+		t.Fatalf("halting: %d %s", rec.Code, rec.Body)
+	}
+
+	body, _ := json.Marshal(PlaceOrderRequest{UserID: 7, Type: MarketOrder, Bid: true, Size: 1, Market: MarketETH})
+	rec := do(e, http.MethodPost, "/order", string(body))
+
+	apiErr := APIError{}
+	json.NewDecoder(rec.Body).Decode(&apiErr)
+	if rec.Code != http.StatusBadRequest || apiErr.Reason != ReasonMarketHalted {
+		t.Errorf("got %d %+v, want a rejection for the halt", rec.Code, apiErr)
+	}
+
+	orders, _ := ex.Store.Orders(store.OrderFilter{UserID: 7, Status: store.OrderRejected})
+	if len(orders) != 1 {
+		t.Errorf("got %d rejected orders, want 1", len(orders))
+	}
+}
+
+func TestBookHidesUsers(t *testing.T) {
+	t.Setenv("EXCHANGE_ADMIN_TOKEN", "secret")
+	ex := newTestExchange(t)
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	for _, req := range []PlaceOrderRequest{
+		{UserID: 7, Type: LimitOrder, Bid: true, Size: 1, Price: 99, Market: MarketETH},
+		{UserID: 8, Type: LimitOrder, Bid: true, Size: 1, Price: 99, Market: MarketETH},
+		{UserID: 7, Type: LimitOrder, Bid: true, Size: 1, Price: 98, Market: MarketETH},
+	} {
+		if _, code := placeOrder(e, req); code != http.StatusOK {
+			t.Fatalf("placing order: %d", code)
+		}
+	}
+
+	// The best price doesn't tell whose order it is
+	rec := do(e, http.MethodGet, "/book/ETH/bid", "")
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "UserID") {
+		t.Errorf("got best bid %d %s, want the price only", rec.Code, rec.Body)
+	}
+	for _, target := range []string{"/book/NOPE/bid", "/book/NOPE/ask"} {
+		if rec := do(e, http.MethodGet, target, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", target, rec.Code)
+		}
+	}
+
+	// The full book requires the admin token
+	req := httptest.NewRequest(http.MethodGet, "/admin/book/ETH", nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got %d for the book without the admin token, want 403", rec.Code)
+	}
+	if rec := doAs(e, 7, http.MethodGet, "/admin/book/ETH", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("got %d for the book with a user token, want 403", rec.Code)
+	}
+	for _, target := range []string{"/admin/book/NOPE", "/admin/book/ETH?levels=0"} {
+		if rec := do(e, http.MethodGet, target, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", target, rec.Code)
+		}
+	}
+
+	// and shows the users under aliases
+	rec = do(e, http.MethodGet, "/admin/book/ETH", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("getting book: %d %s", rec.Code, rec.Body)
+	}
+	book := OrderbookData{}
+	json.NewDecoder(rec.Body).Decode(&book)
+
+	users := []int64{}
+	for _, order := range book.Bids {
+		users = append(users, order.UserID)
+	}
+	if want := []int64{1, 2, 1}; !reflect.DeepEqual(users, want) {
+		t.Errorf("got users %v, want aliases %v", users, want)
+	}
+
+	// The levels bound the book like the depth
+	rec = do(e, http.MethodGet, "/admin/book/ETH?levels=1", "")
+	book = OrderbookData{}
+	json.NewDecoder(rec.Body).Decode(&book)
+	if len(book.Bids) != 2 || book.Bids[0].Price != 99 || book.Bids[1].Price != 99 {
+		t.Errorf("got bids %+v, want the orders of the best level", book.Bids)
+	}
+}
+
+func TestGetKlines(t *testing.T) {
+	ex := newTestExchange(t)
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	minute := time.Minute.Nanoseconds()
+	for i := int64(0); i < 3; i++ {
+		ex.Store.SaveCandle(candles.Candle{Market: string(MarketETH), Interval: candles.Minute, OpenTime: i * minute, Close: float64(100 + i)})
+	}
+	ex.Store.SaveCandle(candles.Candle{Market: string(MarketETH), Interval: candles.Hour, Close: 200})
+
+	klines := func(target string) ([]candles.Candle, int) {
+		rec := do(e, http.MethodGet, target, "")
+		klines := []candles.Candle{}
+		json.NewDecoder(rec.Body).Decode(&klines)
+		return klines, rec.Code
+	}
+
+	// Oldest first, 1m by default
+	got, code := klines("/klines/ETH")
+	if code != http.StatusOK || len(got) != 3 || got[0].OpenTime != 0 || got[2].OpenTime != 2*minute {
+		t.Errorf("got klines %d %+v, want the 3 minute candles oldest first", code, got)
+	}
+
+	// The limit keeps the newest candles
+	got, code = klines("/klines/ETH?limit=2")
+	if code != http.StatusOK || len(got) != 2 || got[0].OpenTime != minute {
+		t.Errorf("got klines %d %+v, want the 2 newest candles", code, got)
+	}
+
+	got, code = klines("/klines/ETH?interval=1h")
+	if code != http.StatusOK || len(got) != 1 || got[0].Close != 200 {
+		t.Errorf("got klines %d %+v, want the hour candle", code, got)
+	}
+
+	for _, target := range []string{"/klines/ETH?limit=many", "/klines/ETH?from=now", "/klines/ETH?interval=2m", "/klines/NOPE"} {
+		if _, code := klines(target); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", target, code)
+		}
+	}
+}
+
+func TestGetDepth(t *testing.T) {
+	ex := newTestExchange(t)
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	for _, req := range []PlaceOrderRequest{
+		{UserID: 7, Type: LimitOrder, Bid: true, Size: 1, Price: 99, Market: MarketETH},
+		{UserID: 8, Type: LimitOrder, Bid: true, Size: 2, Price: 99, Market: MarketETH},
+		{UserID: 7, Type: LimitOrder, Bid: true, Size: 1, Price: 98, Market: MarketETH},
+		{UserID: 8, Type: LimitOrder, Bid: false, Size: 3, Price: 101, Market: MarketETH},
+	} {
+		if _, code := placeOrder(e, req); code != http.StatusOK {
+			t.Fatalf("placing order: %d", code)
+		}
+	}
+
+	depth := func(target string) (DepthResponse, int) {
+		rec := do(e, http.MethodGet, target, "")
+		depth := DepthResponse{}
+		json.NewDecoder(rec.Body).Decode(&depth)
+		return depth, rec.Code
+	}
+
+	got, code := depth("/depth/ETH")
+	want := DepthResponse{
+		Market: MarketETH,
+		Bids:   []orderbook.Level{{Price: 99, Size: 3, Orders: 2}, {Price: 98, Size: 1, Orders: 1}},
+		Asks:   []orderbook.Level{{Price: 101, Size: 3, Orders: 1}},
+	}
+	if code != http.StatusOK || !reflect.DeepEqual(got, want) {
+		t.Errorf("got depth %d %+v, want %+v", code, got, want)
+	}
+
+	// The levels are limited per side
+	got, code = depth("/depth/ETH?levels=1")
+	if code != http.StatusOK || len(got.Bids) != 1 || len(got.Asks) != 1 || got.Bids[0].Price != 99 {
+		t.Errorf("got depth %d %+v, want the best level of each side", code, got)
+	}
+	if _, code := depth(fmt.Sprintf("/depth/ETH?levels=%d", maxDepthLevels+1)); code != http.StatusOK {
+		t.Errorf("got %d for levels above the max, want them capped", code)
+	}
+
+	for _, target := range []string{"/depth/ETH?levels=0", "/depth/ETH?levels=-1", "/depth/ETH?levels=all", "/depth/NOPE"} {
+		if _, code := depth(target); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", target, code)
+		}
+	}
+}
+
+func TestGetTicker(t *testing.T) {
+	ex := newTestExchange(t)
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	now := time.Now()
+	ex.Tickers.Add(string(MarketETH), 100, 1, now.Add(-time.Hour).UnixNano())
+	ex.Tickers.Add(string(MarketETH), 110, 2, now.UnixNano())
+	placeOrder(e, PlaceOrderRequest{UserID: 7, Type: LimitOrder, Bid: true, Size: 1, Price: 99, Market: MarketETH})
+	placeOrder(e, PlaceOrderRequest{UserID: 8, Type: LimitOrder, Bid: false, Size: 2, Price: 111, Market: MarketETH})
+
+	rec := do(e, http.MethodGet, "/ticker/ETH", "")
+	tk := ticker.Ticker{}
+	json.NewDecoder(rec.Body).Decode(&tk)
+	if rec.Code != http.StatusOK || tk.Market != string(MarketETH) || tk.LastPrice != 110 || tk.Open != 100 || tk.Volume != 3 || tk.Trades != 2 {
+		t.Errorf("got ticker %d %+v, want the statistics of the trades", rec.Code, tk)
+	}
+	if tk.BestBid != 99 || tk.BestBidSize != 1 || tk.BestAsk != 111 || tk.BestAskSize != 2 {
+		t.Errorf("got ticker %+v, want the best bid and ask of the book", tk)
+	}
+
+	rec = do(e, http.MethodGet, "/ticker", "")
+	tickers := []ticker.Ticker{}
+	json.NewDecoder(rec.Body).Decode(&tickers)
+	if rec.Code != http.StatusOK || len(tickers) != len(ex.orderbooks) || tickers[0].Market != tk.Market || tickers[0].LastPrice != tk.LastPrice {
+		t.Errorf("got tickers %d %+v, want the ticker of every market", rec.Code, tickers)
+	}
+
+	if rec := do(e, http.MethodGet, "/ticker/NOPE", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("got %d for an unknown market, want 400", rec.Code)
+	}
+}
+
+func TestBatchAndCancelAll(t *testing.T) {
+	ex := newTestExchange(t)
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	batch := func(req BatchRequest) ([]BatchResult, int) {
+		body, _ := json.Marshal(req)
+		rec := doAs(e, req.UserID, http.MethodPost, "/orders/batch", string(body))
+		resp := BatchResponse{}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp.Results, rec.Code
+	}
+	cancelAll := func(query string) []int64 {
+		rec := doAs(e, 7, http.MethodDelete, "/orders?"+query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("cancel all: %d %s", rec.Code, rec.Body)
+		}
+		resp := CancelAllResponse{}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp.Canceled
+	}
+
+	other, _ := placeOrder(e, PlaceOrderRequest{UserID: 8, Type: LimitOrder, Bid: true, Size: 1, Price: 97, Market: MarketETH})
+
+	// Every item gets its own result
+	results, code := batch(BatchRequest{UserID: 7, Market: MarketETH, Items: []BatchItem{
+		{Bid: true, Size: 1, Price: 99},
+		{Bid: true, Size: 1, Price: 98},
+		{Size: 1, Price: 101},
+	}})
+	if code != http.StatusOK || len(results) != 3 {
+		t.Fatalf("batch: %d %+v", code, results)
+	}
+	for _, r := range results {
+		if r.Status != orderbook.StatusNew || r.Error != "" {
+			t.Errorf("unexpected result %+v", r)
+		}
+	}
+
+	// An item failing rejects the batch, orders of other users can't be canceled
+	for _, cancelID := range []int64{12345, other} {
+		rejected, code := batch(BatchRequest{UserID: 7, Market: MarketETH, Items: []BatchItem{
+			{CancelID: results[2].OrderID},
+			{Bid: true, Size: 1, Price: 96},
+			{CancelID: cancelID},
+		}})
+		if code != http.StatusBadRequest || len(rejected) != 3 {
+			t.Fatalf("batch: %d %+v", code, rejected)
+		}
+		if rejected[0].Error != engine.ErrBatchRejected.Error() || rejected[1].Status != orderbook.StatusRejected {
+			t.Errorf("unexpected results %+v", rejected)
+		}
+		if rejected[2].Error != engine.ErrOrderNotFound.Error() {
+			t.Errorf("canceled order %d", cancelID)
+		}
+	}
+	if resting := ex.restingOrders(7); len(resting) != 3 {
+		t.Errorf("%d resting orders of user 7 after rejected batches", len(resting))
+	}
+
+	results, _ = batch(BatchRequest{UserID: 7, Market: MarketETH, Items: []BatchItem{{CancelID: results[0].OrderID}}})
+	if results[0].Status != orderbook.StatusCanceled {
+		t.Errorf("unexpected result %+v", results[0])
+	}
+
+	// Cancel-all takes one side, then everything left
+	var bid, ask int64
+	for _, o := range ex.restingOrders(7) {
+		if o.Bid {
+			bid = o.ID
+		} else {
+			ask = o.ID
+		}
+	}
+	if canceled := cancelAll("userID=7&side=bid"); len(canceled) != 1 || canceled[0] != bid {
+		t.Errorf("canceled %v, want %d", canceled, bid)
+	}
+	if canceled := cancelAll("userID=7&market=ETH"); len(canceled) != 1 || canceled[0] != ask {
+		t.Errorf("canceled %v, want %d", canceled, ask)
+	}
+	if resting := ex.restingOrders(8); len(resting) != 1 {
+		t.Errorf("%d resting orders of user 8", len(resting))
+	}
+
+	// Batches are bounded
+	_, code = batch(BatchRequest{UserID: 7, Market: MarketETH, Items: make([]BatchItem, maxBatchSize+1)})
+	if code != http.StatusBadRequest {
+		t.Errorf("oversized batch: %d", code)
+	}
+
+	// Only the user can place and cancel their orders
+	body, _ := json.Marshal(BatchRequest{UserID: 8, Market: MarketETH, Items: []BatchItem{{CancelID: other}}})
+	if rec := do(e, http.MethodPost, "/orders/batch", string(body)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("batch without a token: %d", rec.Code)
+	}
+	if rec := doAs(e, 7, http.MethodPost, "/orders/batch", string(body)); rec.Code != http.StatusForbidden {
+		t.Errorf("batch with the token of another user: %d", rec.Code)
+	}
+	if rec := doAs(e, 7, http.MethodDelete, "/orders?userID=8", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("cancel-all with the token of another user: %d", rec.Code)
+	}
+	if resting := ex.restingOrders(8); len(resting) != 1 {
+		t.Errorf("%d resting orders of user 8", len(resting))
+	}
+
+	// Risk limits apply to the batch as a whole, a cancel frees its slot
+	ex.Risk.SetLimits(TierMarketMaker, string(MarketETH), risk.Limits{MaxOpenOrders: 2, MaxPosition: 3})
+	results, code = batch(BatchRequest{UserID: 7, Market: MarketETH, Items: []BatchItem{
+		{Bid: true, Size: 2, Price: 90},
+		{Bid: true, Size: 2, Price: 89},
+		{Size: 1, Price: 110},
+		{Size: 1, Price: 111},
+	}})
+	if code != http.StatusBadRequest {
+		t.Errorf("batch over the limits: %d", code)
+	}
+	if r := results[1]; r.Status != orderbook.StatusRejected || r.Reason != risk.ReasonMaxPosition {
+		t.Errorf("unexpected result %+v", r)
+	}
+	if r := results[3]; r.Status != orderbook.StatusRejected || r.Reason != risk.ReasonMaxOpenOrders {
+		t.Errorf("unexpected result %+v", r)
+	}
+	results, _ = batch(BatchRequest{UserID: 7, Market: MarketETH, Items: []BatchItem{
+		{Bid: true, Size: 2, Price: 90},
+		{Size: 1, Price: 110},
+	}})
+	if r := results[1]; r.Status != orderbook.StatusNew {
+		t.Errorf("unexpected result %+v", r)
+	}
+	results, _ = batch(BatchRequest{UserID: 7, Market: MarketETH, Items: []BatchItem{
+		{CancelID: results[0].OrderID},
+		{Size: 1, Price: 111},
+	}})
+	if r := results[1]; r.Status != orderbook.StatusNew {
+		t.Errorf("unexpected result %+v", r)
+	}
+}
+
+func TestConcurrentOrdersRespectLimits(t *testing.T) {
+	ex := newTestExchange(t)
+	ex.Risk.SetLimits(TierMarketMaker, string(MarketETH), risk.Limits{MaxOpenOrders: 5, MaxPosition: 8})
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		accepted = 0
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, code := placeOrder(e, PlaceOrderRequest{UserID: 7, Type: LimitOrder, Bid: i%2 == 0, Size: 1, Price: 90 + float64(i%2)*20, Market: MarketETH})
+			if code == http.StatusOK {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if accepted != 5 {
+		t.Errorf("accepted %d orders, max is 5", accepted)
+	}
+	if resting := ex.restingOrders(7); len(resting) != 5 {
+		t.Errorf("%d resting orders, max is 5", len(resting))
+	}
+}
+
+func TestAmendPassesRiskChecks(t *testing.T) {
+	ex := newTestExchange(t)
+	ex.Risk.SetLimits(TierMarketMaker, string(MarketETH), risk.Limits{MaxOrderSize: 10, MaxOpenOrders: 2, MaxPosition: 12, PriceCollar: 0.1})
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	placeOrder(e, PlaceOrderRequest{UserID: 8, Type: LimitOrder, Bid: false, Size: 1, Price: 101, Market: MarketETH})
+	first, _ := placeOrder(e, PlaceOrderRequest{UserID: 7, Type: LimitOrder, Bid: true, Size: 5, Price: 99, Market: MarketETH})
+	second, _ := placeOrder(e, PlaceOrderRequest{UserID: 7, Type: LimitOrder, Bid: true, Size: 1, Price: 98, Market: MarketETH})
+
+	amend := func(id int64, body string) (int, APIError) {
+		rec := do(e, http.MethodPatch, fmt.Sprintf("/order/%d", id), body)
+		apiErr := APIError{}
+		json.NewDecoder(rec.Body).Decode(&apiErr)
+		return rec.Code, apiErr
+	}
+
+	tests := []struct {
+		name   string
+		id     int64
+		body   string
+		code   int
+		reason risk.Reason
+	}{
+		{"size", second, `{"Price": 98, "Size": 20}`, http.StatusBadRequest, risk.ReasonMaxOrderSize},
+		{"position", second, `{"Price": 98, "Size": 8}`, http.StatusBadRequest, risk.ReasonMaxPosition},
+		{"collar", second, `{"Price": 50, "Size": 1}`, http.StatusBadRequest, risk.ReasonPriceCollar},
+		{"zero price", second, `{"Size": 1}`, http.StatusBadRequest, risk.ReasonInvalidOrder},
+		{"negative price", second, `{"Price": -1, "Size": 1}`, http.StatusBadRequest, risk.ReasonInvalidOrder},
+		// The order's own slot and size are replaced, not added
+		{"own slot", second, `{"Price": 97, "Size": 7}`, http.StatusOK, ""},
+		{"reduce", first, `{"Price": 99, "Size": 4}`, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		code, apiErr := amend(tt.id, tt.body)
+		if code != tt.code || apiErr.Reason != tt.reason {
+			t.Errorf("%s: %d %+v, want %d %s", tt.name, code, apiErr, tt.code, tt.reason)
+		}
+	}
+
+	if o := ex.orderbooks[MarketETH].Order(second); o == nil || o.Price != 97 || o.Size != 7 {
+		t.Errorf("amended order %+v", o)
+	}
+}
+
+func TestCancelAllSkipsOrdersGone(t *testing.T) {
+	ex := newTestExchange(t)
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	id, _ := placeOrder(e, PlaceOrderRequest{UserID: 7, Type: LimitOrder, Bid: true, Size: 1, Price: 99, Market: MarketETH})
+
+	// The order 12345 was filled before the cancels were applied
+	applied, err := ex.cancelAtomic([]engine.Command{
+		{Type: engine.CommandCancel, Market: string(MarketETH), OrderID: 12345},
+		{Type: engine.CommandCancel, Market: string(MarketETH), OrderID: id},
+	})
+	if err != nil || len(applied) != 1 || applied[0].OrderID != id {
+		t.Errorf("got %+v (%v), want the cancel of order %d", applied, err, id)
+	}
+	if resting := ex.restingOrders(7); len(resting) != 0 {
+		t.Errorf("%d resting orders after cancel-all", len(resting))
+	}
+}
+
+func TestDeadManSwitch(t *testing.T) {
+	ex := newTestExchange(t)
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	heartbeat := func(timeout string) (DeadManResponse, int) {
+		body, _ := json.Marshal(DeadManRequest{UserID: 7, Timeout: timeout})
+		rec := doAs(e, 7, http.MethodPost, "/deadman", string(body))
+		resp := DeadManResponse{}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp, rec.Code
+	}
+
+	sub := ex.events.Subscribe(userTopic(7))
+	defer sub.Close()
+
+	id, _ := placeOrder(e, PlaceOrderRequest{UserID: 7, Type: LimitOrder, Bid: true, Size: 1, Price: 99, Market: MarketETH})
+
+	if _, code := heartbeat("soon"); code != http.StatusBadRequest {
+		t.Errorf("invalid timeout: %d", code)
+	}
+
+	// Only the user arms their switch
+	body, _ := json.Marshal(DeadManRequest{UserID: 7, Timeout: "1ms"})
+	if rec := do(e, http.MethodPost, "/deadman", string(body)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("arming without a token: %d", rec.Code)
+	}
+	if rec := doAs(e, 8, http.MethodPost, "/deadman", string(body)); rec.Code != http.StatusForbidden {
+		t.Errorf("arming with the token of another user: %d", rec.Code)
+	}
+
+	// A heartbeat within the timeout keeps the orders alive
+	if resp, code := heartbeat("50ms"); code != http.StatusOK || !resp.Armed || resp.Deadline == 0 {
+		t.Fatalf("arm: %d %+v", code, resp)
+	}
+	heartbeat("1h")
+	time.Sleep(100 * time.Millisecond)
+	if resting := ex.restingOrders(7); len(resting) != 1 {
+		t.Fatalf("%d resting orders after refresh", len(resting))
+	}
+
+	// A disarmed switch doesn't fire
+	if resp, _ := heartbeat(""); resp.Armed {
+		t.Errorf("still armed: %+v", resp)
+	}
+
+	// Without a heartbeat the orders are canceled with a reason
+	heartbeat("20ms")
+	select {
+	case ev := <-sub.C:
+		cancel, ok := ev.Data.(CancelEvent)
+		if ev.Type != EventCancel || !ok || cancel.OrderID != id || cancel.Reason != CancelReasonDeadMan {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no cancel event")
+	}
+	if resting := ex.restingOrders(7); len(resting) != 0 {
+		t.Errorf("%d resting orders after the switch fired", len(resting))
+	}
+}
+
+func TestLoadSignerDevKeys(t *testing.T) {
+	t.Setenv(devKeysEnv, "")
+	if _, err := loadSigner("EXCHANGE"); err == nil {
+		t.Fatalf("loadSigner without a signer configured succeeded, want an error")
+	}
+
+	t.Setenv(devKeysEnv, "true")
+	s, err := loadSigner("EXCHANGE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := signer.FromHex(devKeys["EXCHANGE"])
+	if s.Address() != want.Address() {
+		t.Errorf("got address %s, want the development key %s", s.Address(), want.Address())
+	}
+
+	if _, err := loadSigner("USER_1"); err == nil {
+		t.Errorf("loadSigner for an account without a development key succeeded, want an error")
+	}
+}
+
+// transfer is a transfer made through a recordingSettler.
+type transfer struct {
+	from, to common.Address
+	amount   string
+}
+
+// recordingSettler records the transfers instead of settling them.
+type recordingSettler struct {
+	transfers []transfer
+}
+
+func (s *recordingSettler) Transfer(ctx context.Context, from signer.Signer, to common.Address, amount *big.Int) error {
+	s.transfers = append(s.transfers, transfer{from: from.Address(), to: to, amount: amount.String()})
+	return nil
+}
+
+func TestSettleFractionalFees(t *testing.T) {
+	ex := newTestExchange(t)
+	settler := &recordingSettler{}
+	ex.Settler = settler
+
+	seller, _ := ex.user(8)
+	buyer, _ := ex.user(7)
+	match := orderbook.Match{
+		Ask:        &orderbook.Order{ID: 1, UserID: 8, Size: 1.5},
+		Bid:        &orderbook.Order{ID: 2, UserID: 7, Bid: true, Size: 1.5},
+		SizeFilled: 1.5,
+		Price:      100,
+		TakerBid:   true,
+		TakerFee:   0.003,
+		MakerFee:   0.15,
+	}
+	if err := ex.handleMatches(MarketETH, []orderbook.Match{match}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []transfer{
+		{from: seller.Signer.Address(), to: buyer.Signer.Address(), amount: "1497000000000000000"},
+		{from: seller.Signer.Address(), to: ex.Signer.Address(), amount: "3000000000000000"},
+	}
+	if len(settler.transfers) != len(want) {
+		t.Fatalf("got transfers %+v, want %+v", settler.transfers, want)
+	}
+	for i := range want {
+		if settler.transfers[i] != want[i] {
+			t.Errorf("transfer %d: got %+v, want %+v", i, settler.transfers[i], want[i])
+		}
+	}
+}
+
+// failingSettler fails every transfer.
+type failingSettler struct{}
+
+func (failingSettler) Transfer(ctx context.Context, from signer.Signer, to common.Address, amount *big.Int) error {
+	return errors.New("node unavailable")
+}
+
+func TestFailedSettlement(t *testing.T) {
+	ex := newTestExchange(t)
+	ex.Settler = failingSettler{}
+
+	sub := ex.events.Subscribe(userTopic(7), userTopic(8))
+	defer sub.Close()
+
+	match := orderbook.Match{
+		Ask:        &orderbook.Order{ID: 1, UserID: 8, Size: 1},
+		Bid:        &orderbook.Order{ID: 2, UserID: 7, Bid: true, Size: 1},
+		SizeFilled: 1,
+		Price:      100,
+		TakerBid:   true,
+		TakerFee:   0.002,
+		MakerFee:   0.1,
+	}
+	if err := ex.handleMatches(MarketETH, []orderbook.Match{match}); err == nil {
+		t.Fatal("expected settlement error")
+	}
+
+	if balances := ex.FeeAccount.Balances(); len(balances) != 0 {
+		t.Errorf("fees credited for a failed settlement: %v", balances)
+	}
+	select {
+	case ev := <-sub.C:
+		t.Errorf("fill published for a failed settlement: %+v", ev)
+	default:
+	}
+}
+
+func TestReplayRecordsStore(t *testing.T) {
+	var (
+		dir         = t.TempDir()
+		path        = filepath.Join(dir, "journal.log")
+		snapshotDir = filepath.Join(dir, "snapshots")
+	)
+
+	ex := newTestExchange(t)
+	if err := ex.OpenJournal(path, snapshotDir, journal.DefaultOptions); err != nil {
+		t.Fatal(err)
+	}
+	ask := ex.engine.NewOrder(false, 2, 8)
+	bid := ex.engine.NewOrder(true, 1.5, 7)
+	for _, cmd := range []engine.Command{placeCommand(MarketETH, ask, true, 100), placeCommand(MarketETH, bid, false, 0)} {
+		if _, err := ex.execute(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ex.Close()
+
+	// The store lost everything that was journaled, the trade is settled
+	// again from the store
+	restarted := newTestExchange(t)
+	settler := &recordingSettler{}
+	restarted.Settler = settler
+	if err := restarted.OpenJournal(path, snapshotDir, journal.DefaultOptions); err != nil {
+		t.Fatal(err)
+	}
+	restarted.Close()
+
+	trades, _ := restarted.Store.Trades(store.TradeFilter{})
+	if len(trades) != 1 || trades[0].Size != 1.5 {
+		t.Errorf("got trades %+v, want the journaled trade", trades)
+	}
+	order, err := restarted.Store.Order(ask.ID)
+	if err != nil || order.Filled != 1.5 || order.Status != store.OrderPartiallyFilled {
+		t.Errorf("got order %+v (%v), want it partially filled", order, err)
+	}
+	balances, _ := restarted.Store.Balances(7)
+	if balances["ETH"] == 0 {
+		t.Errorf("got balances %v, want the fill in the ledger", balances)
+	}
+	if next := restarted.engine.NewOrder(true, 1, 7); next.ID != bid.ID+1 {
+		t.Errorf("got order ID %d after recovery, want %d", next.ID, bid.ID+1)
+	}
+	if len(settler.transfers) == 0 {
+		t.Error("replayed trade not settled")
+	}
+	if ticker := restarted.Tickers.Ticker(string(MarketETH), time.Now()); ticker.Volume != 1.5 {
+		t.Errorf("got ticker %+v, want the replayed trade", ticker)
+	}
+
+	// Commands already recorded aren't recorded or settled again
+	again := newTestExchange(t)
+	again.Store = restarted.Store
+	settler = &recordingSettler{}
+	again.Settler = settler
+	if err := again.OpenJournal(path, snapshotDir, journal.DefaultOptions); err != nil {
+		t.Fatal(err)
+	}
+	again.Close()
+
+	if trades, _ := again.Store.Trades(store.TradeFilter{}); len(trades) != 1 {
+		t.Errorf("got %d trades after replaying twice, want 1", len(trades))
+	}
+	if len(settler.transfers) != 0 {
+		t.Errorf("got transfers %+v after replaying twice, want none", settler.transfers)
+	}
+}
+
+func TestInterruptedSettlementIsSkipped(t *testing.T) {
+	ex := newTestExchange(t)
+	ex.Store.Record(store.Batch{Seq: 3, Trades: []*store.Trade{{Market: string(MarketETH), BidUserID: 7, AskUserID: 8, Price: 2, Size: 1}}})
+	ex.Store.SaveConsumerSeq("settlement"+startedSuffix, 3)
+	settler := &recordingSettler{}
+	ex.Settler = settler
+
+	if err := ex.catchUpConsumers(); err != nil {
+		t.Fatal(err)
+	}
+	if len(settler.transfers) != 0 {
+		t.Errorf("got transfers %+v, want the interrupted settlement skipped", settler.transfers)
+	}
+	if seq, _ := ex.Store.ConsumerSeq("settlement"); seq != 3 {
+		t.Errorf("got settlement seq %d, want 3", seq)
+	}
+	ex.Close()
+}
+
+func TestRejectionUsesEngineClock(t *testing.T) {
+	ex := newTestExchange(t)
+	now := time.Unix(1700000000, 0)
+	ex.engine.SetClock(orderbook.FixedClock(now))
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	// Only market orders have a quote size
+	if _, code := placeOrder(e, PlaceOrderRequest{UserID: 7, Type: LimitOrder, Size: 1, Price: 100, Quote: 100, Market: MarketETH}); code != http.StatusBadRequest {
+		t.Fatalf("placing invalid order: %d", code)
+	}
+
+	orders, err := ex.Store.Orders(store.OrderFilter{UserID: 7, Status: store.OrderRejected})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 1 || orders[0].CreatedAt != now.UnixNano() || orders[0].UpdatedAt != now.UnixNano() {
+		t.Errorf("got rejected orders %+v, want one created at %d", orders, now.UnixNano())
+	}
+}
+
+func TestInvalidOrdersAreRejected(t *testing.T) {
+	ex := newTestExchange(t)
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	for _, req := range []PlaceOrderRequest{
+		{UserID: 7, Type: LimitOrder, Size: 0, Price: 100, Market: MarketETH},
+		{UserID: 7, Type: LimitOrder, Size: -1, Price: 100, Market: MarketETH},
+		{UserID: 7, Type: LimitOrder, Size: 1, Price: 0, Market: MarketETH},
+		{UserID: 7, Type: MarketOrder, Size: 0, Market: MarketETH},
+	} {
+		body, _ := json.Marshal(req)
+		rec := do(e, http.MethodPost, "/order", string(body))
+
+		apiErr := APIError{}
+		json.NewDecoder(rec.Body).Decode(&apiErr)
+		if rec.Code != http.StatusBadRequest || apiErr.Reason != risk.ReasonInvalidOrder {
+			t.Errorf("%+v: got %d %+v, want an invalid order", req, rec.Code, apiErr)
+		}
+	}
+
+	orders, _ := ex.Store.Orders(store.OrderFilter{UserID: 7, Status: store.OrderRejected})
+	if len(orders) != 4 {
+		t.Errorf("got %d rejected orders, want 4", len(orders))
+	}
+}
+
+func TestPrivateTopicsRequireToken(t *testing.T) {
+	ex := newTestExchange(t)
+	user, _ := ex.user(7)
+	user.APIToken = "token-7"
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?topics="
+
+	tests := []struct {
+		topics string
+		token  string
+		ok     bool
+	}{
+		{topics: "market:ETH", ok: true},
+		{topics: "user:7", ok: false},
+		{topics: "user:7", token: "wrong", ok: false},
+		{topics: "market:ETH,user:7", token: "token-7", ok: true},
+		{topics: "user:7,user:8", token: "token-7", ok: false},
+		{topics: "user:8", token: "", ok: false},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.token != "" {
+			header.Set(userTokenHeader, tt.token)
+		}
+
+		conn, resp, err := websocket.DefaultDialer.Dial(url+tt.topics, header)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%s with token %q: %v", tt.topics, tt.token, err)
+				continue
+			}
+			conn.Close()
+			continue
+		}
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s with token %q: subscribed", tt.topics, tt.token)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s with token %q: %v, want 403", tt.topics, tt.token, err)
+		}
+	}
+}
+
+func TestCancelOnDisconnect(t *testing.T) {
+	ex := newTestExchange(t)
+	user, _ := ex.user(7)
+	user.APIToken = "token-7"
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?cancelOnDisconnect=true&topics="
+
+	id, _ := placeOrder(e, PlaceOrderRequest{UserID: 7, Type: LimitOrder, Bid: true, Size: 1, Price: 99, Market: MarketETH})
+
+	// Only authenticated sessions of a user cancel the orders
+	if _, resp, err := websocket.DefaultDialer.Dial(url+"market:ETH", nil); err == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("cancelOnDisconnect without a user topic: %v", err)
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(url+"user:7", nil); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("cancelOnDisconnect without a token: %v", err)
+	}
+
+	header := http.Header{}
+	header.Set(userTokenHeader, "token-7")
+	conn, _, err := websocket.DefaultDialer.Dial(url+"user:7", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.orderbooks[MarketETH].Order(id) == nil {
+		t.Fatal("order canceled while connected")
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for ex.orderbooks[MarketETH].Order(id) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("order not canceled on disconnect")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHistoryRequiresUserToken(t *testing.T) {
+	ex := newTestExchange(t)
+	e := echo.New()
+	ex.registerRoutes(e)
+
+	placeOrder(e, PlaceOrderRequest{UserID: 8, Type: LimitOrder, Bid: false, Size: 1, Price: 100, Market: MarketETH})
+	placeOrder(e, PlaceOrderRequest{UserID: 7, Type: MarketOrder, Bid: true, Size: 1, Market: MarketETH})
+
+	for _, target := range []string{"/fills/7", "/fills/7?format=csv", "/ledger/7", "/balances/7"} {
+		if rec := do(e, http.MethodGet, target, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s without a token: %d", target, rec.Code)
+		}
+		if rec := doAs(e, 8, http.MethodGet, target, ""); rec.Code != http.StatusForbidden {
+			t.Errorf("%s with the token of another user: %d", target, rec.Code)
+		}
+		if rec := doAs(e, 7, http.MethodGet, target, ""); rec.Code != http.StatusOK {
+			t.Errorf("%s with the token of the user: %d %s", target, rec.Code, rec.Body)
+		}
+	}
+
+	rec := doAs(e, 7, http.MethodGet, "/fills/7", "")
+	fills := []store.Fill{}
+	json.NewDecoder(rec.Body).Decode(&fills)
+	if len(fills) != 1 || fills[0].UserID != 7 {
+		t.Errorf("got fills %+v, want the fill of user 7", fills)
+	}
+}
+
+func TestCloseStopsSnapshots(t *testing.T) {
+	var (
+		dir         = t.TempDir()
+		path        = filepath.Join(dir, "journal.log")
+		snapshotDir = filepath.Join(dir, "snapshots")
+	)
+
+	ex := newTestExchange(t)
+	if err := ex.OpenJournal(path, snapshotDir, journal.DefaultOptions); err != nil {
+		t.Fatal(err)
+	}
+	ex.loops.Add(1)
+	go ex.runSnapshots(snapshotDir, time.Millisecond)
+
+	e := echo.New()
+	ex.registerRoutes(e)
+	placeOrder(e, PlaceOrderRequest{UserID: 8, Type: LimitOrder, Bid: false, Size: 1, Price: 100, Market: MarketETH})
+
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if paths, _ := engine.Snapshots(snapshotDir); len(paths) > 0 {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("no snapshot written")
+		}
+	}
+
+	// Close waits for the loop, which writes no snapshot after it
+	if err := ex.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := engine.Snapshots(snapshotDir)
+	time.Sleep(10 * time.Millisecond)
+	if after, _ := engine.Snapshots(snapshotDir); len(after) != len(before) {
+		t.Errorf("got %d snapshots after close, want %d", len(after), len(before))
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/inagib21/crypto-exchange/engine"
+	"github.com/inagib21/crypto-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// sessionTickInterval is how often the timed session transitions are run.
+const sessionTickInterval = 250 * time.Millisecond
+
+// Event types of the trading session.
+const (
+	EventState      EventType = "STATE"
+	EventIndicative EventType = "INDICATIVE"
+)
+
+type SetStateRequest struct {
+	State orderbook.State
+}
+
+// runSessions drives the timed state transitions of every market through
+// the sequencer, which records and settles the matches of auctions that
+// uncross, and publishes the indicative price of running auctions, until the
+// exchange is closed.
+func (ex *Exchange) runSessions(interval time.Duration) {
+	defer ex.loops.Done()
+
+	var (
+		ticker     = time.NewTicker(interval)
+		states     = make(map[Market]orderbook.State)
+		indicative = make(map[Market]orderbook.Indicative)
+	)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-ex.done:
+			return
+		}
+
+		for market, ob := range ex.orderbooks {
+			if _, err := ex.sequencer.Tick(string(market), now); err != nil {
+				logrus.Error(err)
+			}
+
+			status := ex.marketStatus(market, ob)
+			if status.State != states[market] {
+				states[market] = status.State
+				ex.events.Publish(marketTopic(market), EventState, status)
+			}
+
+			if status.Indicative != nil && *status.Indicative != indicative[market] {
+				indicative[market] = *status.Indicative
+				ex.events.Publish(marketTopic(market), EventIndicative, status.Indicative)
+			}
+		}
+	}
+}
+
+func (ex *Exchange) handleSetMarketState(c echo.Context) error {
+	market := Market(c.Param("market"))
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	req := SetStateRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	res, err := ex.execute(engine.Command{
+		Type:   engine.CommandSetState,
+		Market: string(market),
+		State:  req.State,
+	})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"market":  market,
+		"state":   req.State,
+		"matches": len(res.Matches),
+	}).Info("market state set by admin")
+
+	return c.JSON(http.StatusOK, ex.marketStatus(market, ob))
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"math/big"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/inagib21/crypto-exchange/signer"
+)
+
+// weiPerETH is the number of wei in an ETH.
+var weiPerETH = new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil))
+
+// toWei converts an amount of ETH, such as a size or a fee, to wei rounded
+// toward zero. The amount is read back from its shortest decimal form, so
+// e.g. 0.3 is exactly 3e17 wei.
+func toWei(eth float64) *big.Int {
+	amount, ok := new(big.Rat).SetString(strconv.FormatFloat(eth, 'f', -1, 64))
+	if !ok {
+		return new(big.Int)
+	}
+	amount.Mul(amount, weiPerETH)
+	return new(big.Int).Quo(amount.Num(), amount.Denom())
+}
+
+// Settler moves funds between accounts once orders are matched.
+type Settler interface {
+	Transfer(ctx context.Context, from signer.Signer, to common.Address, amount *big.Int) error
+}
+
+// ETHSettler settles matches with plain ETH transfers on an Ethereum node.
+type ETHSettler struct {
+	Client  *ethclient.Client
+	ChainID *big.Int
+}
+
+// NewETHSettler creates a settler sending transactions through client.
+func NewETHSettler(client *ethclient.Client) *ETHSettler {
+	return &ETHSettler{
+		Client:  client,
+		ChainID: big.NewInt(1337),
+	}
+}
+
+// Transfer sends amount wei from the signer's account to the given address.
+func (s *ETHSettler) Transfer(ctx context.Context, from signer.Signer, to common.Address, amount *big.Int) error {
+	nonce, err := s.Client.PendingNonceAt(ctx, from.Address())
+	if err != nil {
+		return err
+	}
+
+	gasLimit := uint64(21000)
+	gasPrice, err := s.Client.SuggestGasPrice(ctx)
+	if err != nil {
+		return err
+	}
+
+	tx := types.NewTransaction(nonce, to, amount, gasLimit, gasPrice, nil)
+
+	signedTx, err := from.SignTx(ctx, tx, s.ChainID)
+	if err != nil {
+		return err
+	}
+
+	return s.Client.SendTransaction(ctx, signedTx)
+}
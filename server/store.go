@@ -0,0 +1,490 @@
+package server
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/inagib21/crypto-exchange/engine"
+	"github.com/inagib21/crypto-exchange/fees"
+	"github.com/inagib21/crypto-exchange/orderbook"
+	"github.com/inagib21/crypto-exchange/store"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultStorePath is where the database is stored when EXCHANGE_DB isn't set.
+const defaultStorePath = "data/exchange.db"
+
+// Reasons of ledger entries.
+const (
+	LedgerFill = "FILL"
+	LedgerFee  = "FEE"
+)
+
+// execute executes a command through the sequencer. The engine records the
+// orders and trades resulting from it in the store, see record.
+func (ex *Exchange) execute(cmd engine.Command) (engine.Result, error) {
+	return ex.sequencer.Execute(cmd)
+}
+
+// executeAtomic executes commands of a single market if all of them are
+// valid, see engine.Sequencer.ExecuteAtomic.
+func (ex *Exchange) executeAtomic(cmds []engine.Command) []engine.Reply {
+	return ex.sequencer.ExecuteAtomic(cmds)
+}
+
+// record writes the orders changed by a command, the trades resulting from
+// it and the ledger entries settling them to the store, in one batch at the
+// sequence number of the command. It is called while the engine is locked,
+// right after the command was journaled, so the store follows the journal
+// and OpenJournal records the commands a crash kept out of it.
+func (ex *Exchange) record(cmd engine.Command, res engine.Result) {
+	var (
+		b     = newHistoryBatch(ex.Store, res.Seq)
+		order = res.OrderState
+		err   error
+	)
+
+	switch cmd.Type {
+	case engine.CommandPlace:
+		b.saveOrder(store.Order{
+			ID:           order.ID,
+			UserID:       order.UserID,
+			Market:       cmd.Market,
+			Bid:          order.Bid,
+			Limit:        cmd.Limit,
+			Price:        order.Price,
+			OriginalSize: order.OriginalSize,
+			Filled:       order.Filled,
+			AvgPrice:     order.AvgPrice,
+			Status:       store.OrderStatus(order.Status),
+			CreatedAt:    res.Timestamp,
+			UpdatedAt:    res.Timestamp,
+		})
+	case engine.CommandCancel:
+		err = b.updateOrder(order.ID, res.Timestamp, func(o *store.Order) {
+			o.Status = store.OrderCanceled
+		})
+	case engine.CommandAmend:
+		err = b.updateOrder(order.ID, res.Timestamp, func(o *store.Order) {
+			o.Price = order.Price
+			o.OriginalSize = o.Filled + order.Size
+		})
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"command": cmd.Type,
+			"error":   err,
+		}).Error("recording order")
+	}
+
+	for _, match := range res.Matches {
+		if err := b.addMatch(cmd, res.Timestamp, match); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"market": cmd.Market,
+				"error":  err,
+			}).Error("recording trade")
+		}
+	}
+
+	if err := ex.Store.Record(b.batch()); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"seq":   res.Seq,
+			"error": err,
+		}).Error("recording command")
+	}
+}
+
+// historyBatch collects the history of a command before it is written to
+// the store in one batch. Orders changed more than once by the command are
+// changed in the batch.
+type historyBatch struct {
+	st     store.Store
+	seq    uint64
+	orders map[int64]*store.Order
+	ids    []int64
+	trades []*store.Trade
+	ledger []*store.LedgerEntry
+}
+
+func newHistoryBatch(st store.Store, seq uint64) *historyBatch {
+	return &historyBatch{
+		st:     st,
+		seq:    seq,
+		orders: make(map[int64]*store.Order),
+	}
+}
+
+// saveOrder inserts or replaces an order in the batch.
+func (b *historyBatch) saveOrder(o store.Order) {
+	if _, ok := b.orders[o.ID]; !ok {
+		b.ids = append(b.ids, o.ID)
+	}
+	b.orders[o.ID] = &o
+}
+
+// updateOrder applies fn to an order of the batch, or of the store when the
+// batch doesn't have it yet.
+func (b *historyBatch) updateOrder(id int64, timestamp int64, fn func(o *store.Order)) error {
+	o, ok := b.orders[id]
+	if !ok {
+		stored, err := b.st.Order(id)
+		if err != nil {
+			return err
+		}
+		b.saveOrder(stored)
+		o = b.orders[id]
+	}
+
+	fn(o)
+	o.UpdatedAt = timestamp
+	return nil
+}
+
+// addMatch adds the trade of a match, the fills of the resting orders it
+// matched and the ledger entries settling it.
+func (b *historyBatch) addMatch(cmd engine.Command, timestamp int64, match orderbook.Match) error {
+	b.trades = append(b.trades, &store.Trade{
+		Market:     cmd.Market,
+		Price:      match.Price,
+		Size:       match.SizeFilled,
+		Bid:        match.TakerBid,
+		BidOrderID: match.Bid.ID,
+		AskOrderID: match.Ask.ID,
+		BidUserID:  match.Bid.UserID,
+		AskUserID:  match.Ask.UserID,
+		MakerFee:   match.MakerFee,
+		TakerFee:   match.TakerFee,
+		Timestamp:  timestamp,
+	})
+	b.ledger = append(b.ledger, settlementEntries(Market(cmd.Market), match, timestamp)...)
+
+	for _, order := range []*orderbook.Order{match.Bid, match.Ask} {
+		// The fills of a placed order are stored with it.
+		if cmd.Type == engine.CommandPlace && order.ID == cmd.OrderID {
+			continue
+		}
+
+		err := b.updateOrder(order.ID, timestamp, func(o *store.Order) {
+			o.Fill(match.SizeFilled, match.Price)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// batch returns the store batch of the history collected.
+func (b *historyBatch) batch() store.Batch {
+	batch := store.Batch{Seq: b.seq, Trades: b.trades, Ledger: b.ledger}
+	for _, id := range b.ids {
+		batch.Orders = append(batch.Orders, *b.orders[id])
+	}
+	return batch
+}
+
+// recordRejection stores an order that was rejected before reaching the
+// order book, at the time the engine created it.
+func (ex *Exchange) recordRejection(market Market, order *orderbook.Order, req *PlaceOrderRequest) {
+	now := order.Timestamp
+	order.Status = orderbook.StatusRejected
+
+	err := ex.Store.SaveOrder(store.Order{
+		ID:           order.ID,
+		UserID:       order.UserID,
+		Market:       string(market),
+		Bid:          order.Bid,
+		Limit:        req.Type == LimitOrder,
+		Price:        req.Price,
+		OriginalSize: req.Size,
+		Status:       store.OrderStatus(order.Status),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"order": order.ID,
+			"error": err,
+		}).Error("recording rejected order")
+	}
+}
+
+// matchFees returns the fees of the bid and the ask of a match.
+func matchFees(match orderbook.Match) (bidFee, askFee float64) {
+	if match.TakerBid {
+		return match.TakerFee, match.MakerFee
+	}
+	return match.MakerFee, match.TakerFee
+}
+
+// settlementEntries returns the ledger entries of a match: the buyer
+// receives the base asset and pays the quote asset, the seller the other
+// way around, and both pay their fee in the asset they receive.
+func settlementEntries(market Market, match orderbook.Match, timestamp int64) []*store.LedgerEntry {
+	var (
+		bidFee, askFee = matchFees(match)
+		base           = market.assetName(fees.Base)
+		quote          = market.assetName(fees.Quote)
+		notional       = match.SizeFilled * match.Price
+	)
+
+	entries := []*store.LedgerEntry{
+		{UserID: match.Bid.UserID, Asset: base, Amount: match.SizeFilled, Reason: LedgerFill, OrderID: match.Bid.ID},
+		{UserID: match.Bid.UserID, Asset: quote, Amount: -notional, Reason: LedgerFill, OrderID: match.Bid.ID},
+		{UserID: match.Ask.UserID, Asset: base, Amount: -match.SizeFilled, Reason: LedgerFill, OrderID: match.Ask.ID},
+		{UserID: match.Ask.UserID, Asset: quote, Amount: notional, Reason: LedgerFill, OrderID: match.Ask.ID},
+	}
+	if bidFee != 0 {
+		entries = append(entries, &store.LedgerEntry{UserID: match.Bid.UserID, Asset: base, Amount: -bidFee, Reason: LedgerFee, OrderID: match.Bid.ID})
+	}
+	if askFee != 0 {
+		entries = append(entries, &store.LedgerEntry{UserID: match.Ask.UserID, Asset: quote, Amount: -askFee, Reason: LedgerFee, OrderID: match.Ask.ID})
+	}
+	for _, e := range entries {
+		e.Timestamp = timestamp
+	}
+
+	return entries
+}
+
+// parsePage reads the offset and limit query parameters.
+func parsePage(c echo.Context) (store.Page, error) {
+	page := store.Page{}
+
+	offset, err := queryInt(c, "offset")
+	if err != nil {
+		return page, err
+	}
+	limit, err := queryInt(c, "limit")
+	if err != nil {
+		return page, err
+	}
+
+	page.Offset, page.Limit = int(offset), int(limit)
+	return page, nil
+}
+
+// queryInt reads an integer query parameter, zero if it isn't set.
+func queryInt(c echo.Context, name string) (int64, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// queryUint reads an unsigned integer query parameter, zero if it isn't set.
+func queryUint(c echo.Context, name string) (uint64, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(v, 10, 64)
+}
+
+func (ex *Exchange) handleGetTrades(c echo.Context) error {
+	market := Market(c.Param("market"))
+	if _, ok := ex.orderbooks[market]; !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "orderbook not found"})
+	}
+
+	filter := store.TradeFilter{Market: string(market)}
+	page, err := parsePage(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	filter.Page = page
+
+	if filter.UserID, err = queryInt(c, "userID"); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	if filter.From, err = queryInt(c, "from"); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	if filter.To, err = queryInt(c, "to"); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	trades, err := ex.Store.Trades(filter)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, trades)
+}
+
+// handleGetOrderHistory returns the orders of every status, filtered by the
+// userID, market, status, from and to query parameters.
+func (ex *Exchange) handleGetOrderHistory(c echo.Context) error {
+	filter := store.OrderFilter{
+		Market: c.QueryParam("market"),
+		Status: store.OrderStatus(c.QueryParam("status")),
+	}
+
+	page, err := parsePage(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	filter.Page = page
+
+	if filter.UserID, err = queryInt(c, "userID"); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	if filter.From, err = queryInt(c, "from"); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	if filter.To, err = queryInt(c, "to"); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	orders, err := ex.Store.Orders(filter)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, orders)
+}
+
+// handleGetOrder returns an order of the order history by ID.
+func (ex *Exchange) handleGetOrder(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid order id"})
+	}
+
+	order, err := ex.Store.Order(id)
+	if errors.Is(err, store.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, APIError{Error: "order not found"})
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+// handleGetFills returns the fills of a user, filtered by the market, from,
+// to, fromTrade and toTrade query parameters. With format=csv the fills are
+// exported as CSV.
+func (ex *Exchange) handleGetFills(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+	if ok, err := ex.authorizeUser(c, userID); !ok {
+		return err
+	}
+
+	filter := store.FillFilter{UserID: userID, Market: c.QueryParam("market")}
+	page, err := parsePage(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	filter.Page = page
+
+	if filter.From, err = queryInt(c, "from"); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	if filter.To, err = queryInt(c, "to"); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	if filter.FromTrade, err = queryUint(c, "fromTrade"); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	if filter.ToTrade, err = queryUint(c, "toTrade"); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	fills, err := ex.Store.Fills(filter)
+	if err != nil {
+		return err
+	}
+
+	switch format := c.QueryParam("format"); format {
+	case "", "json":
+		return c.JSON(http.StatusOK, fills)
+	case "csv":
+		c.Response().Header().Set(echo.HeaderContentType, "text/csv")
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=fills-%d.csv", userID))
+		c.Response().WriteHeader(http.StatusOK)
+		return writeFillsCSV(c.Response(), fills)
+	default:
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("unknown format %q", format)})
+	}
+}
+
+// writeFillsCSV writes fills as CSV with a header row.
+func writeFillsCSV(w io.Writer, fills []store.Fill) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"TradeID", "Market", "OrderID", "UserID", "Side", "Price", "Size", "Liquidity", "Fee", "Timestamp"})
+
+	for _, f := range fills {
+		side := "ASK"
+		if f.Bid {
+			side = "BID"
+		}
+		cw.Write([]string{
+			strconv.FormatUint(f.TradeID, 10),
+			f.Market,
+			strconv.FormatInt(f.OrderID, 10),
+			strconv.FormatInt(f.UserID, 10),
+			side,
+			strconv.FormatFloat(f.Price, 'f', -1, 64),
+			strconv.FormatFloat(f.Size, 'f', -1, 64),
+			string(f.Liquidity),
+			strconv.FormatFloat(f.Fee, 'f', -1, 64),
+			strconv.FormatInt(f.Timestamp, 10),
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func (ex *Exchange) handleGetLedger(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+	if ok, err := ex.authorizeUser(c, userID); !ok {
+		return err
+	}
+	page, err := parsePage(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	entries, err := ex.Store.Ledger(store.LedgerFilter{
+		UserID: userID,
+		Asset:  c.QueryParam("asset"),
+		Page:   page,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
+
+func (ex *Exchange) handleGetBalances(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+	if ok, err := ex.authorizeUser(c, userID); !ok {
+		return err
+	}
+
+	balances, err := ex.Store.Balances(userID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, balances)
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/inagib21/crypto-exchange/store"
+	"github.com/inagib21/crypto-exchange/ticker"
+	"github.com/labstack/echo/v4"
+)
+
+// restoreTickers adds the stored trades of the ticker window to the
+// tickers, oldest first.
+func (ex *Exchange) restoreTickers() error {
+	for market := range ex.orderbooks {
+		var (
+			filter = store.TradeFilter{
+				Market: string(market),
+				From:   time.Now().Add(-ticker.DefaultWindow).UnixNano(),
+				Page:   store.Page{Limit: store.MaxLimit},
+			}
+			trades = []store.Trade{}
+		)
+
+		for {
+			page, err := ex.Store.Trades(filter)
+			if err != nil {
+				return err
+			}
+			trades = append(trades, page...)
+			if len(page) < filter.Limit {
+				break
+			}
+			filter.Offset += len(page)
+		}
+
+		for i := len(trades) - 1; i >= 0; i-- {
+			ex.Tickers.Add(string(market), trades[i].Price, trades[i].Size, trades[i].Timestamp)
+		}
+	}
+	return nil
+}
+
+// ticker returns the ticker of a market with the best bid and ask of its book.
+func (ex *Exchange) ticker(market Market, now time.Time) ticker.Ticker {
+	tk := ex.Tickers.Ticker(string(market), now)
+
+	depth := ex.orderbooks[market].Depth(1)
+	if len(depth.Bids) > 0 {
+		tk.BestBid, tk.BestBidSize = depth.Bids[0].Price, depth.Bids[0].Size
+	}
+	if len(depth.Asks) > 0 {
+		tk.BestAsk, tk.BestAskSize = depth.Asks[0].Price, depth.Asks[0].Size
+	}
+
+	return tk
+}
+
+// handleGetTickers returns the tickers of every market, by market name.
+func (ex *Exchange) handleGetTickers(c echo.Context) error {
+	now := time.Now()
+
+	tickers := make([]ticker.Ticker, 0, len(ex.orderbooks))
+	for market := range ex.orderbooks {
+		tickers = append(tickers, ex.ticker(market, now))
+	}
+	sort.Slice(tickers, func(i, j int) bool { return tickers[i].Market < tickers[j].Market })
+
+	return c.JSON(http.StatusOK, tickers)
+}
+
+func (ex *Exchange) handleGetTicker(c echo.Context) error {
+	market := Market(c.Param("market"))
+	if _, ok := ex.orderbooks[market]; !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	return c.JSON(http.StatusOK, ex.ticker(market, time.Now()))
+}
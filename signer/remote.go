@@ -0,0 +1,184 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// RemoteSigner signs transactions through an external signer speaking the
+// Clef JSON-RPC API (account_signTransaction) over HTTP.
+type RemoteSigner struct {
+	url     string
+	address common.Address
+	client  *http.Client
+	nextID  atomic.Int64
+}
+
+// NewRemote creates a RemoteSigner for the account at address, served by the
+// signer listening on url.
+func NewRemote(url string, address common.Address) *RemoteSigner {
+	return &RemoteSigner{
+		url:     url,
+		address: address,
+		client:  http.DefaultClient,
+	}
+}
+
+// SendTxArgs are the transaction arguments expected by account_signTransaction.
+type SendTxArgs struct {
+	From     common.Address  `json:"from"`
+	To       *common.Address `json:"to"`
+	Gas      hexutil.Uint64  `json:"gas"`
+	GasPrice *hexutil.Big    `json:"gasPrice"`
+	Value    *hexutil.Big    `json:"value"`
+	Nonce    hexutil.Uint64  `json:"nonce"`
+	Data     hexutil.Bytes   `json:"data"`
+	ChainID  *hexutil.Big    `json:"chainId,omitempty"`
+}
+
+// SignTxResult is the result returned by account_signTransaction.
+type SignTxResult struct {
+	Raw hexutil.Bytes `json:"raw"`
+}
+
+type rpcRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      int64  `json:"id"`
+	Method  string `json:"method"`
+	Params  []any  `json:"params"`
+}
+
+type rpcResponse struct {
+	ID     int64           `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Address returns the address of the remote account.
+func (s *RemoteSigner) Address() common.Address {
+	return s.address
+}
+
+// ErrTxMismatch is returned when the remote signer returns a transaction
+// that isn't the requested one signed by the account.
+var ErrTxMismatch = errors.New("remote signer returned a different transaction")
+
+// SignTx asks the remote signer to sign the transaction. The signed
+// transaction is only returned when it is the requested one, signed by the
+// address of the signer.
+func (s *RemoteSigner) SignTx(ctx context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	args := SendTxArgs{
+		From:     s.address,
+		To:       tx.To(),
+		Gas:      hexutil.Uint64(tx.Gas()),
+		GasPrice: (*hexutil.Big)(tx.GasPrice()),
+		Value:    (*hexutil.Big)(tx.Value()),
+		Nonce:    hexutil.Uint64(tx.Nonce()),
+		Data:     tx.Data(),
+		ChainID:  (*hexutil.Big)(chainID),
+	}
+
+	var result SignTxResult
+	if err := s.call(ctx, "account_signTransaction", &result, args); err != nil {
+		return nil, err
+	}
+
+	signed := new(types.Transaction)
+	if err := signed.UnmarshalBinary(result.Raw); err != nil {
+		return nil, fmt.Errorf("decoding signed transaction: %w", err)
+	}
+	if err := checkSigned(tx, signed, chainID, s.address); err != nil {
+		return nil, err
+	}
+
+	return signed, nil
+}
+
+// checkSigned verifies that signed is tx signed by from for chainID.
+func checkSigned(tx, signed *types.Transaction, chainID *big.Int, from common.Address) error {
+	sender, err := types.Sender(types.LatestSignerForChainID(chainID), signed)
+	if err != nil {
+		return fmt.Errorf("recovering sender of signed transaction: %w", err)
+	}
+	if sender != from {
+		return fmt.Errorf("%w: signed by %s instead of %s", ErrTxMismatch, sender.Hex(), from.Hex())
+	}
+
+	switch {
+	case signed.Nonce() != tx.Nonce():
+		return fmt.Errorf("%w: nonce %d instead of %d", ErrTxMismatch, signed.Nonce(), tx.Nonce())
+	case !sameAddress(signed.To(), tx.To()):
+		return fmt.Errorf("%w: different recipient", ErrTxMismatch)
+	case signed.Value().Cmp(tx.Value()) != 0:
+		return fmt.Errorf("%w: value %s instead of %s", ErrTxMismatch, signed.Value(), tx.Value())
+	case signed.Gas() != tx.Gas():
+		return fmt.Errorf("%w: gas %d instead of %d", ErrTxMismatch, signed.Gas(), tx.Gas())
+	case signed.GasPrice().Cmp(tx.GasPrice()) != 0:
+		return fmt.Errorf("%w: gas price %s instead of %s", ErrTxMismatch, signed.GasPrice(), tx.GasPrice())
+	case !bytes.Equal(signed.Data(), tx.Data()):
+		return fmt.Errorf("%w: different data", ErrTxMismatch)
+	}
+
+	return nil
+}
+
+// sameAddress reports whether two optional addresses are equal.
+func sameAddress(a, b *common.Address) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// call performs a single JSON-RPC call against the remote signer.
+func (s *RemoteSigner) call(ctx context.Context, method string, result any, params ...any) error {
+	body, err := json.Marshal(rpcRequest{
+		JSONRPC: "2.0",
+		ID:      s.nextID.Add(1),
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("remote signer returned status %d", resp.StatusCode)
+	}
+
+	var rpcResp rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return err
+	}
+
+	if rpcResp.Error != nil {
+		return fmt.Errorf("remote signer error %d: %s", rpcResp.Error.Code, rpcResp.Error.Message)
+	}
+
+	return json.Unmarshal(rpcResp.Result, result)
+}
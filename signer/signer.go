@@ -0,0 +1,93 @@
+package signer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Signer is a handle to an account that can sign transactions.
+// The private key behind a Signer is never exposed to its users.
+type Signer interface {
+	// Address returns the address of the account backing the signer.
+	Address() common.Address
+	// SignTx signs the transaction for the given chain ID.
+	SignTx(ctx context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error)
+}
+
+// keySigner signs transactions with a private key held in memory.
+type keySigner struct {
+	address common.Address
+	key     *ecdsa.PrivateKey
+}
+
+// FromHex creates a Signer from a hex encoded private key.
+func FromHex(hexKey string) (Signer, error) {
+	key, err := crypto.HexToECDSA(strings.TrimPrefix(hexKey, "0x"))
+	if err != nil {
+		return nil, err
+	}
+
+	return newKeySigner(key), nil
+}
+
+// FromEnv creates a Signer from a hex encoded private key stored in the
+// given environment variable.
+func FromEnv(name string) (Signer, error) {
+	hexKey, ok := os.LookupEnv(name)
+	if !ok || hexKey == "" {
+		return nil, fmt.Errorf("environment variable %s not set", name)
+	}
+
+	s, err := FromHex(hexKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %w", name, err)
+	}
+
+	return s, nil
+}
+
+// FromKeystore creates a Signer from a go-ethereum encrypted keystore file.
+func FromKeystore(path, passphrase string) (Signer, error) {
+	keyJSON, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := keystore.DecryptKey(keyJSON, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting keystore %s: %w", path, err)
+	}
+
+	return newKeySigner(key.PrivateKey), nil
+}
+
+func newKeySigner(key *ecdsa.PrivateKey) *keySigner {
+	return &keySigner{
+		address: crypto.PubkeyToAddress(key.PublicKey),
+		key:     key,
+	}
+}
+
+// Address returns the address derived from the private key.
+func (s *keySigner) Address() common.Address {
+	return s.address
+}
+
+// SignTx signs the transaction with an EIP-155 signer.
+func (s *keySigner) SignTx(ctx context.Context, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	return types.SignTx(tx, types.NewEIP155Signer(chainID), s.key)
+}
+
+// String returns the address of the signer so keys never end up in logs.
+func (s *keySigner) String() string {
+	return s.address.Hex()
+}
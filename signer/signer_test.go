@@ -0,0 +1,179 @@
+package signer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const testKey = "4f3edf983ac636a65a842ce7c78d9aa706d3b113bce9c46f30d7d21715b23b1d"
+
+func testTx() *types.Transaction {
+	return types.NewTransaction(1, common.HexToAddress("0x01"), big.NewInt(10), 21000, big.NewInt(1), nil)
+}
+
+func assertSender(t *testing.T, tx *types.Transaction, chainID *big.Int, want common.Address) {
+	from, err := types.Sender(types.NewEIP155Signer(chainID), tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != want {
+		t.Errorf("sender %s != %s", from, want)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("TEST_SIGNER_KEY", testKey)
+
+	s, err := FromEnv("TEST_SIGNER_KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chainID := big.NewInt(1337)
+	tx, err := s.SignTx(context.Background(), testTx(), chainID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSender(t, tx, chainID, s.Address())
+
+	if _, err := FromEnv("TEST_SIGNER_MISSING"); err == nil {
+		t.Error("expected error for missing variable")
+	}
+}
+
+func TestFromKeystore(t *testing.T) {
+	key, err := crypto.HexToECDSA(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks := keystore.NewKeyStore(t.TempDir(), keystore.LightScryptN, keystore.LightScryptP)
+	account, err := ks.ImportECDSA(key, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := FromKeystore(account.URL.Path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Address() != account.Address {
+		t.Errorf("address %s != %s", s.Address(), account.Address)
+	}
+
+	if _, err := FromKeystore(account.URL.Path, "wrong"); err == nil {
+		t.Error("expected error for wrong passphrase")
+	}
+	if _, err := FromKeystore(filepath.Join(os.TempDir(), "missing.json"), "secret"); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+// clefStandIn behaves like Clef: it decodes the transaction arguments, lets
+// tamper change them, signs them with key and returns the raw transaction.
+func clefStandIn(t *testing.T, key Signer, tamper func(args *SendTxArgs)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     int64        `json:"id"`
+			Method string       `json:"method"`
+			Params []SendTxArgs `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+		if req.Method != "account_signTransaction" {
+			t.Errorf("unexpected method %s", req.Method)
+		}
+
+		args := req.Params[0]
+		if tamper != nil {
+			tamper(&args)
+		}
+		tx := types.NewTransaction(uint64(args.Nonce), *args.To, args.Value.ToInt(), uint64(args.Gas), args.GasPrice.ToInt(), args.Data)
+		signed, err := key.SignTx(r.Context(), tx, args.ChainID.ToInt())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		raw, err := signed.MarshalBinary()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"jsonrpc": "2.0",
+			"id":      req.ID,
+			"result":  SignTxResult{Raw: raw},
+		})
+	}))
+}
+
+func TestRemoteSigner(t *testing.T) {
+	local, err := FromHex(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := clefStandIn(t, local, nil)
+	defer srv.Close()
+
+	chainID := big.NewInt(1337)
+	remote := NewRemote(srv.URL, local.Address())
+	tx, err := remote.SignTx(context.Background(), testTx(), chainID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSender(t, tx, chainID, local.Address())
+}
+
+func TestRemoteSignerRejectsOtherTransactions(t *testing.T) {
+	local, err := FromHex(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := FromHex("829e924fdf021ba3dbbc4225edfece9aca04b929d6e75613329ca6f1d31c0bb4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attacker := common.HexToAddress("0xbad")
+	tests := map[string]struct {
+		key    Signer
+		tamper func(args *SendTxArgs)
+	}{
+		"other account": {key: other},
+		"recipient":     {key: local, tamper: func(args *SendTxArgs) { args.To = &attacker }},
+		"value":         {key: local, tamper: func(args *SendTxArgs) { args.Value = (*hexutil.Big)(big.NewInt(1000)) }},
+		"nonce":         {key: local, tamper: func(args *SendTxArgs) { args.Nonce++ }},
+		"gas":           {key: local, tamper: func(args *SendTxArgs) { args.Gas++ }},
+		"gas price":     {key: local, tamper: func(args *SendTxArgs) { args.GasPrice = (*hexutil.Big)(big.NewInt(2)) }},
+		"data":          {key: local, tamper: func(args *SendTxArgs) { args.Data = []byte{1} }},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := clefStandIn(t, tt.key, tt.tamper)
+			defer srv.Close()
+
+			remote := NewRemote(srv.URL, local.Address())
+			if _, err := remote.SignTx(context.Background(), testTx(), big.NewInt(1337)); !errors.Is(err, ErrTxMismatch) {
+				t.Errorf("err = %v, want ErrTxMismatch", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package sim
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/inagib21/crypto-exchange/mm"
+	"github.com/inagib21/crypto-exchange/orderbook"
+)
+
+// NoiseTrader trades at random: in a share Rate of the steps it places an
+// order of a random side and size, a limit order within Spread of the
+// fundamental price in a share LimitRatio of them and a market order
+// otherwise. Its limit orders are canceled after MaxAge.
+type NoiseTrader struct {
+	Rate       float64
+	MaxSize    float64
+	LimitRatio float64
+	Spread     float64
+	MaxAge     time.Duration
+}
+
+// Act cancels the expired orders and maybe places a new one.
+func (t NoiseTrader) Act(m *Market) {
+	for _, o := range m.Orders() {
+		if t.MaxAge > 0 && m.Time.Sub(time.Unix(0, o.Timestamp)) >= t.MaxAge {
+			if err := m.Cancel(o.ID); err != nil {
+				m.Fail(err)
+			}
+		}
+	}
+
+	if m.Rand.Float64() >= t.Rate {
+		return
+	}
+
+	bid := m.Rand.Intn(2) == 0
+	size := roundSize(math.Max(orderbook.DefaultLot, m.Rand.Float64()*t.MaxSize))
+
+	if m.Rand.Float64() < t.LimitRatio {
+		offset := m.Rand.Float64() * t.Spread
+		price := m.Fundamental * (1 + offset)
+		if bid {
+			price = m.Fundamental * (1 - offset)
+		}
+		if _, err := m.PlaceLimit(bid, roundPrice(price), size); err != nil && !errors.Is(err, ErrWouldCross) {
+			m.Fail(err)
+		}
+		return
+	}
+
+	if _, err := m.PlaceMarket(bid, size); err != nil {
+		m.Fail(err)
+	}
+}
+
+// MomentumTrader follows the trend: when the mid price moved more than
+// Threshold, as a fraction, over the last Lookback steps it places a market
+// order of Size in the same direction, as long as its position stays within
+// MaxPosition.
+type MomentumTrader struct {
+	Lookback    int
+	Threshold   float64
+	Size        float64
+	MaxPosition float64
+}
+
+// Act trades in the direction of the trend, if any.
+func (t MomentumTrader) Act(m *Market) {
+	history := m.History(t.Lookback + 1)
+	if t.Lookback <= 0 || len(history) <= t.Lookback {
+		return
+	}
+
+	change := history[len(history)-1]/history[0] - 1
+	position := m.Position()
+
+	var bid bool
+	switch {
+	case change > t.Threshold && (t.MaxPosition == 0 || position+t.Size <= t.MaxPosition):
+		bid = true
+	case change < -t.Threshold && (t.MaxPosition == 0 || position-t.Size >= -t.MaxPosition):
+		bid = false
+	default:
+		return
+	}
+
+	if _, err := m.PlaceMarket(bid, t.Size); err != nil {
+		m.Fail(err)
+	}
+}
+
+// LiquidityTaker takes liquidity with market orders of Size in a share Rate
+// of the steps, buying in a share BuyRatio of them and selling otherwise.
+type LiquidityTaker struct {
+	Rate     float64
+	Size     float64
+	BuyRatio float64
+}
+
+// Act maybe places a market order.
+func (t LiquidityTaker) Act(m *Market) {
+	if m.Rand.Float64() >= t.Rate {
+		return
+	}
+
+	bid := m.Rand.Float64() < t.BuyRatio
+	if _, err := m.PlaceMarket(bid, t.Size); err != nil {
+		m.Fail(err)
+	}
+}
+
+// MarketMaker quotes the book with a strategy of the mm package. Every step
+// it cancels its orders and places the quotes of the strategy, except those
+// that would cross the book and, beyond MaxPosition, those on the side that
+// would grow its position. Strategies with state, such as mm.Join, can't be
+// shared between market makers.
+type MarketMaker struct {
+	Strategy    mm.Strategy
+	MaxPosition float64
+}
+
+// Act moves the orders of the market maker to its new quotes.
+func (t MarketMaker) Act(m *Market) {
+	m.CancelAll()
+
+	state := mm.MarketState{FeedPrice: m.Fundamental, Reference: m.Mid()}
+	if best, ok := m.Best(true); ok {
+		state.BestBid = best.Price
+	}
+	if best, ok := m.Best(false); ok {
+		state.BestAsk = best.Price
+	}
+	if state.Empty() {
+		state.Reference = m.Fundamental
+	}
+
+	position := m.Position()
+	bids, asks := t.Strategy.Quotes(state, mm.Inventory{Position: position, Mark: state.Reference})
+
+	if t.MaxPosition > 0 && position >= t.MaxPosition {
+		bids = nil
+	}
+	if t.MaxPosition > 0 && position <= -t.MaxPosition {
+		asks = nil
+	}
+
+	for _, side := range []struct {
+		bid    bool
+		quotes []mm.Quote
+	}{{true, bids}, {false, asks}} {
+		for _, q := range side.quotes {
+			size := roundSize(q.Size)
+			if size <= 0 {
+				continue
+			}
+			if _, err := m.PlaceLimit(side.bid, roundPrice(q.Price), size); err != nil && !errors.Is(err, ErrWouldCross) {
+				m.Fail(err)
+			}
+		}
+	}
+}
+
+// DefaultParticipants returns a market of two market makers, noise traders,
+// momentum traders and a liquidity taker that sells more than it buys.
+func DefaultParticipants() []Participant {
+	participants := []Participant{
+		{Name: "join-maker", Agent: MarketMaker{
+			Strategy:    &mm.Join{Offset: 0.5, SeedOffset: 5, Levels: 3, Size: 2},
+			MaxPosition: 50,
+		}},
+		{Name: "as-maker", Agent: MarketMaker{
+			Strategy: mm.AvellanedaStoikov{
+				Gamma:   0.1,
+				Kappa:   1.5,
+				Sigma:   0.15,
+				Horizon: time.Minute,
+				Size:    2,
+			},
+			MaxPosition: 50,
+		}},
+		{Name: "momentum-fast", Agent: MomentumTrader{Lookback: 5, Threshold: 0.001, Size: 0.5, MaxPosition: 10}},
+		{Name: "momentum-slow", Agent: MomentumTrader{Lookback: 30, Threshold: 0.003, Size: 1, MaxPosition: 20}},
+		{Name: "taker", Agent: LiquidityTaker{Rate: 0.5, Size: 1, BuyRatio: 0.3}},
+	}
+
+	for _, name := range []string{"noise-1", "noise-2", "noise-3", "noise-4", "noise-5"} {
+		participants = append(participants, Participant{Name: name, Agent: NoiseTrader{
+			Rate:       0.3,
+			MaxSize:    2,
+			LimitRatio: 0.6,
+			Spread:     0.005,
+			MaxAge:     time.Minute,
+		}})
+	}
+
+	return participants
+}
+
+// roundPrice rounds a price to cents.
+func roundPrice(price float64) float64 {
+	return math.Round(price*100) / 100
+}
@@ -0,0 +1,227 @@
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// depthBand is the distance from the mid price, as a fraction of it, the
+// depth of the book is measured within.
+const depthBand = 0.01
+
+// secondsPerYear annualizes the volatility of the mid price.
+const secondsPerYear = 365 * 24 * 60 * 60
+
+// metrics are sampled at the end of every step.
+type metrics struct {
+	spreads []float64
+	depths  []float64
+	// mids are the mid prices of the steps the book had both sides.
+	mids     []float64
+	oneSided int
+	trades   int
+	volume   float64
+}
+
+// sample records the mid price, the spread and the depth of the book.
+func (s *Simulator) sample() {
+	mid := s.mid()
+	s.mids = append(s.mids, mid)
+
+	bid, okBid := s.book.Best(true)
+	ask, okAsk := s.book.Best(false)
+	if !okBid || !okAsk {
+		s.metrics.oneSided++
+		return
+	}
+	s.metrics.spreads = append(s.metrics.spreads, ask.Price-bid.Price)
+	s.metrics.mids = append(s.metrics.mids, mid)
+
+	depth := 0.0
+	book := s.book.Depth(0)
+	for _, level := range book.Bids {
+		if level.Price < mid*(1-depthBand) {
+			break
+		}
+		depth += level.Size
+	}
+	for _, level := range book.Asks {
+		if level.Price > mid*(1+depthBand) {
+			break
+		}
+		depth += level.Size
+	}
+	s.metrics.depths = append(s.metrics.depths, depth)
+}
+
+// Report summarizes a simulation.
+type Report struct {
+	Seed  int64
+	Steps int
+	Step  time.Duration
+
+	// Fundamental is the fundamental price at the end, LastPrice the price
+	// of the last trade.
+	Fundamental float64
+	LastPrice   float64
+	Trades      int
+	Volume      float64
+
+	// Spread is the spread of the book over the steps it had both sides,
+	// OneSided the number of steps it didn't.
+	Spread   Stats
+	OneSided int
+	// Depth is the size resting within 1% of the mid price.
+	Depth Stats
+	// Volatility is the annualized volatility of the mid price over the
+	// steps the book had both sides, and FundamentalVolatility the one the
+	// fundamental price was simulated at.
+	Volatility            float64
+	FundamentalVolatility float64
+
+	Participants []ParticipantReport
+}
+
+// Stats summarizes samples.
+type Stats struct {
+	Mean   float64
+	Median float64
+	Min    float64
+	Max    float64
+}
+
+// ParticipantReport is the outcome of a participant. PnL values the change
+// of its balances at the last mid price.
+type ParticipantReport struct {
+	Name     string
+	Trades   int
+	Volume   float64
+	Position float64
+	Cash     float64
+	PnL      float64
+}
+
+// report summarizes the simulation so far.
+func (s *Simulator) report() *Report {
+	r := &Report{
+		Seed:                  s.cfg.Seed,
+		Steps:                 s.cfg.Steps,
+		Step:                  s.cfg.Step,
+		Fundamental:           s.fundamental,
+		LastPrice:             s.book.LastPrice(),
+		Trades:                s.metrics.trades,
+		Volume:                s.metrics.volume,
+		Spread:                newStats(s.metrics.spreads),
+		OneSided:              s.metrics.oneSided,
+		Depth:                 newStats(s.metrics.depths),
+		Volatility:            volatility(s.metrics.mids, s.cfg.Step),
+		FundamentalVolatility: s.cfg.Volatility,
+	}
+
+	mark := s.mid()
+	for i, p := range s.cfg.Participants {
+		a := s.accounts[i]
+		position, cash := a.Base-s.cfg.Base, a.Quote-s.cfg.Quote
+		r.Participants = append(r.Participants, ParticipantReport{
+			Name:     p.Name,
+			Trades:   a.Trades,
+			Volume:   a.Volume,
+			Position: position,
+			Cash:     cash,
+			PnL:      cash + position*mark,
+		})
+	}
+
+	return r
+}
+
+// newStats summarizes samples, zero without samples.
+func newStats(samples []float64) Stats {
+	if len(samples) == 0 {
+		return Stats{}
+	}
+
+	sorted := append([]float64{}, samples...)
+	sort.Float64s(sorted)
+
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+
+	n := len(sorted)
+	median := sorted[n/2]
+	if n%2 == 0 {
+		median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+
+	return Stats{
+		Mean:   sum / float64(n),
+		Median: median,
+		Min:    sorted[0],
+		Max:    sorted[n-1],
+	}
+}
+
+// volatility returns the annualized standard deviation of the log returns
+// of prices sampled every step.
+func volatility(prices []float64, step time.Duration) float64 {
+	if len(prices) < 3 {
+		return 0
+	}
+
+	returns := make([]float64, 0, len(prices)-1)
+	for i := 1; i < len(prices); i++ {
+		returns = append(returns, math.Log(prices[i]/prices[i-1]))
+	}
+
+	mean := 0.0
+	for _, r := range returns {
+		mean += r
+	}
+	mean /= float64(len(returns))
+
+	variance := 0.0
+	for _, r := range returns {
+		variance += (r - mean) * (r - mean)
+	}
+	variance /= float64(len(returns) - 1)
+
+	return math.Sqrt(variance * secondsPerYear / step.Seconds())
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteText writes the report as a human readable summary.
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "seed\t%d\n", r.Seed)
+	fmt.Fprintf(tw, "steps\t%d x %s\n", r.Steps, r.Step)
+	fmt.Fprintf(tw, "fundamental\t%.2f\n", r.Fundamental)
+	fmt.Fprintf(tw, "last price\t%.2f\n", r.LastPrice)
+	fmt.Fprintf(tw, "trades\t%d (volume %.4f)\n", r.Trades, r.Volume)
+	fmt.Fprintf(tw, "spread\tmean %.2f, median %.2f, min %.2f, max %.2f (%d one-sided steps)\n",
+		r.Spread.Mean, r.Spread.Median, r.Spread.Min, r.Spread.Max, r.OneSided)
+	fmt.Fprintf(tw, "depth ±1%%\tmean %.4f, median %.4f, min %.4f, max %.4f\n",
+		r.Depth.Mean, r.Depth.Median, r.Depth.Min, r.Depth.Max)
+	fmt.Fprintf(tw, "volatility\t%.2f%% (fundamental %.2f%%)\n", r.Volatility*100, r.FundamentalVolatility*100)
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "participant\ttrades\tvolume\tposition\tcash\tpnl")
+	for _, p := range r.Participants {
+		fmt.Fprintf(tw, "%s\t%d\t%.4f\t%.4f\t%.2f\t%.2f\n", p.Name, p.Trades, p.Volume, p.Position, p.Cash, p.PnL)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,398 @@
+// Package sim runs agent-based simulations of a market against an
+// in-process matching engine. Trades settle in memory, the simulated time
+// advances a step at a time and all randomness comes from one seed, so a
+// simulation is reproducible.
+package sim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/inagib21/crypto-exchange/engine"
+	"github.com/inagib21/crypto-exchange/mm"
+	"github.com/inagib21/crypto-exchange/orderbook"
+)
+
+// market is the name of the simulated market in the engine.
+const market = "SIM"
+
+// Defaults of the zero fields of Config.
+const (
+	DefaultSteps    = 1000
+	DefaultStep     = time.Second
+	DefaultPrice    = 1000.0
+	DefaultBase     = 100.0
+	DefaultQuote    = 100000.0
+	DefaultSlippage = 0.02
+)
+
+// epoch is the simulated time of the first step.
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ErrWouldCross rejects limit orders that would cross the book. The book
+// only matches market orders, so the simulation treats limit orders as
+// post-only.
+var ErrWouldCross = errors.New("limit order would cross the book")
+
+// Config configures a simulation.
+type Config struct {
+	// Seed seeds every random choice of the simulation.
+	Seed int64
+	// Steps is the number of steps simulated.
+	Steps int
+	// Step is the simulated time between two steps.
+	Step time.Duration
+	// Price is the starting fundamental price. The fundamental price
+	// follows a geometric Brownian motion with an annualized Drift and
+	// Volatility.
+	Price      float64
+	Drift      float64
+	Volatility float64
+	// Base and Quote are the starting balances of every participant.
+	Base  float64
+	Quote float64
+	// Participants are the agents trading in the market.
+	Participants []Participant
+}
+
+// Participant is an agent taking part in a simulation.
+type Participant struct {
+	Name  string
+	Agent Agent
+}
+
+// Agent is a trader of the simulated market.
+type Agent interface {
+	// Act is called once every step to trade through m.
+	Act(m *Market)
+}
+
+// Account is the balances of a participant, settled after every match.
+type Account struct {
+	Base  float64
+	Quote float64
+	// Trades and Volume count the matches of the participant and their
+	// size.
+	Trades int
+	Volume float64
+}
+
+// Simulator runs a simulation.
+type Simulator struct {
+	cfg    Config
+	rand   *rand.Rand
+	clock  *clock
+	feed   *mm.GBMFeed
+	engine *engine.Engine
+	book   *orderbook.Orderbook
+
+	accounts []*Account
+	// orders are the orders placed by every participant that may still rest.
+	orders [][]*orderbook.Order
+
+	fundamental float64
+	mids        []float64
+	metrics     metrics
+}
+
+// clock is the simulated time.
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time { return c.now }
+
+// New creates a simulator for cfg, filling in the defaults.
+func New(cfg Config) *Simulator {
+	if cfg.Steps <= 0 {
+		cfg.Steps = DefaultSteps
+	}
+	if cfg.Step <= 0 {
+		cfg.Step = DefaultStep
+	}
+	if cfg.Price <= 0 {
+		cfg.Price = DefaultPrice
+	}
+	if cfg.Base == 0 && cfg.Quote == 0 {
+		cfg.Base, cfg.Quote = DefaultBase, DefaultQuote
+	}
+
+	c := &clock{now: epoch}
+	book := orderbook.NewOrderbook()
+	book.SetClock(c)
+
+	e := engine.New(map[string]*orderbook.Orderbook{market: book}, nil)
+	e.SetClock(c)
+	e.SetIDGenerator(orderbook.NewSequentialIDs(0))
+
+	feed := mm.NewGBMFeed(cfg.Price, cfg.Drift, cfg.Volatility, cfg.Seed)
+	feed.Step = cfg.Step
+
+	s := &Simulator{
+		cfg:         cfg,
+		rand:        rand.New(rand.NewSource(cfg.Seed)),
+		clock:       c,
+		feed:        feed,
+		engine:      e,
+		book:        book,
+		accounts:    make([]*Account, len(cfg.Participants)),
+		orders:      make([][]*orderbook.Order, len(cfg.Participants)),
+		fundamental: cfg.Price,
+	}
+	for i := range s.accounts {
+		s.accounts[i] = &Account{Base: cfg.Base, Quote: cfg.Quote}
+	}
+
+	return s
+}
+
+// Run simulates every step and returns the report of the simulation.
+func (s *Simulator) Run() (*Report, error) {
+	for step := 0; step < s.cfg.Steps; step++ {
+		if err := s.step(step); err != nil {
+			return nil, fmt.Errorf("step %d: %w", step, err)
+		}
+	}
+	return s.report(), nil
+}
+
+// step moves the fundamental price and lets every agent act once, in an
+// order shuffled every step.
+func (s *Simulator) step(step int) error {
+	if step > 0 {
+		s.clock.now = s.clock.now.Add(s.cfg.Step)
+		p, err := s.feed.Price(context.Background())
+		if err != nil {
+			return err
+		}
+		s.fundamental = p.Price
+	}
+
+	for _, i := range s.rand.Perm(len(s.cfg.Participants)) {
+		m := &Market{
+			Step:        step,
+			Time:        s.clock.now,
+			Fundamental: s.fundamental,
+			Rand:        s.rand,
+			sim:         s,
+			participant: i,
+		}
+		s.cfg.Participants[i].Agent.Act(m)
+		if m.err != nil {
+			return fmt.Errorf("%s: %w", s.cfg.Participants[i].Name, m.err)
+		}
+	}
+
+	s.sample()
+	return nil
+}
+
+// execute runs a command of a participant and settles its matches.
+func (s *Simulator) execute(cmd engine.Command) (engine.Result, error) {
+	cmd.Market = market
+	cmd.Timestamp = s.clock.now.UnixNano()
+
+	res, err := s.engine.Execute(cmd)
+	if err != nil {
+		return res, err
+	}
+
+	for _, match := range res.Matches {
+		s.settle(match)
+	}
+	return res, nil
+}
+
+// settle moves the base size of a match to the bid and its price to the
+// ask. Participants are numbered from user ID 1.
+func (s *Simulator) settle(match orderbook.Match) {
+	quote := match.SizeFilled * match.Price
+	bid, ask := s.accounts[match.Bid.UserID-1], s.accounts[match.Ask.UserID-1]
+
+	bid.Base += match.SizeFilled
+	bid.Quote -= quote
+	ask.Base -= match.SizeFilled
+	ask.Quote += quote
+
+	for _, a := range []*Account{bid, ask} {
+		a.Trades++
+		a.Volume += match.SizeFilled
+	}
+	s.metrics.trades++
+	s.metrics.volume += match.SizeFilled
+}
+
+// mid returns the mid price of the book, the best price of its only side,
+// or the fundamental price when it is empty.
+func (s *Simulator) mid() float64 {
+	bid, okBid := s.book.Best(true)
+	ask, okAsk := s.book.Best(false)
+	switch {
+	case okBid && okAsk:
+		return (bid.Price + ask.Price) / 2
+	case okBid:
+		return bid.Price
+	case okAsk:
+		return ask.Price
+	default:
+		return s.fundamental
+	}
+}
+
+// Market is the view of the market an agent acts on in a step, and the
+// handle it trades through.
+type Market struct {
+	Step int
+	Time time.Time
+	// Fundamental is the price the market would trade at if it were
+	// efficient, e.g. the price on other exchanges.
+	Fundamental float64
+	// Rand is the random source of the simulation.
+	Rand *rand.Rand
+
+	sim         *Simulator
+	participant int
+	err         error
+}
+
+// UserID returns the user ID the agent trades as.
+func (m *Market) UserID() int64 {
+	return int64(m.participant + 1)
+}
+
+// Best returns the best order of a side of the book, false if it is empty.
+func (m *Market) Best(bid bool) (orderbook.Order, bool) {
+	return m.sim.book.Best(bid)
+}
+
+// Mid returns the mid price of the book, the best price of its only side,
+// or the fundamental price when it is empty.
+func (m *Market) Mid() float64 {
+	return m.sim.mid()
+}
+
+// Depth returns the best levels of both sides of the book.
+func (m *Market) Depth(levels int) orderbook.Depth {
+	return m.sim.book.Depth(levels)
+}
+
+// History returns the mid prices at the end of the last n steps, oldest
+// first, fewer at the start of the simulation.
+func (m *Market) History(n int) []float64 {
+	mids := m.sim.mids
+	return mids[max(0, len(mids)-n):]
+}
+
+// Account returns the balances of the agent.
+func (m *Market) Account() Account {
+	return *m.sim.accounts[m.participant]
+}
+
+// Position returns the base size the agent gained since the start,
+// negative when it sold more than it bought.
+func (m *Market) Position() float64 {
+	return m.sim.accounts[m.participant].Base - m.sim.cfg.Base
+}
+
+// Orders returns the resting orders of the agent.
+func (m *Market) Orders() []orderbook.Order {
+	resting := m.sim.book.Resting(m.sim.orders[m.participant])
+
+	// Orders no longer resting are forgotten.
+	live := m.sim.orders[m.participant][:0]
+	for _, o := range m.sim.orders[m.participant] {
+		if m.sim.book.Order(o.ID) != nil {
+			live = append(live, o)
+		}
+	}
+	m.sim.orders[m.participant] = live
+
+	return resting
+}
+
+// PlaceLimit places a limit order and returns its ID. Orders that would
+// cross the book are rejected with ErrWouldCross.
+func (m *Market) PlaceLimit(bid bool, price, size float64) (int64, error) {
+	if best, ok := m.Best(!bid); ok && ((bid && price >= best.Price) || (!bid && price <= best.Price)) {
+		return 0, ErrWouldCross
+	}
+	if price <= 0 || size <= 0 {
+		return 0, fmt.Errorf("invalid limit order of %.4f at %.2f", size, price)
+	}
+
+	order := m.sim.engine.NewOrder(bid, size, m.UserID())
+	res, err := m.sim.execute(engine.Command{
+		Type:    engine.CommandPlace,
+		OrderID: order.ID,
+		UserID:  order.UserID,
+		Limit:   true,
+		Bid:     bid,
+		Size:    size,
+		Price:   price,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	m.sim.orders[m.participant] = append(m.sim.orders[m.participant], res.Order)
+	return order.ID, nil
+}
+
+// PlaceMarket places a market order that fills at most DefaultSlippage away
+// from the best price, and returns the size filled.
+func (m *Market) PlaceMarket(bid bool, size float64) (float64, error) {
+	order := m.sim.engine.NewOrder(bid, size, m.UserID())
+	res, err := m.sim.execute(engine.Command{
+		Type:        engine.CommandPlace,
+		OrderID:     order.ID,
+		UserID:      order.UserID,
+		Bid:         bid,
+		Size:        size,
+		MaxSlippage: DefaultSlippage,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	filled := 0.0
+	for _, match := range res.Matches {
+		filled += match.SizeFilled
+	}
+	return filled, nil
+}
+
+// Cancel cancels a resting order of the agent.
+func (m *Market) Cancel(id int64) error {
+	if o := m.sim.book.Order(id); o == nil || o.UserID != m.UserID() {
+		return engine.ErrOrderNotFound
+	}
+
+	_, err := m.sim.execute(engine.Command{Type: engine.CommandCancel, OrderID: id})
+	return err
+}
+
+// CancelAll cancels every resting order of the agent.
+func (m *Market) CancelAll() {
+	for _, o := range m.Orders() {
+		if err := m.Cancel(o.ID); err != nil {
+			m.Fail(err)
+		}
+	}
+}
+
+// Fail stops the simulation after the step with err. Agents report errors
+// of the exchange they can't handle with it.
+func (m *Market) Fail(err error) {
+	if m.err == nil {
+		m.err = err
+	}
+}
+
+// roundSize rounds a size to the lot of the simulation.
+func roundSize(size float64) float64 {
+	return math.Round(size/orderbook.DefaultLot) / math.Round(1/orderbook.DefaultLot)
+}
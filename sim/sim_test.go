@@ -0,0 +1,110 @@
+package sim
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/inagib21/crypto-exchange/mm"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	// Every order placed is logged otherwise.
+	logrus.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func run(t *testing.T, cfg Config) *Report {
+	t.Helper()
+
+	r, err := New(cfg).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestDeterministic(t *testing.T) {
+	cfg := func(seed int64) Config {
+		return Config{Seed: seed, Steps: 500, Volatility: 0.8, Participants: DefaultParticipants()}
+	}
+
+	// The same seed gives the same simulation
+	a, b := run(t, cfg(1)), run(t, cfg(1))
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("reports differ:\n%+v\n%+v", a, b)
+	}
+
+	// Another seed gives another one
+	if c := run(t, cfg(2)); reflect.DeepEqual(a.Participants, c.Participants) {
+		t.Error("seeds 1 and 2 trade the same")
+	}
+}
+
+func TestSettlement(t *testing.T) {
+	r := run(t, Config{Seed: 3, Steps: 500, Volatility: 0.8, Participants: DefaultParticipants()})
+
+	if r.Trades == 0 || r.Spread.Mean <= 0 || r.Depth.Mean <= 0 || r.Volatility <= 0 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+
+	// Trades move assets between participants without creating any
+	position, cash := 0.0, 0.0
+	for _, p := range r.Participants {
+		position += p.Position
+		cash += p.Cash
+	}
+	if math.Abs(position) > 1e-6 || math.Abs(cash) > 1e-3 {
+		t.Errorf("net position %f, net cash %f", position, cash)
+	}
+
+	// The text report has a line per participant
+	buf := &bytes.Buffer{}
+	if err := r.WriteText(buf); err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(buf.Bytes(), []byte("\n")); lines < 9+len(r.Participants) {
+		t.Errorf("report of %d lines:\n%s", lines, buf)
+	}
+}
+
+func TestAgents(t *testing.T) {
+	maker := MarketMaker{Strategy: mm.FixedSpread{Spread: 2, Size: 1}, MaxPosition: 3}
+	r := run(t, Config{
+		Seed:  4,
+		Steps: 200,
+		Participants: []Participant{
+			{Name: "maker", Agent: maker},
+			{Name: "buyer", Agent: LiquidityTaker{Rate: 1, Size: 1, BuyRatio: 1}},
+			{Name: "momentum", Agent: MomentumTrader{Lookback: 3, Threshold: 0.0001, Size: 1}},
+		},
+	})
+
+	// The maker stops offering at its position limit
+	if got := r.Participants[0].Position; got != -3 {
+		t.Errorf("maker position %f, want -3", got)
+	}
+	// Buyers only get filled while the maker offers
+	if got := r.Participants[1].Position + r.Participants[2].Position; got != 3 {
+		t.Errorf("bought %f, want 3", got)
+	}
+	if r.OneSided == 0 {
+		t.Error("the book was never one-sided")
+	}
+
+	// Noise traders cancel their orders after their maximum age
+	noise := NoiseTrader{Rate: 1, MaxSize: 1, LimitRatio: 1, Spread: 0.01, MaxAge: 5 * time.Second}
+	s := New(Config{Seed: 5, Steps: 50, Participants: []Participant{{Name: "noise", Agent: noise}}})
+	if _, err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	m := &Market{Time: s.clock.now, sim: s}
+	if orders := m.Orders(); len(orders) > 5 {
+		t.Errorf("%d orders resting", len(orders))
+	}
+}
@@ -0,0 +1,478 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/inagib21/crypto-exchange/candles"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	usersBucket        = []byte("users")
+	ordersBucket       = []byte("orders")
+	ordersByTimeBucket = []byte("orders_by_time")
+	tradesBucket       = []byte("trades")
+	candlesBucket      = []byte("candles")
+	ledgerBucket       = []byte("ledger")
+	balancesBucket     = []byte("balances")
+	metaBucket         = []byte("meta")
+
+	// recordedSeqKey keeps the Seq of the last batch recorded in metaBucket.
+	recordedSeqKey = []byte("recorded_seq")
+	// consumerSeqPrefix starts the keys of the Seq of the consumers in
+	// metaBucket.
+	consumerSeqPrefix = []byte("consumer_seq:")
+)
+
+// Bolt is a Store backed by an embedded bbolt database. Orders are indexed
+// by creation time, trades and ledger entries are keyed by their sequential
+// ID and candles by market, interval and open time so history queries walk
+// the newest records first. They start at the upper bound of the filter and
+// stop at its lower bound, trades are added in the order they are executed
+// so their timestamps bound them too. Balances are kept up to date as
+// ledger entries are added.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens the database at path, creating it if needed.
+func OpenBolt(path string) (*Bolt, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{usersBucket, ordersBucket, ordersByTimeBucket, tradesBucket, candlesBucket, ledgerBucket, balancesBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Bolt{db: db}, nil
+}
+
+func (b *Bolt) SaveUser(u User) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(usersBucket), itob(uint64(u.ID)), u)
+	})
+}
+
+func (b *Bolt) User(id int64) (User, error) {
+	u := User{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return get(tx.Bucket(usersBucket), itob(uint64(id)), &u)
+	})
+	return u, err
+}
+
+func (b *Bolt) SaveOrder(o Order) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return saveOrder(tx, o)
+	})
+}
+
+func saveOrder(tx *bolt.Tx, o Order) error {
+	var (
+		orders = tx.Bucket(ordersBucket)
+		index  = tx.Bucket(ordersByTimeBucket)
+		key    = itob(uint64(o.ID))
+	)
+
+	old := Order{}
+	switch err := get(orders, key, &old); err {
+	case nil:
+		if err := index.Delete(orderIndexKey(old)); err != nil {
+			return err
+		}
+	case ErrNotFound:
+	default:
+		return err
+	}
+
+	if err := index.Put(orderIndexKey(o), key); err != nil {
+		return err
+	}
+	return put(orders, key, o)
+}
+
+func (b *Bolt) Order(id int64) (Order, error) {
+	o := Order{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return get(tx.Bucket(ordersBucket), itob(uint64(id)), &o)
+	})
+	return o, err
+}
+
+func (b *Bolt) Orders(f OrderFilter) ([]Order, error) {
+	page := []Order{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var (
+			orders = tx.Bucket(ordersBucket)
+			c      = tx.Bucket(ordersByTimeBucket).Cursor()
+			p      = newPager(f.Page)
+		)
+
+		for k, id := seekBefore(c, f.To); k != nil && !p.done(); k, id = c.Prev() {
+			if f.From != 0 && int64(binary.BigEndian.Uint64(k)) < f.From {
+				break
+			}
+			o := Order{}
+			if err := get(orders, id, &o); err != nil {
+				return err
+			}
+			if f.match(o) && p.take() {
+				page = append(page, o)
+			}
+		}
+		return nil
+	})
+	return page, err
+}
+
+func (b *Bolt) LastOrderID() (int64, error) {
+	id := int64(0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket(ordersBucket).Cursor().Last(); k != nil {
+			id = int64(binary.BigEndian.Uint64(k))
+		}
+		return nil
+	})
+	return id, err
+}
+
+// orderIndexKey sorts orders by creation time and ID.
+func orderIndexKey(o Order) []byte {
+	return append(itob(uint64(o.CreatedAt)), itob(uint64(o.ID))...)
+}
+
+func (b *Bolt) AddTrade(t *Trade) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return addTrade(tx, t)
+	})
+}
+
+func addTrade(tx *bolt.Tx, t *Trade) error {
+	trades := tx.Bucket(tradesBucket)
+
+	id, err := trades.NextSequence()
+	if err != nil {
+		return err
+	}
+	t.ID = id
+
+	return put(trades, itob(id), t)
+}
+
+func (b *Bolt) Trades(f TradeFilter) ([]Trade, error) {
+	page := []Trade{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var (
+			c = tx.Bucket(tradesBucket).Cursor()
+			p = newPager(f.Page)
+		)
+
+		for k, v := c.Last(); k != nil && !p.done(); k, v = c.Prev() {
+			t := Trade{}
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			if f.From != 0 && t.Timestamp < f.From {
+				break
+			}
+			if f.match(t) && p.take() {
+				page = append(page, t)
+			}
+		}
+		return nil
+	})
+	return page, err
+}
+
+func (b *Bolt) Fills(f FillFilter) ([]Fill, error) {
+	page := []Fill{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var (
+			c = tx.Bucket(tradesBucket).Cursor()
+			p = newPager(f.Page)
+		)
+
+		for k, v := seekBefore(c, int64(f.ToTrade)); k != nil && !p.done(); k, v = c.Prev() {
+			if binary.BigEndian.Uint64(k) < f.FromTrade {
+				break
+			}
+			t := Trade{}
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			if f.From != 0 && t.Timestamp < f.From {
+				break
+			}
+			page = f.collect(page, p, t)
+		}
+		return nil
+	})
+	return page, err
+}
+
+func (b *Bolt) TradesAfter(seq uint64) ([]Trade, error) {
+	trades := []Trade{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(tradesBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			t := Trade{}
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			if t.Seq <= seq {
+				break
+			}
+			trades = append(trades, t)
+		}
+		return nil
+	})
+
+	for i, j := 0, len(trades)-1; i < j; i, j = i+1, j-1 {
+		trades[i], trades[j] = trades[j], trades[i]
+	}
+	return trades, err
+}
+
+func (b *Bolt) SaveCandle(c candles.Candle) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(candlesBucket), append(candlePrefix(c.Market, c.Interval), itob(uint64(c.OpenTime))...), c)
+	})
+}
+
+func (b *Bolt) Candles(f CandleFilter) ([]candles.Candle, error) {
+	page := []candles.Candle{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var (
+			c      = tx.Bucket(candlesBucket).Cursor()
+			p      = newPager(f.Page)
+			prefix = candlePrefix(f.Market, f.Interval)
+			to     = uint64(math.MaxInt64)
+		)
+		if f.To != 0 {
+			to = uint64(f.To)
+		}
+
+		// Walk back from the last candle opening before To.
+		k, v := c.Seek(append(prefix, itob(to)...))
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+
+		for ; k != nil && bytes.HasPrefix(k, prefix) && !p.done(); k, v = c.Prev() {
+			candle := candles.Candle{}
+			if err := json.Unmarshal(v, &candle); err != nil {
+				return err
+			}
+			if f.match(candle) && p.take() {
+				page = append(page, candle)
+			}
+		}
+		return nil
+	})
+	return page, err
+}
+
+// candlePrefix groups the candles of a market and interval, the open time
+// follows it in the key.
+func candlePrefix(market string, interval candles.Interval) []byte {
+	prefix := append([]byte(market), 0)
+	prefix = append(prefix, interval...)
+	return append(prefix, 0)
+}
+
+func (b *Bolt) AddLedgerEntries(entries ...*LedgerEntry) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return addLedgerEntries(tx, entries)
+	})
+}
+
+func addLedgerEntries(tx *bolt.Tx, entries []*LedgerEntry) error {
+	var (
+		ledger   = tx.Bucket(ledgerBucket)
+		balances = tx.Bucket(balancesBucket)
+	)
+
+	for _, e := range entries {
+		id, err := ledger.NextSequence()
+		if err != nil {
+			return err
+		}
+		e.ID = id
+
+		if err := put(ledger, itob(id), e); err != nil {
+			return err
+		}
+
+		key := balanceKey(e.UserID, e.Asset)
+		balance := 0.0
+		if v := balances.Get(key); v != nil {
+			balance = math.Float64frombits(binary.BigEndian.Uint64(v))
+		}
+		if err := balances.Put(key, itob(math.Float64bits(balance+e.Amount))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bolt) Ledger(f LedgerFilter) ([]LedgerEntry, error) {
+	page := []LedgerEntry{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var (
+			c = tx.Bucket(ledgerBucket).Cursor()
+			p = newPager(f.Page)
+		)
+
+		for k, v := c.Last(); k != nil && !p.done(); k, v = c.Prev() {
+			e := LedgerEntry{}
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if f.match(e) && p.take() {
+				page = append(page, e)
+			}
+		}
+		return nil
+	})
+	return page, err
+}
+
+func (b *Bolt) Balances(userID int64) (map[string]float64, error) {
+	balances := make(map[string]float64)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var (
+			c      = tx.Bucket(balancesBucket).Cursor()
+			prefix = itob(uint64(userID))
+		)
+
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			balances[string(k[len(prefix):])] = math.Float64frombits(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	return balances, err
+}
+
+// balanceKey keys the balances of a user by asset.
+func balanceKey(userID int64, asset string) []byte {
+	return append(itob(uint64(userID)), asset...)
+}
+
+func (b *Bolt) Record(batch Batch) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if v := meta.Get(recordedSeqKey); v != nil && binary.BigEndian.Uint64(v) >= batch.Seq {
+			return nil
+		}
+
+		for _, o := range batch.Orders {
+			if err := saveOrder(tx, o); err != nil {
+				return err
+			}
+		}
+		for _, t := range batch.Trades {
+			t.Seq = batch.Seq
+			if err := addTrade(tx, t); err != nil {
+				return err
+			}
+		}
+		if err := addLedgerEntries(tx, batch.Ledger); err != nil {
+			return err
+		}
+
+		return meta.Put(recordedSeqKey, itob(batch.Seq))
+	})
+}
+
+func (b *Bolt) RecordedSeq() (uint64, error) {
+	seq := uint64(0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(metaBucket).Get(recordedSeqKey); v != nil {
+			seq = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	return seq, err
+}
+
+func (b *Bolt) SaveConsumerSeq(name string, seq uint64) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(consumerSeqKey(name), itob(seq))
+	})
+}
+
+func (b *Bolt) ConsumerSeq(name string) (uint64, error) {
+	seq := uint64(0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(metaBucket).Get(consumerSeqKey(name)); v != nil {
+			seq = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	return seq, err
+}
+
+func consumerSeqKey(name string) []byte {
+	return append(append([]byte{}, consumerSeqPrefix...), name...)
+}
+
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+// seekBefore moves the cursor to the last key before the big endian key
+// bound, or to the last key when bound is zero.
+func seekBefore(c *bolt.Cursor, bound int64) (k, v []byte) {
+	if bound == 0 {
+		return c.Last()
+	}
+	if k, _ := c.Seek(itob(uint64(bound))); k == nil {
+		return c.Last()
+	}
+	return c.Prev()
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func put(bucket *bolt.Bucket, key []byte, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
+
+func get(bucket *bolt.Bucket, key []byte, v any) error {
+	data := bucket.Get(key)
+	if data == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, v)
+}
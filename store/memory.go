@@ -0,0 +1,287 @@
+package store
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/inagib21/crypto-exchange/candles"
+)
+
+// Memory is a Store keeping everything in memory, for tests.
+type Memory struct {
+	mu      sync.RWMutex
+	users   map[int64]User
+	orders  map[int64]Order
+	trades  []Trade
+	candles map[candleKey]candles.Candle
+	ledger  []LedgerEntry
+	// recorded is the Seq of the last batch recorded.
+	recorded uint64
+	// consumers maps a consumer to the Seq it processed.
+	consumers map[string]uint64
+}
+
+type candleKey struct {
+	market   string
+	interval candles.Interval
+	open     int64
+}
+
+// NewMemory creates an empty in-memory store.
+func NewMemory() *Memory {
+	return &Memory{
+		users:     make(map[int64]User),
+		orders:    make(map[int64]Order),
+		candles:   make(map[candleKey]candles.Candle),
+		consumers: make(map[string]uint64),
+	}
+}
+
+func (m *Memory) SaveUser(u User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.users[u.ID] = u
+	return nil
+}
+
+func (m *Memory) User(id int64) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+func (m *Memory) SaveOrder(o Order) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.orders[o.ID] = o
+	return nil
+}
+
+func (m *Memory) Order(id int64) (Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	o, ok := m.orders[id]
+	if !ok {
+		return Order{}, ErrNotFound
+	}
+	return o, nil
+}
+
+func (m *Memory) Orders(f OrderFilter) ([]Order, error) {
+	m.mu.RLock()
+	orders := make([]Order, 0, len(m.orders))
+	for _, o := range m.orders {
+		if f.match(o) {
+			orders = append(orders, o)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(orders, func(i, j int) bool { return newerOrder(orders[i], orders[j]) })
+
+	page := []Order{}
+	p := newPager(f.Page)
+	for _, o := range orders {
+		if p.done() {
+			break
+		}
+		if p.take() {
+			page = append(page, o)
+		}
+	}
+	return page, nil
+}
+
+func (m *Memory) LastOrderID() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	last := int64(0)
+	for id := range m.orders {
+		last = max(last, id)
+	}
+	return last, nil
+}
+
+// newerOrder orders orders by creation time, newest first, and ID.
+func newerOrder(a, b Order) bool {
+	if a.CreatedAt != b.CreatedAt {
+		return a.CreatedAt > b.CreatedAt
+	}
+	return a.ID > b.ID
+}
+
+func (m *Memory) AddTrade(t *Trade) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t.ID = uint64(len(m.trades) + 1)
+	m.trades = append(m.trades, *t)
+	return nil
+}
+
+func (m *Memory) Trades(f TradeFilter) ([]Trade, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	page := []Trade{}
+	p := newPager(f.Page)
+	for i := len(m.trades) - 1; i >= 0 && !p.done(); i-- {
+		if f.match(m.trades[i]) && p.take() {
+			page = append(page, m.trades[i])
+		}
+	}
+	return page, nil
+}
+
+func (m *Memory) Fills(f FillFilter) ([]Fill, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	page := []Fill{}
+	p := newPager(f.Page)
+	for i := len(m.trades) - 1; i >= 0 && !p.done(); i-- {
+		page = f.collect(page, p, m.trades[i])
+	}
+	return page, nil
+}
+
+func (m *Memory) TradesAfter(seq uint64) ([]Trade, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := len(m.trades)
+	for i > 0 && m.trades[i-1].Seq > seq {
+		i--
+	}
+	return append([]Trade{}, m.trades[i:]...), nil
+}
+
+func (m *Memory) SaveCandle(c candles.Candle) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.candles[candleKey{market: c.Market, interval: c.Interval, open: c.OpenTime}] = c
+	return nil
+}
+
+func (m *Memory) Candles(f CandleFilter) ([]candles.Candle, error) {
+	m.mu.RLock()
+	matching := []candles.Candle{}
+	for _, c := range m.candles {
+		if f.match(c) {
+			matching = append(matching, c)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(matching, func(i, j int) bool { return matching[i].OpenTime > matching[j].OpenTime })
+
+	page := []candles.Candle{}
+	p := newPager(f.Page)
+	for _, c := range matching {
+		if p.done() {
+			break
+		}
+		if p.take() {
+			page = append(page, c)
+		}
+	}
+	return page, nil
+}
+
+func (m *Memory) AddLedgerEntries(entries ...*LedgerEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range entries {
+		e.ID = uint64(len(m.ledger) + 1)
+		m.ledger = append(m.ledger, *e)
+	}
+	return nil
+}
+
+func (m *Memory) Ledger(f LedgerFilter) ([]LedgerEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	page := []LedgerEntry{}
+	p := newPager(f.Page)
+	for i := len(m.ledger) - 1; i >= 0 && !p.done(); i-- {
+		if f.match(m.ledger[i]) && p.take() {
+			page = append(page, m.ledger[i])
+		}
+	}
+	return page, nil
+}
+
+func (m *Memory) Balances(userID int64) (map[string]float64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	balances := make(map[string]float64)
+	for _, e := range m.ledger {
+		if e.UserID == userID {
+			balances[e.Asset] += e.Amount
+		}
+	}
+	return balances, nil
+}
+
+func (m *Memory) Record(b Batch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if b.Seq <= m.recorded {
+		return nil
+	}
+
+	for _, o := range b.Orders {
+		m.orders[o.ID] = o
+	}
+	for _, t := range b.Trades {
+		t.ID = uint64(len(m.trades) + 1)
+		t.Seq = b.Seq
+		m.trades = append(m.trades, *t)
+	}
+	for _, e := range b.Ledger {
+		e.ID = uint64(len(m.ledger) + 1)
+		m.ledger = append(m.ledger, *e)
+	}
+	m.recorded = b.Seq
+	return nil
+}
+
+func (m *Memory) RecordedSeq() (uint64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.recorded, nil
+}
+
+func (m *Memory) SaveConsumerSeq(name string, seq uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.consumers[name] = seq
+	return nil
+}
+
+func (m *Memory) ConsumerSeq(name string) (uint64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.consumers[name], nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,341 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/inagib21/crypto-exchange/candles"
+	"github.com/inagib21/crypto-exchange/fees"
+	"github.com/inagib21/crypto-exchange/orderbook"
+)
+
+const (
+	// DefaultLimit is the page size of queries that don't set one.
+	DefaultLimit = 100
+	// MaxLimit bounds the page size of queries.
+	MaxLimit = 1000
+)
+
+// ErrNotFound is returned when a record doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// OrderStatus is the status of an order in the order history, it follows
+// the lifecycle of the orders of the order book.
+type OrderStatus string
+
+const (
+	OrderNew             OrderStatus = "NEW"
+	OrderPartiallyFilled OrderStatus = "PARTIALLY_FILLED"
+	OrderFilled          OrderStatus = "FILLED"
+	OrderCanceled        OrderStatus = "CANCELED"
+	OrderExpired         OrderStatus = "EXPIRED"
+	OrderRejected        OrderStatus = "REJECTED"
+)
+
+// User is a registered user of the exchange.
+type User struct {
+	ID      int64
+	Address string
+	Tier    string
+}
+
+// Order is an order of the order history. OriginalSize is the total size of
+// the order, Filled the part of it that was matched at an average price of
+// AvgPrice.
+type Order struct {
+	ID           int64
+	UserID       int64
+	Market       string
+	Bid          bool
+	Limit        bool
+	Price        float64
+	OriginalSize float64
+	Filled       float64
+	AvgPrice     float64
+	Status       OrderStatus
+	CreatedAt    int64
+	UpdatedAt    int64
+}
+
+// Fill records a fill of size at price and updates the status of the order.
+// Like in the order book, an order with less than orderbook.Dust left is filled.
+func (o *Order) Fill(size, price float64) {
+	o.AvgPrice = (o.AvgPrice*o.Filled + price*size) / (o.Filled + size)
+	o.Filled += size
+
+	o.Status = OrderPartiallyFilled
+	if o.OriginalSize-o.Filled < orderbook.Dust {
+		o.Status = OrderFilled
+	}
+}
+
+// Trade is an executed match. Bid tells whether the bid was the taker and
+// Seq is the journal sequence number of the command that executed it.
+type Trade struct {
+	ID         uint64
+	Seq        uint64 `json:",omitempty"`
+	Market     string
+	Price      float64
+	Size       float64
+	Bid        bool
+	BidOrderID int64
+	AskOrderID int64
+	BidUserID  int64
+	AskUserID  int64
+	MakerFee   float64
+	TakerFee   float64
+	Timestamp  int64
+}
+
+// Fill is the side of a trade of one user. A trade between two orders of
+// the same user is two fills.
+type Fill struct {
+	TradeID   uint64
+	Market    string
+	OrderID   int64
+	UserID    int64
+	Bid       bool
+	Price     float64
+	Size      float64
+	Liquidity fees.Liquidity
+	Fee       float64
+	Timestamp int64
+}
+
+// Fills returns the fills of a trade, the bid first.
+func (t Trade) Fills() []Fill {
+	bid := Fill{
+		TradeID:   t.ID,
+		Market:    t.Market,
+		OrderID:   t.BidOrderID,
+		UserID:    t.BidUserID,
+		Bid:       true,
+		Price:     t.Price,
+		Size:      t.Size,
+		Liquidity: fees.Maker,
+		Fee:       t.MakerFee,
+		Timestamp: t.Timestamp,
+	}
+	ask := bid
+	ask.OrderID, ask.UserID, ask.Bid = t.AskOrderID, t.AskUserID, false
+
+	if t.Bid {
+		bid.Liquidity, bid.Fee = fees.Taker, t.TakerFee
+	} else {
+		ask.Liquidity, ask.Fee = fees.Taker, t.TakerFee
+	}
+
+	return []Fill{bid, ask}
+}
+
+// LedgerEntry is a change of the balance of a user in an asset.
+type LedgerEntry struct {
+	ID        uint64
+	UserID    int64
+	Asset     string
+	Amount    float64
+	Reason    string
+	OrderID   int64 `json:",omitempty"`
+	Timestamp int64
+}
+
+// Batch is the history written for one command of the journal: the orders
+// it changed, the trades it executed and the ledger entries settling them.
+type Batch struct {
+	// Seq is the journal sequence number of the command.
+	Seq    uint64
+	Orders []Order
+	Trades []*Trade
+	Ledger []*LedgerEntry
+}
+
+// Page selects a page of results, newest first.
+type Page struct {
+	Offset int
+	Limit  int
+}
+
+// limit returns the page size to use.
+func (p Page) limit() int {
+	switch {
+	case p.Limit <= 0:
+		return DefaultLimit
+	case p.Limit > MaxLimit:
+		return MaxLimit
+	default:
+		return p.Limit
+	}
+}
+
+// OrderFilter selects orders. Zero fields match every order, From and To
+// bound the creation time in nanoseconds, To is exclusive.
+type OrderFilter struct {
+	UserID int64
+	Market string
+	Status OrderStatus
+	From   int64
+	To     int64
+	Page
+}
+
+func (f OrderFilter) match(o Order) bool {
+	return (f.UserID == 0 || o.UserID == f.UserID) &&
+		(f.Market == "" || o.Market == f.Market) &&
+		(f.Status == "" || o.Status == f.Status) &&
+		(f.From == 0 || o.CreatedAt >= f.From) &&
+		(f.To == 0 || o.CreatedAt < f.To)
+}
+
+// TradeFilter selects trades. Zero fields match every trade, From and To
+// bound the timestamp in nanoseconds, To is exclusive.
+type TradeFilter struct {
+	Market string
+	UserID int64
+	From   int64
+	To     int64
+	Page
+}
+
+func (f TradeFilter) match(t Trade) bool {
+	return (f.Market == "" || t.Market == f.Market) &&
+		(f.UserID == 0 || t.BidUserID == f.UserID || t.AskUserID == f.UserID) &&
+		(f.From == 0 || t.Timestamp >= f.From) &&
+		(f.To == 0 || t.Timestamp < f.To)
+}
+
+// FillFilter selects the fills of a user. Zero fields match every fill, From
+// and To bound the timestamp in nanoseconds, FromTrade and ToTrade the trade
+// ID. To and ToTrade are exclusive.
+type FillFilter struct {
+	UserID    int64
+	Market    string
+	From      int64
+	To        int64
+	FromTrade uint64
+	ToTrade   uint64
+	Page
+}
+
+// trades selects the trades the fills are part of.
+func (f FillFilter) trades() TradeFilter {
+	return TradeFilter{Market: f.Market, UserID: f.UserID, From: f.From, To: f.To}
+}
+
+// collect adds the fills of a matching trade to the page. Fills of the same
+// trade are visited ask first, like the rest of the results newest first.
+func (f FillFilter) collect(page []Fill, p *pager, t Trade) []Fill {
+	if !f.trades().match(t) ||
+		(f.FromTrade != 0 && t.ID < f.FromTrade) || (f.ToTrade != 0 && t.ID >= f.ToTrade) {
+		return page
+	}
+
+	fills := t.Fills()
+	for i := len(fills) - 1; i >= 0 && !p.done(); i-- {
+		if fills[i].UserID == f.UserID && p.take() {
+			page = append(page, fills[i])
+		}
+	}
+	return page
+}
+
+// CandleFilter selects the candles of a market and interval. From and To
+// bound the open time in nanoseconds, To is exclusive, zero doesn't bound it.
+type CandleFilter struct {
+	Market   string
+	Interval candles.Interval
+	From     int64
+	To       int64
+	Page
+}
+
+func (f CandleFilter) match(c candles.Candle) bool {
+	return c.Market == f.Market && c.Interval == f.Interval &&
+		(f.From == 0 || c.OpenTime >= f.From) &&
+		(f.To == 0 || c.OpenTime < f.To)
+}
+
+// LedgerFilter selects ledger entries. Zero fields match every entry.
+type LedgerFilter struct {
+	UserID int64
+	Asset  string
+	Page
+}
+
+func (f LedgerFilter) match(e LedgerEntry) bool {
+	return (f.UserID == 0 || e.UserID == f.UserID) &&
+		(f.Asset == "" || e.Asset == f.Asset)
+}
+
+// Store persists the users, the order history, the trades, the candles and
+// the ledger of the exchange. Queries return the newest records first.
+type Store interface {
+	SaveUser(u User) error
+	User(id int64) (User, error)
+
+	// SaveOrder inserts or updates an order.
+	SaveOrder(o Order) error
+	Order(id int64) (Order, error)
+	Orders(f OrderFilter) ([]Order, error)
+	// LastOrderID returns the highest ID of the order history, zero when
+	// it is empty.
+	LastOrderID() (int64, error)
+
+	// AddTrade inserts a trade and sets its ID.
+	AddTrade(t *Trade) error
+	Trades(f TradeFilter) ([]Trade, error)
+	// Fills returns the fills of a user from the trades.
+	Fills(f FillFilter) ([]Fill, error)
+	// TradesAfter returns the trades of the commands after seq, oldest
+	// first.
+	TradesAfter(seq uint64) ([]Trade, error)
+
+	// SaveCandle inserts or updates a candle.
+	SaveCandle(c candles.Candle) error
+	Candles(f CandleFilter) ([]candles.Candle, error)
+
+	// AddLedgerEntries inserts ledger entries and sets their IDs.
+	AddLedgerEntries(entries ...*LedgerEntry) error
+	Ledger(f LedgerFilter) ([]LedgerEntry, error)
+	// Balances sums the ledger entries of a user by asset.
+	Balances(userID int64) (map[string]float64, error)
+
+	// Record writes a batch atomically and sets the IDs of its trades and
+	// ledger entries, and the Seq of its trades. A batch whose Seq isn't after the last one recorded
+	// is skipped, so the journal can be replayed into the store.
+	Record(b Batch) error
+	// RecordedSeq returns the Seq of the last batch recorded.
+	RecordedSeq() (uint64, error)
+
+	// SaveConsumerSeq saves the Seq of the last command a consumer of the
+	// journal processed.
+	SaveConsumerSeq(name string, seq uint64) error
+	// ConsumerSeq returns the Seq saved for a consumer, zero if none was.
+	ConsumerSeq(name string) (uint64, error)
+
+	Close() error
+}
+
+// pager collects the page of matching records while they are visited newest
+// first.
+type pager struct {
+	skip  int
+	limit int
+}
+
+func newPager(p Page) *pager {
+	return &pager{skip: p.Offset, limit: p.limit()}
+}
+
+// take reports whether the next matching record belongs to the page.
+func (p *pager) take() bool {
+	if p.skip > 0 {
+		p.skip--
+		return false
+	}
+	p.limit--
+	return p.limit >= 0
+}
+
+// done reports whether the page is full.
+func (p *pager) done() bool {
+	return p.limit <= 0
+}
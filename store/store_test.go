@@ -0,0 +1,330 @@
+package store
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/inagib21/crypto-exchange/candles"
+	"github.com/inagib21/crypto-exchange/fees"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+// stores returns every Store implementation, opened empty.
+func stores(t *testing.T) map[string]Store {
+	db, err := OpenBolt(filepath.Join(t.TempDir(), "exchange.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return map[string]Store{
+		"memory": NewMemory(),
+		"bolt":   db,
+	}
+}
+
+func TestUsers(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			_, err := s.User(7)
+			assert(t, err, ErrNotFound)
+
+			user := User{ID: 7, Address: "0x7", Tier: "default"}
+			assert(t, s.SaveUser(user), nil)
+			got, err := s.User(7)
+			assert(t, err, nil)
+			assert(t, got, user)
+		})
+	}
+}
+
+func TestOrderHistory(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i := int64(1); i <= 5; i++ {
+				assert(t, s.SaveOrder(Order{ID: i, UserID: i % 2, Market: "ETH", OriginalSize: 2, Status: OrderNew, CreatedAt: i * 10}), nil)
+			}
+
+			last, err := s.LastOrderID()
+			assert(t, err, nil)
+			assert(t, last, int64(5))
+
+			// Updating an order keeps a single copy of it
+			order, err := s.Order(3)
+			assert(t, err, nil)
+			order.Fill(1, 100)
+			order.Fill(1, 103)
+			assert(t, order.AvgPrice, 101.5)
+			assert(t, order.Status, OrderFilled)
+			assert(t, s.SaveOrder(order), nil)
+
+			orders, err := s.Orders(OrderFilter{UserID: 1})
+			assert(t, err, nil)
+			assert(t, ids(orders), []int64{5, 3, 1})
+
+			orders, err = s.Orders(OrderFilter{Status: OrderNew, Page: Page{Offset: 1, Limit: 2}})
+			assert(t, err, nil)
+			assert(t, ids(orders), []int64{4, 2})
+
+			// From is inclusive, To exclusive
+			orders, err = s.Orders(OrderFilter{From: 20, To: 40})
+			assert(t, err, nil)
+			assert(t, ids(orders), []int64{3, 2})
+
+			orders, err = s.Orders(OrderFilter{From: 35, To: 100})
+			assert(t, err, nil)
+			assert(t, ids(orders), []int64{5, 4})
+
+			orders, err = s.Orders(OrderFilter{Status: OrderFilled})
+			assert(t, err, nil)
+			assert(t, orders, []Order{order})
+
+			_, err = s.Order(42)
+			assert(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestFillLeavesNoDust(t *testing.T) {
+	// Ten fills of 0.1 add up to a sliver less than 1
+	order := Order{OriginalSize: 1}
+	for i := 0; i < 10; i++ {
+		assert(t, order.Status != OrderFilled, true)
+		order.Fill(0.1, 100)
+	}
+	assert(t, order.Filled < order.OriginalSize, true)
+	assert(t, order.Status, OrderFilled)
+}
+
+func ids(orders []Order) []int64 {
+	ids := []int64{}
+	for _, o := range orders {
+		ids = append(ids, o.ID)
+	}
+	return ids
+}
+
+func TestTrades(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i := 1; i <= 4; i++ {
+				trade := &Trade{Market: "ETH", Price: float64(100 + i), Size: 1, BidUserID: 7, AskUserID: int64(i), Timestamp: int64(i)}
+				assert(t, s.AddTrade(trade), nil)
+				assert(t, trade.ID, uint64(i))
+			}
+
+			trades, err := s.Trades(TradeFilter{Market: "ETH", Page: Page{Limit: 2}})
+			assert(t, err, nil)
+			assert(t, len(trades), 2)
+			assert(t, trades[0].Price, 104.0)
+			assert(t, trades[1].Price, 103.0)
+
+			trades, err = s.Trades(TradeFilter{UserID: 2})
+			assert(t, err, nil)
+			assert(t, len(trades), 1)
+
+			trades, err = s.Trades(TradeFilter{From: 2, To: 4})
+			assert(t, err, nil)
+			assert(t, len(trades), 2)
+
+			trades, err = s.Trades(TradeFilter{Market: "BTC"})
+			assert(t, err, nil)
+			assert(t, trades, []Trade{})
+		})
+	}
+}
+
+func TestFills(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			trades := []*Trade{
+				// User 7 takes the ask of user 8
+				{Market: "ETH", Price: 100, Size: 1, Bid: true, BidOrderID: 1, AskOrderID: 2, BidUserID: 7, AskUserID: 8, MakerFee: -0.1, TakerFee: 0.2, Timestamp: 1},
+				{Market: "BTC", Price: 200, Size: 1, BidOrderID: 3, AskOrderID: 4, BidUserID: 8, AskUserID: 9, Timestamp: 2},
+				// User 7 trades with itself
+				{Market: "ETH", Price: 101, Size: 2, BidOrderID: 5, AskOrderID: 6, BidUserID: 7, AskUserID: 7, MakerFee: -0.1, TakerFee: 0.2, Timestamp: 3},
+			}
+			for _, trade := range trades {
+				assert(t, s.AddTrade(trade), nil)
+			}
+
+			fills, err := s.Fills(FillFilter{UserID: 7})
+			assert(t, err, nil)
+			assert(t, len(fills), 3)
+
+			// The ask of the self trade took the bid
+			assert(t, fills[0], Fill{TradeID: 3, Market: "ETH", OrderID: 6, UserID: 7, Price: 101, Size: 2, Liquidity: fees.Taker, Fee: 0.2, Timestamp: 3})
+			assert(t, fills[1].Liquidity, fees.Maker)
+			assert(t, fills[1].OrderID, int64(5))
+			assert(t, fills[2], Fill{TradeID: 1, Market: "ETH", OrderID: 1, UserID: 7, Bid: true, Price: 100, Size: 1, Liquidity: fees.Taker, Fee: 0.2, Timestamp: 1})
+
+			// Pages count fills, not trades
+			fills, err = s.Fills(FillFilter{UserID: 7, Page: Page{Offset: 1, Limit: 1}})
+			assert(t, err, nil)
+			assert(t, len(fills), 1)
+			assert(t, fills[0].OrderID, int64(5))
+
+			// Trade IDs bound the fills, ToTrade is exclusive
+			fills, err = s.Fills(FillFilter{UserID: 7, FromTrade: 2, ToTrade: 3})
+			assert(t, err, nil)
+			assert(t, fills, []Fill{})
+
+			fills, err = s.Fills(FillFilter{UserID: 7, FromTrade: 3})
+			assert(t, err, nil)
+			assert(t, len(fills), 2)
+
+			fills, err = s.Fills(FillFilter{UserID: 7, ToTrade: 2})
+			assert(t, err, nil)
+			assert(t, len(fills), 1)
+			assert(t, fills[0].TradeID, uint64(1))
+
+			fills, err = s.Fills(FillFilter{UserID: 7, FromTrade: 1, ToTrade: 10})
+			assert(t, err, nil)
+			assert(t, len(fills), 3)
+
+			fills, err = s.Fills(FillFilter{UserID: 8, Market: "BTC"})
+			assert(t, err, nil)
+			assert(t, len(fills), 1)
+			assert(t, fills[0].Bid, true)
+			assert(t, fills[0].Liquidity, fees.Maker)
+		})
+	}
+}
+
+func TestCandles(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i := int64(1); i <= 4; i++ {
+				assert(t, s.SaveCandle(candles.Candle{Market: "ETH", Interval: candles.Minute, OpenTime: i * 60, Close: 100}), nil)
+				assert(t, s.SaveCandle(candles.Candle{Market: "ETH", Interval: candles.Hour, OpenTime: i * 3600}), nil)
+			}
+			assert(t, s.SaveCandle(candles.Candle{Market: "BTC", Interval: candles.Minute, OpenTime: 60}), nil)
+
+			// Saving a candle again updates it
+			assert(t, s.SaveCandle(candles.Candle{Market: "ETH", Interval: candles.Minute, OpenTime: 240, Close: 101}), nil)
+
+			got, err := s.Candles(CandleFilter{Market: "ETH", Interval: candles.Minute})
+			assert(t, err, nil)
+			assert(t, len(got), 4)
+			assert(t, got[0].Close, 101.0)
+
+			got, err = s.Candles(CandleFilter{Market: "ETH", Interval: candles.Minute, From: 120, To: 240})
+			assert(t, err, nil)
+			assert(t, len(got), 2)
+			assert(t, got[0].OpenTime, int64(180))
+
+			got, err = s.Candles(CandleFilter{Market: "ETH", Interval: candles.Hour, Page: Page{Limit: 1}})
+			assert(t, err, nil)
+			assert(t, got[0].OpenTime, int64(4*3600))
+
+			got, err = s.Candles(CandleFilter{Market: "BTC", Interval: candles.Hour})
+			assert(t, err, nil)
+			assert(t, got, []candles.Candle{})
+		})
+	}
+}
+
+func TestLedger(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			assert(t, s.AddLedgerEntries(
+				&LedgerEntry{UserID: 7, Asset: "ETH", Amount: 2, Reason: "FILL"},
+				&LedgerEntry{UserID: 7, Asset: "ETH", Amount: -0.5, Reason: "FEE"},
+				&LedgerEntry{UserID: 8, Asset: "USD", Amount: 100, Reason: "FILL"},
+			), nil)
+
+			entries, err := s.Ledger(LedgerFilter{UserID: 7})
+			assert(t, err, nil)
+			assert(t, len(entries), 2)
+			assert(t, entries[0].Reason, "FEE")
+
+			balances, err := s.Balances(7)
+			assert(t, err, nil)
+			assert(t, balances, map[string]float64{"ETH": 1.5})
+		})
+	}
+}
+
+func TestPageLimit(t *testing.T) {
+	assert(t, Page{}.limit(), DefaultLimit)
+	assert(t, Page{Limit: 5}.limit(), 5)
+	assert(t, Page{Limit: MaxLimit + 1}.limit(), MaxLimit)
+}
+
+func TestRecord(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			seq, err := s.RecordedSeq()
+			assert(t, err, nil)
+			assert(t, seq, uint64(0))
+
+			batch := Batch{
+				Seq:    3,
+				Orders: []Order{{ID: 1, UserID: 7, Market: "ETH", OriginalSize: 2, Filled: 2, Status: OrderFilled}},
+				Trades: []*Trade{{Market: "ETH", Price: 100, Size: 2, BidOrderID: 1, BidUserID: 7, AskUserID: 8}},
+				Ledger: []*LedgerEntry{{UserID: 7, Asset: "ETH", Amount: 2}, {UserID: 8, Asset: "ETH", Amount: -2}},
+			}
+			assert(t, s.Record(batch), nil)
+			assert(t, batch.Trades[0].ID, uint64(1))
+			assert(t, batch.Ledger[1].ID, uint64(2))
+
+			// A batch that was already recorded is skipped
+			replayed := batch
+			replayed.Trades = []*Trade{{Market: "ETH", Price: 100, Size: 2}}
+			assert(t, s.Record(replayed), nil)
+
+			seq, err = s.RecordedSeq()
+			assert(t, err, nil)
+			assert(t, seq, uint64(3))
+			trades, err := s.Trades(TradeFilter{})
+			assert(t, err, nil)
+			assert(t, len(trades), 1)
+			balances, err := s.Balances(7)
+			assert(t, err, nil)
+			assert(t, balances, map[string]float64{"ETH": 2})
+			order, err := s.Order(1)
+			assert(t, err, nil)
+			assert(t, order.Status, OrderFilled)
+		})
+	}
+}
+
+func TestConsumers(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			// Trades recorded before their command had a Seq are never fed again
+			assert(t, s.AddTrade(&Trade{Market: "ETH", Price: 99, Size: 1}), nil)
+			for seq := uint64(2); seq <= 4; seq++ {
+				batch := Batch{Seq: seq, Trades: []*Trade{{Market: "ETH", Price: 100, Size: float64(seq)}}}
+				assert(t, s.Record(batch), nil)
+			}
+
+			trades, err := s.TradesAfter(2)
+			assert(t, err, nil)
+			assert(t, len(trades), 2)
+			assert(t, trades[0].Seq, uint64(3))
+			assert(t, trades[1].Seq, uint64(4))
+			trades, err = s.TradesAfter(0)
+			assert(t, err, nil)
+			assert(t, len(trades), 3)
+
+			seq, err := s.ConsumerSeq("settlement")
+			assert(t, err, nil)
+			assert(t, seq, uint64(0))
+			assert(t, s.SaveConsumerSeq("settlement", 3), nil)
+			seq, err = s.ConsumerSeq("settlement")
+			assert(t, err, nil)
+			assert(t, seq, uint64(3))
+			seq, err = s.ConsumerSeq("candles")
+			assert(t, err, nil)
+			assert(t, seq, uint64(0))
+		})
+	}
+}
@@ -0,0 +1,164 @@
+// Package ticker keeps rolling window statistics of the trades of markets.
+package ticker
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultWindow is the window of the statistics of a ticker.
+const DefaultWindow = 24 * time.Hour
+
+// Ticker is the statistics of the trades of a market in the window ending
+// at CloseTime. Times are in nanoseconds. LastPrice is the price of the last
+// trade, even when it is older than the window.
+type Ticker struct {
+	Market             string
+	LastPrice          float64
+	Open               float64
+	High               float64
+	Low                float64
+	Volume             float64
+	QuoteVolume        float64
+	PriceChange        float64
+	PriceChangePercent float64
+	VWAP               float64
+	Trades             int
+	OpenTime           int64
+	CloseTime          int64
+	BestBid            float64
+	BestBidSize        float64
+	BestAsk            float64
+	BestAskSize        float64
+}
+
+type trade struct {
+	price     float64
+	size      float64
+	timestamp int64
+}
+
+// window keeps the trades of the window with running sums and monotonic
+// queues of the highest and lowest prices, so adding and expiring trades
+// never rescans the window.
+type window struct {
+	trades []trade
+	// highs has decreasing and lows increasing prices, the first of each is
+	// the high and low of the window.
+	highs  []trade
+	lows   []trade
+	volume float64
+	quote  float64
+	last   float64
+}
+
+func (w *window) add(t trade) {
+	w.trades = append(w.trades, t)
+	w.volume += t.size
+	w.quote += t.price * t.size
+	w.last = t.price
+
+	for len(w.highs) > 0 && w.highs[len(w.highs)-1].price <= t.price {
+		w.highs = w.highs[:len(w.highs)-1]
+	}
+	w.highs = append(w.highs, t)
+
+	for len(w.lows) > 0 && w.lows[len(w.lows)-1].price >= t.price {
+		w.lows = w.lows[:len(w.lows)-1]
+	}
+	w.lows = append(w.lows, t)
+}
+
+// expire drops the trades before start.
+func (w *window) expire(start int64) {
+	n := 0
+	for n < len(w.trades) && w.trades[n].timestamp < start {
+		w.volume -= w.trades[n].size
+		w.quote -= w.trades[n].price * w.trades[n].size
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	w.trades = w.trades[n:]
+
+	for len(w.highs) > 0 && w.highs[0].timestamp < start {
+		w.highs = w.highs[1:]
+	}
+	for len(w.lows) > 0 && w.lows[0].timestamp < start {
+		w.lows = w.lows[1:]
+	}
+
+	// Running sums drift by rounding errors, reset them when the window empties.
+	if len(w.trades) == 0 {
+		w.volume, w.quote = 0, 0
+	}
+}
+
+// Tracker keeps the statistics of every market over a rolling window.
+type Tracker struct {
+	mu      sync.Mutex
+	period  time.Duration
+	windows map[string]*window
+}
+
+// NewTracker returns a tracker of the statistics over the given period.
+func NewTracker(period time.Duration) *Tracker {
+	return &Tracker{
+		period:  period,
+		windows: make(map[string]*window),
+	}
+}
+
+// Add adds a trade of a market. Trades are expected in time order.
+func (t *Tracker) Add(market string, price, size float64, timestamp int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	w, ok := t.windows[market]
+	if !ok {
+		w = &window{}
+		t.windows[market] = w
+	}
+
+	w.expire(timestamp - int64(t.period))
+	w.add(trade{price: price, size: size, timestamp: timestamp})
+}
+
+// Ticker returns the statistics of a market over the window ending at now.
+// The best bid and ask are left to the caller, they come from the book.
+func (t *Tracker) Ticker(market string, now time.Time) Ticker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tk := Ticker{
+		Market:    market,
+		OpenTime:  now.Add(-t.period).UnixNano(),
+		CloseTime: now.UnixNano(),
+	}
+
+	w, ok := t.windows[market]
+	if !ok {
+		return tk
+	}
+
+	w.expire(tk.OpenTime)
+	tk.LastPrice = w.last
+	if len(w.trades) == 0 {
+		return tk
+	}
+
+	tk.Open = w.trades[0].price
+	tk.High = w.highs[0].price
+	tk.Low = w.lows[0].price
+	tk.Volume = w.volume
+	tk.QuoteVolume = w.quote
+	tk.Trades = len(w.trades)
+	tk.PriceChange = tk.LastPrice - tk.Open
+	tk.PriceChangePercent = tk.PriceChange / tk.Open * 100
+	if tk.Volume > 0 {
+		tk.VWAP = tk.QuoteVolume / tk.Volume
+	}
+
+	return tk
+}
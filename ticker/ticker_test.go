@@ -0,0 +1,57 @@
+package ticker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func TestRollingWindow(t *testing.T) {
+	var (
+		tr    = NewTracker(time.Hour)
+		start = time.Unix(1700000000, 0)
+		at    = func(d time.Duration) int64 { return start.Add(d).UnixNano() }
+	)
+
+	tr.Add("ETH", 100, 1, at(0))
+	tr.Add("ETH", 120, 1, at(10*time.Minute))
+	tr.Add("ETH", 90, 2, at(20*time.Minute))
+	tr.Add("ETH", 110, 1, at(30*time.Minute))
+
+	tk := tr.Ticker("ETH", start.Add(40*time.Minute))
+	assert(t, tk.Open, 100.0)
+	assert(t, tk.High, 120.0)
+	assert(t, tk.Low, 90.0)
+	assert(t, tk.LastPrice, 110.0)
+	assert(t, tk.Volume, 5.0)
+	assert(t, tk.QuoteVolume, 510.0)
+	assert(t, tk.VWAP, 102.0)
+	assert(t, tk.PriceChange, 10.0)
+	assert(t, tk.PriceChangePercent, 10.0)
+	assert(t, tk.Trades, 4)
+
+	// The high and the open leave the window
+	tk = tr.Ticker("ETH", start.Add(time.Hour+15*time.Minute))
+	assert(t, tk.Open, 90.0)
+	assert(t, tk.High, 110.0)
+	assert(t, tk.Low, 90.0)
+	assert(t, tk.Volume, 3.0)
+	assert(t, tk.Trades, 2)
+
+	// The last price outlives the window
+	tk = tr.Ticker("ETH", start.Add(2*time.Hour))
+	assert(t, tk.LastPrice, 110.0)
+	assert(t, tk.Trades, 0)
+	assert(t, tk.Volume, 0.0)
+
+	tk = tr.Ticker("BTC", start)
+	assert(t, tk.Market, "BTC")
+	assert(t, tk.LastPrice, 0.0)
+}